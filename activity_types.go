@@ -0,0 +1,133 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// activityTypeIcons are the icons an activity type can be shown with
+var activityTypeIcons = map[string]bool{
+	"call":         true,
+	"meeting":      true,
+	"task":         true,
+	"deadline":     true,
+	"email":        true,
+	"lunch":        true,
+	"visit":        true,
+	"car":          true,
+	"flag":         true,
+	"coffee":       true,
+	"document":     true,
+	"presentation": true,
+	"support":      true,
+	"video":        true,
+}
+
+var activityTypeColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// prepareActivityType validates an activity type before it is saved. New
+// types are custom, get a key made of their name and are ordered last.
+// Built-in types keep their key.
+func prepareActivityType(model *ActivityType, existing *ActivityType) error {
+	model.Name = strings.TrimSpace(model.Name)
+	model.Color = strings.ToLower(strings.TrimSpace(model.Color))
+	if model.Name == "" {
+		return validationError("Please enter a name")
+	}
+	if model.Color != "" && !activityTypeColor.MatchString(model.Color) {
+		return validationErrorf("Invalid color %s, please use #rrggbb", model.Color)
+	}
+	if model.Icon != "" && !activityTypeIcons[model.Icon] {
+		return validationErrorf("Unknown icon %s", model.Icon)
+	}
+
+	types, err := selectActivityTypesByCompany(model.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		model.ID = existing.ID
+		model.IsCustomFlag = existing.IsCustomFlag
+		if !existing.IsCustomFlag || model.KeyString == "" {
+			model.KeyString = existing.KeyString
+		}
+	} else {
+		model.IsCustomFlag = true
+		model.OrderNr = len(types)
+		if model.KeyString == "" {
+			model.KeyString = customFieldKey(model.Name)
+		}
+	}
+	if model.KeyString == "" {
+		return validationError("Please enter a key")
+	}
+
+	for _, at := range types {
+		if at.ID == model.ID {
+			continue
+		}
+		if at.KeyString == model.KeyString {
+			return validationError("An activity type with this key already exists")
+		}
+		if strings.EqualFold(at.Name, model.Name) {
+			return validationError("An activity type with this name already exists")
+		}
+	}
+	return nil
+}
+
+// removeActivityType deletes a custom activity type. The activities of the
+// type are moved to the replacement type, which is needed when there are
+// any.
+func removeActivityType(model ActivityType, replacementID string) error {
+	if !model.IsCustomFlag {
+		return validationError("Built-in activity types cannot be deleted")
+	}
+
+	count, err := countActivitiesByType(model.ID)
+	if err != nil {
+		return err
+	}
+	if replacementID == "" {
+		if count > 0 {
+			return validationErrorf("Please select an activity type to move the %d activities of %s to", count, model.Name)
+		}
+		return deleteActivityType(model)
+	}
+
+	if replacementID == model.ID {
+		return validationError("Please select another activity type")
+	}
+	replacement, err := selectActivityTypeByID(replacementID)
+	if err != nil {
+		return err
+	}
+	if replacement == nil || replacement.DeletedAt != nil || replacement.CompanyID != model.CompanyID {
+		return validationError("Activity type not found")
+	}
+	return replaceActivityType(model, replacement.ID)
+}
+
+// orderActivityTypes numbers the activity types of the company in the
+// given order. All types must be in it.
+func orderActivityTypes(companyID string, IDs []string) error {
+	types, err := selectActivityTypesByCompany(companyID)
+	if err != nil {
+		return err
+	}
+	if len(IDs) != len(types) {
+		return validationError("Please order all the activity types")
+	}
+	known := make(map[string]bool)
+	for _, at := range types {
+		known[at.ID] = true
+	}
+	for _, ID := range IDs {
+		if !known[ID] {
+			return validationError("Activity type not found")
+		}
+		delete(known, ID)
+	}
+	return updateActivityTypeOrder(IDs)
+}
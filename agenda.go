@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"sort"
+	"time"
+)
+
+// agendaDigestHours is how long after config.DigestHour the agenda is still
+// sent, so users that are added later in the day do not get it at night
+const agendaDigestHours = 4
+
+// agenda is the morning e-mail of a user
+type agenda struct {
+	Day      time.Time
+	Today    []Activity
+	Overdue  []Activity
+	Tasks    []Task
+	location *time.Location
+}
+
+func (a agenda) empty() bool {
+	return len(a.Today) == 0 && len(a.Overdue) == 0 && len(a.Tasks) == 0
+}
+
+// composeAgenda picks the activities of the user due on the day, including
+// occurrences of recurring activities that are not created yet, the undone
+// activities due before the day and the open tasks of the user without a
+// next activity
+func composeAgenda(userID string, activities []Activity, tasks []Task, day time.Time, location *time.Location) agenda {
+	result := agenda{Day: day, location: location}
+	locations := map[string]*time.Location{userID: location}
+	// all-day activities are on their UTC date, which can be a day off the
+	// local one
+	for _, activity := range activitiesInRange(activities, day.AddDate(0, 0, -1), day.AddDate(0, 0, 2), locations) {
+		if activity.DeletedAt == nil && activityAssigneeID(activity) == userID && activityDay(activity, location).Equal(day) {
+			result.Today = append(result.Today, activity)
+		}
+	}
+	for _, activity := range activities {
+		if activity.DeletedAt != nil || activity.Done || activity.DueDate == nil || !activityDue(activity, location).Before(day) {
+			continue
+		}
+		if activityAssigneeID(activity) == userID {
+			result.Overdue = append(result.Overdue, activity)
+		}
+	}
+	sort.SliceStable(result.Overdue, func(i, j int) bool {
+		return activityDue(result.Overdue[i], location).Before(activityDue(result.Overdue[j], location))
+	})
+	for _, task := range tasks {
+		if task.UserID == userID {
+			result.Tasks = append(result.Tasks, task)
+		}
+	}
+	return result
+}
+
+// sendAgendaDigests e-mails every user their agenda of the day, once per
+// company per day from config.DigestHour in the timezone of the user. Users
+// with nothing on the agenda get no e-mail.
+func sendAgendaDigests() error {
+	recipients, err := selectAgendaDigestRecipients()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	users := make(map[string]*User)
+	activities := make(map[string][]Activity)
+	tasks := make(map[string][]Task)
+	for _, recipient := range recipients {
+		user, ok := users[recipient.UserID]
+		if !ok {
+			user, err = selectUserByID(recipient.UserID)
+			if err != nil {
+				log.Println(err)
+			}
+			users[recipient.UserID] = user
+		}
+		if user == nil {
+			continue
+		}
+
+		location := userLocation(*user)
+		local := now.In(location)
+		if local.Hour() < config.DigestHour || local.Hour() >= config.DigestHour+agendaDigestHours {
+			continue
+		}
+
+		key := fmt.Sprintf("agenda_digest:%s:%s:%s", user.ID, recipient.CompanyID, local.Format("2006-01-02"))
+		claimed, err := claimSentEmail(key, user.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		if _, ok := activities[recipient.CompanyID]; !ok {
+			companyActivities, err := selectActivitiesByCompany(recipient.CompanyID)
+			if err != nil {
+				releaseSentEmail(key)
+				return err
+			}
+			companyTasks, err := selectTasksWithoutNextActivity(recipient.CompanyID)
+			if err != nil {
+				releaseSentEmail(key)
+				return err
+			}
+			activities[recipient.CompanyID] = companyActivities
+			tasks[recipient.CompanyID] = companyTasks
+		}
+
+		day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+		a := composeAgenda(user.ID, activities[recipient.CompanyID], tasks[recipient.CompanyID], day, location)
+		if a.empty() {
+			continue
+		}
+
+		subj, text, html, err := agendaEmail(a)
+		if err == nil {
+			err = sendMultipartEmail(user.Email, subj, text, html)
+		}
+		if err != nil {
+			log.Println("Error sending agenda digest to", user.Email, err)
+			if err := releaseSentEmail(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var agendaHTML = template.Must(template.New("agenda").Parse(`<html>
+<body style="font-family: sans-serif">
+<h2>Your agenda for {{.Date}}</h2>
+{{if .Today}}<h3>Today</h3>
+<ul>{{range .Today}}
+<li><b>{{.Time}}</b> {{.Name}}{{if .Details}} <span style="color: #777">{{.Details}}</span>{{end}}</li>{{end}}
+</ul>{{end}}
+{{if .Overdue}}<h3>Overdue</h3>
+<ul>{{range .Overdue}}
+<li><b style="color: #c00">{{.Time}}</b> {{.Name}}{{if .Details}} <span style="color: #777">{{.Details}}</span>{{end}}</li>{{end}}
+</ul>{{end}}
+{{if .Tasks}}<h3>Tasks without a next activity</h3>
+<ul>{{range .Tasks}}
+<li>{{.Name}}{{if .Details}} <span style="color: #777">{{.Details}}</span>{{end}}</li>{{end}}
+</ul>{{end}}
+<p>See it on <a href="http://superwork.io">http://superwork.io</a></p>
+</body>
+</html>
+`))
+
+type agendaLine struct {
+	Time    string
+	Name    string
+	Details string
+}
+
+func agendaActivityLine(activity Activity, location *time.Location, layout string) agendaLine {
+	line := agendaLine{Time: activityDue(activity, location).Format(layout), Name: activity.Name}
+	for _, detail := range []string{activity.Type, activity.OrgName, activity.PersonName, activity.TaskTitle} {
+		if detail == "" {
+			continue
+		}
+		if line.Details != "" {
+			line.Details += ", "
+		}
+		line.Details += detail
+	}
+	return line
+}
+
+// agendaEmail returns the subject and the plain text and HTML bodies of the
+// agenda
+func agendaEmail(a agenda) (string, string, string, error) {
+	var view struct {
+		Date    string
+		Today   []agendaLine
+		Overdue []agendaLine
+		Tasks   []agendaLine
+	}
+	view.Date = a.Day.Format("Monday 2 January")
+	for _, activity := range a.Today {
+		line := agendaActivityLine(activity, a.location, "15:04")
+		if isAllDay(activity) {
+			line.Time = "All day"
+		}
+		view.Today = append(view.Today, line)
+	}
+	for _, activity := range a.Overdue {
+		view.Overdue = append(view.Overdue, agendaActivityLine(activity, a.location, "Mon 2 Jan"))
+	}
+	for _, task := range a.Tasks {
+		line := agendaLine{Name: task.Name, Details: task.StageName}
+		if task.OrgName != "" {
+			line.Details += ", " + task.OrgName
+		}
+		view.Tasks = append(view.Tasks, line)
+	}
+
+	subj := fmt.Sprintf("Your agenda for %s: %d activities", a.Day.Format("Mon 2 Jan"), len(a.Today))
+	if len(a.Overdue) > 0 {
+		subj += fmt.Sprintf(", %d overdue", len(a.Overdue))
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "Your agenda for %s\r\n", view.Date)
+	sections := []struct {
+		title string
+		lines []agendaLine
+	}{
+		{"Today", view.Today},
+		{"Overdue", view.Overdue},
+		{"Tasks without a next activity", view.Tasks},
+	}
+	for _, section := range sections {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "\r\n%s:\r\n", section.title)
+		for _, line := range section.lines {
+			fmt.Fprintf(b, "-")
+			if line.Time != "" {
+				fmt.Fprintf(b, " %s", line.Time)
+			}
+			fmt.Fprintf(b, " %s", line.Name)
+			if line.Details != "" {
+				fmt.Fprintf(b, " (%s)", line.Details)
+			}
+			fmt.Fprintf(b, "\r\n")
+		}
+	}
+	fmt.Fprintf(b, "\r\nSee it on http://superwork.io\r\n")
+
+	h := &bytes.Buffer{}
+	if err := agendaHTML.Execute(h, view); err != nil {
+		return "", "", "", err
+	}
+	return subj, b.String(), h.String(), nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 )
@@ -23,12 +25,17 @@ func populateUser(user User) error {
 }
 
 func assignOrganization(input ModelWithOrg, user User) error {
+	return assignOrganizationWith(db, input, user)
+}
+
+func assignOrganizationWith(ex execer, input ModelWithOrg, user User) error {
 	if input.GetOrgName() != "" && input.GetOrgID() == "" {
 		org := Organization{}
 		org.Name = input.GetOrgName()
 		org.CompanyID = user.ActiveCompanyID
 		org.OwnerID = user.ID
-		if err := insertOrganization(&org); err != nil {
+		org.implicit = true
+		if err := insertOrganizationWith(ex, &org); err != nil {
 			return err
 		}
 		input.SetOrgID(org.ID)
@@ -40,7 +47,7 @@ func assignOrganization(input ModelWithOrg, user User) error {
 			Action:         "created",
 		}
 		timeline.Name = org.Name
-		if err := insertTimeline(&timeline); err != nil {
+		if err := insertTimelineWith(ex, &timeline); err != nil {
 			return err
 		}
 	}
@@ -54,6 +61,7 @@ func assignPerson(input ModelWithPerson, user User) error {
 		person.Name = input.GetPersonName()
 		person.CompanyID = user.ActiveCompanyID
 		person.OwnerID = user.ID
+		person.implicit = true
 		if err := insertPerson(&person); err != nil {
 			return err
 		}
@@ -74,6 +82,213 @@ func assignPerson(input ModelWithPerson, user User) error {
 	return nil
 }
 
+// organizationIDsByName maps the normalized names of the organizations of
+// the company to their IDs.
+func organizationIDsByName(companyID string) (map[string]string, error) {
+	orgs, err := selectOrganizationsByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for _, org := range orgs {
+		result[normalizeOrganizationName(org.Name)] = org.ID
+	}
+	return result, nil
+}
+
+// previewPersonImports links imported persons to the existing organizations
+// of the same name and finds the existing persons they may duplicate.
+func previewPersonImports(imports []PersonImport, companyID string) error {
+	orgIDs, err := organizationIDsByName(companyID)
+	if err != nil {
+		return err
+	}
+
+	for i := range imports {
+		person := &imports[i].Person
+		person.CompanyID = companyID
+		if person.OrgName != "" {
+			person.OrgID = orgIDs[normalizeOrganizationName(person.OrgName)]
+		}
+		if err := normalizePersonContacts(imports[i].Contacts); err != nil {
+			return fmt.Errorf("%s: %v", person.Name, err)
+		}
+		duplicates, err := findContactDuplicates(*person, imports[i].Contacts)
+		if err != nil {
+			return err
+		}
+		imports[i].Duplicates = duplicates
+	}
+	return nil
+}
+
+// importPersons saves imported persons with their contacts, leaving out the
+// skipped ones. Persons are linked to the existing organizations of the same
+// name and an unknown organization is created once, like when a person is
+// added with an organization name. Either all persons are saved or none.
+func importPersons(imports []PersonImport, user User) ([]Person, error) {
+	orgIDs, err := organizationIDsByName(user.ActiveCompanyID)
+	if err != nil {
+		return nil, err
+	}
+	knownOrgs := make(map[string]bool)
+	for _, ID := range orgIDs {
+		knownOrgs[ID] = true
+	}
+	for i := range imports {
+		if imports[i].Skip {
+			continue
+		}
+		if err := normalizePersonContacts(imports[i].Contacts); err != nil {
+			return nil, fmt.Errorf("%s: %v", imports[i].Person.Name, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var personIDs []string
+	for _, item := range imports {
+		if item.Skip {
+			continue
+		}
+
+		person := item.Person
+		person.ID = ""
+		person.CompanyID = user.ActiveCompanyID
+		person.OwnerID = user.ID
+		person.implicit = true
+
+		orgName := normalizeOrganizationName(person.OrgName)
+		if !knownOrgs[person.OrgID] {
+			person.OrgID = ""
+		}
+		if person.OrgID == "" && orgName != "" {
+			person.OrgID = orgIDs[orgName]
+		}
+		if err := assignOrganizationWith(tx, &person, user); err != nil {
+			return nil, err
+		}
+		if orgName != "" && person.OrgID != "" {
+			orgIDs[orgName] = person.OrgID
+			knownOrgs[person.OrgID] = true
+		}
+
+		if err := insertPersonWith(tx, &person); err != nil {
+			return nil, err
+		}
+
+		timeline := Timeline{
+			UnderCompanyID: user.ActiveCompanyID,
+			UserID:         user.ID,
+			PersonID:       person.ID,
+			Action:         "created",
+		}
+		timeline.Name = person.Name
+		if err := insertTimelineWith(tx, &timeline); err != nil {
+			return nil, err
+		}
+
+		for _, contact := range item.Contacts {
+			contact.PersonID = person.ID
+			if err := insertContactWith(tx, &contact); err != nil {
+				return nil, err
+			}
+		}
+
+		personIDs = append(personIDs, person.ID)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	var result []Person
+	for _, ID := range personIDs {
+		model, err := selectPersonByID(ID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+
+	return result, nil
+}
+
+// savePersonContacts replaces the contacts of a person. Contacts with an ID
+// are updated, the others are added and the contacts of the person missing
+// from the list are deleted. The contacts are expected to be normalized.
+func savePersonContacts(person Person, contacts []Contact, user User) error {
+	existing, err := selectContactsByPerson(person.ID)
+	if err != nil {
+		return err
+	}
+	saved := make(map[string]Contact)
+	for _, contact := range existing {
+		saved[contact.ID] = contact
+	}
+	keep := make(map[string]bool)
+	for _, contact := range contacts {
+		if contact.ID == "" {
+			continue
+		}
+		if _, ok := saved[contact.ID]; !ok {
+			return errors.New("Contact not found")
+		}
+		keep[contact.ID] = true
+	}
+
+	var changes []Timeline
+	for _, contact := range existing {
+		if keep[contact.ID] {
+			continue
+		}
+		if err := deleteContact(contact.ID); err != nil {
+			return err
+		}
+		timeline := Timeline{ContactID: contact.ID, Action: "deleted"}
+		timeline.Name = contact.Name
+		changes = append(changes, timeline)
+	}
+
+	for _, contact := range contacts {
+		contact.PersonID = person.ID
+		if contact.ID == "" {
+			if err := insertContact(&contact); err != nil {
+				return err
+			}
+			timeline := Timeline{ContactID: contact.ID, Action: "created"}
+			timeline.Name = contact.Name
+			changes = append(changes, timeline)
+			continue
+		}
+
+		old := saved[contact.ID]
+		if old.Name == contact.Name && old.Type == contact.Type && old.Label == contact.Label && old.Primary == contact.Primary {
+			continue
+		}
+		if err := updateContact(contact); err != nil {
+			return err
+		}
+		timeline := Timeline{ContactID: contact.ID, Action: "updated"}
+		timeline.Name = contact.Name
+		changes = append(changes, timeline)
+	}
+
+	for _, timeline := range changes {
+		timeline.UnderCompanyID = user.ActiveCompanyID
+		timeline.UserID = user.ID
+		timeline.PersonID = person.ID
+		if err := insertTimeline(&timeline); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func populateActivityTypes(user User) error {
 	if has, err := hasActivityTypes(user.ID); err != nil {
 		return err
@@ -84,6 +299,7 @@ func populateActivityTypes(user User) error {
 	at := ActivityType{}
 	at.Name = "Call"
 	at.KeyString = "call"
+	at.Icon = "call"
 	at.OrderNr = 0
 	at.CompanyID = user.ActiveCompanyID
 	at.IsCustomFlag = false
@@ -94,6 +310,7 @@ func populateActivityTypes(user User) error {
 	at = ActivityType{}
 	at.Name = "Meeting"
 	at.KeyString = "meeting"
+	at.Icon = "meeting"
 	at.OrderNr = 1
 	at.CompanyID = user.ActiveCompanyID
 	at.IsCustomFlag = false
@@ -104,6 +321,7 @@ func populateActivityTypes(user User) error {
 	at = ActivityType{}
 	at.Name = "Task"
 	at.KeyString = "task"
+	at.Icon = "task"
 	at.OrderNr = 2
 	at.CompanyID = user.ActiveCompanyID
 	at.IsCustomFlag = false
@@ -114,6 +332,7 @@ func populateActivityTypes(user User) error {
 	at = ActivityType{}
 	at.Name = "Deadline"
 	at.KeyString = "deadline"
+	at.Icon = "deadline"
 	at.OrderNr = 3
 	at.CompanyID = user.ActiveCompanyID
 	at.IsCustomFlag = false
@@ -124,6 +343,7 @@ func populateActivityTypes(user User) error {
 	at = ActivityType{}
 	at.Name = "Email"
 	at.KeyString = "email"
+	at.Icon = "email"
 	at.OrderNr = 4
 	at.CompanyID = user.ActiveCompanyID
 	at.IsCustomFlag = false
@@ -134,6 +354,7 @@ func populateActivityTypes(user User) error {
 	at = ActivityType{}
 	at.Name = "Lunch"
 	at.KeyString = "lunch"
+	at.Icon = "lunch"
 	at.OrderNr = 5
 	at.CompanyID = user.ActiveCompanyID
 	at.IsCustomFlag = false
@@ -151,45 +372,165 @@ func populateWorkflow(user User) error {
 		return nil
 	}
 
+	template, err := findWorkflowTemplate(user.ActiveCompanyID, "default")
+	if err != nil {
+		return err
+	}
+
 	workflow := Workflow{}
-	workflow.Name = "My workflow"
 	workflow.CompanyID = user.ActiveCompanyID
-	if err := insertWorkflow(&workflow); err != nil {
+	if err := insertWorkflowFromTemplate(&workflow, *template); err != nil {
 		return err
 	}
 	user.ActiveWorkflowID = workflow.ID
 
-	if err := updateUser(user); err != nil {
-		return err
+	return updateUser(user)
+}
+
+// builtinWorkflowTemplates returns the templates in db/workflow_templates.json
+func builtinWorkflowTemplates() ([]WorkflowTemplate, error) {
+	b, err := ioutil.ReadFile(filepath.Join(config.Dir, "db", "workflow_templates.json"))
+	if err != nil {
+		return nil, err
 	}
 
-	// Workflow stages
+	var templates []WorkflowTemplate
+	if err := json.Unmarshal(b, &templates); err != nil {
+		return nil, err
+	}
 
-	stage := Stage{}
-	stage.Name = "Planned"
-	stage.WorkflowID = workflow.ID
-	stage.OrderNr = 0
-	if err := insertStage(&stage); err != nil {
-		return err
+	return templates, nil
+}
+
+// selectWorkflowTemplates returns the built-in templates followed by the
+// templates the company has saved.
+func selectWorkflowTemplates(companyID string) ([]WorkflowTemplate, error) {
+	templates, err := builtinWorkflowTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := selectWorkflowTemplatesByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(templates, saved...), nil
+}
+
+// findWorkflowTemplate looks up a built-in template by its key or a
+// template saved by the company by its ID.
+func findWorkflowTemplate(companyID, ID string) (*WorkflowTemplate, error) {
+	templates, err := builtinWorkflowTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		if template.ID == ID {
+			return &template, nil
+		}
+	}
+
+	template, err := selectWorkflowTemplateByID(ID)
+	if err != nil {
+		return nil, err
+	}
+	if template.CompanyID != companyID {
+		return nil, errors.New("Workflow template not found")
+	}
+	return template, nil
+}
+
+// insertWorkflowFromTemplate creates the workflow with the stages of the
+// template. The template name is used if the workflow has none.
+func insertWorkflowFromTemplate(workflow *Workflow, template WorkflowTemplate) error {
+	if workflow.Name == "" {
+		workflow.Name = template.Name
 	}
 
-	stage = Stage{}
-	stage.Name = "In progress"
-	stage.WorkflowID = workflow.ID
-	stage.OrderNr = 1
-	if err := insertStage(&stage); err != nil {
+	tx, err := db.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	stage = Stage{}
-	stage.Name = "Done"
-	stage.WorkflowID = workflow.ID
-	stage.OrderNr = 2
-	if err := insertStage(&stage); err != nil {
+	if err := insertWorkflowWith(tx, workflow); err != nil {
 		return err
 	}
 
-	return nil
+	for i, s := range template.Stages {
+		stage := Stage{}
+		stage.Name = s.Name
+		stage.WorkflowID = workflow.ID
+		stage.OrderNr = i
+		stage.TaskProbability = s.TaskProbability
+		stage.RottenFlag = s.RottenFlag
+		stage.RottenDays = s.RottenDays
+		if err := insertStageWith(tx, &stage); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// saveWorkflowAsTemplate stores the stages of the workflow as a company
+// template.
+func saveWorkflowAsTemplate(workflow Workflow, name string) (*WorkflowTemplate, error) {
+	stages, err := selectStagesByWorkflow(workflow.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	template := WorkflowTemplate{}
+	template.Name = name
+	if template.Name == "" {
+		template.Name = workflow.Name
+	}
+	template.CompanyID = workflow.CompanyID
+	template.Stages = []WorkflowTemplateStage{}
+	for _, stage := range stages {
+		template.Stages = append(template.Stages, WorkflowTemplateStage{
+			Name:            stage.Name,
+			TaskProbability: stage.TaskProbability,
+			RottenFlag:      stage.RottenFlag,
+			RottenDays:      stage.RottenDays,
+		})
+	}
+
+	if err := insertWorkflowTemplate(&template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// workflowStageMap completes stageMap so that every stage of the source
+// workflow maps to a target stage, matching unmapped stages by position.
+func workflowStageMap(sourceID, targetID string, stageMap map[string]string) (map[string]string, error) {
+	sourceStages, err := selectStagesByWorkflow(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	targetStages, err := selectStagesByWorkflow(targetID)
+	if err != nil {
+		return nil, err
+	}
+	if len(targetStages) == 0 {
+		return nil, errors.New("The target workflow has no stages")
+	}
+
+	result := make(map[string]string)
+	for i, stage := range sourceStages {
+		if targetStageID, ok := stageMap[stage.ID]; ok && targetStageID != "" {
+			result[stage.ID] = targetStageID
+			continue
+		}
+		if i >= len(targetStages) {
+			i = len(targetStages) - 1
+		}
+		result[stage.ID] = targetStages[i].ID
+	}
+	return result, nil
 }
 
 func populateCurrencies(user User) error {
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseActivityDuration parses the duration of an activity, either HH:MM,
+// HH:MM:SS with optional fractions of a second, or a duration like 1h30m.
+// An empty duration is zero.
+func parseActivityDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if !strings.Contains(s, ":") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("Invalid duration %s", s)
+		}
+		return d, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("Invalid duration %s", s)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 {
+		return 0, fmt.Errorf("Invalid duration %s", s)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("Invalid duration %s", s)
+	}
+	seconds := 0.0
+	if len(parts) == 3 {
+		seconds, err = strconv.ParseFloat(parts[2], 64)
+		if err != nil || seconds < 0 || seconds >= 60 {
+			return 0, fmt.Errorf("Invalid duration %s", s)
+		}
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), nil
+}
+
+// isAllDay reports whether the activity takes the whole day. All-day
+// activities are flagged as such and are due at midnight UTC of the date
+// they are for, so they stay on that date in every timezone.
+func isAllDay(activity Activity) bool {
+	return activity.AllDay && activity.DueDate != nil
+}
+
+// prepareAllDay keeps all-day activities at midnight UTC of their date,
+// without a duration. A due date that is not at midnight UTC yet is for the
+// date in the offset it was given in.
+func prepareAllDay(model *Activity) {
+	if !model.AllDay {
+		return
+	}
+	model.Duration = ""
+	if model.DueDate == nil {
+		return
+	}
+	d := *model.DueDate
+	if u := d.UTC(); u.Hour() == 0 && u.Minute() == 0 && u.Second() == 0 && u.Nanosecond() == 0 {
+		d = u
+	}
+	due := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+	model.DueDate = &due
+}
+
+// activityDue returns the due date of the activity in the location. All-day
+// activities are due at the start of their date there.
+func activityDue(activity Activity, location *time.Location) time.Time {
+	if isAllDay(activity) {
+		due := activity.DueDate.UTC()
+		return time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, location)
+	}
+	return activity.DueDate.In(location)
+}
+
+// activityDay returns the start of the day the activity is on in the
+// location
+func activityDay(activity Activity, location *time.Location) time.Time {
+	due := activityDue(activity, location)
+	return time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, location)
+}
+
+// matches reports whether the activity passes the filter
+func (f ActivityFilter) matches(activity Activity) bool {
+	if f.Done != nil && activity.Done != *f.Done {
+		return false
+	}
+	if len(f.AssigneeIDs) > 0 && !containsString(f.AssigneeIDs, activityAssigneeID(activity)) {
+		return false
+	}
+	if len(f.TypeIDs) > 0 && !containsString(f.TypeIDs, activity.TypeID) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// activityCalendar places the activities that pass the filter on the days
+// from until until, both included, in the location, with the occurrences of
+// recurring activities that are not created yet, followed in the locations
+// of their assignees. Every day of the range is counted, also the days
+// without activities.
+func activityCalendar(models []Activity, from, until time.Time, location *time.Location, assigneeLocations map[string]*time.Location, filter ActivityFilter) ActivityCalendar {
+	end := until.AddDate(0, 0, 1)
+	result := ActivityCalendar{
+		From:         from.Format("2006-01-02"),
+		Until:        until.Format("2006-01-02"),
+		TimezoneName: location.String(),
+		Activities:   []CalendarActivity{},
+		Days:         []CalendarDay{},
+	}
+
+	index := make(map[string]int)
+	for day := from; day.Before(end); day = day.AddDate(0, 0, 1) {
+		index[day.Format("2006-01-02")] = len(result.Days)
+		result.Days = append(result.Days, CalendarDay{Date: day.Format("2006-01-02")})
+	}
+
+	// all-day activities are on their UTC date, which can be a day off the
+	// local range
+	for _, activity := range activitiesInRange(models, from.AddDate(0, 0, -1), end.AddDate(0, 0, 1), assigneeLocations) {
+		if !filter.matches(activity) {
+			continue
+		}
+		day := activityDay(activity, location)
+		if day.Before(from) || !day.Before(end) {
+			continue
+		}
+
+		model := CalendarActivity{
+			Activity: activity,
+			Day:      day.Format("2006-01-02"),
+		}
+		if d, err := parseActivityDuration(activity.Duration); err == nil && d > 0 {
+			model.DurationMinutes = int(d / time.Minute)
+			end := activity.DueDate.Add(d)
+			model.End = &end
+		}
+		result.Activities = append(result.Activities, model)
+
+		count := &result.Days[index[model.Day]]
+		count.Count++
+		if activity.Done {
+			count.Done++
+		} else {
+			count.Undone++
+		}
+		count.Minutes += model.DurationMinutes
+	}
+
+	return result
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+)
+
+// contactTypes are the channels a person can be reached by
+var contactTypes = map[string]bool{
+	"email":   true,
+	"phone":   true,
+	"website": true,
+	"im":      true,
+	"other":   true,
+}
+
+// contactLabels are the labels a contact can be given
+var contactLabels = map[string]bool{
+	"work":   true,
+	"home":   true,
+	"mobile": true,
+	"fax":    true,
+	"other":  true,
+}
+
+// normalizeEmail validates an e-mail address and lowercases its domain
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(email), "mailto:"))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != email {
+		return "", fmt.Errorf("Invalid e-mail address %s", email)
+	}
+	at := strings.LastIndex(email, "@")
+	domain := strings.ToLower(email[at+1:])
+	if !strings.Contains(strings.Trim(domain, "."), ".") {
+		return "", fmt.Errorf("Invalid e-mail address %s", email)
+	}
+	return email[:at+1] + domain, nil
+}
+
+// normalizePhone returns a phone number in E.164 format. Numbers entered
+// without a country code get config.PhoneCountryCode in place of their
+// trunk prefix, or are kept as they are entered when it is not set.
+func normalizePhone(phone string) (string, error) {
+	phone = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(phone), "tel:"))
+
+	// "+44 (0)20 ..." writes the trunk prefix that is dropped when calling
+	// from abroad
+	number := strings.Replace(phone, "(0)", "", 1)
+	var digits strings.Builder
+	international := false
+	for _, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && digits.Len() == 0 && !international:
+			international = true
+		case strings.ContainsRune(" -./()", r):
+		default:
+			return "", fmt.Errorf("Invalid phone number %s", phone)
+		}
+	}
+
+	number = digits.String()
+	switch {
+	case international:
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case config.PhoneCountryCode != "":
+		number = strings.TrimPrefix(config.PhoneCountryCode, "+") + strings.TrimPrefix(number, "0")
+	default:
+		return phone, nil
+	}
+	if len(number) < 7 || len(number) > 15 || number[0] == '0' {
+		return "", fmt.Errorf("Invalid phone number %s", phone)
+	}
+	return "+" + number, nil
+}
+
+// normalizeContact validates a contact and normalizes its value, e-mail
+// addresses by their domain and phone numbers to E.164
+func normalizeContact(contact *Contact) error {
+	contact.Name = strings.TrimSpace(contact.Name)
+	contact.Label = strings.ToLower(strings.TrimSpace(contact.Label))
+	if contact.Name == "" {
+		return errors.New("Please enter a phone number or an e-mail")
+	}
+	if contact.Type == "" {
+		return errors.New("Please select contact type")
+	}
+	if !contactTypes[contact.Type] {
+		return fmt.Errorf("Unknown contact type %s", contact.Type)
+	}
+	if contact.Label != "" && !contactLabels[contact.Label] {
+		return fmt.Errorf("Unknown contact label %s", contact.Label)
+	}
+
+	var err error
+	switch contact.Type {
+	case "email":
+		contact.Name, err = normalizeEmail(contact.Name)
+	case "phone":
+		contact.Name, err = normalizePhone(contact.Name)
+	}
+	return err
+}
+
+// normalizePersonContacts normalizes the contacts of a person and checks
+// that at most one contact of each type is primary.
+func normalizePersonContacts(contacts []Contact) error {
+	primary := make(map[string]bool)
+	for i := range contacts {
+		if contacts[i].Type == "" {
+			contacts[i].DetectType()
+		}
+		if err := normalizeContact(&contacts[i]); err != nil {
+			return err
+		}
+		if contacts[i].Primary {
+			if primary[contacts[i].Type] {
+				return fmt.Errorf("Please select only one primary %s", contacts[i].Type)
+			}
+			primary[contacts[i].Type] = true
+		}
+	}
+	return nil
+}
+
+// hasPrimaryContact reports whether one of the contacts of the type is primary
+func hasPrimaryContact(contacts []Contact, contactType string) bool {
+	for _, contact := range contacts {
+		if contact.Type == contactType && contact.Primary {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillContacts normalizes the phone numbers and e-mail addresses saved
+// before contacts were normalized. Contacts that do not pass the validation
+// are logged and kept as they are.
+func backfillContacts() error {
+	contacts, err := selectContactsToNormalize()
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, contact := range contacts {
+		name := contact.Name
+		if err := normalizeContact(&contact); err != nil {
+			log.Println("Contact", contact.ID, err)
+			continue
+		}
+		if contact.Name == name {
+			continue
+		}
+		if err := updateContactName(contact.ID, contact.Name); err != nil {
+			return err
+		}
+		total++
+	}
+	log.Printf("Normalized %d contacts", total)
+	return nil
+}
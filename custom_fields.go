@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// CustomFields holds the custom field values of a record by field key.
+// It is stored in a jsonb column.
+type CustomFields map[string]interface{}
+
+func (c CustomFields) Value() (driver.Value, error) {
+	if c == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (c *CustomFields) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*c = CustomFields{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into custom fields", src)
+	}
+	result := CustomFields{}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return err
+	}
+	*c = result
+	return nil
+}
+
+var customFieldTypes = map[string]bool{
+	"text":         true,
+	"number":       true,
+	"money":        true,
+	"date":         true,
+	"picklist":     true,
+	"user":         true,
+	"organization": true,
+}
+
+// customFieldDefinition is the part of a task, person, organization,
+// activity or product field that is needed to validate values.
+type customFieldDefinition struct {
+	Key           string
+	Name          string
+	FieldType     string
+	PicklistData  string
+	MandatoryFlag bool
+}
+
+// customFieldKey derives a field key from the field name
+func customFieldKey(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// picklistOptions parses PicklistData, a JSON array of strings or a comma
+// separated list.
+func picklistOptions(data string) []string {
+	var options []string
+	if err := json.Unmarshal([]byte(data), &options); err == nil {
+		return options
+	}
+	for _, option := range strings.Split(data, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// validateCustomFieldDefinition checks the definition of a field and derives
+// its key from the name if it has none.
+func validateCustomFieldDefinition(name string, key *string, fieldType, picklistData string) error {
+	if name == "" {
+		return errors.New("Please enter a name")
+	}
+	if !customFieldTypes[fieldType] {
+		return fmt.Errorf("Unknown field type %s", fieldType)
+	}
+	if fieldType == "picklist" && len(picklistOptions(picklistData)) == 0 {
+		return errors.New("Please enter the picklist options")
+	}
+	if *key == "" {
+		*key = customFieldKey(name)
+	}
+	if *key == "" {
+		return errors.New("Please enter a key")
+	}
+	return nil
+}
+
+// validationError is an invalid value sent by the client, handlers answer
+// it with 400 Bad Request instead of 500
+type validationError string
+
+func (e validationError) Error() string {
+	return string(e)
+}
+
+func validationErrorf(format string, a ...interface{}) error {
+	return validationError(fmt.Sprintf(format, a...))
+}
+
+// errorStatus returns the HTTP status for an error of saving a record
+func errorStatus(err error) int {
+	if _, ok := err.(validationError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// validateCustomFields checks values against the field definitions of the
+// company and normalizes them, numbers to float64 and dates to YYYY-MM-DD.
+// Keys that are stored on the record but whose field was deleted are
+// dropped, so records stay editable after a field is removed.
+func validateCustomFields(values, stored CustomFields, fields []customFieldDefinition, companyID string) error {
+	byKey := make(map[string]customFieldDefinition)
+	for _, field := range fields {
+		byKey[field.Key] = field
+	}
+
+	for key := range values {
+		if _, ok := byKey[key]; ok {
+			continue
+		}
+		if _, ok := stored[key]; ok {
+			delete(values, key)
+			continue
+		}
+		return validationErrorf("Unknown custom field %s", key)
+	}
+
+	for _, field := range fields {
+		value, ok := values[field.Key]
+		if !ok || value == nil || value == "" {
+			if field.MandatoryFlag {
+				return validationErrorf("Please enter %s", field.Name)
+			}
+			delete(values, field.Key)
+			continue
+		}
+
+		normalized, err := validateCustomFieldValue(field, value, companyID)
+		if err != nil {
+			return err
+		}
+		values[field.Key] = normalized
+	}
+
+	return nil
+}
+
+func validateCustomFieldValue(field customFieldDefinition, value interface{}, companyID string) (interface{}, error) {
+	switch field.FieldType {
+	case "text":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "number":
+		if n, ok := customFieldNumber(value); ok {
+			return n, nil
+		}
+	case "money":
+		if m, ok := value.(map[string]interface{}); ok {
+			amount, ok := customFieldNumber(m["amount"])
+			currency, _ := m["currency"].(string)
+			if ok && currency != "" {
+				return map[string]interface{}{"amount": amount, "currency": currency}, nil
+			}
+		}
+		return nil, validationErrorf("%s should have an amount and a currency", field.Name)
+	case "date":
+		if s, ok := value.(string); ok {
+			if len(s) > 10 {
+				s = s[:10]
+			}
+			if _, err := time.Parse("2006-01-02", s); err == nil {
+				return s, nil
+			}
+		}
+		return nil, validationErrorf("%s should be a date", field.Name)
+	case "picklist":
+		if s, ok := value.(string); ok {
+			for _, option := range picklistOptions(field.PicklistData) {
+				if option == s {
+					return s, nil
+				}
+			}
+		}
+		return nil, validationErrorf("%s should be one of the picklist options", field.Name)
+	case "user":
+		if s, ok := value.(string); ok && isUUID(s) {
+			companyUser, err := selectCompanyUserByUserAndCompany(s, companyID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if companyUser != nil {
+				return s, nil
+			}
+		}
+	case "organization":
+		if s, ok := value.(string); ok && isUUID(s) {
+			org, err := selectOrganizationByID(s)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if org != nil && org.CompanyID == companyID {
+				return s, nil
+			}
+		}
+	}
+	return nil, validationErrorf("Invalid value for %s", field.Name)
+}
+
+func customFieldNumber(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// customFieldString formats a value for comparison with a filter value.
+// Money is compared by its amount.
+func customFieldString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}:
+		return customFieldString(v["amount"])
+	}
+	return fmt.Sprint(value)
+}
+
+// matchCustomFields reports whether the values match every filter, a map
+// from field key to the wanted value.
+func matchCustomFields(values CustomFields, filters map[string]string) bool {
+	for key, want := range filters {
+		if customFieldString(values[key]) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// customFieldFilters reads custom field filters from query parameters of
+// the form cf_<key>=<value>.
+func customFieldFilters(query map[string][]string) map[string]string {
+	filters := make(map[string]string)
+	for name, values := range query {
+		if strings.HasPrefix(name, "cf_") && len(values) > 0 {
+			filters[strings.TrimPrefix(name, "cf_")] = values[0]
+		}
+	}
+	return filters
+}
+
+// customFieldTables are the tables of the field definitions and of the
+// records of every kind of record with custom fields
+var customFieldTables = map[string]struct{ fields, records string }{
+	"task":         {"task_fields", "tasks"},
+	"person":       {"person_fields", "persons"},
+	"organization": {"organization_fields", "organizations"},
+	"activity":     {"activity_fields", "activities"},
+	"product":      {"product_fields", "products"},
+}
+
+// validateCustomFieldsFor checks the custom field values of a record of the
+// kind against the fields of its company. recordID is empty for records
+// that are not saved yet. Without mandatory, fields may be left empty.
+func validateCustomFieldsFor(kind string, values *CustomFields, companyID, recordID string, mandatory bool) error {
+	tables, ok := customFieldTables[kind]
+	if !ok {
+		return fmt.Errorf("Unknown kind of custom fields %s", kind)
+	}
+	if *values == nil {
+		*values = CustomFields{}
+	}
+	fields, err := selectCustomFieldDefinitions(tables.fields, companyID)
+	if err != nil {
+		return err
+	}
+	if !mandatory {
+		for i := range fields {
+			fields[i].MandatoryFlag = false
+		}
+	}
+	stored, err := selectStoredCustomFields(tables.records, recordID)
+	if err != nil {
+		return err
+	}
+	return validateCustomFields(*values, stored, fields, companyID)
+}
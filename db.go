@@ -2,11 +2,22 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func selectStats() (*stats, error) {
 	var result stats
 	err := db.QueryRow(`
@@ -158,6 +169,10 @@ func selectUserByID(userID string) (*User, error) {
 			users.picture,
 			users.active_company_id,
 			users.active_workflow_id,
+			users.timezone_name,
+			users.reminder_minutes,
+			users.reminders_off,
+			users.agenda_digest_off,
 			companies.name,
 			workflows.name
     	FROM
@@ -184,6 +199,10 @@ func selectUserByID(userID string) (*User, error) {
 		&user.Picture,
 		&activeCompanyID,
 		&activeWorkflowID,
+		&user.TimezoneName,
+		&user.ReminderMinutes,
+		&user.RemindersOff,
+		&user.AgendaDigestOff,
 		&activeCompanyName,
 		&activeWorkflowName,
 	)
@@ -282,6 +301,10 @@ func selectUserByEmail(email string) (*User, error) {
 			users.picture,
 			users.active_company_id,
 			users.active_workflow_id,
+			users.timezone_name,
+			users.reminder_minutes,
+			users.reminders_off,
+			users.agenda_digest_off,
 			companies.name,
 			workflows.name
     	FROM
@@ -310,6 +333,10 @@ func selectUserByEmail(email string) (*User, error) {
 		&user.Picture,
 		&activeCompanyID,
 		&activeWorkflowID,
+		&user.TimezoneName,
+		&user.ReminderMinutes,
+		&user.RemindersOff,
+		&user.AgendaDigestOff,
 		&activeCompanyName,
 		&activeWorkflowName,
 	)
@@ -388,9 +415,13 @@ func updateUser(model User) error {
 			name = $3,
 			picture = $4,
 			active_company_id = $5,
-			active_workflow_id = $6
+			active_workflow_id = $6,
+			timezone_name = $7,
+			reminder_minutes = $8,
+			reminders_off = $9,
+			agenda_digest_off = $10
 		WHERE
-			id = $7
+			id = $11
 	`,
 		model.Phone,
 		model.YearOfBirth,
@@ -398,6 +429,10 @@ func updateUser(model User) error {
 		model.Picture,
 		model.ActiveCompanyID,
 		maybeNull(model.ActiveWorkflowID),
+		model.TimezoneName,
+		model.ReminderMinutes,
+		model.RemindersOff,
+		model.AgendaDigestOff,
 		model.ID,
 	)
 	if err != nil {
@@ -668,6 +703,10 @@ func deleteCompanyUser(companyUserID string) error {
 }
 
 func insertWorkflow(model *Workflow) error {
+	return insertWorkflowWith(db, model)
+}
+
+func insertWorkflowWith(ex execer, model *Workflow) error {
 	if model.CompanyID == "" {
 		return errors.New("Please select a company")
 	}
@@ -675,7 +714,7 @@ func insertWorkflow(model *Workflow) error {
 		return errors.New("Please enter a name")
 	}
 
-	row := db.QueryRow(`
+	row := ex.QueryRow(`
 		INSERT INTO workflows(
 			company_id,
 			name,
@@ -748,10 +787,20 @@ func deleteWorkflow(workflowID string) error {
 		return err
 	}
 	if used {
-		return errors.New("The workflow has tasks. Please remove the tasks first")
+		return errors.New("The workflow has tasks. Please move the tasks to another workflow first")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := switchActiveWorkflow(tx, workflowID, ""); err != nil {
+		return err
 	}
 
-	_, err = db.Exec(`
+	_, err = tx.Exec(`
 		UPDATE
 			workflows
 		SET
@@ -761,133 +810,252 @@ func deleteWorkflow(workflowID string) error {
 	`,
 		workflowID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func insertPerson(model *Person) error {
-	if model.Name == "" {
-		return errors.New("Please enter a name")
+// migrateAndDeleteWorkflow moves all tasks of source to target, using
+// stageMap from source stage ID to target stage ID, and deletes source in
+// one transaction. Tasks still in deleted stages of source, which are not in
+// stageMap, go to the first stage of target. It returns the moved tasks with
+// their new stage.
+func migrateAndDeleteWorkflow(source, target Workflow, stageMap map[string]string, userID string) ([]Task, error) {
+	if source.ID == target.ID {
+		return nil, errors.New("Please select another workflow")
 	}
 
-	row := db.QueryRow(`
-		INSERT INTO persons(
-			company_id,
-			owner_id,
-			org_id,
-			first_name,
-			name,
-			created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var firstStageID string
+	err = tx.QueryRow(`
+		select
+			id
+		from
+			stages
+		where
+			workflow_id = $1
+		and
+			deleted_at is null
+		order by
+			order_nr
+		limit 1
 	`,
-		model.CompanyID,
-		model.OwnerID,
-		maybeNull(model.OrgID),
-		model.FirstName,
-		model.Name,
+		target.ID,
+	).Scan(
+		&firstStageID,
 	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
+	if err == sql.ErrNoRows {
+		return nil, errors.New("The target workflow has no stages")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		select distinct
+			stage_id
+		from
+			tasks
+		where
+			workflow_id = $1
+		and
+			deleted_at is null
+	`,
+		source.ID,
 	)
-}
+	if err != nil {
+		return nil, err
+	}
+	stageIDs := make(map[string]string)
+	for sourceStageID, targetStageID := range stageMap {
+		stageIDs[sourceStageID] = targetStageID
+	}
+	for rows.Next() {
+		var stageID sql.NullString
+		if err := rows.Scan(&stageID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// tasks without a stage are keyed by the empty stage ID
+		if _, ok := stageIDs[stageID.String]; !ok {
+			stageIDs[stageID.String] = firstStageID
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-func updatePerson(model Person) error {
-	if model.Name == "" {
-		return errors.New("Please enter a name")
+	var moved []Task
+	for sourceStageID, targetStageID := range stageIDs {
+		// the moved tasks keep their order after the tasks of the target stage
+		rows, err := tx.Query(`
+			UPDATE
+				tasks
+			SET
+				workflow_id = $1,
+				stage_id = $2,
+				stage_order_nr = numbered.order_nr,
+				stage_change_time = current_timestamp,
+				updated_at = current_timestamp
+			FROM
+				(
+					select
+						id,
+						(
+							select coalesce(max(stage_order_nr), -1)
+							from tasks
+							where stage_id = $2
+							and deleted_at is null
+						) + row_number() over (order by stage_order_nr, created_at) as order_nr
+					from
+						tasks
+					where
+						workflow_id = $3
+					and
+						stage_id is not distinct from $4
+					and
+						deleted_at is null
+				) numbered
+			WHERE
+				tasks.id = numbered.id
+			AND
+				$2 IN (select id from stages where workflow_id = $1 and deleted_at is null)
+			RETURNING
+				tasks.id,
+				tasks.name
+		`,
+			target.ID,
+			targetStageID,
+			source.ID,
+			maybeNull(sourceStageID),
+		)
+		if err != nil {
+			return nil, err
+		}
+		var tasks []Task
+		for rows.Next() {
+			var model Task
+			if err := rows.Scan(&model.ID, &model.Name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			model.StageID = targetStageID
+			model.WorkflowID = target.ID
+			tasks = append(tasks, model)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, task := range tasks {
+			if _, err := recordTaskStageWith(tx, task.ID, task.StageID, userID); err != nil {
+				return nil, err
+			}
+		}
+		moved = append(moved, tasks...)
 	}
 
-	_, err := db.Exec(`
+	var left int
+	err = tx.QueryRow(`
+		select
+			count(1)
+		from
+			tasks
+		where
+			deleted_at is null
+		and
+			workflow_id = $1
+	`,
+		source.ID,
+	).Scan(
+		&left,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if left > 0 {
+		return nil, errors.New("Please select a target stage for every stage of the workflow")
+	}
+
+	if err := switchActiveWorkflow(tx, source.ID, target.ID); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
 		UPDATE
-			persons
+			workflows
 		SET
-			owner_id = $1,
-			org_id = $2,
-			first_name = $3,
-			name = $4,
-			updated_at = current_timestamp
+			deleted_at = current_timestamp
 		WHERE
-			id = $5
+			id = $1
 	`,
-		model.OwnerID,
-		maybeNull(model.OrgID),
-		model.FirstName,
-		model.Name,
-		model.ID,
+		source.ID,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	return moved, tx.Commit()
 }
 
-func deletePerson(personID string) error {
-	_, err := db.Exec(`
+// switchActiveWorkflow points users whose active workflow is fromID to toID,
+// or to another workflow of the same company if toID is empty.
+func switchActiveWorkflow(ex execer, fromID, toID string) error {
+	_, err := ex.Exec(`
 		UPDATE
-			persons
+			users
 		SET
-			deleted_at = current_timestamp
+			active_workflow_id = coalesce($2, (
+				select workflows.id
+				from workflows
+				where workflows.company_id = (select company_id from workflows where id = $1)
+				and workflows.id <> $1
+				and workflows.deleted_at is null
+				order by workflows.order_nr, workflows.created_at
+				limit 1
+			))
 		WHERE
-			id = $1
+			active_workflow_id = $1
 	`,
-		personID,
+		fromID,
+		maybeNull(toID),
 	)
 	return err
 }
 
-func insertOrganization(model *Organization) error {
+func insertWorkflowTemplate(model *WorkflowTemplate) error {
+	if model.CompanyID == "" {
+		return errors.New("Please select a company")
+	}
 	if model.Name == "" {
 		return errors.New("Please enter a name")
 	}
 
+	stages, err := json.Marshal(model.Stages)
+	if err != nil {
+		return err
+	}
+
 	row := db.QueryRow(`
-		INSERT INTO organizations(
+		INSERT INTO workflow_templates(
 			company_id,
-			owner_id,
 			name,
-			country_code,
-			address,
-			address_subpremise,
-			address_street_number,
-			address_route,
-			address_sublocality,
-			address_locality,
-			address_admin_area_level_1,
-			address_admin_area_level_2,
-			address_country,
-			address_postal_code,
-			category_id,
-			picture_id,
-			first_char,
-			visible_to,
+			stages,
 			created_at
 		)
 		VALUES(
 			$1,
 			$2,
 			$3,
-			$4,
-			$5,
-			$6,
-			$7,
-			$8,
-			$9,
-			$10,
-			$11,
-			$12,
-			$13,
-			$14,
-			$15,
-			$16,
-			$17,
-			$18,
 			current_timestamp
 		)
 		RETURNING
@@ -895,23 +1063,8 @@ func insertOrganization(model *Organization) error {
 			created_at
 	`,
 		model.CompanyID,
-		model.OwnerID,
 		model.Name,
-		model.CountryCode,
-		model.Address,
-		model.AddressSubpremise,
-		model.AddressStreetNumber,
-		model.AddressRoute,
-		model.AddressSublocality,
-		model.AddressLocality,
-		model.AddressAdminAreaLevel1,
-		model.AddressAdminAreaLevel2,
-		model.AddressCountry,
-		model.AddressPostalCode,
-		maybeNull(model.CategoryID),
-		maybeNull(model.PictureID),
-		model.FirstChar,
-		model.VisibleTo,
+		string(stages),
 	)
 	return row.Scan(
 		&model.ID,
@@ -919,94 +1072,251 @@ func insertOrganization(model *Organization) error {
 	)
 }
 
-func updateOrganization(model Organization) error {
-	if model.Name == "" {
-		return errors.New("Please enter a name")
-	}
-
+func deleteWorkflowTemplate(model WorkflowTemplate) error {
 	_, err := db.Exec(`
 		UPDATE
-			organizations
+			workflow_templates
 		SET
-			owner_id = $1,
-			name = $2,
-			country_code = $3,
-			address = $4,
-			address_subpremise = $5,
-			address_street_number = $6,
-			address_route = $7,
-			address_sublocality = $8,
-			address_locality = $9,
-			address_admin_area_level_1 = $10,
-			address_admin_area_level_2 = $11,
-			address_country = $12,
-			address_postal_code = $13,
-			category_id = $14,
-			picture_id = $15,
-			first_char = $16,
-			visible_to = $17,
-			updated_at = current_timestamp
+			deleted_at = current_timestamp
 		WHERE
-			id = $18
+			id = $1
 	`,
-		model.OwnerID,
-		model.Name,
-		model.CountryCode,
-		model.Address,
-		model.AddressSubpremise,
-		model.AddressStreetNumber,
-		model.AddressRoute,
-		model.AddressSublocality,
-		model.AddressLocality,
-		model.AddressAdminAreaLevel1,
-		model.AddressAdminAreaLevel2,
-		model.AddressCountry,
-		model.AddressPostalCode,
-		maybeNull(model.CategoryID),
-		maybeNull(model.PictureID),
-		model.FirstChar,
-		model.VisibleTo,
 		model.ID,
 	)
 	return err
 }
 
-func deleteOrganization(organizationID string) error {
-	_, err := db.Exec(`
-		UPDATE
-			organizations
-		SET
-			deleted_at = current_timestamp
+func selectWorkflowTemplatesByCompany(companyID string) ([]WorkflowTemplate, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			stages,
+			created_at,
+			updated_at,
+			deleted_at
+		FROM
+			workflow_templates
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			name
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []WorkflowTemplate
+	for rows.Next() {
+		model, err := scanWorkflowTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
+}
+
+func selectWorkflowTemplateByID(ID string) (*WorkflowTemplate, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			stages,
+			created_at,
+			updated_at,
+			deleted_at
+		FROM
+			workflow_templates
 		WHERE
+			deleted_at IS NULL
+		AND
 			id = $1
 	`,
-		organizationID,
+		ID,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanWorkflowTemplate(rows)
 }
 
-func insertActivity(model *Activity) error {
+func scanWorkflowTemplate(rows *sql.Rows) (*WorkflowTemplate, error) {
+	var model WorkflowTemplate
+	var stages []byte
+
+	if err := rows.Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&stages,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(stages, &model.Stages); err != nil {
+		return nil, err
+	}
+
+	return &model, nil
+}
+
+// cloneWorkflow copies the workflow with its stages and, if includeTasks is
+// set, its open tasks, in one transaction.
+func cloneWorkflow(source Workflow, name, userID string, includeTasks bool) (*Workflow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	model := Workflow{}
+	model.Name = name
+	model.CompanyID = source.CompanyID
+	if err := insertWorkflowWith(tx, &model); err != nil {
+		return nil, err
+	}
+
+	stages, err := selectStagesByWorkflow(source.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range stages {
+		clone := stage
+		clone.WorkflowID = model.ID
+		if err := insertStageWith(tx, &clone); err != nil {
+			return nil, err
+		}
+
+		if !includeTasks {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			WITH copied AS (
+				INSERT INTO tasks(
+					name,
+					creator_user_id,
+					user_id,
+					person_id,
+					org_id,
+					stage_id,
+					value,
+					currency,
+					status,
+					visible_to,
+					workflow_id,
+					expected_close_date,
+					stage_order_nr,
+					probability,
+					cc_email,
+					org_hidden,
+					person_hidden,
+					company_id,
+					custom_fields,
+					stage_change_time,
+					created_at
+				)
+				SELECT
+					name,
+					$3::uuid,
+					user_id,
+					person_id,
+					org_id,
+					$2::uuid,
+					value,
+					currency,
+					'open',
+					visible_to,
+					$4::uuid,
+					expected_close_date,
+					stage_order_nr,
+					probability,
+					cc_email,
+					org_hidden,
+					person_hidden,
+					company_id,
+					custom_fields,
+					current_timestamp,
+					current_timestamp
+				FROM
+					tasks
+				WHERE
+					stage_id = $1
+				AND
+					deleted_at IS NULL
+				AND
+					won_time IS NULL
+				AND
+					lost_time IS NULL
+				RETURNING
+					id,
+					stage_id
+			)
+			INSERT INTO task_stage_history(
+				task_id,
+				stage_id,
+				entered_user_id,
+				entered_at
+			)
+			SELECT
+				id,
+				stage_id,
+				$3::uuid,
+				current_timestamp
+			FROM
+				copied
+		`,
+			stage.ID,
+			clone.ID,
+			maybeNull(userID),
+			model.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &model, tx.Commit()
+}
+
+func insertPerson(model *Person) error {
+	return insertPersonWith(db, model)
+}
+
+func insertPersonWith(ex execer, model *Person) error {
 	if model.Name == "" {
-		return errors.New("Please enter a subject")
+		return errors.New("Please enter a name")
+	}
+	if err := validateCustomFieldsFor("person", &model.CustomFields, model.CompanyID, model.ID, !model.implicit); err != nil {
+		return err
 	}
 
-	row := db.QueryRow(`
-		INSERT INTO activities(
-			name,
+	row := ex.QueryRow(`
+		INSERT INTO persons(
 			company_id,
-			user_id,
-			done,
-			type_id,
-			reference_type,
-			reference_id,
-			due_date,
-			duration,
-			marked_as_done_time,
-			task_id,
+			owner_id,
 			org_id,
-			person_id,
-			assigned_to_user_id,
-			created_by_user_id,
+			first_name,
+			name,
+			custom_fields,
 			created_at
 		)
 		VALUES(
@@ -1016,36 +1326,18 @@ func insertActivity(model *Activity) error {
 			$4,
 			$5,
 			$6,
-			$7,
-			$8,
-			$9,
-			$10,
-			$11,
-			$12,
-			$13,
-			$14,
-			$15,
 			current_timestamp
 		)
 		RETURNING
 			id,
 			created_at
 	`,
-		model.Name,
 		model.CompanyID,
-		model.UserID,
-		model.Done,
-		maybeNull(model.TypeID),
-		model.ReferenceType,
-		model.ReferenceID,
-		model.DueDate,
-		model.Duration,
-		model.DoneAt,
-		maybeNull(model.TaskID),
+		model.OwnerID,
 		maybeNull(model.OrgID),
-		maybeNull(model.PersonID),
-		maybeNull(model.AssignedToUserID),
-		maybeNull(model.CreatedByUserID),
+		model.FirstName,
+		model.Name,
+		model.CustomFields,
 	)
 	return row.Scan(
 		&model.ID,
@@ -1053,175 +1345,293 @@ func insertActivity(model *Activity) error {
 	)
 }
 
-func updateActivity(model Activity) error {
+func updatePerson(model Person) error {
 	if model.Name == "" {
-		return errors.New("Please enter a subject")
+		return errors.New("Please enter a name")
+	}
+	if err := validateCustomFieldsFor("person", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
 	}
 
 	_, err := db.Exec(`
 		UPDATE
-			activities
+			persons
 		SET
-			name = $1,
-			user_id = $2,
-			done = $3,
-			type_id = $4,
-			reference_type = $5,
-			reference_id = $6,
-			due_date = $7,
-			duration = $8,
-			marked_as_done_time = $9,
-			task_id = $10,
-			org_id = $11,
-			person_id = $12,
-			assigned_to_user_id = $13,
-			created_by_user_id = $14,
+			owner_id = $1,
+			org_id = $2,
+			first_name = $3,
+			name = $4,
+			custom_fields = $5,
 			updated_at = current_timestamp
 		WHERE
-			id = $15
+			id = $6
 	`,
-		model.Name,
-		model.UserID,
-		model.Done,
-		maybeNull(model.TypeID),
-		model.ReferenceType,
-		model.ReferenceID,
-		model.DueDate,
-		model.Duration,
-		model.DoneAt,
-		maybeNull(model.TaskID),
+		model.OwnerID,
 		maybeNull(model.OrgID),
-		maybeNull(model.PersonID),
-		maybeNull(model.AssignedToUserID),
-		maybeNull(model.CreatedByUserID),
+		model.FirstName,
+		model.Name,
+		model.CustomFields,
 		model.ID,
 	)
 	return err
 }
 
-func deleteActivity(activityID string) error {
+func deletePerson(personID string) error {
 	_, err := db.Exec(`
 		UPDATE
-			activities
+			persons
 		SET
 			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
-		activityID,
+		personID,
 	)
 	return err
 }
 
-func insertNote(model *Note) error {
-	row := db.QueryRow(`
-		INSERT INTO notes(
-		  	name,
-			company_id,
-			user_id,
-			task_id,
-			person_id,
-			org_id,
-			pinned_to_task_flag,
-			pinned_to_person_flag,
-			pinned_to_organization_flag,
-			last_update_user_id,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			$7,
-			$8,
-			$9,
-			$10,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
+// selectPersonIDsByContact returns the persons of the company other than
+// contact.PersonID with the same e-mail address or phone number as the
+// contact. E-mail addresses are compared case insensitively and phone numbers
+// by their digits once normalized. A national number kept as entered matches
+// an international one that is the same number after a country code.
+func selectPersonIDsByContact(companyID string, contact Contact) ([]string, error) {
+	name := contact.Name
+	if contact.Type == "phone" {
+		if phone, err := normalizePhone(name); err == nil {
+			name = phone
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT
+			contacts.person_id
+		FROM
+			contacts
+		INNER JOIN
+			persons ON persons.id = contacts.person_id
+		CROSS JOIN LATERAL
+			(
+				select
+					ltrim(regexp_replace(contacts.name, '[^0-9]', '', 'g'), '0') as stored,
+					ltrim(regexp_replace($4, '[^0-9]', '', 'g'), '0') as given,
+					contacts.name ~ '^\s*(\+|00)' as stored_international,
+					$4 ~ '^\s*(\+|00)' as given_international
+			) phone
+		WHERE
+			contacts.deleted_at IS NULL
+		AND
+			persons.deleted_at IS NULL
+		AND
+			persons.company_id = $1
+		AND
+			($2::uuid IS NULL OR contacts.person_id <> $2)
+		AND
+			contacts.type = $3
+		AND
+			(
+				($3 = 'email' AND lower(trim(contacts.name)) = lower(trim($4)))
+			OR
+				(
+					$3 = 'phone'
+				AND
+					length(phone.given) >= 6
+				AND
+					length(phone.stored) >= 6
+				AND
+					(
+						phone.stored = phone.given
+					OR
+						(
+							phone.stored_international
+						AND
+							NOT phone.given_international
+						AND
+							length(phone.stored) - length(phone.given) BETWEEN 1 AND 3
+						AND
+							right(phone.stored, length(phone.given)) = phone.given
+						)
+					OR
+						(
+							phone.given_international
+						AND
+							NOT phone.stored_international
+						AND
+							length(phone.given) - length(phone.stored) BETWEEN 1 AND 3
+						AND
+							right(phone.given, length(phone.stored)) = phone.stored
+						)
+					)
+				)
+			)
 	`,
-		model.Name,
-		model.CompanyID,
-		model.UserID,
-		maybeNull(model.TaskID),
-		maybeNull(model.PersonID),
-		maybeNull(model.OrgID),
-		model.PinnedToTaskFlag,
-		model.PinnedToPersonFlag,
-		model.PinnedToOrganizationFlag,
-		maybeNull(model.LastUpdateUserID),
-	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
+		companyID,
+		maybeNull(contact.PersonID),
+		contact.Type,
+		name,
 	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var ID string
+		if err := rows.Scan(&ID); err != nil {
+			return nil, err
+		}
+		result = append(result, ID)
+	}
+	return result, rows.Err()
 }
 
-func updateNote(model Note) error {
-	_, err := db.Exec(`
+// mergePersons moves the tasks, activities, notes, files, contacts and
+// timeline of loser to winner and deletes loser. Contacts that winner already
+// has are deleted instead of moved. Empty organization and custom fields of
+// winner are taken from loser.
+func mergePersons(winner, loser Person) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"tasks", "activities", "notes", "files", "timeline"} {
+		if _, err := tx.Exec(fmt.Sprintf(`
+			UPDATE
+				%s
+			SET
+				person_id = $1
+			WHERE
+				person_id = $2
+		`, table),
+			winner.ID,
+			loser.ID,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`
 		UPDATE
-			notes
+			contacts
 		SET
-		  	name = $1,
-			user_id = $2,
-			task_id = $3,
-			person_id = $4,
-			org_id = $5,
-			pinned_to_task_flag = $6,
-			pinned_to_person_flag = $7,
-			pinned_to_organization_flag = $8,
-			last_update_user_id = $9,
+			deleted_at = current_timestamp
+		WHERE
+			person_id = $2
+		AND
+			deleted_at IS NULL
+		AND
+			EXISTS (
+				select 1
+				from contacts existing
+				where existing.person_id = $1
+				and existing.deleted_at is null
+				and existing.type = contacts.type
+				and lower(trim(existing.name)) = lower(trim(contacts.name))
+			)
+	`,
+		winner.ID,
+		loser.ID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE
+			contacts
+		SET
+			person_id = $1,
+			primary_contact = false,
 			updated_at = current_timestamp
 		WHERE
-			id = $10
+			person_id = $2
+		AND
+			deleted_at IS NULL
 	`,
-		model.Name,
-		model.UserID,
-		maybeNull(model.TaskID),
-		maybeNull(model.PersonID),
-		maybeNull(model.OrgID),
-		model.PinnedToTaskFlag,
-		model.PinnedToPersonFlag,
-		model.PinnedToOrganizationFlag,
-		maybeNull(model.LastUpdateUserID),
-		model.ID,
-	)
-	return err
-}
+		winner.ID,
+		loser.ID,
+	); err != nil {
+		return err
+	}
 
-func deleteNote(noteID string) error {
-	_, err := db.Exec(`
+	if _, err := tx.Exec(`
 		UPDATE
-			notes
+			persons
+		SET
+			org_id = coalesce(winner.org_id, loser.org_id),
+			first_name = (case when winner.first_name = '' then loser.first_name else winner.first_name end),
+			custom_fields = loser.custom_fields || winner.custom_fields,
+			updated_at = current_timestamp
+		FROM
+			persons winner,
+			persons loser
+		WHERE
+			persons.id = $1
+		AND
+			winner.id = $1
+		AND
+			loser.id = $2
+	`,
+		winner.ID,
+		loser.ID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE
+			persons
 		SET
 			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
-		noteID,
-	)
-	return err
+		loser.ID,
+	); err != nil {
+		return err
+	}
+
+	if err := assignPrimaryContacts(tx, winner.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func insertContact(model *Contact) error {
+func insertOrganization(model *Organization) error {
+	return insertOrganizationWith(db, model)
+}
+
+func insertOrganizationWith(ex execer, model *Organization) error {
 	if model.Name == "" {
-		return errors.New("Please enter a phone number or an e-mail")
+		return errors.New("Please enter a name")
 	}
-	if model.Type == "" {
-		return errors.New("Please select contact type")
+	if err := validateCustomFieldsFor("organization", &model.CustomFields, model.CompanyID, model.ID, !model.implicit); err != nil {
+		return err
 	}
 
-	row := db.QueryRow(`
-		INSERT INTO contacts(
+	row := ex.QueryRow(`
+		INSERT INTO organizations(
+			company_id,
+			owner_id,
 			name,
-			person_id,
-			type,
-			primary_contact,
+			country_code,
+			address,
+			address_subpremise,
+			address_street_number,
+			address_route,
+			address_sublocality,
+			address_locality,
+			address_admin_area_level_1,
+			address_admin_area_level_2,
+			address_country,
+			address_postal_code,
+			category_id,
+			picture_id,
+			first_char,
+			visible_to,
+			custom_fields,
 			created_at
 		)
 		VALUES(
@@ -1229,16 +1639,46 @@ func insertContact(model *Contact) error {
 			$2,
 			$3,
 			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11,
+			$12,
+			$13,
+			$14,
+			$15,
+			$16,
+			$17,
+			$18,
+			$19,
 			current_timestamp
 		)
 		RETURNING
 			id,
 			created_at
 	`,
+		model.CompanyID,
+		model.OwnerID,
 		model.Name,
-		model.PersonID,
-		model.Type,
-		model.Primary,
+		model.CountryCode,
+		model.Address,
+		model.AddressSubpremise,
+		model.AddressStreetNumber,
+		model.AddressRoute,
+		model.AddressSublocality,
+		model.AddressLocality,
+		model.AddressAdminAreaLevel1,
+		model.AddressAdminAreaLevel2,
+		model.AddressCountry,
+		model.AddressPostalCode,
+		maybeNull(model.CategoryID),
+		maybeNull(model.PictureID),
+		model.FirstChar,
+		model.VisibleTo,
+		model.CustomFields,
 	)
 	return row.Scan(
 		&model.ID,
@@ -1246,187 +1686,291 @@ func insertContact(model *Contact) error {
 	)
 }
 
-func updateContact(model Contact) error {
+func updateOrganization(model Organization) error {
 	if model.Name == "" {
-		return errors.New("Please enter a phone number or an e-mail")
+		return errors.New("Please enter a name")
 	}
-	if model.Type == "" {
-		return errors.New("Please select contact type")
+	if err := validateCustomFieldsFor("organization", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
 	}
 
 	_, err := db.Exec(`
 		UPDATE
-			contacts
+			organizations
 		SET
-			name = $1,
-			type = $2,
-			primary_contact = $3,
+			owner_id = $1,
+			name = $2,
+			country_code = $3,
+			address = $4,
+			address_subpremise = $5,
+			address_street_number = $6,
+			address_route = $7,
+			address_sublocality = $8,
+			address_locality = $9,
+			address_admin_area_level_1 = $10,
+			address_admin_area_level_2 = $11,
+			address_country = $12,
+			address_postal_code = $13,
+			category_id = $14,
+			picture_id = $15,
+			first_char = $16,
+			visible_to = $17,
+			custom_fields = $18,
+			address_geocoded_at = (case
+				when (address, address_subpremise, address_street_number, address_route, address_sublocality, address_locality, address_admin_area_level_1, address_admin_area_level_2, address_country, address_postal_code)
+					IS DISTINCT FROM ($4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+				then NULL
+				else address_geocoded_at
+			end),
+			address_geocode_claimed_at = (case
+				when (address, address_subpremise, address_street_number, address_route, address_sublocality, address_locality, address_admin_area_level_1, address_admin_area_level_2, address_country, address_postal_code)
+					IS DISTINCT FROM ($4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+				then NULL
+				else address_geocode_claimed_at
+			end),
 			updated_at = current_timestamp
 		WHERE
-			id = $4
+			id = $19
 	`,
+		model.OwnerID,
 		model.Name,
-		model.Type,
-		model.Primary,
+		model.CountryCode,
+		model.Address,
+		model.AddressSubpremise,
+		model.AddressStreetNumber,
+		model.AddressRoute,
+		model.AddressSublocality,
+		model.AddressLocality,
+		model.AddressAdminAreaLevel1,
+		model.AddressAdminAreaLevel2,
+		model.AddressCountry,
+		model.AddressPostalCode,
+		maybeNull(model.CategoryID),
+		maybeNull(model.PictureID),
+		model.FirstChar,
+		model.VisibleTo,
+		model.CustomFields,
 		model.ID,
 	)
 	return err
 }
 
-func deleteContact(ID string) error {
+func deleteOrganization(organizationID string) error {
 	_, err := db.Exec(`
 		UPDATE
-			contacts
+			organizations
 		SET
 			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
-		ID,
+		organizationID,
 	)
 	return err
 }
 
-func insertPersonField(model *PersonField) error {
-	row := db.QueryRow(`
-		INSERT INTO person_fields(
-		   	company_id,
-		   	name,
-		   	key,
-		   	order_nr,
-		   	picklist_data,
-			field_type,
-			edit_flag,
-			index_visible_flag,
-			details_visible_flag,
-			add_visible_flag,
-			important_flag,
-			bulk_edit_allowed,
-			use_field,
-			link,
-			mandatory_flag,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			$7,
-			$8,
-			$9,
-			$10,
-			$11,
-			$12,
-			$13,
-			$14,
-			$15,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
+// mergeOrganizations moves the persons, tasks, activities, notes, files,
+// relationships and timeline of loser to winner and deletes loser.
+// Relationships that would link winner to itself or repeat an existing
+// relationship are deleted. Empty address, category and custom fields of
+// winner are taken from loser.
+func mergeOrganizations(winner, loser Organization) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrganizationHierarchy(tx, winner.CompanyID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		select
+			rel_owner_org_id,
+			rel_linked_org_id
+		from
+			organization_relationships
+		where
+			deleted_at is null
+		and
+			type = 'parent'
+		and
+			company_id = $1
+		for update
 	`,
-		model.CompanyID,
-		model.Name,
-		model.Key,
-		model.OrderNr,
-		model.PicklistData,
-		model.FieldType,
-		model.EditFlag,
-		model.IndexVisibleFlag,
-		model.DetailsVisibleFlag,
-		model.AddVisibleFlag,
-		model.ImportantFlag,
-		model.BulkEditAllowed,
-		model.UseField,
-		model.Link,
-		model.MandatoryFlag,
-	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
+		winner.CompanyID,
 	)
-}
+	if err != nil {
+		return err
+	}
+	var parents [][2]string
+	for rows.Next() {
+		var edge [2]string
+		if err := rows.Scan(&edge[0], &edge[1]); err != nil {
+			rows.Close()
+			return err
+		}
+		parents = append(parents, edge)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := checkMergedHierarchy(parents, winner.ID, loser.ID); err != nil {
+		return err
+	}
 
-func updatePersonField(model PersonField) error {
-	_, err := db.Exec(`
+	for _, column := range [][2]string{
+		{"persons", "org_id"},
+		{"tasks", "org_id"},
+		{"activities", "org_id"},
+		{"notes", "org_id"},
+		{"files", "org_id"},
+		{"timeline", "organization_id"},
+		{"organization_relationships", "rel_owner_org_id"},
+		{"organization_relationships", "rel_linked_org_id"},
+		{"organization_relationships", "calculated_related_org_id"},
+	} {
+		if _, err := tx.Exec(fmt.Sprintf(`
+			UPDATE
+				%[1]s
+			SET
+				%[2]s = $1
+			WHERE
+				%[2]s = $2
+		`, column[0], column[1]),
+			winner.ID,
+			loser.ID,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`
 		UPDATE
-			person_fields
+			organization_relationships
 		SET
-		   	name = $1,
-		   	key = $2,
-		   	order_nr = $3,
-		   	picklist_data = $4,
-			field_type = $5,
-			edit_flag = $6,
-			index_visible_flag = $7,
-			details_visible_flag = $8,
-			add_visible_flag = $9,
-			important_flag = $10,
-			bulk_edit_allowed = $11,
-			use_field = $12,
-			link = $13,
-			mandatory_flag = $14,
+			deleted_at = current_timestamp
+		WHERE
+			deleted_at IS NULL
+		AND
+			(rel_owner_org_id = $1 OR rel_linked_org_id = $1)
+		AND
+			(
+				rel_owner_org_id = rel_linked_org_id
+			OR
+				EXISTS (
+					select 1
+					from organization_relationships other
+					where other.deleted_at is null
+					and other.id <> organization_relationships.id
+					and other.type = organization_relationships.type
+					and other.rel_owner_org_id = organization_relationships.rel_owner_org_id
+					and other.rel_linked_org_id = organization_relationships.rel_linked_org_id
+					and (other.created_at, other.id) < (organization_relationships.created_at, organization_relationships.id)
+				)
+			)
+	`,
+		winner.ID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE
+			organizations
+		SET
+			address = (case when winner.address = '' then loser.address else winner.address end),
+			address_subpremise = (case when winner.address = '' then loser.address_subpremise else winner.address_subpremise end),
+			address_street_number = (case when winner.address = '' then loser.address_street_number else winner.address_street_number end),
+			address_route = (case when winner.address = '' then loser.address_route else winner.address_route end),
+			address_sublocality = (case when winner.address = '' then loser.address_sublocality else winner.address_sublocality end),
+			address_locality = (case when winner.address = '' then loser.address_locality else winner.address_locality end),
+			address_admin_area_level_1 = (case when winner.address = '' then loser.address_admin_area_level_1 else winner.address_admin_area_level_1 end),
+			address_admin_area_level_2 = (case when winner.address = '' then loser.address_admin_area_level_2 else winner.address_admin_area_level_2 end),
+			address_country = (case when winner.address = '' then loser.address_country else winner.address_country end),
+			address_postal_code = (case when winner.address = '' then loser.address_postal_code else winner.address_postal_code end),
+			address_formatted_address = (case when winner.address = '' then loser.address_formatted_address else winner.address_formatted_address end),
+			address_latitude = (case when winner.address = '' then loser.address_latitude else winner.address_latitude end),
+			address_longitude = (case when winner.address = '' then loser.address_longitude else winner.address_longitude end),
+			address_geocoded_at = (case when winner.address = '' then loser.address_geocoded_at else winner.address_geocoded_at end),
+			address_geocode_claimed_at = NULL,
+			category_id = coalesce(winner.category_id, loser.category_id),
+			custom_fields = loser.custom_fields || winner.custom_fields,
 			updated_at = current_timestamp
+		FROM
+			organizations winner,
+			organizations loser
 		WHERE
-			id = $15
+			organizations.id = $1
+		AND
+			winner.id = $1
+		AND
+			loser.id = $2
 	`,
-		model.Name,
-		model.Key,
-		model.OrderNr,
-		model.PicklistData,
-		model.FieldType,
-		model.EditFlag,
-		model.IndexVisibleFlag,
-		model.DetailsVisibleFlag,
-		model.AddVisibleFlag,
-		model.ImportantFlag,
-		model.BulkEditAllowed,
-		model.UseField,
-		model.Link,
-		model.MandatoryFlag,
-		model.ID,
-	)
-	return err
-}
+		winner.ID,
+		loser.ID,
+	); err != nil {
+		return err
+	}
 
-func deletePersonField(model PersonField) error {
-	_, err := db.Exec(`
+	if _, err := tx.Exec(`
 		UPDATE
-			person_fields
+			organizations
 		SET
 			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
-		model.ID,
-	)
-	return err
+		loser.ID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func insertFile(model *File) error {
+func insertActivity(model *Activity) error {
+	if model.Name == "" {
+		return validationError("Please enter a subject")
+	}
+	if err := validateCustomFieldsFor("activity", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
+	}
+	if model.ReminderMinutes != nil && (*model.ReminderMinutes < 0 || *model.ReminderMinutes > maxReminderMinutes) {
+		return validationError("Please select a reminder of at most four weeks before")
+	}
+
+	prepareAllDay(model)
+
 	row := db.QueryRow(`
-		INSERT INTO files(
-		   	name,
+		INSERT INTO activities(
+			name,
+			company_id,
 			user_id,
+			done,
+			type_id,
+			reference_type,
+			reference_id,
+			due_date,
+			duration,
+			marked_as_done_time,
 			task_id,
-			person_id,
 			org_id,
-			activity_id,
-			note_id,
-			file_type,
-			file_size,
-			inline_flag,
-			remote_location,
-			remote_id,
-			cid,
-			s3_bucket,
-			url,
-			description,
-		    created_at
+			person_id,
+			assigned_to_user_id,
+			created_by_user_id,
+			custom_fields,
+			recurrence_rule,
+			recurrence_start,
+			recurrence_index,
+			series_id,
+			reminder_minutes,
+			reminder_off,
+			snoozed_until,
+			all_day,
+			created_at
 		)
 		VALUES(
 			$1,
@@ -1445,6 +1989,14 @@ func insertFile(model *File) error {
 			$14,
 			$15,
 			$16,
+			$17,
+			$18,
+			$19,
+			$20,
+			$21,
+			$22,
+			$23,
+			$24,
 			current_timestamp
 		)
 		RETURNING
@@ -1452,21 +2004,29 @@ func insertFile(model *File) error {
 			created_at
 	`,
 		model.Name,
+		model.CompanyID,
 		model.UserID,
+		model.Done,
+		maybeNull(model.TypeID),
+		model.ReferenceType,
+		model.ReferenceID,
+		model.DueDate,
+		model.Duration,
+		model.DoneAt,
 		maybeNull(model.TaskID),
-		maybeNull(model.PersonID),
 		maybeNull(model.OrgID),
-		maybeNull(model.ActivityID),
-		maybeNull(model.NoteID),
-		model.FileType,
-		model.FileSize,
-		model.InlineFlag,
-		model.RemoteLocation,
-		model.RemoteID,
-		model.CID,
-		model.S3Bucket,
-		model.URL,
-		model.Description,
+		maybeNull(model.PersonID),
+		maybeNull(model.AssignedToUserID),
+		maybeNull(model.CreatedByUserID),
+		model.CustomFields,
+		model.RecurrenceRule,
+		model.RecurrenceStart,
+		model.RecurrenceIndex,
+		maybeNull(model.SeriesID),
+		model.ReminderMinutes,
+		model.ReminderOff,
+		model.SnoozedUntil,
+		model.AllDay,
 	)
 	return row.Scan(
 		&model.ID,
@@ -1474,218 +2034,247 @@ func insertFile(model *File) error {
 	)
 }
 
-func updateFile(model File) error {
+func updateActivity(model Activity) error {
+	if model.Name == "" {
+		return validationError("Please enter a subject")
+	}
+	if err := validateCustomFieldsFor("activity", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
+	}
+	if model.ReminderMinutes != nil && (*model.ReminderMinutes < 0 || *model.ReminderMinutes > maxReminderMinutes) {
+		return validationError("Please select a reminder of at most four weeks before")
+	}
+
+	prepareAllDay(&model)
+
 	_, err := db.Exec(`
 		UPDATE
-			files
+			activities
 		SET
-		   	name = $1,
+			name = $1,
 			user_id = $2,
-			task_id = $3,
-			person_id = $4,
-			org_id = $5,
-			activity_id = $6,
-			note_id = $7,
-			file_type = $8,
-			file_size = $9,
-			inline_flag = $10,
-			remote_location = $11,
-			remote_id = $12,
-			cid = $13,
-			s3_bucket = $14,
-			url = $15,
-			description = $16,
+			done = $3,
+			type_id = $4,
+			reference_type = $5,
+			reference_id = $6,
+			due_date = $7,
+			duration = $8,
+			marked_as_done_time = $9,
+			task_id = $10,
+			org_id = $11,
+			person_id = $12,
+			assigned_to_user_id = $13,
+			created_by_user_id = $14,
+			custom_fields = $15,
+			recurrence_rule = $16,
+			recurrence_start = $17,
+			recurrence_index = $18,
+			series_id = $19,
+			reminder_minutes = $20,
+			reminder_off = $21,
+			snoozed_until = $22,
+			all_day = $23,
 			updated_at = current_timestamp
 		WHERE
-			id = $17
+			id = $24
 	`,
 		model.Name,
 		model.UserID,
+		model.Done,
+		maybeNull(model.TypeID),
+		model.ReferenceType,
+		model.ReferenceID,
+		model.DueDate,
+		model.Duration,
+		model.DoneAt,
 		maybeNull(model.TaskID),
-		maybeNull(model.PersonID),
 		maybeNull(model.OrgID),
-		maybeNull(model.ActivityID),
-		maybeNull(model.NoteID),
-		model.FileType,
-		model.FileSize,
-		model.InlineFlag,
-		model.RemoteLocation,
-		model.RemoteID,
-		model.CID,
-		model.S3Bucket,
-		model.URL,
-		model.Description,
+		maybeNull(model.PersonID),
+		maybeNull(model.AssignedToUserID),
+		maybeNull(model.CreatedByUserID),
+		model.CustomFields,
+		model.RecurrenceRule,
+		model.RecurrenceStart,
+		model.RecurrenceIndex,
+		maybeNull(model.SeriesID),
+		model.ReminderMinutes,
+		model.ReminderOff,
+		model.SnoozedUntil,
+		model.AllDay,
 		model.ID,
 	)
 	return err
 }
 
-func deleteFile(model File) error {
-	_, err := db.Exec(`
-		UPDATE
-			files
-		SET
-			deleted_at = current_timestamp
-		WHERE
-			id = $1
+// activityOccurrenceExists reports whether the series has the occurrence
+func activityOccurrenceExists(seriesID string, start time.Time, index int) (bool, error) {
+	var result bool
+	err := db.QueryRow(`
+		select
+			count(1) > 0
+		from
+			activities
+		where
+			series_id = $1
+		and
+			recurrence_start = $2
+		and
+			recurrence_index = $3
+		and
+			deleted_at is null
 	`,
-		model.ID,
+		seriesID,
+		start,
+		index,
+	).Scan(
+		&result,
 	)
-	return err
+	return result, err
 }
 
-func insertStage(model *Stage) error {
-	if model.Name == "" {
-		return errors.New("Please enter a name")
-	}
+// updateActivitySeries copies the subject, type, duration, links, assignee,
+// custom fields, reminder and all-day flag of the occurrence to the other
+// undone occurrences of its series. Occurrences that become all-day move to
+// midnight UTC of their UTC date.
+func updateActivitySeries(model Activity) error {
+	prepareAllDay(&model)
 
-	row := db.QueryRow(`
-		INSERT INTO stages(
-		  	name,
-			order_nr,
-			task_probability,
-			workflow_id,
-			rotten_flag,
-			rotten_days,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
+	_, err := db.Exec(`
+		UPDATE
+			activities
+		SET
+			name = $1,
+			type_id = $2,
+			duration = $3,
+			task_id = $4,
+			org_id = $5,
+			person_id = $6,
+			assigned_to_user_id = $7,
+			custom_fields = $8,
+			reminder_minutes = $9,
+			reminder_off = $10,
+			all_day = $11,
+			due_date = CASE WHEN $11 AND NOT all_day
+				THEN date_trunc('day', due_date AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+				ELSE due_date END,
+			updated_at = current_timestamp
+		WHERE
+			series_id = $12
+		AND
+			id <> $13
+		AND
+			done = false
+		AND
+			deleted_at IS NULL
 	`,
 		model.Name,
-		model.OrderNr,
-		model.TaskProbability,
-		model.WorkflowID,
-		model.RottenFlag,
-		model.RottenDays,
-	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
+		maybeNull(model.TypeID),
+		model.Duration,
+		maybeNull(model.TaskID),
+		maybeNull(model.OrgID),
+		maybeNull(model.PersonID),
+		maybeNull(model.AssignedToUserID),
+		model.CustomFields,
+		model.ReminderMinutes,
+		model.ReminderOff,
+		model.AllDay,
+		model.SeriesID,
+		model.ID,
 	)
+	return err
 }
 
-func updateStage(model Stage) error {
-	if model.Name == "" {
-		return errors.New("Please enter a name")
-	}
-
+// updateActivitySnooze moves the reminder of the activity to until
+func updateActivitySnooze(ID string, until time.Time) error {
 	_, err := db.Exec(`
 		UPDATE
-			stages
+			activities
 		SET
-		  	name = $1,
-			order_nr = $2,
-			task_probability = $3,
-			workflow_id = $4,
-			rotten_flag = $5,
-			rotten_days = $6,
+			snoozed_until = $1,
 			updated_at = current_timestamp
 		WHERE
-			id = $7
+			id = $2
 	`,
-		model.Name,
-		model.OrderNr,
-		model.TaskProbability,
-		model.WorkflowID,
-		model.RottenFlag,
-		model.RottenDays,
-		model.ID,
+		until,
+		ID,
 	)
 	return err
 }
 
-func stageIsInUse(stageID string) (bool, error) {
-	var result bool
-	err := db.QueryRow(`
-		select
-			count(1) > 0
-		from
-			tasks
-		where
-			deleted_at is null
-		and
-			stage_id = $1
+// deleteActivitySeries deletes the undone occurrences of the series
+func deleteActivitySeries(seriesID string) error {
+	_, err := db.Exec(`
+		UPDATE
+			activities
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			series_id = $1
+		AND
+			done = false
+		AND
+			deleted_at IS NULL
 	`,
-		stageID,
-	).Scan(
-		&result,
+		seriesID,
 	)
-	return result, err
+	return err
 }
 
-func deleteStage(stageID string) error {
-	used, err := stageIsInUse(stageID)
+// updateActivityDueDates moves the activities to the due dates by ID at once
+func updateActivityDueDates(dueDates map[string]time.Time) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	if used {
-		return errors.New("The stage has tasks. Please remove the tasks first")
+	defer tx.Rollback()
+
+	for ID, dueDate := range dueDates {
+		if _, err := tx.Exec(`
+			UPDATE
+				activities
+			SET
+				due_date = $1,
+				updated_at = current_timestamp
+			WHERE
+				id = $2
+		`,
+			dueDate,
+			ID,
+		); err != nil {
+			return err
+		}
 	}
 
-	_, err = db.Exec(`
+	return tx.Commit()
+}
+
+func deleteActivity(activityID string) error {
+	_, err := db.Exec(`
 		UPDATE
-			stages
+			activities
 		SET
 			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
-		stageID,
+		activityID,
 	)
 	return err
 }
 
-func insertTask(model *Task) error {
-	if model.CompanyID == "" {
-		return errors.New("Please assign a company")
-	}
-	if model.StageID == "" {
-		return errors.New("Please assign a workflow stage")
-	}
-	if model.Name == "" {
-		return errors.New("Please enter a title")
-	}
-
+func insertNote(model *Note) error {
 	row := db.QueryRow(`
-		INSERT INTO tasks(
-		   	name,
-			creator_user_id,
+		INSERT INTO notes(
+		  	name,
+			company_id,
 			user_id,
+			task_id,
 			person_id,
 			org_id,
-			stage_id,
-			value,
-			currency,
-			stage_change_time,
-			status,
-			lost_reason,
-			visible_to,
-			close_time,
-			workflow_id,
-			won_time,
-			first_won_time,
-			lost_time,
-			expected_close_date,
-			stage_order_nr,
-			formatted_value,
-			rotten_time,
-			weighted_value,
-			formatted_weighted_value,
-			cc_email,
-			org_hidden,
-			person_hidden,
-			company_id,
+			pinned_to_task_flag,
+			pinned_to_person_flag,
+			pinned_to_organization_flag,
+			last_update_user_id,
 		    created_at
 		)
 		VALUES(
@@ -1699,23 +2288,6 @@ func insertTask(model *Task) error {
 			$8,
 			$9,
 			$10,
-			$11,
-			$12,
-			$13,
-			$14,
-			$15,
-			$16,
-			$17,
-			$18,
-			$19,
-			$20,
-			$21,
-			$22,
-			$23,
-			$24,
-			$25,
-			$26,
-			$27,
 			current_timestamp
 		)
 		RETURNING
@@ -1723,32 +2295,15 @@ func insertTask(model *Task) error {
 			created_at
 	`,
 		model.Name,
-		model.CreatorUserID,
+		model.CompanyID,
 		model.UserID,
+		maybeNull(model.TaskID),
 		maybeNull(model.PersonID),
 		maybeNull(model.OrgID),
-		model.StageID,
-		model.Value,
-		model.Currency,
-		model.StageChangeTime,
-		model.Status,
-		model.LostReason,
-		model.VisibleTo,
-		model.CloseTime,
-		model.WorkflowID,
-		model.WonTime,
-		model.FirstWonTime,
-		model.LostTime,
-		model.ExpectedCloseDate,
-		model.StageOrderNr,
-		model.FormattedValue,
-		model.RottenTime,
-		model.WeightedValue,
-		model.FormattedWeightedValue,
-		model.CCEmail,
-		model.OrgHidden,
-		model.PersonHidden,
-		model.CompanyID,
+		model.PinnedToTaskFlag,
+		model.PinnedToPersonFlag,
+		model.PinnedToOrganizationFlag,
+		maybeNull(model.LastUpdateUserID),
 	)
 	return row.Scan(
 		&model.ID,
@@ -1756,104 +2311,286 @@ func insertTask(model *Task) error {
 	)
 }
 
-func updateTask(model Task) error {
-	if model.CompanyID == "" {
-		return errors.New("Please assign a company")
-	}
-	if model.StageID == "" {
-		return errors.New("Please assign a workflow stage")
-	}
-	if model.Name == "" {
-		return errors.New("Please enter a title")
-	}
-
+func updateNote(model Note) error {
 	_, err := db.Exec(`
 		UPDATE
-			tasks
+			notes
 		SET
-		   	name = $1,
-			creator_user_id = $2,
-			user_id = $3,
+		  	name = $1,
+			user_id = $2,
+			task_id = $3,
 			person_id = $4,
 			org_id = $5,
-			stage_id = $6,
-			value = $7,
-			currency = $8,
-			stage_change_time = $9,
-			status = $10,
-			lost_reason = $11,
-			visible_to = $12,
-			close_time = $13,
-			workflow_id = $14,
-			won_time = $15,
-			first_won_time = $16,
-			lost_time = $17,
-			expected_close_date = $18,
-			stage_order_nr = $19,
-			formatted_value = $20,
-			rotten_time = $21,
-			weighted_value = $22,
-			formatted_weighted_value = $23,
-			cc_email = $24,
-			org_hidden = $25,
-			person_hidden = $26,
+			pinned_to_task_flag = $6,
+			pinned_to_person_flag = $7,
+			pinned_to_organization_flag = $8,
+			last_update_user_id = $9,
 			updated_at = current_timestamp
 		WHERE
-			id = $27
+			id = $10
 	`,
 		model.Name,
-		model.CreatorUserID,
 		model.UserID,
+		maybeNull(model.TaskID),
 		maybeNull(model.PersonID),
 		maybeNull(model.OrgID),
-		model.StageID,
-		model.Value,
-		model.Currency,
-		model.StageChangeTime,
-		model.Status,
-		model.LostReason,
-		model.VisibleTo,
-		model.CloseTime,
-		model.WorkflowID,
-		model.WonTime,
-		model.FirstWonTime,
-		model.LostTime,
-		model.ExpectedCloseDate,
-		model.StageOrderNr,
-		model.FormattedValue,
-		model.RottenTime,
-		model.WeightedValue,
-		model.FormattedWeightedValue,
-		model.CCEmail,
-		model.OrgHidden,
-		model.PersonHidden,
+		model.PinnedToTaskFlag,
+		model.PinnedToPersonFlag,
+		model.PinnedToOrganizationFlag,
+		maybeNull(model.LastUpdateUserID),
 		model.ID,
 	)
 	return err
 }
 
-func deleteTask(taskID string) error {
+func deleteNote(noteID string) error {
 	_, err := db.Exec(`
 		UPDATE
-			tasks
+			notes
 		SET
 			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
-		taskID,
+		noteID,
 	)
 	return err
 }
 
-func insertOrganizationField(model *OrganizationField) error {
-	row := db.QueryRow(`
-		INSERT INTO organization_fields(
-			company_id,
+// assignPrimaryContacts makes the oldest contact of each type primary when
+// the person has no primary contact of that type.
+func assignPrimaryContacts(db execer, personID string) error {
+	_, err := db.Exec(`
+		UPDATE
+			contacts
+		SET
+			primary_contact = true
+		WHERE
+			id IN (
+				SELECT DISTINCT ON (c.type)
+					c.id
+				FROM
+					contacts c
+				WHERE
+					c.person_id = $1
+				AND
+					c.deleted_at IS NULL
+				AND
+					NOT EXISTS (
+						SELECT 1
+						FROM contacts p
+						WHERE p.person_id = c.person_id
+						AND p.type = c.type
+						AND p.primary_contact
+						AND p.deleted_at IS NULL
+					)
+				ORDER BY
+					c.type, c.created_at, c.id
+			)
+	`,
+		personID,
+	)
+	return err
+}
+
+// unsetPrimaryContact clears the primary flag of the other contacts of the
+// same type when the contact is primary.
+func unsetPrimaryContact(db execer, model Contact) error {
+	if !model.Primary {
+		return nil
+	}
+	_, err := db.Exec(`
+		UPDATE
+			contacts
+		SET
+			primary_contact = false
+		WHERE
+			person_id = $1
+		AND
+			type = $2
+		AND
+			($3::uuid IS NULL OR id <> $3)
+		AND
+			primary_contact
+	`,
+		model.PersonID,
+		model.Type,
+		maybeNull(model.ID),
+	)
+	return err
+}
+
+func insertContact(model *Contact) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertContactWith(tx, model); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertContactWith(ex execer, model *Contact) error {
+	if err := normalizeContact(model); err != nil {
+		return err
+	}
+
+	if err := unsetPrimaryContact(ex, *model); err != nil {
+		return err
+	}
+
+	return ex.QueryRow(`
+		INSERT INTO contacts(
 			name,
-			key,
-			order_nr,
-			picklist_data,
+			person_id,
+			type,
+			label,
+			primary_contact,
+			created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5 OR NOT EXISTS (
+				SELECT 1
+				FROM contacts
+				WHERE person_id = $2
+				AND type = $3
+				AND primary_contact
+				AND deleted_at IS NULL
+			),
+			current_timestamp
+		)
+		RETURNING
+			id,
+			primary_contact,
+			created_at
+	`,
+		model.Name,
+		model.PersonID,
+		model.Type,
+		model.Label,
+		model.Primary,
+	).Scan(
+		&model.ID,
+		&model.Primary,
+		&model.CreatedAt,
+	)
+}
+
+func updateContact(model Contact) error {
+	if err := normalizeContact(&model); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(`
+		SELECT
+			person_id
+		FROM
+			contacts
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	).Scan(
+		&model.PersonID,
+	); err != nil {
+		return err
+	}
+
+	if err := unsetPrimaryContact(tx, model); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE
+			contacts
+		SET
+			name = $1,
+			type = $2,
+			label = $3,
+			primary_contact = $4,
+			updated_at = current_timestamp
+		WHERE
+			id = $5
+	`,
+		model.Name,
+		model.Type,
+		model.Label,
+		model.Primary,
+		model.ID,
+	); err != nil {
+		return err
+	}
+
+	if err := assignPrimaryContacts(tx, model.PersonID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deleteContact(ID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var personID string
+	if err := tx.QueryRow(`
+		UPDATE
+			contacts
+		SET
+			primary_contact = false,
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+		RETURNING
+			person_id
+	`,
+		ID,
+	).Scan(
+		&personID,
+	); err != nil {
+		return err
+	}
+
+	if err := assignPrimaryContacts(tx, personID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertPersonField(model *PersonField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("person_fields", model.CompanyID, model.Key, ""); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	row := db.QueryRow(`
+		INSERT INTO person_fields(
+		   	company_id,
+		   	name,
+		   	key,
+		   	order_nr,
+		   	picklist_data,
 			field_type,
 			edit_flag,
 			index_visible_flag,
@@ -1910,15 +2647,35 @@ func insertOrganizationField(model *OrganizationField) error {
 	)
 }
 
-func updateOrganizationField(model OrganizationField) error {
-	_, err := db.Exec(`
+func updatePersonField(model PersonField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("person_fields", model.CompanyID, model.Key, model.ID); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldKey, err := lockCustomFieldKey(tx, "person_fields", model.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
 		UPDATE
-			organization_fields
+			person_fields
 		SET
-			name = $1,
-			key = $2,
-			order_nr = $3,
-			picklist_data = $4,
+		   	name = $1,
+		   	key = $2,
+		   	order_nr = $3,
+		   	picklist_data = $4,
 			field_type = $5,
 			edit_flag = $6,
 			index_visible_flag = $7,
@@ -1949,13 +2706,28 @@ func updateOrganizationField(model OrganizationField) error {
 		model.MandatoryFlag,
 		model.ID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if err := renameCustomFieldKey(tx, "persons", model.CompanyID, oldKey, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func deleteOrganizationField(model OrganizationField) error {
-	_, err := db.Exec(`
+// deletePersonField deletes the field and its values on the persons
+func deletePersonField(model PersonField) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
 		UPDATE
-			organization_fields
+			person_fields
 		SET
 			deleted_at = current_timestamp
 		WHERE
@@ -1963,12 +2735,21 @@ func deleteOrganizationField(model OrganizationField) error {
 	`,
 		model.ID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if err := removeCustomFieldKey(tx, "persons", model.CompanyID, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func insertTaskField(model *TaskField) error {
-	row := db.QueryRow(`
-		INSERT INTO task_fields(
+func selectPersonFieldsByCompany(companyID string) ([]PersonField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
 			company_id,
 			name,
 			key,
@@ -1981,16 +2762,139 @@ func insertTaskField(model *TaskField) error {
 			add_visible_flag,
 			important_flag,
 			bulk_edit_allowed,
+			use_field,
+			link,
 			mandatory_flag,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			person_fields
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			order_nr, created_at
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []PersonField
+	for rows.Next() {
+		model, err := scanPersonField(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
+}
+
+func selectPersonFieldByID(ID string) (*PersonField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			use_field,
+			link,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			person_fields
+		WHERE
+			deleted_at IS NULL
+		AND
+			id = $1
+	`,
+		ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanPersonField(rows)
+}
+
+func scanPersonField(rows *sql.Rows) (*PersonField, error) {
+	var model PersonField
+	err := rows.Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.Key,
+		&model.OrderNr,
+		&model.PicklistData,
+		&model.FieldType,
+		&model.EditFlag,
+		&model.IndexVisibleFlag,
+		&model.DetailsVisibleFlag,
+		&model.AddVisibleFlag,
+		&model.ImportantFlag,
+		&model.BulkEditAllowed,
+		&model.UseField,
+		&model.Link,
+		&model.MandatoryFlag,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func insertFile(model *File) error {
+	row := db.QueryRow(`
+		INSERT INTO files(
+		   	name,
+			user_id,
+			task_id,
+			person_id,
+			org_id,
+			activity_id,
+			note_id,
+			file_type,
+			file_size,
+			inline_flag,
+			remote_location,
+			remote_id,
+			cid,
+			s3_bucket,
+			url,
+			description,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
 			$7,
 			$8,
 			$9,
@@ -1998,25 +2902,31 @@ func insertTaskField(model *TaskField) error {
 			$11,
 			$12,
 			$13,
+			$14,
+			$15,
+			$16,
 			current_timestamp
 		)
 		RETURNING
 			id,
 			created_at
 	`,
-		model.CompanyID,
 		model.Name,
-		model.Key,
-		model.OrderNr,
-		model.PicklistData,
-		model.FieldType,
-		model.EditFlag,
-		model.IndexVisibleFlag,
-		model.DetailsVisibleFlag,
-		model.AddVisibleFlag,
-		model.ImportantFlag,
-		model.BulkEditAllowed,
-		model.MandatoryFlag,
+		model.UserID,
+		maybeNull(model.TaskID),
+		maybeNull(model.PersonID),
+		maybeNull(model.OrgID),
+		maybeNull(model.ActivityID),
+		maybeNull(model.NoteID),
+		model.FileType,
+		model.FileSize,
+		model.InlineFlag,
+		model.RemoteLocation,
+		model.RemoteID,
+		model.CID,
+		model.S3Bucket,
+		model.URL,
+		model.Description,
 	)
 	return row.Scan(
 		&model.ID,
@@ -2024,48 +2934,56 @@ func insertTaskField(model *TaskField) error {
 	)
 }
 
-func updateTaskField(model TaskField) error {
+func updateFile(model File) error {
 	_, err := db.Exec(`
 		UPDATE
-			task_fields
+			files
 		SET
-			name = $1,
-			key = $2,
-			order_nr = $3,
-			picklist_data = $4,
-			field_type = $5,
-			edit_flag = $6,
-			index_visible_flag = $7,
-			details_visible_flag = $8,
-			add_visible_flag = $9,
-			important_flag = $10,
-			bulk_edit_allowed = $11,
-			mandatory_flag = $12,
+		   	name = $1,
+			user_id = $2,
+			task_id = $3,
+			person_id = $4,
+			org_id = $5,
+			activity_id = $6,
+			note_id = $7,
+			file_type = $8,
+			file_size = $9,
+			inline_flag = $10,
+			remote_location = $11,
+			remote_id = $12,
+			cid = $13,
+			s3_bucket = $14,
+			url = $15,
+			description = $16,
 			updated_at = current_timestamp
 		WHERE
-			id = $13
+			id = $17
 	`,
 		model.Name,
-		model.Key,
-		model.OrderNr,
-		model.PicklistData,
-		model.FieldType,
-		model.EditFlag,
-		model.IndexVisibleFlag,
-		model.DetailsVisibleFlag,
-		model.AddVisibleFlag,
-		model.ImportantFlag,
-		model.BulkEditAllowed,
-		model.MandatoryFlag,
+		model.UserID,
+		maybeNull(model.TaskID),
+		maybeNull(model.PersonID),
+		maybeNull(model.OrgID),
+		maybeNull(model.ActivityID),
+		maybeNull(model.NoteID),
+		model.FileType,
+		model.FileSize,
+		model.InlineFlag,
+		model.RemoteLocation,
+		model.RemoteID,
+		model.CID,
+		model.S3Bucket,
+		model.URL,
+		model.Description,
 		model.ID,
 	)
 	return err
 }
 
-func deleteTaskField(model TaskField) error {
+func deleteFile(model File) error {
 	_, err := db.Exec(`
 		UPDATE
-			task_fields
+			files
 		SET
 			deleted_at = current_timestamp
 		WHERE
@@ -2076,859 +2994,877 @@ func deleteTaskField(model TaskField) error {
 	return err
 }
 
-func selectTasksByWorkflow(workflowID string, activeOnly bool) ([]Task, error) {
-	if workflowID == "" {
-		return nil, nil
+func insertStage(model *Stage) error {
+	return insertStageWith(db, model)
+}
+
+func insertStageWith(ex execer, model *Stage) error {
+	if model.Name == "" {
+		return errors.New("Please enter a name")
 	}
-	rows, err := db.Query(`
-		SELECT
-		   	tasks.id,
-		   	tasks.name,
-			tasks.creator_user_id,
-			tasks.user_id,
-			tasks.person_id,
-			tasks.org_id,
-			tasks.stage_id,
-			tasks.value,
-			tasks.currency,
-			tasks.stage_change_time,
-			tasks.status,
-			tasks.lost_reason,
-			tasks.visible_to,
-			tasks.close_time,
-			tasks.workflow_id,
-			tasks.won_time,
-			tasks.first_won_time,
-			tasks.lost_time,
-			tasks.expected_close_date,
-			tasks.stage_order_nr,
-			tasks.formatted_value,
-			tasks.rotten_time,
-			tasks.weighted_value,
-			tasks.formatted_weighted_value,
-			tasks.cc_email,
-			tasks.org_hidden,
-			tasks.person_hidden,
-		    tasks.created_at,
-		    tasks.updated_at,
-		    tasks.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as owner_name,
-		   	persons.name as person_name,
-		   	organizations.name as org_name,
-		   	stages.name as stage_name,
-		   	(
-		   		select activities.due_date
-		   		from activities
-		   		where activities.task_id = tasks.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_date,
-		   	(
-		   		select activities.id
-		   		from activities
-		   		where activities.task_id = tasks.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_id,
-		   	tasks.company_id
-		FROM
-			tasks
-		LEFT OUTER JOIN
-			users ON users.id = tasks.user_id
-		LEFT OUTER JOIN
-			persons ON persons.id = tasks.person_id
-		LEFT OUTER JOIN
-			organizations ON organizations.id = tasks.org_id
-		LEFT OUTER JOIN
-			stages ON stages.id = tasks.stage_id
-		WHERE
-			tasks.deleted_at IS NULL
-		AND
-			tasks.workflow_id = $1
-		AND (
-			($2 AND tasks.won_time IS NULL AND tasks.lost_time IS NULL) OR (NOT $2)
+	if model.RottenFlag && model.RottenDays < 1 {
+		return errors.New("Please enter the number of days after which tasks rot")
+	}
+
+	row := ex.QueryRow(`
+		INSERT INTO stages(
+		  	name,
+			order_nr,
+			task_probability,
+			workflow_id,
+			rotten_flag,
+			rotten_days,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			current_timestamp
 		)
+		RETURNING
+			id,
+			created_at
 	`,
-		workflowID,
-		activeOnly,
+		model.Name,
+		model.OrderNr,
+		model.TaskProbability,
+		model.WorkflowID,
+		model.RottenFlag,
+		model.RottenDays,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
 	)
-	if err != nil {
-		return nil, err
-	}
-
-	return scanTasks(rows)
 }
 
-func scanTasks(rows *sql.Rows) ([]Task, error) {
-	defer rows.Close()
-	var result []Task
-	for rows.Next() {
-
-		var model Task
-
-		var personID sql.NullString
-		var personName sql.NullString
-		var orgID sql.NullString
-		var orgName sql.NullString
-		var ownerName sql.NullString
-		var nextActivityID sql.NullString
-
-		if err := rows.Scan(
-			&model.ID,
-			&model.Name,
-			&model.CreatorUserID,
-			&model.UserID,
-			&personID,
-			&orgID,
-			&model.StageID,
-			&model.Value,
-			&model.Currency,
-			&model.StageChangeTime,
-			&model.Status,
-			&model.LostReason,
-			&model.VisibleTo,
-			&model.CloseTime,
-			&model.WorkflowID,
-			&model.WonTime,
-			&model.FirstWonTime,
-			&model.LostTime,
-			&model.ExpectedCloseDate,
-			&model.StageOrderNr,
-			&model.FormattedValue,
-			&model.RottenTime,
-			&model.WeightedValue,
-			&model.FormattedWeightedValue,
-			&model.CCEmail,
-			&model.OrgHidden,
-			&model.PersonHidden,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-			&ownerName,
-			&personName,
-			&orgName,
-			&model.StageName,
-			&model.NextActivityDate,
-			&nextActivityID,
-			&model.CompanyID,
-		); err != nil {
-			return nil, err
-		}
-
-		model.PersonID = personID.String
-		model.PersonName = personName.String
-		model.OrgID = orgID.String
-		model.OrgName = orgName.String
-		model.OwnerName = ownerName.String
-		model.NextActivityID = nextActivityID.String
-
-		result = append(result, model)
+func updateStage(model Stage) error {
+	if model.Name == "" {
+		return errors.New("Please enter a name")
+	}
+	if model.RottenFlag && model.RottenDays < 1 {
+		return errors.New("Please enter the number of days after which tasks rot")
 	}
-	return result, rows.Err()
-}
 
-func selectTasksByPerson(personID string) ([]Task, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	tasks.id,
-		   	tasks.name,
-			tasks.creator_user_id,
-			tasks.user_id,
-			tasks.person_id,
-			tasks.org_id,
-			tasks.stage_id,
-			tasks.value,
-			tasks.currency,
-			tasks.stage_change_time,
-			tasks.status,
-			tasks.lost_reason,
-			tasks.visible_to,
-			tasks.close_time,
-			tasks.workflow_id,
-			tasks.won_time,
-			tasks.first_won_time,
-			tasks.lost_time,
-			tasks.expected_close_date,
-			tasks.stage_order_nr,
-			tasks.formatted_value,
-			tasks.rotten_time,
-			tasks.weighted_value,
-			tasks.formatted_weighted_value,
-			tasks.cc_email,
-			tasks.org_hidden,
-			tasks.person_hidden,
-		    tasks.created_at,
-		    tasks.updated_at,
-		    tasks.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as owner_name,
-		   	persons.name as person_name,
-		   	organizations.name as org_name,
-		   	stages.name as stage_name,
-		   	(
-		   		select activities.due_date
-		   		from activities
-		   		where activities.task_id = tasks.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_date,
-		   	(
-		   		select activities.id
-		   		from activities
-		   		where activities.task_id = tasks.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_id,
-		   	tasks.company_id
-		FROM
-			tasks
-		LEFT OUTER JOIN
-			users ON users.id = tasks.user_id
-		LEFT OUTER JOIN
-			persons ON persons.id = tasks.person_id
-		LEFT OUTER JOIN
-			organizations ON organizations.id = tasks.org_id
-		LEFT OUTER JOIN
-			stages ON stages.id = tasks.stage_id
+	_, err := db.Exec(`
+		UPDATE
+			stages
+		SET
+		  	name = $1,
+			order_nr = $2,
+			task_probability = $3,
+			workflow_id = $4,
+			rotten_flag = $5,
+			rotten_days = $6,
+			updated_at = current_timestamp
 		WHERE
-			tasks.deleted_at IS NULL
-		AND
-			tasks.person_id = $1
+			id = $7
 	`,
-		personID,
+		model.Name,
+		model.OrderNr,
+		model.TaskProbability,
+		model.WorkflowID,
+		model.RottenFlag,
+		model.RottenDays,
+		model.ID,
 	)
-	if err != nil {
-		return nil, err
-	}
-
-	return scanTasks(rows)
+	return err
 }
 
-func selectFirstWorkflowByCompany(companyID string) (ID string, name string, err error) {
-	err = db.QueryRow(`
+func stageIsInUse(stageID string) (bool, error) {
+	var result bool
+	err := db.QueryRow(`
 		select
-			id,
-			name
+			count(1) > 0
 		from
-			workflows
+			tasks
 		where
 			deleted_at is null
 		and
-			company_id = $1
-		limit 1
+			stage_id = $1
 	`,
-		companyID,
+		stageID,
 	).Scan(
-		&ID,
-		&name,
+		&result,
 	)
-	if err == sql.ErrNoRows {
-		return "", "", nil
-	}
-	return ID, name, err
+	return result, err
 }
 
-func selectFirstCompanyByUser(userID string) (string, error) {
-	var result string
-	err := db.QueryRow(`
-		select
-			company_id
-		from
-			company_users
-		where
-			deleted_at is null
-		and
-			user_id = $1
-		limit 1
-	`,
-		userID,
+func deleteStage(stageID string) error {
+	used, err := stageIsInUse(stageID)
+	if err != nil {
+		return err
+	}
+	if used {
+		return errors.New("The stage has tasks. Please select a stage to move the tasks to")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var workflowID string
+	err = tx.QueryRow(`
+		UPDATE
+			stages
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+		RETURNING
+			workflow_id
+	`,
+		stageID,
 	).Scan(
-		&result,
+		&workflowID,
 	)
-	return result, err
+	if err != nil {
+		return err
+	}
+
+	if err := renumberStages(tx, workflowID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func selectActivityTypeByID(ID string) (*ActivityType, error) {
-	var model ActivityType
-	err := db.QueryRow(`
+// moveTasksAndDeleteStage moves all tasks of the stage to the end of the
+// target stage and deletes the stage in one transaction. It returns the
+// moved tasks.
+func moveTasksAndDeleteStage(stage Stage, targetStageID, userID string) ([]Task, error) {
+	if targetStageID == stage.ID {
+		return nil, errors.New("Please select another stage")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var valid bool
+	err = tx.QueryRow(`
 		select
-		   	id,
-			company_id,
-		   	name,
-			key_string,
-			order_nr,
-			color,
-			is_custom_flag,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			activity_types
-		WHERE
+			count(1) > 0
+		from
+			stages
+		where
+			deleted_at is null
+		and
 			id = $1
+		and
+			workflow_id = $2
 	`,
-		ID,
+		targetStageID,
+		stage.WorkflowID,
 	).Scan(
-		&model.ID,
-		&model.CompanyID,
-		&model.Name,
-		&model.KeyString,
-		&model.OrderNr,
-		&model.Color,
-		&model.IsCustomFlag,
-		&model.CreatedAt,
-		&model.UpdatedAt,
-		&model.DeletedAt,
+		&valid,
 	)
-	return &model, err
-}
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, errors.New("Please select a stage in the same workflow")
+	}
 
-func selectActivityTypesByCompany(companyID string) ([]ActivityType, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	id,
-			company_id,
-		   	name,
-			key_string,
-			order_nr,
-			color,
-			is_custom_flag,
-		    created_at,
-		    updated_at,
-		    deleted_at
+	// the moved tasks keep their order after the tasks of the target stage
+	rows, err := tx.Query(`
+		UPDATE
+			tasks
+		SET
+			stage_id = $1,
+			stage_order_nr = numbered.order_nr,
+			stage_change_time = current_timestamp,
+			updated_at = current_timestamp
 		FROM
-			activity_types
+			(
+				select
+					id,
+					(
+						select coalesce(max(stage_order_nr), -1)
+						from tasks
+						where stage_id = $1
+						and deleted_at is null
+					) + row_number() over (order by stage_order_nr, created_at) as order_nr
+				from
+					tasks
+				where
+					stage_id = $2
+				and
+					deleted_at is null
+			) numbered
 		WHERE
-			deleted_at IS NULL
-		AND
-			company_id = $1
+			tasks.id = numbered.id
+		RETURNING
+			tasks.id,
+			tasks.name
 	`,
-		companyID,
+		targetStageID,
+		stage.ID,
 	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var result []ActivityType
+	var moved []Task
 	for rows.Next() {
-
-		var model ActivityType
-
-		err = rows.Scan(
-			&model.ID,
-			&model.CompanyID,
-			&model.Name,
-			&model.KeyString,
-			&model.OrderNr,
-			&model.Color,
-			&model.IsCustomFlag,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-		)
-		if err != nil {
+		var model Task
+		if err := rows.Scan(&model.ID, &model.Name); err != nil {
+			rows.Close()
 			return nil, err
 		}
+		model.StageID = targetStageID
+		model.WorkflowID = stage.WorkflowID
+		moved = append(moved, model)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		result = append(result, model)
+	for _, task := range moved {
+		if _, err := recordTaskStageWith(tx, task.ID, task.StageID, userID); err != nil {
+			return nil, err
+		}
 	}
-	return result, rows.Err()
-}
 
-func selectWorkflowsByCompany(companyID string) ([]Workflow, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	id,
-			company_id,
-		   	name,
-			order_nr,
-			url_title,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			workflows
+	_, err = tx.Exec(`
+		UPDATE
+			stages
+		SET
+			deleted_at = current_timestamp
 		WHERE
-			deleted_at IS NULL
-		AND
-			company_id = $1
+			id = $1
 	`,
-		companyID,
+		stage.ID,
 	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var result []Workflow
-	for rows.Next() {
-
-		var model Workflow
-
-		var urlTitle sql.NullString
-		var orderNr sql.NullInt64
-
-		err = rows.Scan(
-			&model.ID,
-			&model.CompanyID,
-			&model.Name,
-			&orderNr,
-			&urlTitle,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		model.URLTitle = urlTitle.String
-		model.OrderNr = int(orderNr.Int64)
 
-		result = append(result, model)
+	if err := renumberStages(tx, stage.WorkflowID); err != nil {
+		return nil, err
 	}
-	return result, rows.Err()
+
+	return moved, tx.Commit()
 }
 
-func selectActivitiesByCompany(companyID string) ([]Activity, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	activities.id,
-		   	activities.name,
-			activities.company_id,
-			activities.user_id,
-			activities.done,
-			activities.reference_type,
-			activities.reference_id,
-			activities.due_date,
-			activities.duration,
-			activities.marked_as_done_time,
-			activities.task_id,
-			activities.org_id,
-			activities.person_id,
-			activities.assigned_to_user_id,
-			activities.created_by_user_id,
-		    activities.created_at,
-		    activities.updated_at,
-		    activities.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as user_name,
-		    persons.name as person_name,
-		    tasks.name as task_name,
-		    organizations.name as org_name,
-		    activities.type_id,
-		    activity_types.name as type,
-		   	(
-		   		select string_agg(contacts.name, ', ')
-		   		from contacts
-		   		where contacts.person_id = persons.id
-		   		and contacts.type = 'email'
-		   		and contacts.deleted_at is null
-		   	) as person_email,
-		   	(
-		   		select string_agg(contacts.name, ', ')
-		   		from contacts
-		   		where contacts.person_id = persons.id
-		   		and contacts.type = 'phone'
-		   		and contacts.deleted_at is null
-		   	) as person_phone,
-		   	assigned_users.name as assigned_to_user_name
-		FROM
-			activities
-		LEFT OUTER JOIN
-			users ON users.id = activities.user_id
-		LEFT OUTER JOIN
-			users AS assigned_users ON assigned_users.id = activities.assigned_to_user_id
-		LEFT OUTER JOIN
-			persons ON persons.id = activities.person_id
-		LEFT OUTER JOIN
-			tasks ON tasks.id = activities.task_id
-		LEFT OUTER JOIN
-			organizations ON organizations.id = activities.org_id
-		LEFT OUTER JOIN
-			activity_types ON activity_types.id = activities.type_id
+// renumberStages makes the order numbers of the workflow stages run from 0
+// without gaps.
+func renumberStages(ex execer, workflowID string) error {
+	_, err := ex.Exec(`
+		UPDATE
+			stages
+		SET
+			order_nr = numbered.nr - 1
+		FROM (
+			select
+				id,
+				row_number() over (order by order_nr, created_at) as nr
+			from stages
+			where workflow_id = $1
+			and deleted_at is null
+		) numbered
 		WHERE
-			activities.deleted_at IS NULL
-		AND
-			activities.company_id = $1
+			stages.id = numbered.id
 	`,
-		companyID,
+		workflowID,
 	)
-	if err != nil {
-		return nil, err
-	}
+	return err
+}
 
-	return scanActivities(rows)
+func insertTask(model *Task) error {
+	return insertTaskWith(db, model)
 }
 
-func selectCompanyUsersByUser(userID string) ([]CompanyUser, error) {
-	rows, err := db.Query(`
-		SELECT
-			company_users.id,
-			company_users.user_id,
-			company_users.is_admin,
-			company_users.company_id,
-		    company_users.created_at,
-		    company_users.updated_at,
-		    company_users.deleted_at,
-		    users.email,
-		    users.name
-		FROM
-			company_users
-		LEFT OUTER JOIN
-			users ON users.id = company_users.user_id
-		WHERE
-			company_users.deleted_at IS NULL
-		AND
-			company_users.user_id = $1
+func insertTaskWith(ex execer, model *Task) error {
+	if model.CompanyID == "" {
+		return errors.New("Please assign a company")
+	}
+	if model.StageID == "" {
+		return errors.New("Please assign a workflow stage")
+	}
+	if model.Name == "" {
+		return errors.New("Please enter a title")
+	}
+	if model.Probability != nil && (*model.Probability < 0 || *model.Probability > 100) {
+		return errors.New("Probability must be between 0 and 100")
+	}
+	if err := validateCustomFieldsFor("task", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
+	}
+
+	// New tasks are always open, see markTaskWon, markTaskLost and reopenTask
+	row := ex.QueryRow(`
+		INSERT INTO tasks(
+		   	name,
+			creator_user_id,
+			user_id,
+			person_id,
+			org_id,
+			stage_id,
+			value,
+			currency,
+			status,
+			visible_to,
+			workflow_id,
+			expected_close_date,
+			stage_order_nr,
+			probability,
+			cc_email,
+			org_hidden,
+			person_hidden,
+			company_id,
+			custom_fields,
+			stage_change_time,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			'open',
+			$9,
+			$10,
+			$11,
+			$12,
+			$13,
+			$14,
+			$15,
+			$16,
+			$17,
+			$18,
+			current_timestamp,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			status,
+			created_at,
+			stage_change_time
 	`,
-		userID,
+		model.Name,
+		model.CreatorUserID,
+		model.UserID,
+		maybeNull(model.PersonID),
+		maybeNull(model.OrgID),
+		model.StageID,
+		model.Value,
+		model.Currency,
+		model.VisibleTo,
+		model.WorkflowID,
+		model.ExpectedCloseDate,
+		model.StageOrderNr,
+		model.Probability,
+		model.CCEmail,
+		model.OrgHidden,
+		model.PersonHidden,
+		model.CompanyID,
+		model.CustomFields,
 	)
-	if err != nil {
-		return nil, err
+	if err := row.Scan(
+		&model.ID,
+		&model.Status,
+		&model.CreatedAt,
+		&model.StageChangeTime,
+	); err != nil {
+		return err
 	}
 
-	return scanCompanyUsers(rows)
+	_, err := recordTaskStageWith(ex, model.ID, model.StageID, model.CreatorUserID)
+	return err
 }
 
-func selectContactByID(ID string) (*Contact, error) {
-	var model Contact
+func updateTask(model Task) error {
+	if model.CompanyID == "" {
+		return errors.New("Please assign a company")
+	}
+	if model.StageID == "" {
+		return errors.New("Please assign a workflow stage")
+	}
+	if model.Name == "" {
+		return errors.New("Please enter a title")
+	}
+	if model.Probability != nil && (*model.Probability < 0 || *model.Probability > 100) {
+		return errors.New("Probability must be between 0 and 100")
+	}
+	if err := validateCustomFieldsFor("task", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
+	}
 
-	err := db.QueryRow(`
-		SELECT
-		   	id,
-		   	name,
-			person_id,
-			primary_contact,
-			type,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			contacts
+	// stage_change_time is maintained here, clients can't set it.
+	// Status and won/lost fields are changed by markTaskWon, markTaskLost
+	// and reopenTask only.
+	_, err := db.Exec(`
+		UPDATE
+			tasks
+		SET
+		   	name = $1,
+			creator_user_id = $2,
+			user_id = $3,
+			person_id = $4,
+			org_id = $5,
+			stage_change_time = (
+				case when stage_id is distinct from $6
+				then current_timestamp
+				else coalesce(stage_change_time, created_at) end
+			),
+			stage_id = $6,
+			value = $7,
+			currency = $8,
+			visible_to = $9,
+			workflow_id = $10,
+			expected_close_date = $11,
+			stage_order_nr = $12,
+			probability = $13,
+			cc_email = $14,
+			org_hidden = $15,
+			person_hidden = $16,
+			custom_fields = $17,
+			updated_at = current_timestamp
+		WHERE
+			id = $18
+	`,
+		model.Name,
+		model.CreatorUserID,
+		model.UserID,
+		maybeNull(model.PersonID),
+		maybeNull(model.OrgID),
+		model.StageID,
+		model.Value,
+		model.Currency,
+		model.VisibleTo,
+		model.WorkflowID,
+		model.ExpectedCloseDate,
+		model.StageOrderNr,
+		model.Probability,
+		model.CCEmail,
+		model.OrgHidden,
+		model.PersonHidden,
+		model.CustomFields,
+		model.ID,
+	)
+	return err
+}
+
+func markTaskWon(taskID string) error {
+	result, err := db.Exec(`
+		UPDATE
+			tasks
+		SET
+			status = 'won',
+			won_time = current_timestamp,
+			first_won_time = coalesce(first_won_time, current_timestamp),
+			lost_time = null,
+			lost_reason = '',
+			lost_reason_id = null,
+			close_time = current_timestamp,
+			updated_at = current_timestamp
 		WHERE
 			id = $1
-		LIMIT 1
+		AND
+			status <> 'won'
 	`,
-		ID,
-	).Scan(
-		&model.ID,
-		&model.Name,
-		&model.PersonID,
-		&model.Primary,
-		&model.Type,
-		&model.CreatedAt,
-		&model.UpdatedAt,
-		&model.DeletedAt,
+		taskID,
 	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("Task is already won")
+	}
+	return nil
+}
 
-	switch {
-	case err == sql.ErrNoRows:
-		return nil, errors.New("No contact with that ID")
-	case err != nil:
-		return nil, err
+func markTaskLost(taskID string, reason LostReason) error {
+	if reason.ID == "" {
+		return errors.New("Please select a lost reason")
 	}
 
-	return &model, nil
+	result, err := db.Exec(`
+		UPDATE
+			tasks
+		SET
+			status = 'lost',
+			lost_time = current_timestamp,
+			lost_reason = $2,
+			lost_reason_id = $3,
+			won_time = null,
+			close_time = current_timestamp,
+			updated_at = current_timestamp
+		WHERE
+			id = $1
+		AND
+			status <> 'lost'
+	`,
+		taskID,
+		reason.Name,
+		reason.ID,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("Task is already lost")
+	}
+	return nil
 }
 
-func selectContactsByPerson(personID string) ([]Contact, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	id,
-		   	name,
-			person_id,
-			primary_contact,
-			type,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			contacts
+// reopenTask moves a won or lost task back to open. first_won_time is
+// kept, so a task that was won once still counts as won in reports.
+func reopenTask(taskID string) error {
+	result, err := db.Exec(`
+		UPDATE
+			tasks
+		SET
+			status = 'open',
+			won_time = null,
+			lost_time = null,
+			lost_reason = '',
+			lost_reason_id = null,
+			close_time = null,
+			updated_at = current_timestamp
 		WHERE
-			person_id = $1
+			id = $1
 		AND
-			deleted_at is null
-		ORDER BY
-			type, name
+			status <> 'open'
 	`,
-		personID,
+		taskID,
 	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("Task is already open")
+	}
+	return nil
+}
+
+// reorderTasks moves the tasks into the stage in the given order, in one
+// transaction. Other tasks of the stage keep their relative order after the
+// given ones. It returns the IDs of the tasks that changed stage.
+func reorderTasks(stage Stage, companyID string, taskIDs []string, userID string) ([]string, error) {
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var result []Contact
-	for rows.Next() {
-		var model Contact
+	defer tx.Rollback()
 
-		err = rows.Scan(
-			&model.ID,
-			&model.Name,
-			&model.PersonID,
-			&model.Primary,
-			&model.Type,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
+	var moved []string
+	for i, taskID := range taskIDs {
+		result, err := tx.Exec(`
+			UPDATE
+				tasks
+			SET
+				stage_change_time = (
+					case when stage_id is distinct from $1
+					then current_timestamp
+					else coalesce(stage_change_time, created_at) end
+				),
+				stage_id = $1,
+				workflow_id = $2,
+				stage_order_nr = $3,
+				updated_at = current_timestamp
+			WHERE
+				id = $4
+			AND
+				company_id = $5
+			AND
+				deleted_at IS NULL
+		`,
+			stage.ID,
+			stage.WorkflowID,
+			i+1,
+			taskID,
+			companyID,
 		)
 		if err != nil {
 			return nil, err
 		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errors.New("Task not found")
+		}
 
-		result = append(result, model)
+		ok, err := recordTaskStageWith(tx, taskID, stage.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			moved = append(moved, taskID)
+		}
 	}
-	return result, rows.Err()
-}
 
-func selectPersonsByCompany(companyID string) ([]Person, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	persons.id,
-		   	persons.name,
-			persons.company_id,
-			persons.owner_id,
-			persons.org_id,
-			persons.first_name,
-		    persons.created_at,
-		    persons.updated_at,
-		    persons.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as owner_name,
-		    (
-		    	select count(1)
-		    	from tasks
-		    	where tasks.person_id = persons.id
-		    	and deleted_at is null
-		    	and (won_time is null and lost_time is null)
-		    ) as open_tasks_count,
-		    (
-		    	select count(1)
-		    	from tasks
-		    	where tasks.person_id = persons.id
-		    	and deleted_at is null
-		    	and (won_time is not null or lost_time is not null)
-		    ) as closed_tasks_count,
-		    organizations.name as org_name,
-		   	(
-		   		select activities.due_date
-		   		from activities
-		   		where activities.person_id = persons.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_date,
-		   	(
-		   		select activities.id
-		   		from activities
-		   		where activities.person_id = persons.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_id,
-		   	(
-		   		select string_agg(contacts.name, ', ')
-		   		from contacts
-		   		where contacts.person_id = persons.id
-		   		and contacts.type = 'email'
-		   		and contacts.deleted_at is null
-		   	) as email,
-		   	(
-		   		select string_agg(contacts.name, ', ')
-		   		from contacts
-		   		where contacts.person_id = persons.id
-		   		and contacts.type = 'phone'
-		   		and contacts.deleted_at is null
-		   	) as phone
-		FROM
-			persons
-		LEFT OUTER JOIN
-			users ON users.id = persons.owner_id
-		LEFT OUTER JOIN
-			organizations ON organizations.id = persons.org_id
+	_, err = tx.Exec(`
+		UPDATE
+			tasks
+		SET
+			stage_order_nr = $2 + rest.nr
+		FROM (
+			select
+				id,
+				row_number() over (order by stage_order_nr, created_at) as nr
+			from tasks
+			where stage_id = $1
+			and deleted_at is null
+			and not (id = any($3::uuid[]))
+		) rest
 		WHERE
-			persons.deleted_at IS NULL
-		AND
-			persons.company_id = $1
-		ORDER BY
-			persons.name
+			tasks.id = rest.id
 	`,
-		companyID,
+		stage.ID,
+		len(taskIDs),
+		pq.Array(taskIDs),
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return scanPersons(rows)
+	return moved, tx.Commit()
 }
 
-func scanPersons(rows *sql.Rows) ([]Person, error) {
-	defer rows.Close()
-	var result []Person
-	for rows.Next() {
-		var model Person
-
-		var orgID sql.NullString
-		var ownerName sql.NullString
-		var orgName sql.NullString
-		var nextActivityID sql.NullString
-		var email sql.NullString
-		var phone sql.NullString
-
-		if err := rows.Scan(
-			&model.ID,
-			&model.Name,
-			&model.CompanyID,
-			&model.OwnerID,
-			&orgID,
-			&model.FirstName,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-			&ownerName,
-			&model.OpenTasksCount,
-			&model.ClosedTasksCount,
-			&orgName,
-			&model.NextActivityDate,
-			&nextActivityID,
-			&email,
-			&phone,
-		); err != nil {
-			return nil, err
-		}
-
-		model.OrgID = orgID.String
-		model.OwnerName = ownerName.String
-		model.OrgName = orgName.String
-		model.NextActivityID = nextActivityID.String
-		model.Email = email.String
-		model.Phone = phone.String
+func deleteTask(taskID string) error {
+	_, err := db.Exec(`
+		UPDATE
+			tasks
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		taskID,
+	)
+	return err
+}
 
-		result = append(result, model)
+func insertOrganizationField(model *OrganizationField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("organization_fields", model.CompanyID, model.Key, ""); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
 	}
-	return result, rows.Err()
-}
 
-func selectCurrenciesByCompany(companyID string) ([]Currency, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	id,
+	row := db.QueryRow(`
+		INSERT INTO organization_fields(
 			company_id,
 			name,
-			code,
-			decimal_points,
-			symbol,
-			is_custom_flag,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			currencies
-		WHERE
-			deleted_at IS NULL
-		AND
-			company_id = $1
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			use_field,
+			link,
+			mandatory_flag,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11,
+			$12,
+			$13,
+			$14,
+			$15,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
 	`,
-		companyID,
+		model.CompanyID,
+		model.Name,
+		model.Key,
+		model.OrderNr,
+		model.PicklistData,
+		model.FieldType,
+		model.EditFlag,
+		model.IndexVisibleFlag,
+		model.DetailsVisibleFlag,
+		model.AddVisibleFlag,
+		model.ImportantFlag,
+		model.BulkEditAllowed,
+		model.UseField,
+		model.Link,
+		model.MandatoryFlag,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
 	)
+}
+
+func updateOrganizationField(model OrganizationField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("organization_fields", model.CompanyID, model.Key, model.ID); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	var result []Currency
-	for rows.Next() {
-		var model Currency
+	defer tx.Rollback()
 
-		err = rows.Scan(
-			&model.ID,
-			&model.CompanyID,
-			&model.Name,
-			&model.Code,
-			&model.DecimalPoints,
-			&model.Symbol,
-			&model.IsCustomFlag,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
+	oldKey, err := lockCustomFieldKey(tx, "organization_fields", model.ID)
+	if err != nil {
+		return err
+	}
 
-		result = append(result, model)
+	_, err = tx.Exec(`
+		UPDATE
+			organization_fields
+		SET
+			name = $1,
+			key = $2,
+			order_nr = $3,
+			picklist_data = $4,
+			field_type = $5,
+			edit_flag = $6,
+			index_visible_flag = $7,
+			details_visible_flag = $8,
+			add_visible_flag = $9,
+			important_flag = $10,
+			bulk_edit_allowed = $11,
+			use_field = $12,
+			link = $13,
+			mandatory_flag = $14,
+			updated_at = current_timestamp
+		WHERE
+			id = $15
+	`,
+		model.Name,
+		model.Key,
+		model.OrderNr,
+		model.PicklistData,
+		model.FieldType,
+		model.EditFlag,
+		model.IndexVisibleFlag,
+		model.DetailsVisibleFlag,
+		model.AddVisibleFlag,
+		model.ImportantFlag,
+		model.BulkEditAllowed,
+		model.UseField,
+		model.Link,
+		model.MandatoryFlag,
+		model.ID,
+	)
+	if err != nil {
+		return err
 	}
-	return result, rows.Err()
+
+	if err := renameCustomFieldKey(tx, "organizations", model.CompanyID, oldKey, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func selectOrganizationsByCompany(companyID string) ([]Organization, error) {
+// deleteOrganizationField deletes the field and its values on the organizations
+func deleteOrganizationField(model OrganizationField) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE
+			organization_fields
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := removeCustomFieldKey(tx, "organizations", model.CompanyID, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func selectOrganizationFieldsByCompany(companyID string) ([]OrganizationField, error) {
 	rows, err := db.Query(`
 		SELECT
-		   	organizations.id,
-		   	organizations.name,
-			organizations.company_id,
-			organizations.owner_id,
-			organizations.country_code,
-			organizations.address,
-			organizations.address_subpremise,
-			organizations.address_street_number,
-			organizations.address_route,
-			organizations.address_sublocality,
-			organizations.address_locality,
-			organizations.address_admin_area_level_1,
-			organizations.address_admin_area_level_2,
-			organizations.address_country,
-			organizations.address_postal_code,
-			organizations.category_id,
-			organizations.first_char,
-			organizations.visible_to,
-		    organizations.created_at,
-		    organizations.updated_at,
-		    organizations.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as owner_name,
-		    (
-		    	select count(1)
-		    	from tasks
-		    	where tasks.org_id = organizations.id
-		    	and deleted_at is null
-		    	and (won_time is null and lost_time is null)
-		    ) as open_tasks_count,
-		    (
-		    	select count(1)
-		    	from tasks
-		    	where tasks.org_id = organizations.id
-		    	and deleted_at is null
-		    	and (won_time is not null or lost_time is not null)
-		    ) as closed_tasks_count,
-		    (
-		    	select count(1)
-		    	from persons
-		    	where persons.org_id = organizations.id
-		    	and persons.deleted_at is null
-		    ) as people_count,
-		    (
-		    	select min(due_date)
-		    	from activities
-		    	where deleted_at is null
-		    	and activities.org_id = organizations.id
-		    ) as next_activity_date,
-		    (
-		    	select activities.id
-		    	from activities
-		    	where deleted_at is null
-		    	and activities.org_id = organizations.id
-		    	order by activities.due_date asc
-		    	limit 1
-		    ) as next_activity_id
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			use_field,
+			link,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
 		FROM
-			organizations
-		LEFT OUTER JOIN
-			users ON users.id = organizations.owner_id
+			organization_fields
 		WHERE
-			organizations.deleted_at IS NULL
+			deleted_at IS NULL
 		AND
-			organizations.company_id = $1
+			company_id = $1
 		ORDER BY
-			organizations.name
+			order_nr, created_at
 	`,
 		companyID,
 	)
@@ -2936,9 +3872,9 @@ func selectOrganizationsByCompany(companyID string) ([]Organization, error) {
 		return nil, err
 	}
 	defer rows.Close()
-	var result []Organization
+	var result []OrganizationField
 	for rows.Next() {
-		model, err := scanOrganization(rows)
+		model, err := scanOrganizationField(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -2947,337 +3883,91 @@ func selectOrganizationsByCompany(companyID string) ([]Organization, error) {
 	return result, rows.Err()
 }
 
-func scanOrganization(rows *sql.Rows) (*Organization, error) {
-	var model Organization
-
-	var categoryID sql.NullString
-	var ownerName sql.NullString
-	var nextActivityID sql.NullString
-
-	if err := rows.Scan(
-		&model.ID,
-		&model.Name,
-		&model.CompanyID,
-		&model.OwnerID,
-		&model.CountryCode,
-		&model.Address,
-		&model.AddressSubpremise,
-		&model.AddressStreetNumber,
-		&model.AddressRoute,
-		&model.AddressSublocality,
-		&model.AddressLocality,
-		&model.AddressAdminAreaLevel1,
-		&model.AddressAdminAreaLevel2,
-		&model.AddressCountry,
-		&model.AddressPostalCode,
-		&categoryID,
-		&model.FirstChar,
-		&model.VisibleTo,
-		&model.CreatedAt,
-		&model.UpdatedAt,
-		&model.DeletedAt,
-		&ownerName,
-		&model.OpenTasksCount,
-		&model.ClosedTasksCount,
-		&model.PeopleCount,
-		&model.NextActivityDate,
-		&nextActivityID,
-	); err != nil {
-		return nil, err
-	}
-
-	model.CategoryID = categoryID.String
-	model.OwnerName = ownerName.String
-	model.NextActivityID = nextActivityID.String
-
-	return &model, nil
-}
-
-func selectNotesByTask(TaskID string) ([]Note, error) {
+func selectOrganizationFieldByID(ID string) (*OrganizationField, error) {
 	rows, err := db.Query(`
 		SELECT
-		   	notes.id,
-		   	notes.name,
-			notes.company_id,
-			notes.user_id,
-			notes.task_id,
-			notes.person_id,
-			notes.org_id,
-			notes.pinned_to_task_flag,
-			notes.pinned_to_person_flag,
-			notes.pinned_to_organization_flag,
-			notes.last_update_user_id,
-		    notes.created_at,
-		    notes.updated_at,
-		    notes.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as user_name
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			use_field,
+			link,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
 		FROM
-			notes
-		LEFT OUTER JOIN
-			users ON users.id = notes.user_id
+			organization_fields
 		WHERE
-			notes.deleted_at IS NULL
+			deleted_at IS NULL
 		AND
-			notes.task_id = $1
+			id = $1
 	`,
-		TaskID,
+		ID,
 	)
 	if err != nil {
 		return nil, err
 	}
-
-	return scanNotes(rows)
-}
-
-func scanNotes(rows *sql.Rows) ([]Note, error) {
 	defer rows.Close()
-	var result []Note
-	for rows.Next() {
-		var model Note
-
-		var personID sql.NullString
-		var orgID sql.NullString
-		var lastUpdateUserID sql.NullString
-		var taskID sql.NullString
-
-		if err := rows.Scan(
-			&model.ID,
-			&model.Name,
-			&model.CompanyID,
-			&model.UserID,
-			&taskID,
-			&personID,
-			&orgID,
-			&model.PinnedToTaskFlag,
-			&model.PinnedToPersonFlag,
-			&model.PinnedToOrganizationFlag,
-			&lastUpdateUserID,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-			&model.UserName,
-		); err != nil {
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
 			return nil, err
 		}
-
-		model.PersonID = personID.String
-		model.OrgID = orgID.String
-		model.LastUpdateUserID = lastUpdateUserID.String
-		model.TaskID = taskID.String
-
-		result = append(result, model)
-	}
-	return result, rows.Err()
-}
-
-func selectNotesByPerson(personID string) ([]Note, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	notes.id,
-		   	notes.name,
-			notes.company_id,
-			notes.user_id,
-			notes.task_id,
-			notes.person_id,
-			notes.org_id,
-			notes.pinned_to_task_flag,
-			notes.pinned_to_person_flag,
-			notes.pinned_to_organization_flag,
-			notes.last_update_user_id,
-		    notes.created_at,
-		    notes.updated_at,
-		    notes.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as user_name
-		FROM
-			notes
-		LEFT OUTER JOIN
-			users ON users.id = notes.user_id
-		WHERE
-			notes.deleted_at IS NULL
-		AND
-			notes.person_id = $1
-	`,
-		personID,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	return scanNotes(rows)
-}
-
-func selectPersonsByOrganization(organizationID string) ([]Person, error) {
-	rows, err := db.Query(`
-		SELECT
-		   	persons.id,
-		   	persons.name,
-			persons.company_id,
-			persons.owner_id,
-			persons.org_id,
-			persons.first_name,
-		    persons.created_at,
-		    persons.updated_at,
-		    persons.deleted_at,
-		    (case when users.name = '' then users.email else users.name end) as owner_name,
-		    (
-		    	select count(1)
-		    	from tasks
-		    	where tasks.person_id = persons.id
-		    	and deleted_at is null
-		    	and (won_time is null and lost_time is null)
-		    ) as open_tasks_count,
-		    (
-		    	select count(1)
-		    	from tasks
-		    	where tasks.person_id = persons.id
-		    	and deleted_at is null
-		    	and (won_time is not null or lost_time is not null)
-		    ) as closed_tasks_count,
-		    organizations.name as org_name,
-		   	(
-		   		select activities.due_date
-		   		from activities
-		   		where activities.person_id = persons.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_date,
-		   	(
-		   		select activities.id
-		   		from activities
-		   		where activities.person_id = persons.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_id,
-		   	(
-		   		select string_agg(contacts.name, ', ')
-		   		from contacts
-		   		where contacts.person_id = persons.id
-		   		and contacts.type = 'email'
-		   		and contacts.deleted_at is null
-		   	) as email,
-		   	(
-		   		select string_agg(contacts.name, ', ')
-		   		from contacts
-		   		where contacts.person_id = persons.id
-		   		and contacts.type = 'phone'
-		   		and contacts.deleted_at is null
-		   	) as phone
-		FROM
-			persons
-		LEFT OUTER JOIN
-			users ON users.id = persons.owner_id
-		LEFT OUTER JOIN
-			organizations ON organizations.id = persons.org_id
-		WHERE
-			persons.deleted_at IS NULL
-		AND
-			persons.org_id = $1
-		ORDER BY
-			persons.name
-	`,
-		organizationID,
-	)
-	if err != nil {
-		return nil, err
+		return nil, sql.ErrNoRows
 	}
-
-	return scanPersons(rows)
+	return scanOrganizationField(rows)
 }
 
-func selectStageByID(stageID string) (*Stage, error) {
-	var model Stage
-	err := db.QueryRow(`
-		select
-		   	id,
-		   	name,
-			order_nr,
-			task_probability,
-			workflow_id,
-			rotten_flag,
-			rotten_days,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			stages
-		WHERE
-			id = $1
-	`,
-		stageID,
-	).Scan(
+func scanOrganizationField(rows *sql.Rows) (*OrganizationField, error) {
+	var model OrganizationField
+	err := rows.Scan(
 		&model.ID,
+		&model.CompanyID,
 		&model.Name,
+		&model.Key,
 		&model.OrderNr,
-		&model.TaskProbability,
-		&model.WorkflowID,
-		&model.RottenFlag,
-		&model.RottenDays,
+		&model.PicklistData,
+		&model.FieldType,
+		&model.EditFlag,
+		&model.IndexVisibleFlag,
+		&model.DetailsVisibleFlag,
+		&model.AddVisibleFlag,
+		&model.ImportantFlag,
+		&model.BulkEditAllowed,
+		&model.UseField,
+		&model.Link,
+		&model.MandatoryFlag,
 		&model.CreatedAt,
 		&model.UpdatedAt,
 		&model.DeletedAt,
 	)
-	return &model, err
-}
-
-func selectStagesByWorkflow(workflowID string) ([]Stage, error) {
-	if workflowID == "" {
-		return nil, nil
-	}
-	rows, err := db.Query(`
-		SELECT
-		   	id,
-		   	name,
-			order_nr,
-			task_probability,
-			workflow_id,
-			rotten_flag,
-			rotten_days,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			stages
-		WHERE
-			deleted_at IS NULL
-		AND
-			workflow_id = $1
-		ORDER BY
-			order_nr
-	`,
-		workflowID,
-	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var result []Stage
-	for rows.Next() {
-		var model Stage
-		err = rows.Scan(
-			&model.ID,
-			&model.Name,
-			&model.OrderNr,
-			&model.TaskProbability,
-			&model.WorkflowID,
-			&model.RottenFlag,
-			&model.RottenDays,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, model)
-	}
-	return result, rows.Err()
+	return &model, nil
 }
 
-func insertActivityField(model *ActivityField) error {
+func insertTaskField(model *TaskField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("task_fields", model.CompanyID, model.Key, ""); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
 	row := db.QueryRow(`
-		INSERT INTO activity_fields(
+		INSERT INTO task_fields(
 			company_id,
 			name,
 			key,
@@ -3333,10 +4023,30 @@ func insertActivityField(model *ActivityField) error {
 	)
 }
 
-func updateActivityField(model ActivityField) error {
-	_, err := db.Exec(`
+func updateTaskField(model TaskField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("task_fields", model.CompanyID, model.Key, model.ID); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldKey, err := lockCustomFieldKey(tx, "task_fields", model.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
 		UPDATE
-			activity_fields
+			task_fields
 		SET
 			name = $1,
 			key = $2,
@@ -3368,408 +4078,3180 @@ func updateActivityField(model ActivityField) error {
 		model.MandatoryFlag,
 		model.ID,
 	)
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func deleteActivityField(model ActivityField) error {
-	_, err := db.Exec(`
+	if err := renameCustomFieldKey(tx, "tasks", model.CompanyID, oldKey, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteTaskField deletes the field and its values on the tasks
+func deleteTaskField(model TaskField) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
 		UPDATE
-			activity_fields
+			task_fields
 		SET
-			updated_at = current_timestamp
+			deleted_at = current_timestamp
 		WHERE
 			id = $1
 	`,
 		model.ID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if err := removeCustomFieldKey(tx, "tasks", model.CompanyID, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func insertActivityType(model *ActivityType) error {
-	row := db.QueryRow(`
-		INSERT INTO activity_types(
+func selectTaskFieldsByCompany(companyID string) ([]TaskField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
 			company_id,
 			name,
-			key_string,
+			key,
 			order_nr,
-			color,
-			is_custom_flag,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
-	`,
-		model.CompanyID,
-		model.Name,
-		model.KeyString,
-		model.OrderNr,
-		model.Color,
-		model.IsCustomFlag,
-	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
-	)
-}
-
-func updateActivityType(model ActivityType) error {
-	_, err := db.Exec(`
-		UPDATE
-			activity_types
-		SET
-			name = $1,
-			key_string = $2,
-			order_nr = $3,
-			color = $4,
-			is_custom_flag = $5,
-			updated_at = current_timestamp
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			task_fields
 		WHERE
-			id = $6
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			order_nr, created_at
 	`,
-		model.Name,
-		model.KeyString,
-		model.OrderNr,
-		model.Color,
-		model.IsCustomFlag,
-		model.ID,
+		companyID,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []TaskField
+	for rows.Next() {
+		model, err := scanTaskField(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
 }
 
-func deleteActivityType(model ActivityType) error {
-	_, err := db.Exec(`
-		UPDATE
-			activity_types
-		SET
-			deleted_at = current_timestamp
+func selectTaskFieldByID(ID string) (*TaskField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			task_fields
 		WHERE
+			deleted_at IS NULL
+		AND
 			id = $1
 	`,
-		model.ID,
+		ID,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanTaskField(rows)
 }
 
-func insertCurrency(model *Currency) error {
-	row := db.QueryRow(`
-		INSERT INTO currencies(
-			company_id,
-			name,
-			code,
-			decimal_points,
-			symbol,
-			is_custom_flag,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
-	`,
-		model.CompanyID,
-		model.Name,
-		model.Code,
-		model.DecimalPoints,
-		model.Symbol,
-		model.IsCustomFlag,
-	)
-	return row.Scan(
+func scanTaskField(rows *sql.Rows) (*TaskField, error) {
+	var model TaskField
+	err := rows.Scan(
 		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.Key,
+		&model.OrderNr,
+		&model.PicklistData,
+		&model.FieldType,
+		&model.EditFlag,
+		&model.IndexVisibleFlag,
+		&model.DetailsVisibleFlag,
+		&model.AddVisibleFlag,
+		&model.ImportantFlag,
+		&model.BulkEditAllowed,
+		&model.MandatoryFlag,
 		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
 }
 
-func updateCurrency(model Currency) error {
-	_, err := db.Exec(`
-		UPDATE
-			currencies
-		SET
-			name = $1,
-			code = $2,
-			decimal_points = $3,
-			symbol = $4,
-			is_custom_flag = $5,
-			updated_at = current_timestamp
-		WHERE
-			id = $6
-	`,
-		model.Name,
-		model.Code,
-		model.DecimalPoints,
-		model.Symbol,
-		model.IsCustomFlag,
-		model.ID,
-	)
-	return err
-}
-
-func deleteCurrency(model Currency) error {
-	_, err := db.Exec(`
-		UPDATE
-			currencies
-		SET
-			deleted_at = current_timestamp
-		WHERE
+// selectStoredCustomFields returns the custom field values saved on the
+// record, none for a record that is not saved yet
+func selectStoredCustomFields(table, ID string) (CustomFields, error) {
+	result := CustomFields{}
+	if ID == "" {
+		return result, nil
+	}
+	err := db.QueryRow(fmt.Sprintf(`
+		select
+			custom_fields
+		from
+			%s
+		where
 			id = $1
-	`,
-		model.ID,
+	`, table),
+		ID,
+	).Scan(
+		&result,
 	)
-	return err
+	if err == sql.ErrNoRows {
+		return CustomFields{}, nil
+	}
+	return result, err
 }
 
-func insertFilter(model *Filter) error {
-	row := db.QueryRow(`
-		INSERT INTO filters(
-			company_id,
+// selectCustomFieldDefinitions returns what is needed to validate values
+// of the fields in table of the company
+func selectCustomFieldDefinitions(table, companyID string) ([]customFieldDefinition, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		select
+			key,
 			name,
-			type,
-			temporary_flag,
-			user_id,
-			visible_to,
-			custom_view_id,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			$7,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
-	`,
-		model.CompanyID,
-		model.Name,
-		model.Type,
-		model.TemporaryFlag,
-		model.UserID,
-		model.VisibleTo,
-		model.CustomViewID,
-	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
+			field_type,
+			picklist_data,
+			mandatory_flag
+		from
+			%s
+		where
+			deleted_at is null
+		and
+			company_id = $1
+		order by
+			order_nr, created_at
+	`, table),
+		companyID,
 	)
-}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-func updateFilter(model Filter) error {
-	_, err := db.Exec(`
-		UPDATE
-			filters
-		SET
-			name = $1,
-			type = $2,
-			temporary_flag = $3,
-			user_id = $4,
-			visible_to = $5,
-			custom_view_id = $6,
-			updated_at = current_timestamp
-		WHERE
-			id = $7
-	`,
-		model.Name,
-		model.Type,
-		model.TemporaryFlag,
-		model.UserID,
-		model.VisibleTo,
-		model.CustomViewID,
-		model.ID,
-	)
-	return err
+	var result []customFieldDefinition
+	for rows.Next() {
+		var field customFieldDefinition
+		if err := rows.Scan(
+			&field.Key,
+			&field.Name,
+			&field.FieldType,
+			&field.PicklistData,
+			&field.MandatoryFlag,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, field)
+	}
+	return result, rows.Err()
 }
 
-func deleteFilter(model Filter) error {
-	_, err := db.Exec(`
-		UPDATE
-			filters
-		SET
-			deleted_at = current_timestamp
-		WHERE
+// lockCustomFieldKey returns the key the field has before it is updated in
+// the transaction
+func lockCustomFieldKey(tx *sql.Tx, table, ID string) (string, error) {
+	var key string
+	err := tx.QueryRow(fmt.Sprintf(`
+		select
+			key
+		from
+			%s
+		where
 			id = $1
-	`,
-		model.ID,
+		for update
+	`, table),
+		ID,
+	).Scan(
+		&key,
 	)
-	return err
+	return key, err
 }
 
-func insertGoal(model *Goal) error {
-	row := db.QueryRow(`
-		INSERT INTO goals(
-			company_id,
-			name,
-			user_id,
-			stage_id,
-			active_goal_id,
-			period,
-			expected,
-			goal_type,
-			expected_sum,
-			currency,
-			expected_type,
-			created_by_user_id,
-			workflow_id,
-			master_expected,
-			delivered,
-			delivered_sum,
-			period_start,
-			period_end,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			$7,
-			$8,
-			$9,
-			$10,
-			$11,
-			$12,
-			$13,
-			$14,
-			$15,
-			$16,
-			$17,
-			$18,
-			current_timestamp
-		)
-		RETURNING
-			id,
-			created_at
-	`,
-		model.CompanyID,
-		model.Name,
-		model.UserID,
-		maybeNull(model.StageID),
-		maybeNull(model.ActiveGoalID),
-		model.Period,
-		model.Expected,
-		model.GoalType,
-		model.ExpectedSum,
-		model.Currency,
-		model.ExpectedType,
-		maybeNull(model.CreatedByUserID),
-		maybeNull(model.WorkflowID),
-		model.MasterExpected,
-		model.Delivered,
-		model.DeliveredSum,
-		model.PeriodStart,
-		model.PeriodEnd,
-	)
-	return row.Scan(
-		&model.ID,
-		&model.CreatedAt,
+// renameCustomFieldKey moves the values of a custom field to its new key
+// on the records of the company
+func renameCustomFieldKey(ex execer, table, companyID, oldKey, newKey string) error {
+	if oldKey == newKey {
+		return nil
+	}
+	_, err := ex.Exec(fmt.Sprintf(`
+		update
+			%s
+		set
+			custom_fields = (custom_fields - $2::text) || jsonb_build_object($3::text, custom_fields -> $2::text)
+		where
+			company_id = $1
+		and
+			custom_fields ? $2::text
+	`, table),
+		companyID,
+		oldKey,
+		newKey,
 	)
+	return err
 }
 
-func updateGoal(model Goal) error {
-	_, err := db.Exec(`
-		UPDATE
-			goals
-		SET
-			name = $1,
-			user_id = $2,
-			stage_id = $3,
-			active_goal_id = $4,
-			period = $5,
-			expected = $6,
-			goal_type = $7,
-			expected_sum = $8,
-			currency = $9,
-			expected_type = $10,
-			created_by_user_id = $11,
-			workflow_id = $12,
-			master_expected = $13,
-			delivered = $14,
-			delivered_sum = $15,
-			period_start = $16,
-			period_end = $17,
-			updated_at = current_timestamp
-		WHERE
-			id = $18
-	`,
-		model.Name,
-		model.UserID,
-		maybeNull(model.StageID),
-		maybeNull(model.ActiveGoalID),
-		model.Period,
-		model.Expected,
-		model.GoalType,
-		model.ExpectedSum,
-		model.Currency,
-		model.ExpectedType,
-		maybeNull(model.CreatedByUserID),
-		maybeNull(model.WorkflowID),
-		model.MasterExpected,
-		model.Delivered,
-		model.DeliveredSum,
-		model.PeriodStart,
-		model.PeriodEnd,
-		model.ID,
+// removeCustomFieldKey strips the values of a deleted custom field from
+// the records of the company
+func removeCustomFieldKey(ex execer, table, companyID, key string) error {
+	_, err := ex.Exec(fmt.Sprintf(`
+		update
+			%s
+		set
+			custom_fields = custom_fields - $2::text
+		where
+			company_id = $1
+		and
+			custom_fields ? $2::text
+	`, table),
+		companyID,
+		key,
 	)
 	return err
 }
 
-func deleteGoal(model Goal) error {
-	_, err := db.Exec(`
-		UPDATE
-			goals
-		SET
-			deleted_at = current_timestamp
-		WHERE
-			id = $1
-	`,
-		model.ID,
+// customFieldKeyInUse reports whether another field of the company in the
+// given field table already uses the key.
+func customFieldKeyInUse(table, companyID, key, exceptID string) (bool, error) {
+	var result bool
+	err := db.QueryRow(fmt.Sprintf(`
+		select
+			count(1) > 0
+		from
+			%s
+		where
+			deleted_at is null
+		and
+			company_id = $1
+		and
+			key = $2
+		and
+			($3::uuid IS NULL OR id <> $3)
+	`, table),
+		companyID,
+		key,
+		maybeNull(exceptID),
+	).Scan(
+		&result,
 	)
-	return err
+	return result, err
 }
 
-func insertNoteField(model *NoteField) error {
-	row := db.QueryRow(`
-		INSERT INTO note_fields(
-			company_id,
-			name,
-			key,
-			field_type,
-			edit_flag,
-			mandatory_flag,
-		    created_at
-		)
-		VALUES(
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			current_timestamp
-		)
+func selectTasksByWorkflow(workflowID string, activeOnly bool) ([]Task, error) {
+	if workflowID == "" {
+		return nil, nil
+	}
+	rows, err := db.Query(`
+		SELECT
+		   	tasks.id,
+		   	tasks.name,
+			tasks.creator_user_id,
+			tasks.user_id,
+			tasks.person_id,
+			tasks.org_id,
+			tasks.stage_id,
+			tasks.value,
+			tasks.currency,
+			tasks.stage_change_time,
+			tasks.status,
+			tasks.lost_reason,
+			tasks.lost_reason_id,
+			tasks.visible_to,
+			tasks.close_time,
+			tasks.workflow_id,
+			tasks.won_time,
+			tasks.first_won_time,
+			tasks.lost_time,
+			tasks.expected_close_date,
+			tasks.stage_order_nr,
+			tasks.formatted_value,
+			(
+				case when stages.rotten_flag
+				and tasks.won_time is null
+				and tasks.lost_time is null
+				then tasks.stage_change_time + stages.rotten_days * interval '1 day'
+				end
+			) as rotten_time,
+			tasks.weighted_value,
+			tasks.formatted_weighted_value,
+			tasks.cc_email,
+			tasks.org_hidden,
+			tasks.person_hidden,
+		    tasks.created_at,
+		    tasks.updated_at,
+		    tasks.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		   	persons.name as person_name,
+		   	organizations.name as org_name,
+		   	stages.name as stage_name,
+		   	(
+		   		select activities.due_date
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	tasks.company_id,
+		   	tasks.probability,
+		   	tasks.custom_fields,
+		   	stages.task_probability,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
+		FROM
+			tasks
+		LEFT OUTER JOIN
+			users ON users.id = tasks.user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = tasks.person_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = tasks.org_id
+		LEFT OUTER JOIN
+			stages ON stages.id = tasks.stage_id
+		WHERE
+			tasks.deleted_at IS NULL
+		AND
+			tasks.workflow_id = $1
+		AND (
+			($2 AND tasks.won_time IS NULL AND tasks.lost_time IS NULL) OR (NOT $2)
+		)
+		ORDER BY
+			stages.order_nr, tasks.stage_order_nr, tasks.created_at
+	`,
+		workflowID,
+		activeOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
+
+func scanTasks(rows *sql.Rows) ([]Task, error) {
+	defer rows.Close()
+	var result []Task
+	for rows.Next() {
+
+		var model Task
+
+		var personID sql.NullString
+		var personName sql.NullString
+		var orgID sql.NullString
+		var orgName sql.NullString
+		var lostReasonID sql.NullString
+		var ownerName sql.NullString
+		var nextActivityID sql.NullString
+		var probability sql.NullInt64
+		var stageProbability sql.NullInt64
+		var decimalPoints sql.NullInt64
+		var currencySymbol sql.NullString
+
+		if err := rows.Scan(
+			&model.ID,
+			&model.Name,
+			&model.CreatorUserID,
+			&model.UserID,
+			&personID,
+			&orgID,
+			&model.StageID,
+			&model.Value,
+			&model.Currency,
+			&model.StageChangeTime,
+			&model.Status,
+			&model.LostReason,
+			&lostReasonID,
+			&model.VisibleTo,
+			&model.CloseTime,
+			&model.WorkflowID,
+			&model.WonTime,
+			&model.FirstWonTime,
+			&model.LostTime,
+			&model.ExpectedCloseDate,
+			&model.StageOrderNr,
+			&model.FormattedValue,
+			&model.RottenTime,
+			&model.WeightedValue,
+			&model.FormattedWeightedValue,
+			&model.CCEmail,
+			&model.OrgHidden,
+			&model.PersonHidden,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+			&ownerName,
+			&personName,
+			&orgName,
+			&model.StageName,
+			&model.NextActivityDate,
+			&nextActivityID,
+			&model.CompanyID,
+			&probability,
+			&model.CustomFields,
+			&stageProbability,
+			&decimalPoints,
+			&currencySymbol,
+		); err != nil {
+			return nil, err
+		}
+
+		model.PersonID = personID.String
+		model.PersonName = personName.String
+		model.OrgID = orgID.String
+		model.OrgName = orgName.String
+		model.LostReasonID = lostReasonID.String
+		model.OwnerName = ownerName.String
+		model.NextActivityID = nextActivityID.String
+		if probability.Valid {
+			p := int(probability.Int64)
+			model.Probability = &p
+		}
+		model.StageProbability = int(stageProbability.Int64)
+		model.DetectRotten()
+		model.CalculateValues(int(decimalPoints.Int64), currencySymbol.String)
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectTasksByPerson(personID string) ([]Task, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	tasks.id,
+		   	tasks.name,
+			tasks.creator_user_id,
+			tasks.user_id,
+			tasks.person_id,
+			tasks.org_id,
+			tasks.stage_id,
+			tasks.value,
+			tasks.currency,
+			tasks.stage_change_time,
+			tasks.status,
+			tasks.lost_reason,
+			tasks.lost_reason_id,
+			tasks.visible_to,
+			tasks.close_time,
+			tasks.workflow_id,
+			tasks.won_time,
+			tasks.first_won_time,
+			tasks.lost_time,
+			tasks.expected_close_date,
+			tasks.stage_order_nr,
+			tasks.formatted_value,
+			(
+				case when stages.rotten_flag
+				and tasks.won_time is null
+				and tasks.lost_time is null
+				then tasks.stage_change_time + stages.rotten_days * interval '1 day'
+				end
+			) as rotten_time,
+			tasks.weighted_value,
+			tasks.formatted_weighted_value,
+			tasks.cc_email,
+			tasks.org_hidden,
+			tasks.person_hidden,
+		    tasks.created_at,
+		    tasks.updated_at,
+		    tasks.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		   	persons.name as person_name,
+		   	organizations.name as org_name,
+		   	stages.name as stage_name,
+		   	(
+		   		select activities.due_date
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	tasks.company_id,
+		   	tasks.probability,
+		   	tasks.custom_fields,
+		   	stages.task_probability,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
+		FROM
+			tasks
+		LEFT OUTER JOIN
+			users ON users.id = tasks.user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = tasks.person_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = tasks.org_id
+		LEFT OUTER JOIN
+			stages ON stages.id = tasks.stage_id
+		WHERE
+			tasks.deleted_at IS NULL
+		AND
+			tasks.person_id = $1
+	`,
+		personID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
+
+func selectRottenTasks() ([]Task, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	tasks.id,
+		   	tasks.name,
+			tasks.creator_user_id,
+			tasks.user_id,
+			tasks.person_id,
+			tasks.org_id,
+			tasks.stage_id,
+			tasks.value,
+			tasks.currency,
+			tasks.stage_change_time,
+			tasks.status,
+			tasks.lost_reason,
+			tasks.lost_reason_id,
+			tasks.visible_to,
+			tasks.close_time,
+			tasks.workflow_id,
+			tasks.won_time,
+			tasks.first_won_time,
+			tasks.lost_time,
+			tasks.expected_close_date,
+			tasks.stage_order_nr,
+			tasks.formatted_value,
+			tasks.stage_change_time + stages.rotten_days * interval '1 day' as rotten_time,
+			tasks.weighted_value,
+			tasks.formatted_weighted_value,
+			tasks.cc_email,
+			tasks.org_hidden,
+			tasks.person_hidden,
+		    tasks.created_at,
+		    tasks.updated_at,
+		    tasks.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		   	persons.name as person_name,
+		   	organizations.name as org_name,
+		   	stages.name as stage_name,
+		   	(
+		   		select activities.due_date
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	tasks.company_id,
+		   	tasks.probability,
+		   	tasks.custom_fields,
+		   	stages.task_probability,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
+		FROM
+			tasks
+		JOIN
+			stages ON stages.id = tasks.stage_id
+		LEFT OUTER JOIN
+			users ON users.id = tasks.user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = tasks.person_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = tasks.org_id
+		WHERE
+			tasks.deleted_at IS NULL
+		AND
+			tasks.won_time IS NULL
+		AND
+			tasks.lost_time IS NULL
+		AND
+			stages.rotten_flag
+		AND
+			tasks.stage_change_time + stages.rotten_days * interval '1 day' <= current_timestamp
+		ORDER BY
+			tasks.user_id, rotten_time
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
+
+// selectTasksWithoutNextActivity returns the open tasks of the company that
+// have no undone activity planned
+func selectTasksWithoutNextActivity(companyID string) ([]Task, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	tasks.id,
+		   	tasks.name,
+			tasks.creator_user_id,
+			tasks.user_id,
+			tasks.person_id,
+			tasks.org_id,
+			tasks.stage_id,
+			tasks.value,
+			tasks.currency,
+			tasks.stage_change_time,
+			tasks.status,
+			tasks.lost_reason,
+			tasks.lost_reason_id,
+			tasks.visible_to,
+			tasks.close_time,
+			tasks.workflow_id,
+			tasks.won_time,
+			tasks.first_won_time,
+			tasks.lost_time,
+			tasks.expected_close_date,
+			tasks.stage_order_nr,
+			tasks.formatted_value,
+			(
+				case when stages.rotten_flag
+				and tasks.won_time is null
+				and tasks.lost_time is null
+				then tasks.stage_change_time + stages.rotten_days * interval '1 day'
+				end
+			) as rotten_time,
+			tasks.weighted_value,
+			tasks.formatted_weighted_value,
+			tasks.cc_email,
+			tasks.org_hidden,
+			tasks.person_hidden,
+		    tasks.created_at,
+		    tasks.updated_at,
+		    tasks.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		   	persons.name as person_name,
+		   	organizations.name as org_name,
+		   	stages.name as stage_name,
+		   	(
+		   		select activities.due_date
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	tasks.company_id,
+		   	tasks.probability,
+		   	tasks.custom_fields,
+		   	stages.task_probability,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
+		FROM
+			tasks
+		JOIN
+			stages ON stages.id = tasks.stage_id
+		LEFT OUTER JOIN
+			users ON users.id = tasks.user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = tasks.person_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = tasks.org_id
+		WHERE
+			tasks.deleted_at IS NULL
+		AND
+			tasks.won_time IS NULL
+		AND
+			tasks.lost_time IS NULL
+		AND
+			tasks.company_id = $1
+		AND
+			NOT EXISTS (
+				select 1
+				from activities
+				where activities.task_id = tasks.id
+				and activities.deleted_at is null
+				and activities.done = false
+			)
+		ORDER BY
+			tasks.user_id, tasks.stage_change_time
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
+
+func selectForecastByCompany(companyID, workflowID, userID string, fromTime, untilTime *time.Time) ([]Forecast, error) {
+	rows, err := db.Query(`
+		SELECT
+			to_char(date_trunc('month', tasks.expected_close_date), 'YYYY-MM') as month,
+			tasks.workflow_id,
+			workflows.name as workflow_name,
+			tasks.user_id,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+			tasks.currency,
+			count(1) as tasks_count,
+			coalesce(sum(tasks.value), 0) as value,
+			coalesce(sum(
+				tasks.value * coalesce(tasks.probability, stages.task_probability, 0) / 100.0
+			), 0) as weighted_value,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = $1
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = $1
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
+		FROM
+			tasks
+		LEFT OUTER JOIN
+			workflows ON workflows.id = tasks.workflow_id
+		LEFT OUTER JOIN
+			users ON users.id = tasks.user_id
+		LEFT OUTER JOIN
+			stages ON stages.id = tasks.stage_id
+		WHERE
+			tasks.deleted_at IS NULL
+		AND
+			tasks.company_id = $1
+		AND
+			tasks.won_time IS NULL
+		AND
+			tasks.lost_time IS NULL
+		AND
+			tasks.expected_close_date IS NOT NULL
+		AND
+			($2::uuid IS NULL OR tasks.workflow_id = $2)
+		AND
+			($3::uuid IS NULL OR tasks.user_id = $3)
+		AND
+			($4::timestamp with time zone IS NULL OR tasks.expected_close_date >= $4)
+		AND
+			($5::timestamp with time zone IS NULL OR tasks.expected_close_date < $5)
+		GROUP BY
+			1, 2, 3, 4, 5, 6
+		ORDER BY
+			month, workflow_name, owner_name, tasks.currency
+	`,
+		companyID,
+		maybeNull(workflowID),
+		maybeNull(userID),
+		fromTime,
+		untilTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Forecast
+	for rows.Next() {
+		var model Forecast
+
+		var workflowName sql.NullString
+		var ownerName sql.NullString
+		var weightedValue float64
+		var decimalPoints sql.NullInt64
+		var currencySymbol sql.NullString
+
+		if err := rows.Scan(
+			&model.Month,
+			&model.WorkflowID,
+			&workflowName,
+			&model.UserID,
+			&ownerName,
+			&model.Currency,
+			&model.TasksCount,
+			&model.Value,
+			&weightedValue,
+			&decimalPoints,
+			&currencySymbol,
+		); err != nil {
+			return nil, err
+		}
+
+		symbol := currencySymbol.String
+		if symbol == "" {
+			symbol = model.Currency
+		}
+
+		model.WorkflowName = workflowName.String
+		model.OwnerName = ownerName.String
+		model.WeightedValue = int(math.Round(weightedValue))
+		model.FormattedValue = formatMoney(float64(model.Value), int(decimalPoints.Int64), symbol)
+		model.FormattedWeightedValue = formatMoney(weightedValue, int(decimalPoints.Int64), symbol)
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+// recordTaskStage closes the open task_stage_history entry of the task and
+// opens a new one for stageID. It does nothing if the task already is in
+// stageID and reports whether the task moved.
+func recordTaskStage(taskID, stageID, userID string) (bool, error) {
+	return recordTaskStageWith(db, taskID, stageID, userID)
+}
+
+// recordTaskStageWith is recordTaskStage for callers that run inside a
+// transaction.
+func recordTaskStageWith(ex execer, taskID, stageID, userID string) (bool, error) {
+	result, err := ex.Exec(`
+		WITH closed AS (
+			UPDATE
+				task_stage_history
+			SET
+				exited_at = current_timestamp,
+				exited_user_id = $3
+			WHERE
+				task_id = $1
+			AND
+				exited_at IS NULL
+			AND
+				stage_id <> $2
+		)
+		INSERT INTO task_stage_history(
+			task_id,
+			stage_id,
+			entered_user_id,
+			entered_at
+		)
+		SELECT
+			$1::uuid,
+			$2::uuid,
+			$3::uuid,
+			current_timestamp
+		WHERE NOT EXISTS (
+			select 1
+			from task_stage_history
+			where task_id = $1
+			and stage_id = $2
+			and exited_at is null
+		)
+	`,
+		taskID,
+		stageID,
+		maybeNull(userID),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func selectTaskStageHistory(taskID string) ([]TaskStageHistory, error) {
+	rows, err := db.Query(`
+		SELECT
+			task_stage_history.id,
+			task_stage_history.task_id,
+			task_stage_history.stage_id,
+			stages.name as stage_name,
+			task_stage_history.entered_user_id,
+			task_stage_history.entered_at,
+			task_stage_history.exited_user_id,
+			task_stage_history.exited_at
+		FROM
+			task_stage_history
+		LEFT OUTER JOIN
+			stages ON stages.id = task_stage_history.stage_id
+		WHERE
+			task_stage_history.task_id = $1
+		ORDER BY
+			task_stage_history.entered_at
+	`,
+		taskID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []TaskStageHistory
+	for rows.Next() {
+		var model TaskStageHistory
+
+		var stageName sql.NullString
+		var enteredUserID sql.NullString
+		var exitedUserID sql.NullString
+
+		err = rows.Scan(
+			&model.ID,
+			&model.TaskID,
+			&model.StageID,
+			&stageName,
+			&enteredUserID,
+			&model.EnteredAt,
+			&exitedUserID,
+			&model.ExitedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		model.StageName = stageName.String
+		model.EnteredUserID = enteredUserID.String
+		model.ExitedUserID = exitedUserID.String
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+// selectStageReportByCompany computes time in stage and stage conversion for
+// stage entries within the date range, and cycle time for tasks closed
+// within the date range. Durations are in seconds.
+func selectStageReportByCompany(companyID, workflowID string, fromTime, untilTime *time.Time) ([]WorkflowReport, error) {
+	rows, err := db.Query(`
+		SELECT
+			workflows.id,
+			workflows.name,
+			count(tasks.id) as closed_tasks_count,
+			coalesce(avg(extract(epoch from tasks.close_time - tasks.created_at)), 0) as average_cycle_time
+		FROM
+			workflows
+		LEFT OUTER JOIN
+			tasks ON tasks.workflow_id = workflows.id
+			AND tasks.deleted_at IS NULL
+			AND tasks.close_time IS NOT NULL
+			AND ($3::timestamp with time zone IS NULL OR tasks.close_time >= $3)
+			AND ($4::timestamp with time zone IS NULL OR tasks.close_time < $4)
+		WHERE
+			workflows.deleted_at IS NULL
+		AND
+			workflows.company_id = $1
+		AND
+			($2::uuid IS NULL OR workflows.id = $2)
+		GROUP BY
+			workflows.id, workflows.name
+		ORDER BY
+			workflows.name
+	`,
+		companyID,
+		maybeNull(workflowID),
+		fromTime,
+		untilTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []WorkflowReport
+	index := make(map[string]int)
+	for rows.Next() {
+		var model WorkflowReport
+		var averageCycleTime float64
+
+		err = rows.Scan(
+			&model.WorkflowID,
+			&model.WorkflowName,
+			&model.ClosedTasksCount,
+			&averageCycleTime,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		model.AverageCycleTime = int64(averageCycleTime)
+		model.Stages = []StageReport{}
+
+		index[model.WorkflowID] = len(result)
+		result = append(result, model)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT
+			stages.workflow_id,
+			stages.id,
+			stages.name,
+			stages.order_nr,
+			count(distinct history.task_id) as tasks_count,
+			coalesce(avg(
+				extract(epoch from history.exited_at - history.entered_at)
+			) filter (where history.exited_at IS NOT NULL), 0) as average_time_in_stage,
+			count(distinct history.task_id) filter (where exists (
+				select 1
+				from task_stage_history later
+				join stages later_stages on later_stages.id = later.stage_id
+				where later.task_id = history.task_id
+				and later.entered_at >= history.entered_at
+				and later_stages.order_nr > stages.order_nr
+			)) as converted_tasks_count
+		FROM
+			stages
+		JOIN
+			workflows ON workflows.id = stages.workflow_id
+		LEFT OUTER JOIN
+			task_stage_history history ON history.stage_id = stages.id
+			AND ($3::timestamp with time zone IS NULL OR history.entered_at >= $3)
+			AND ($4::timestamp with time zone IS NULL OR history.entered_at < $4)
+		WHERE
+			stages.deleted_at IS NULL
+		AND
+			workflows.deleted_at IS NULL
+		AND
+			workflows.company_id = $1
+		AND
+			($2::uuid IS NULL OR workflows.id = $2)
+		GROUP BY
+			stages.workflow_id, stages.id, stages.name, stages.order_nr
+		ORDER BY
+			stages.workflow_id, stages.order_nr
+	`,
+		companyID,
+		maybeNull(workflowID),
+		fromTime,
+		untilTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var model StageReport
+		var workflowID string
+		var averageTimeInStage float64
+
+		err = rows.Scan(
+			&workflowID,
+			&model.StageID,
+			&model.StageName,
+			&model.OrderNr,
+			&model.TasksCount,
+			&averageTimeInStage,
+			&model.ConvertedTasksCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		model.AverageTimeInStage = int64(averageTimeInStage)
+		if model.TasksCount > 0 {
+			model.ConversionRate = float64(model.ConvertedTasksCount) / float64(model.TasksCount)
+		}
+
+		i, ok := index[workflowID]
+		if !ok {
+			continue
+		}
+		result[i].Stages = append(result[i].Stages, model)
+	}
+	return result, rows.Err()
+}
+
+func selectFirstWorkflowByCompany(companyID string) (ID string, name string, err error) {
+	err = db.QueryRow(`
+		select
+			id,
+			name
+		from
+			workflows
+		where
+			deleted_at is null
+		and
+			company_id = $1
+		limit 1
+	`,
+		companyID,
+	).Scan(
+		&ID,
+		&name,
+	)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return ID, name, err
+}
+
+func selectFirstCompanyByUser(userID string) (string, error) {
+	var result string
+	err := db.QueryRow(`
+		select
+			company_id
+		from
+			company_users
+		where
+			deleted_at is null
+		and
+			user_id = $1
+		limit 1
+	`,
+		userID,
+	).Scan(
+		&result,
+	)
+	return result, err
+}
+
+func selectActivityTypeByID(ID string) (*ActivityType, error) {
+	var model ActivityType
+	err := db.QueryRow(`
+		select
+		   	id,
+			company_id,
+		   	name,
+			key_string,
+			order_nr,
+			color,
+			is_custom_flag,
+			icon,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			activity_types
+		WHERE
+			id = $1
+	`,
+		ID,
+	).Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.KeyString,
+		&model.OrderNr,
+		&model.Color,
+		&model.IsCustomFlag,
+		&model.Icon,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &model, nil
+}
+
+func selectActivityTypesByCompany(companyID string) ([]ActivityType, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	id,
+			company_id,
+		   	name,
+			key_string,
+			order_nr,
+			color,
+			is_custom_flag,
+			icon,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			activity_types
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			order_nr,
+			name
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []ActivityType
+	for rows.Next() {
+
+		var model ActivityType
+
+		err = rows.Scan(
+			&model.ID,
+			&model.CompanyID,
+			&model.Name,
+			&model.KeyString,
+			&model.OrderNr,
+			&model.Color,
+			&model.IsCustomFlag,
+			&model.Icon,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectWorkflowsByCompany(companyID string) ([]Workflow, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	id,
+			company_id,
+		   	name,
+			order_nr,
+			url_title,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			workflows
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Workflow
+	for rows.Next() {
+
+		var model Workflow
+
+		var urlTitle sql.NullString
+		var orderNr sql.NullInt64
+
+		err = rows.Scan(
+			&model.ID,
+			&model.CompanyID,
+			&model.Name,
+			&orderNr,
+			&urlTitle,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		model.URLTitle = urlTitle.String
+		model.OrderNr = int(orderNr.Int64)
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectActivitiesByCompany(companyID string) ([]Activity, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	activities.id,
+		   	activities.name,
+			activities.company_id,
+			activities.user_id,
+			activities.done,
+			activities.reference_type,
+			activities.reference_id,
+			activities.due_date,
+			activities.duration,
+			activities.marked_as_done_time,
+			activities.task_id,
+			activities.org_id,
+			activities.person_id,
+			activities.assigned_to_user_id,
+			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
+		    activities.created_at,
+		    activities.updated_at,
+		    activities.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as user_name,
+		    persons.name as person_name,
+		    tasks.name as task_name,
+		    organizations.name as org_name,
+		    activities.type_id,
+		    activity_types.name as type,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as person_email,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as person_phone,
+		   	assigned_users.name as assigned_to_user_name
+		FROM
+			activities
+		LEFT OUTER JOIN
+			users ON users.id = activities.user_id
+		LEFT OUTER JOIN
+			users AS assigned_users ON assigned_users.id = activities.assigned_to_user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = activities.person_id
+		LEFT OUTER JOIN
+			tasks ON tasks.id = activities.task_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = activities.org_id
+		LEFT OUTER JOIN
+			activity_types ON activity_types.id = activities.type_id
+		WHERE
+			activities.deleted_at IS NULL
+		AND
+			activities.company_id = $1
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanActivities(rows)
+}
+
+func selectCompanyUsersByUser(userID string) ([]CompanyUser, error) {
+	rows, err := db.Query(`
+		SELECT
+			company_users.id,
+			company_users.user_id,
+			company_users.is_admin,
+			company_users.company_id,
+		    company_users.created_at,
+		    company_users.updated_at,
+		    company_users.deleted_at,
+		    users.email,
+		    users.name
+		FROM
+			company_users
+		LEFT OUTER JOIN
+			users ON users.id = company_users.user_id
+		WHERE
+			company_users.deleted_at IS NULL
+		AND
+			company_users.user_id = $1
+	`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanCompanyUsers(rows)
+}
+
+func selectContactByID(ID string) (*Contact, error) {
+	var model Contact
+
+	err := db.QueryRow(`
+		SELECT
+		   	id,
+		   	name,
+			person_id,
+			primary_contact,
+			type,
+			label,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			contacts
+		WHERE
+			id = $1
+		LIMIT 1
+	`,
+		ID,
+	).Scan(
+		&model.ID,
+		&model.Name,
+		&model.PersonID,
+		&model.Primary,
+		&model.Type,
+		&model.Label,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errors.New("No contact with that ID")
+	case err != nil:
+		return nil, err
+	}
+
+	return &model, nil
+}
+
+func selectContactsByPerson(personID string) ([]Contact, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	id,
+		   	name,
+			person_id,
+			primary_contact,
+			type,
+			label,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			contacts
+		WHERE
+			person_id = $1
+		AND
+			deleted_at is null
+		ORDER BY
+			type, name
+	`,
+		personID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Contact
+	for rows.Next() {
+		var model Contact
+
+		err = rows.Scan(
+			&model.ID,
+			&model.Name,
+			&model.PersonID,
+			&model.Primary,
+			&model.Type,
+			&model.Label,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+// selectContactsToNormalize returns the phone numbers and e-mail addresses
+// of all persons, see backfillContacts
+func selectContactsToNormalize() ([]Contact, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			name,
+			type,
+			label
+		FROM
+			contacts
+		WHERE
+			type IN ('email', 'phone')
+		AND
+			deleted_at is null
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Contact
+	for rows.Next() {
+		var model Contact
+		if err := rows.Scan(
+			&model.ID,
+			&model.Name,
+			&model.Type,
+			&model.Label,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func updateContactName(ID, name string) error {
+	_, err := db.Exec(`
+		UPDATE
+			contacts
+		SET
+			name = $1,
+			updated_at = current_timestamp
+		WHERE
+			id = $2
+	`,
+		name,
+		ID,
+	)
+	return err
+}
+
+func selectPersonsByCompany(companyID string) ([]Person, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	persons.id,
+		   	persons.name,
+			persons.company_id,
+			persons.owner_id,
+			persons.org_id,
+			persons.first_name,
+			persons.custom_fields,
+		    persons.created_at,
+		    persons.updated_at,
+		    persons.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		    (
+		    	select count(1)
+		    	from tasks
+		    	where tasks.person_id = persons.id
+		    	and deleted_at is null
+		    	and (won_time is null and lost_time is null)
+		    ) as open_tasks_count,
+		    (
+		    	select count(1)
+		    	from tasks
+		    	where tasks.person_id = persons.id
+		    	and deleted_at is null
+		    	and (won_time is not null or lost_time is not null)
+		    ) as closed_tasks_count,
+		    organizations.name as org_name,
+		   	(
+		   		select activities.due_date
+		   		from activities
+		   		where activities.person_id = persons.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.person_id = persons.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as email,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as phone
+		FROM
+			persons
+		LEFT OUTER JOIN
+			users ON users.id = persons.owner_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = persons.org_id
+		WHERE
+			persons.deleted_at IS NULL
+		AND
+			persons.company_id = $1
+		ORDER BY
+			persons.name
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPersons(rows)
+}
+
+func scanPersons(rows *sql.Rows) ([]Person, error) {
+	defer rows.Close()
+	var result []Person
+	for rows.Next() {
+		var model Person
+
+		var orgID sql.NullString
+		var ownerName sql.NullString
+		var orgName sql.NullString
+		var nextActivityID sql.NullString
+		var email sql.NullString
+		var phone sql.NullString
+
+		if err := rows.Scan(
+			&model.ID,
+			&model.Name,
+			&model.CompanyID,
+			&model.OwnerID,
+			&orgID,
+			&model.FirstName,
+			&model.CustomFields,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+			&ownerName,
+			&model.OpenTasksCount,
+			&model.ClosedTasksCount,
+			&orgName,
+			&model.NextActivityDate,
+			&nextActivityID,
+			&email,
+			&phone,
+		); err != nil {
+			return nil, err
+		}
+
+		model.OrgID = orgID.String
+		model.OwnerName = ownerName.String
+		model.OrgName = orgName.String
+		model.NextActivityID = nextActivityID.String
+		model.Email = email.String
+		model.Phone = phone.String
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectCurrenciesByCompany(companyID string) ([]Currency, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	id,
+			company_id,
+			name,
+			code,
+			decimal_points,
+			symbol,
+			is_custom_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			currencies
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Currency
+	for rows.Next() {
+		var model Currency
+
+		err = rows.Scan(
+			&model.ID,
+			&model.CompanyID,
+			&model.Name,
+			&model.Code,
+			&model.DecimalPoints,
+			&model.Symbol,
+			&model.IsCustomFlag,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectLostReasonsByCompany(companyID string) ([]LostReason, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	id,
+			company_id,
+			name,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			lost_reasons
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			name
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []LostReason
+	for rows.Next() {
+		var model LostReason
+
+		err = rows.Scan(
+			&model.ID,
+			&model.CompanyID,
+			&model.Name,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectLostReasonByID(ID string) (*LostReason, error) {
+	var model LostReason
+	err := db.QueryRow(`
+		SELECT
+		   	id,
+			company_id,
+			name,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			lost_reasons
+		WHERE
+			id = $1
+		AND
+			deleted_at IS NULL
+	`,
+		ID,
+	).Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func selectOrganizationsByCompany(companyID string) ([]Organization, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	organizations.id,
+		   	organizations.name,
+			organizations.company_id,
+			organizations.owner_id,
+			organizations.country_code,
+			organizations.address,
+			organizations.address_subpremise,
+			organizations.address_street_number,
+			organizations.address_route,
+			organizations.address_sublocality,
+			organizations.address_locality,
+			organizations.address_admin_area_level_1,
+			organizations.address_admin_area_level_2,
+			organizations.address_country,
+			organizations.address_postal_code,
+			organizations.address_formatted_address,
+			organizations.address_latitude,
+			organizations.address_longitude,
+			organizations.custom_fields,
+			organizations.category_id,
+			organizations.first_char,
+			organizations.visible_to,
+		    organizations.created_at,
+		    organizations.updated_at,
+		    organizations.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		    (
+		    	select count(1)
+		    	from tasks
+		    	where tasks.org_id = organizations.id
+		    	and deleted_at is null
+		    	and (won_time is null and lost_time is null)
+		    ) as open_tasks_count,
+		    (
+		    	select count(1)
+		    	from tasks
+		    	where tasks.org_id = organizations.id
+		    	and deleted_at is null
+		    	and (won_time is not null or lost_time is not null)
+		    ) as closed_tasks_count,
+		    (
+		    	select count(1)
+		    	from persons
+		    	where persons.org_id = organizations.id
+		    	and persons.deleted_at is null
+		    ) as people_count,
+		    (
+		    	select min(due_date)
+		    	from activities
+		    	where deleted_at is null
+		    	and activities.org_id = organizations.id
+		    ) as next_activity_date,
+		    (
+		    	select activities.id
+		    	from activities
+		    	where deleted_at is null
+		    	and activities.org_id = organizations.id
+		    	order by activities.due_date asc
+		    	limit 1
+		    ) as next_activity_id
+		FROM
+			organizations
+		LEFT OUTER JOIN
+			users ON users.id = organizations.owner_id
+		WHERE
+			organizations.deleted_at IS NULL
+		AND
+			organizations.company_id = $1
+		ORDER BY
+			organizations.name
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Organization
+	for rows.Next() {
+		model, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
+}
+
+func scanOrganization(rows *sql.Rows) (*Organization, error) {
+	var model Organization
+
+	var categoryID sql.NullString
+	var ownerName sql.NullString
+	var nextActivityID sql.NullString
+
+	if err := rows.Scan(
+		&model.ID,
+		&model.Name,
+		&model.CompanyID,
+		&model.OwnerID,
+		&model.CountryCode,
+		&model.Address,
+		&model.AddressSubpremise,
+		&model.AddressStreetNumber,
+		&model.AddressRoute,
+		&model.AddressSublocality,
+		&model.AddressLocality,
+		&model.AddressAdminAreaLevel1,
+		&model.AddressAdminAreaLevel2,
+		&model.AddressCountry,
+		&model.AddressPostalCode,
+		&model.AddressFormattedAddress,
+		&model.Latitude,
+		&model.Longitude,
+		&model.CustomFields,
+		&categoryID,
+		&model.FirstChar,
+		&model.VisibleTo,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+		&ownerName,
+		&model.OpenTasksCount,
+		&model.ClosedTasksCount,
+		&model.PeopleCount,
+		&model.NextActivityDate,
+		&nextActivityID,
+	); err != nil {
+		return nil, err
+	}
+
+	model.CategoryID = categoryID.String
+	model.OwnerName = ownerName.String
+	model.NextActivityID = nextActivityID.String
+
+	return &model, nil
+}
+
+func selectNotesByTask(TaskID string) ([]Note, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	notes.id,
+		   	notes.name,
+			notes.company_id,
+			notes.user_id,
+			notes.task_id,
+			notes.person_id,
+			notes.org_id,
+			notes.pinned_to_task_flag,
+			notes.pinned_to_person_flag,
+			notes.pinned_to_organization_flag,
+			notes.last_update_user_id,
+		    notes.created_at,
+		    notes.updated_at,
+		    notes.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as user_name
+		FROM
+			notes
+		LEFT OUTER JOIN
+			users ON users.id = notes.user_id
+		WHERE
+			notes.deleted_at IS NULL
+		AND
+			notes.task_id = $1
+	`,
+		TaskID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNotes(rows)
+}
+
+func scanNotes(rows *sql.Rows) ([]Note, error) {
+	defer rows.Close()
+	var result []Note
+	for rows.Next() {
+		var model Note
+
+		var personID sql.NullString
+		var orgID sql.NullString
+		var lastUpdateUserID sql.NullString
+		var taskID sql.NullString
+
+		if err := rows.Scan(
+			&model.ID,
+			&model.Name,
+			&model.CompanyID,
+			&model.UserID,
+			&taskID,
+			&personID,
+			&orgID,
+			&model.PinnedToTaskFlag,
+			&model.PinnedToPersonFlag,
+			&model.PinnedToOrganizationFlag,
+			&lastUpdateUserID,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+			&model.UserName,
+		); err != nil {
+			return nil, err
+		}
+
+		model.PersonID = personID.String
+		model.OrgID = orgID.String
+		model.LastUpdateUserID = lastUpdateUserID.String
+		model.TaskID = taskID.String
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectNotesByPerson(personID string) ([]Note, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	notes.id,
+		   	notes.name,
+			notes.company_id,
+			notes.user_id,
+			notes.task_id,
+			notes.person_id,
+			notes.org_id,
+			notes.pinned_to_task_flag,
+			notes.pinned_to_person_flag,
+			notes.pinned_to_organization_flag,
+			notes.last_update_user_id,
+		    notes.created_at,
+		    notes.updated_at,
+		    notes.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as user_name
+		FROM
+			notes
+		LEFT OUTER JOIN
+			users ON users.id = notes.user_id
+		WHERE
+			notes.deleted_at IS NULL
+		AND
+			notes.person_id = $1
+	`,
+		personID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNotes(rows)
+}
+
+func selectPersonsByOrganization(organizationID string) ([]Person, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	persons.id,
+		   	persons.name,
+			persons.company_id,
+			persons.owner_id,
+			persons.org_id,
+			persons.first_name,
+			persons.custom_fields,
+		    persons.created_at,
+		    persons.updated_at,
+		    persons.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as owner_name,
+		    (
+		    	select count(1)
+		    	from tasks
+		    	where tasks.person_id = persons.id
+		    	and deleted_at is null
+		    	and (won_time is null and lost_time is null)
+		    ) as open_tasks_count,
+		    (
+		    	select count(1)
+		    	from tasks
+		    	where tasks.person_id = persons.id
+		    	and deleted_at is null
+		    	and (won_time is not null or lost_time is not null)
+		    ) as closed_tasks_count,
+		    organizations.name as org_name,
+		   	(
+		   		select activities.due_date
+		   		from activities
+		   		where activities.person_id = persons.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.person_id = persons.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as email,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as phone
+		FROM
+			persons
+		LEFT OUTER JOIN
+			users ON users.id = persons.owner_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = persons.org_id
+		WHERE
+			persons.deleted_at IS NULL
+		AND
+			persons.org_id = $1
+		ORDER BY
+			persons.name
+	`,
+		organizationID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPersons(rows)
+}
+
+func selectStageByID(stageID string) (*Stage, error) {
+	var model Stage
+	err := db.QueryRow(`
+		select
+		   	id,
+		   	name,
+			order_nr,
+			task_probability,
+			workflow_id,
+			rotten_flag,
+			rotten_days,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			stages
+		WHERE
+			id = $1
+	`,
+		stageID,
+	).Scan(
+		&model.ID,
+		&model.Name,
+		&model.OrderNr,
+		&model.TaskProbability,
+		&model.WorkflowID,
+		&model.RottenFlag,
+		&model.RottenDays,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+	return &model, err
+}
+
+func selectStagesByWorkflow(workflowID string) ([]Stage, error) {
+	if workflowID == "" {
+		return nil, nil
+	}
+	rows, err := db.Query(`
+		SELECT
+		   	id,
+		   	name,
+			order_nr,
+			task_probability,
+			workflow_id,
+			rotten_flag,
+			rotten_days,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			stages
+		WHERE
+			deleted_at IS NULL
+		AND
+			workflow_id = $1
+		ORDER BY
+			order_nr
+	`,
+		workflowID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Stage
+	for rows.Next() {
+		var model Stage
+		err = rows.Scan(
+			&model.ID,
+			&model.Name,
+			&model.OrderNr,
+			&model.TaskProbability,
+			&model.WorkflowID,
+			&model.RottenFlag,
+			&model.RottenDays,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func insertActivityField(model *ActivityField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("activity_fields", model.CompanyID, model.Key, ""); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	row := db.QueryRow(`
+		INSERT INTO activity_fields(
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			mandatory_flag,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11,
+			$12,
+			$13,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
+	`,
+		model.CompanyID,
+		model.Name,
+		model.Key,
+		model.OrderNr,
+		model.PicklistData,
+		model.FieldType,
+		model.EditFlag,
+		model.IndexVisibleFlag,
+		model.DetailsVisibleFlag,
+		model.AddVisibleFlag,
+		model.ImportantFlag,
+		model.BulkEditAllowed,
+		model.MandatoryFlag,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
+	)
+}
+
+func updateActivityField(model ActivityField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("activity_fields", model.CompanyID, model.Key, model.ID); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldKey, err := lockCustomFieldKey(tx, "activity_fields", model.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE
+			activity_fields
+		SET
+			name = $1,
+			key = $2,
+			order_nr = $3,
+			picklist_data = $4,
+			field_type = $5,
+			edit_flag = $6,
+			index_visible_flag = $7,
+			details_visible_flag = $8,
+			add_visible_flag = $9,
+			important_flag = $10,
+			bulk_edit_allowed = $11,
+			mandatory_flag = $12,
+			updated_at = current_timestamp
+		WHERE
+			id = $13
+	`,
+		model.Name,
+		model.Key,
+		model.OrderNr,
+		model.PicklistData,
+		model.FieldType,
+		model.EditFlag,
+		model.IndexVisibleFlag,
+		model.DetailsVisibleFlag,
+		model.AddVisibleFlag,
+		model.ImportantFlag,
+		model.BulkEditAllowed,
+		model.MandatoryFlag,
+		model.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := renameCustomFieldKey(tx, "activities", model.CompanyID, oldKey, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteActivityField deletes the field and its values on the activities
+func deleteActivityField(model ActivityField) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE
+			activity_fields
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := removeCustomFieldKey(tx, "activities", model.CompanyID, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func selectActivityFieldsByCompany(companyID string) ([]ActivityField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			activity_fields
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			order_nr, created_at
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []ActivityField
+	for rows.Next() {
+		model, err := scanActivityField(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
+}
+
+func selectActivityFieldByID(ID string) (*ActivityField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			activity_fields
+		WHERE
+			deleted_at IS NULL
+		AND
+			id = $1
+	`,
+		ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanActivityField(rows)
+}
+
+func scanActivityField(rows *sql.Rows) (*ActivityField, error) {
+	var model ActivityField
+	err := rows.Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.Key,
+		&model.OrderNr,
+		&model.PicklistData,
+		&model.FieldType,
+		&model.EditFlag,
+		&model.IndexVisibleFlag,
+		&model.DetailsVisibleFlag,
+		&model.AddVisibleFlag,
+		&model.ImportantFlag,
+		&model.BulkEditAllowed,
+		&model.MandatoryFlag,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func insertActivityType(model *ActivityType) error {
+	row := db.QueryRow(`
+		INSERT INTO activity_types(
+			company_id,
+			name,
+			key_string,
+			order_nr,
+			color,
+			is_custom_flag,
+			icon,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
+	`,
+		model.CompanyID,
+		model.Name,
+		model.KeyString,
+		model.OrderNr,
+		model.Color,
+		model.IsCustomFlag,
+		model.Icon,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
+	)
+}
+
+func updateActivityType(model ActivityType) error {
+	_, err := db.Exec(`
+		UPDATE
+			activity_types
+		SET
+			name = $1,
+			key_string = $2,
+			order_nr = $3,
+			color = $4,
+			is_custom_flag = $5,
+			icon = $6,
+			updated_at = current_timestamp
+		WHERE
+			id = $7
+	`,
+		model.Name,
+		model.KeyString,
+		model.OrderNr,
+		model.Color,
+		model.IsCustomFlag,
+		model.Icon,
+		model.ID,
+	)
+	return err
+}
+
+func deleteActivityType(model ActivityType) error {
+	_, err := db.Exec(`
+		UPDATE
+			activity_types
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	return err
+}
+
+// countActivitiesByType returns how many activities have the type
+func countActivitiesByType(typeID string) (int, error) {
+	var result int
+	err := db.QueryRow(`
+		select
+			count(1)
+		from
+			activities
+		where
+			type_id = $1
+		and
+			deleted_at is null
+	`,
+		typeID,
+	).Scan(
+		&result,
+	)
+	return result, err
+}
+
+// replaceActivityType moves the activities of the type, deleted ones too,
+// to the replacement type and deletes the type
+func replaceActivityType(model ActivityType, replacementID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE
+			activities
+		SET
+			type_id = $1,
+			updated_at = current_timestamp
+		WHERE
+			type_id = $2
+	`,
+		replacementID,
+		model.ID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE
+			activity_types
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateActivityTypeOrder numbers the activity types in the order of IDs
+func updateActivityTypeOrder(IDs []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, ID := range IDs {
+		if _, err := tx.Exec(`
+			UPDATE
+				activity_types
+			SET
+				order_nr = $1,
+				updated_at = current_timestamp
+			WHERE
+				id = $2
+		`,
+			i,
+			ID,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertCurrency(model *Currency) error {
+	row := db.QueryRow(`
+		INSERT INTO currencies(
+			company_id,
+			name,
+			code,
+			decimal_points,
+			symbol,
+			is_custom_flag,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
+	`,
+		model.CompanyID,
+		model.Name,
+		model.Code,
+		model.DecimalPoints,
+		model.Symbol,
+		model.IsCustomFlag,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
+	)
+}
+
+func updateCurrency(model Currency) error {
+	_, err := db.Exec(`
+		UPDATE
+			currencies
+		SET
+			name = $1,
+			code = $2,
+			decimal_points = $3,
+			symbol = $4,
+			is_custom_flag = $5,
+			updated_at = current_timestamp
+		WHERE
+			id = $6
+	`,
+		model.Name,
+		model.Code,
+		model.DecimalPoints,
+		model.Symbol,
+		model.IsCustomFlag,
+		model.ID,
+	)
+	return err
+}
+
+func deleteCurrency(model Currency) error {
+	_, err := db.Exec(`
+		UPDATE
+			currencies
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	return err
+}
+
+func insertLostReason(model *LostReason) error {
+	if model.CompanyID == "" {
+		return errors.New("Please assign a company")
+	}
+	if model.Name == "" {
+		return errors.New("Please enter a name")
+	}
+
+	row := db.QueryRow(`
+		INSERT INTO lost_reasons(
+			company_id,
+			name,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
+	`,
+		model.CompanyID,
+		model.Name,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
+	)
+}
+
+func updateLostReason(model LostReason) error {
+	if model.Name == "" {
+		return errors.New("Please enter a name")
+	}
+
+	_, err := db.Exec(`
+		UPDATE
+			lost_reasons
+		SET
+			name = $1,
+			updated_at = current_timestamp
+		WHERE
+			id = $2
+	`,
+		model.Name,
+		model.ID,
+	)
+	return err
+}
+
+func deleteLostReason(model LostReason) error {
+	_, err := db.Exec(`
+		UPDATE
+			lost_reasons
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	return err
+}
+
+func insertFilter(model *Filter) error {
+	row := db.QueryRow(`
+		INSERT INTO filters(
+			company_id,
+			name,
+			type,
+			temporary_flag,
+			user_id,
+			visible_to,
+			custom_view_id,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
+	`,
+		model.CompanyID,
+		model.Name,
+		model.Type,
+		model.TemporaryFlag,
+		model.UserID,
+		model.VisibleTo,
+		model.CustomViewID,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
+	)
+}
+
+func updateFilter(model Filter) error {
+	_, err := db.Exec(`
+		UPDATE
+			filters
+		SET
+			name = $1,
+			type = $2,
+			temporary_flag = $3,
+			user_id = $4,
+			visible_to = $5,
+			custom_view_id = $6,
+			updated_at = current_timestamp
+		WHERE
+			id = $7
+	`,
+		model.Name,
+		model.Type,
+		model.TemporaryFlag,
+		model.UserID,
+		model.VisibleTo,
+		model.CustomViewID,
+		model.ID,
+	)
+	return err
+}
+
+func deleteFilter(model Filter) error {
+	_, err := db.Exec(`
+		UPDATE
+			filters
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	return err
+}
+
+func insertGoal(model *Goal) error {
+	row := db.QueryRow(`
+		INSERT INTO goals(
+			company_id,
+			name,
+			user_id,
+			stage_id,
+			active_goal_id,
+			period,
+			expected,
+			goal_type,
+			expected_sum,
+			currency,
+			expected_type,
+			created_by_user_id,
+			workflow_id,
+			master_expected,
+			delivered,
+			delivered_sum,
+			period_start,
+			period_end,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11,
+			$12,
+			$13,
+			$14,
+			$15,
+			$16,
+			$17,
+			$18,
+			current_timestamp
+		)
+		RETURNING
+			id,
+			created_at
+	`,
+		model.CompanyID,
+		model.Name,
+		model.UserID,
+		maybeNull(model.StageID),
+		maybeNull(model.ActiveGoalID),
+		model.Period,
+		model.Expected,
+		model.GoalType,
+		model.ExpectedSum,
+		model.Currency,
+		model.ExpectedType,
+		maybeNull(model.CreatedByUserID),
+		maybeNull(model.WorkflowID),
+		model.MasterExpected,
+		model.Delivered,
+		model.DeliveredSum,
+		model.PeriodStart,
+		model.PeriodEnd,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
+	)
+}
+
+func updateGoal(model Goal) error {
+	_, err := db.Exec(`
+		UPDATE
+			goals
+		SET
+			name = $1,
+			user_id = $2,
+			stage_id = $3,
+			active_goal_id = $4,
+			period = $5,
+			expected = $6,
+			goal_type = $7,
+			expected_sum = $8,
+			currency = $9,
+			expected_type = $10,
+			created_by_user_id = $11,
+			workflow_id = $12,
+			master_expected = $13,
+			delivered = $14,
+			delivered_sum = $15,
+			period_start = $16,
+			period_end = $17,
+			updated_at = current_timestamp
+		WHERE
+			id = $18
+	`,
+		model.Name,
+		model.UserID,
+		maybeNull(model.StageID),
+		maybeNull(model.ActiveGoalID),
+		model.Period,
+		model.Expected,
+		model.GoalType,
+		model.ExpectedSum,
+		model.Currency,
+		model.ExpectedType,
+		maybeNull(model.CreatedByUserID),
+		maybeNull(model.WorkflowID),
+		model.MasterExpected,
+		model.Delivered,
+		model.DeliveredSum,
+		model.PeriodStart,
+		model.PeriodEnd,
+		model.ID,
+	)
+	return err
+}
+
+func deleteGoal(model Goal) error {
+	_, err := db.Exec(`
+		UPDATE
+			goals
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	return err
+}
+
+func insertNoteField(model *NoteField) error {
+	row := db.QueryRow(`
+		INSERT INTO note_fields(
+			company_id,
+			name,
+			key,
+			field_type,
+			edit_flag,
+			mandatory_flag,
+		    created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			current_timestamp
+		)
 		RETURNING
 			id,
 			created_at
@@ -3826,7 +7308,11 @@ func deleteNoteField(model NoteField) error {
 }
 
 func insertOrganizationRelationship(model *OrganizationRelationship) error {
-	row := db.QueryRow(`
+	return insertOrganizationRelationshipWith(db, model)
+}
+
+func insertOrganizationRelationshipWith(ex execer, model *OrganizationRelationship) error {
+	row := ex.QueryRow(`
 		INSERT INTO organization_relationships(
 		    company_id,
 			type,
@@ -3857,45 +7343,407 @@ func insertOrganizationRelationship(model *OrganizationRelationship) error {
 	return row.Scan(&model.ID)
 }
 
-func updateOrganizationRelationship(model OrganizationRelationship) error {
-	_, err := db.Exec(`
-		UPDATE
-			organization_relationships
-		SET
-			type = $1,
-			rel_owner_org_id = $2,
-			rel_linked_org_id = $3,
-			calculated_type = $4,
-			calculated_related_org_id = $5,
-			updated_at = current_timestamp
+func updateOrganizationRelationship(model OrganizationRelationship) error {
+	return updateOrganizationRelationshipWith(db, model)
+}
+
+func updateOrganizationRelationshipWith(ex execer, model OrganizationRelationship) error {
+	_, err := ex.Exec(`
+		UPDATE
+			organization_relationships
+		SET
+			type = $1,
+			rel_owner_org_id = $2,
+			rel_linked_org_id = $3,
+			calculated_type = $4,
+			calculated_related_org_id = $5,
+			updated_at = current_timestamp
+		WHERE
+			id = $6
+	`,
+		model.Type,
+		maybeNull(model.RelOwnerOrgID),
+		maybeNull(model.RelLinkedOrgID),
+		model.CalculatedType,
+		maybeNull(model.CalculatedRelatedOrgID),
+		model.ID,
+	)
+	return err
+}
+
+func deleteOrganizationRelationship(model OrganizationRelationship) error {
+	_, err := db.Exec(`
+		UPDATE
+			organization_relationships
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	return err
+}
+
+// saveOrganizationRelationship validates the relationship and inserts it, or
+// updates it if it has an ID. The hierarchy of the company is locked until
+// the relationship is saved, so concurrent changes cannot make a cycle.
+func saveOrganizationRelationship(model *OrganizationRelationship) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrganizationHierarchy(tx, model.CompanyID); err != nil {
+		return err
+	}
+	if err := prepareOrganizationRelationship(tx, model); err != nil {
+		return err
+	}
+	if model.ID == "" {
+		err = insertOrganizationRelationshipWith(tx, model)
+	} else {
+		err = updateOrganizationRelationshipWith(tx, *model)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockOrganizationHierarchy locks the row of the company, which serializes
+// the changes to the parent relationships of its organizations
+func lockOrganizationHierarchy(tx *sql.Tx, companyID string) error {
+	var ID string
+	return tx.QueryRow(`
+		select
+			id
+		from
+			companies
+		where
+			id = $1
+		for update
+	`,
+		companyID,
+	).Scan(&ID)
+}
+
+// organizationRelationshipColumns are the columns scanned by
+// scanOrganizationRelationships. The calculated columns are relative to the
+// organization $1 when it is given.
+const organizationRelationshipColumns = `
+			organization_relationships.id,
+			organization_relationships.company_id,
+			organization_relationships.type,
+			organization_relationships.rel_owner_org_id,
+			organization_relationships.rel_linked_org_id,
+			(case
+				when $1::uuid IS NULL then organization_relationships.calculated_type
+				when organization_relationships.type <> 'parent' then 'related'
+				when organization_relationships.rel_owner_org_id = $1 then 'daughter'
+				else 'parent'
+			end) as calculated_type,
+			(case
+				when $1::uuid IS NULL then organization_relationships.calculated_related_org_id
+				when organization_relationships.rel_owner_org_id = $1 then organization_relationships.rel_linked_org_id
+				else organization_relationships.rel_owner_org_id
+			end) as calculated_related_org_id,
+			related.name as related_organization_name,
+			organization_relationships.created_at,
+			organization_relationships.updated_at,
+			organization_relationships.deleted_at
+`
+
+func selectOrganizationRelationshipsByOrganization(orgID string) ([]OrganizationRelationship, error) {
+	rows, err := db.Query(`
+		SELECT`+organizationRelationshipColumns+`
+		FROM
+			organization_relationships
+		INNER JOIN
+			organizations related ON related.id = (case
+				when organization_relationships.rel_owner_org_id = $1 then organization_relationships.rel_linked_org_id
+				else organization_relationships.rel_owner_org_id
+			end)
+		WHERE
+			organization_relationships.deleted_at IS NULL
+		AND
+			related.deleted_at IS NULL
+		AND
+			(organization_relationships.rel_owner_org_id = $1 OR organization_relationships.rel_linked_org_id = $1)
+		ORDER BY
+			organization_relationships.type, related.name
+	`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOrganizationRelationships(rows)
+}
+
+// selectOrganizationRelationshipsByCompany returns the relationships between
+// the organizations of the company that are not deleted
+func selectOrganizationRelationshipsByCompany(companyID string) ([]OrganizationRelationship, error) {
+	rows, err := db.Query(`
+		SELECT`+organizationRelationshipColumns+`
+		FROM
+			organization_relationships
+		INNER JOIN
+			organizations owner_org ON owner_org.id = organization_relationships.rel_owner_org_id
+		INNER JOIN
+			organizations related ON related.id = organization_relationships.rel_linked_org_id
+		WHERE
+			organization_relationships.deleted_at IS NULL
+		AND
+			owner_org.deleted_at IS NULL
+		AND
+			related.deleted_at IS NULL
+		AND
+			organization_relationships.company_id = $2
+		ORDER BY
+			organization_relationships.created_at, organization_relationships.id
+	`,
+		nil,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOrganizationRelationships(rows)
+}
+
+func selectOrganizationRelationshipByID(ID string) (*OrganizationRelationship, error) {
+	rows, err := db.Query(`
+		SELECT`+organizationRelationshipColumns+`
+		FROM
+			organization_relationships
+		LEFT OUTER JOIN
+			organizations related ON related.id = organization_relationships.rel_linked_org_id
+		WHERE
+			organization_relationships.deleted_at IS NULL
+		AND
+			organization_relationships.id = $2
+	`,
+		nil,
+		ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	models, err := scanOrganizationRelationships(rows)
+	if err != nil || len(models) == 0 {
+		return nil, err
+	}
+	return &models[0], nil
+}
+
+func scanOrganizationRelationships(rows *sql.Rows) ([]OrganizationRelationship, error) {
+	defer rows.Close()
+	var result []OrganizationRelationship
+	for rows.Next() {
+		var model OrganizationRelationship
+
+		var ownerOrgID sql.NullString
+		var linkedOrgID sql.NullString
+		var calculatedType sql.NullString
+		var calculatedRelatedOrgID sql.NullString
+		var relatedOrganizationName sql.NullString
+
+		if err := rows.Scan(
+			&model.ID,
+			&model.CompanyID,
+			&model.Type,
+			&ownerOrgID,
+			&linkedOrgID,
+			&calculatedType,
+			&calculatedRelatedOrgID,
+			&relatedOrganizationName,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		model.RelOwnerOrgID = ownerOrgID.String
+		model.RelLinkedOrgID = linkedOrgID.String
+		model.CalculatedType = calculatedType.String
+		model.CalculatedRelatedOrgID = calculatedRelatedOrgID.String
+		model.RelatedOrganizationName = relatedOrganizationName.String
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+// organizationRelationshipExists reports whether the organizations of the
+// relationship are already related to each other by another relationship
+func organizationRelationshipExists(ex execer, model OrganizationRelationship) (bool, error) {
+	var exists bool
+	err := ex.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM organization_relationships
+			WHERE deleted_at IS NULL
+			AND ($3::uuid IS NULL OR id <> $3)
+			AND (
+				(rel_owner_org_id = $1 AND rel_linked_org_id = $2)
+			OR
+				(rel_owner_org_id = $2 AND rel_linked_org_id = $1)
+			)
+		)
+	`,
+		model.RelOwnerOrgID,
+		model.RelLinkedOrgID,
+		maybeNull(model.ID),
+	).Scan(&exists)
+	return exists, err
+}
+
+// selectOrganizationAncestorIDs returns the IDs of the parent of the
+// organization, the parent of the parent and so on, leaving out the
+// relationship excludeID
+func selectOrganizationAncestorIDs(ex execer, orgID, excludeID string) ([]string, error) {
+	rows, err := ex.Query(`
+		WITH RECURSIVE ancestors(id) AS (
+			SELECT $1::uuid
+		UNION
+			SELECT
+				organization_relationships.rel_owner_org_id
+			FROM
+				organization_relationships
+			INNER JOIN
+				ancestors ON ancestors.id = organization_relationships.rel_linked_org_id
+			INNER JOIN
+				organizations ON organizations.id = organization_relationships.rel_owner_org_id
+			WHERE
+				organization_relationships.type = 'parent'
+			AND
+				organization_relationships.deleted_at IS NULL
+			AND
+				organizations.deleted_at IS NULL
+			AND
+				($2::uuid IS NULL OR organization_relationships.id <> $2)
+		)
+		SELECT
+			id
+		FROM
+			ancestors
 		WHERE
-			id = $6
+			id <> $1
 	`,
-		model.Type,
-		maybeNull(model.RelOwnerOrgID),
-		maybeNull(model.RelLinkedOrgID),
-		model.CalculatedType,
-		maybeNull(model.CalculatedRelatedOrgID),
-		model.ID,
+		orgID,
+		maybeNull(excludeID),
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var ID string
+		if err := rows.Scan(&ID); err != nil {
+			return nil, err
+		}
+		result = append(result, ID)
+	}
+	return result, rows.Err()
 }
 
-func deleteOrganizationRelationship(model OrganizationRelationship) error {
-	_, err := db.Exec(`
-		UPDATE
-			organization_relationships
-		SET
-			deleted_at = current_timestamp
+// selectOrganizationRollup counts the tasks of the organization and all its
+// subsidiaries into the Related counters and sums the values of the open and
+// won ones by currency
+func selectOrganizationRollup(model *Organization) error {
+	rows, err := db.Query(`
+		WITH RECURSIVE subsidiaries(id) AS (
+			SELECT $1::uuid
+		UNION
+			SELECT
+				organization_relationships.rel_linked_org_id
+			FROM
+				organization_relationships
+			INNER JOIN
+				subsidiaries ON subsidiaries.id = organization_relationships.rel_owner_org_id
+			INNER JOIN
+				organizations ON organizations.id = organization_relationships.rel_linked_org_id
+			WHERE
+				organization_relationships.type = 'parent'
+			AND
+				organization_relationships.deleted_at IS NULL
+			AND
+				organizations.deleted_at IS NULL
+		)
+		SELECT
+			tasks.currency,
+			count(1) filter (where tasks.won_time is null and tasks.lost_time is null),
+			count(1) filter (where tasks.won_time is not null or tasks.lost_time is not null),
+			count(1) filter (where tasks.won_time is not null),
+			count(1) filter (where tasks.lost_time is not null),
+			coalesce(sum(tasks.value) filter (where tasks.won_time is null and tasks.lost_time is null), 0),
+			coalesce(sum(tasks.value) filter (where tasks.won_time is not null), 0)
+		FROM
+			tasks
+		INNER JOIN
+			subsidiaries ON subsidiaries.id = tasks.org_id
 		WHERE
-			id = $1
+			tasks.deleted_at IS NULL
+		GROUP BY
+			tasks.currency
 	`,
 		model.ID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	model.RelatedOpenTasksCount = 0
+	model.RelatedClosedTasksCount = 0
+	model.RelatedWonTasksCount = 0
+	model.RelatedLostTasksCount = 0
+	model.RelatedOpenTasksValues = make(map[string]int)
+	model.RelatedWonTasksValues = make(map[string]int)
+	for rows.Next() {
+		var currency sql.NullString
+		var open, closed, won, lost, openValue, wonValue int
+		if err := rows.Scan(
+			&currency,
+			&open,
+			&closed,
+			&won,
+			&lost,
+			&openValue,
+			&wonValue,
+		); err != nil {
+			return err
+		}
+		model.RelatedOpenTasksCount += open
+		model.RelatedClosedTasksCount += closed
+		model.RelatedWonTasksCount += won
+		model.RelatedLostTasksCount += lost
+		if openValue != 0 {
+			model.RelatedOpenTasksValues[currency.String] += openValue
+		}
+		if wonValue != 0 {
+			model.RelatedWonTasksValues[currency.String] += wonValue
+		}
+	}
+	return rows.Err()
 }
 
 func insertProduct(model *Product) error {
+	if model.Name == "" {
+		return errors.New("Please enter a name")
+	}
+	if err := validateCustomFieldsFor("product", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
+	}
+
 	row := db.QueryRow(`
 		INSERT INTO products(
 			company_id,
@@ -3907,6 +7755,7 @@ func insertProduct(model *Product) error {
 			first_char,
 			visible_to,
 			owner_id,
+			custom_fields,
 		    created_at
 		)
 		VALUES(
@@ -3919,9 +7768,12 @@ func insertProduct(model *Product) error {
 			$7,
 			$8,
 			$9,
+			$10,
 			current_timestamp
 		)
-		RETURNING id
+		RETURNING
+			id,
+			created_at
 	`,
 		model.CompanyID,
 		model.Name,
@@ -3931,12 +7783,23 @@ func insertProduct(model *Product) error {
 		model.Selectable,
 		model.FirstChar,
 		model.VisibleTo,
-		model.OwnerID,
+		maybeNull(model.OwnerID),
+		model.CustomFields,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.CreatedAt,
 	)
-	return row.Scan(&model.ID)
 }
 
 func updateProduct(model Product) error {
+	if model.Name == "" {
+		return errors.New("Please enter a name")
+	}
+	if err := validateCustomFieldsFor("product", &model.CustomFields, model.CompanyID, model.ID, true); err != nil {
+		return err
+	}
+
 	_, err := db.Exec(`
 		UPDATE
 			products
@@ -3949,9 +7812,10 @@ func updateProduct(model Product) error {
 			first_char = $6,
 			visible_to = $7,
 			owner_id = $8,
+			custom_fields = $9,
 			updated_at = current_timestamp
 		WHERE
-			id = $9
+			id = $10
 	`,
 		model.Name,
 		model.Code,
@@ -3960,7 +7824,8 @@ func updateProduct(model Product) error {
 		model.Selectable,
 		model.FirstChar,
 		model.VisibleTo,
-		model.OwnerID,
+		maybeNull(model.OwnerID),
+		model.CustomFields,
 		model.ID,
 	)
 	return err
@@ -3980,6 +7845,111 @@ func deleteProduct(model Product) error {
 	return err
 }
 
+func selectProductsByCompany(companyID string) ([]Product, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			code,
+			unit,
+			tax,
+			selectable,
+			first_char,
+			visible_to,
+			owner_id,
+			custom_fields,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			products
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			name
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Product
+	for rows.Next() {
+		model, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
+}
+
+func selectProductByID(ID string) (*Product, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			code,
+			unit,
+			tax,
+			selectable,
+			first_char,
+			visible_to,
+			owner_id,
+			custom_fields,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			products
+		WHERE
+			deleted_at IS NULL
+		AND
+			id = $1
+	`,
+		ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanProduct(rows)
+}
+
+func scanProduct(rows *sql.Rows) (*Product, error) {
+	var model Product
+	var ownerID sql.NullString
+	err := rows.Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.Code,
+		&model.Unit,
+		&model.Tax,
+		&model.Selectable,
+		&model.FirstChar,
+		&model.VisibleTo,
+		&ownerID,
+		&model.CustomFields,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	model.OwnerID = ownerID.String
+	return &model, nil
+}
+
 func insertPrice(model *Price) error {
 	row := db.QueryRow(`
 		INSERT INTO prices(
@@ -4048,6 +8018,15 @@ func deletePrice(model Price) error {
 }
 
 func insertProductField(model *ProductField) error {
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("product_fields", model.CompanyID, model.Key, ""); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
 	row := db.QueryRow(`
 		INSERT INTO product_fields(
 		   	company_id,
@@ -4107,7 +8086,27 @@ func insertProductField(model *ProductField) error {
 }
 
 func updateProductField(model ProductField) error {
-	_, err := db.Exec(`
+	if err := validateCustomFieldDefinition(model.Name, &model.Key, model.FieldType, model.PicklistData); err != nil {
+		return err
+	}
+	if used, err := customFieldKeyInUse("product_fields", model.CompanyID, model.Key, model.ID); err != nil {
+		return err
+	} else if used {
+		return errors.New("A field with this key already exists")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldKey, err := lockCustomFieldKey(tx, "product_fields", model.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
 		UPDATE
 			product_fields
 		SET
@@ -4145,21 +8144,165 @@ func updateProductField(model ProductField) error {
 		model.MandatoryFlag,
 		model.ID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if err := renameCustomFieldKey(tx, "products", model.CompanyID, oldKey, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteProductField deletes the field and its values on the products
+func deleteProductField(model ProductField) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE
+			product_fields
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := removeCustomFieldKey(tx, "products", model.CompanyID, model.Key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func selectProductFieldsByCompany(companyID string) ([]ProductField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			use_field,
+			link,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			product_fields
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			order_nr, created_at
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []ProductField
+	for rows.Next() {
+		model, err := scanProductField(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *model)
+	}
+	return result, rows.Err()
 }
 
-func deleteProductField(model ProductField) error {
-	_, err := db.Exec(`
-		UPDATE
+func selectProductFieldByID(ID string) (*ProductField, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			name,
+			key,
+			order_nr,
+			picklist_data,
+			field_type,
+			edit_flag,
+			index_visible_flag,
+			details_visible_flag,
+			add_visible_flag,
+			important_flag,
+			bulk_edit_allowed,
+			use_field,
+			link,
+			mandatory_flag,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
 			product_fields
-		SET
-			deleted_at = current_timestamp
 		WHERE
+			deleted_at IS NULL
+		AND
 			id = $1
 	`,
-		model.ID,
+		ID,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanProductField(rows)
+}
+
+func scanProductField(rows *sql.Rows) (*ProductField, error) {
+	var model ProductField
+	err := rows.Scan(
+		&model.ID,
+		&model.CompanyID,
+		&model.Name,
+		&model.Key,
+		&model.OrderNr,
+		&model.PicklistData,
+		&model.FieldType,
+		&model.EditFlag,
+		&model.IndexVisibleFlag,
+		&model.DetailsVisibleFlag,
+		&model.AddVisibleFlag,
+		&model.ImportantFlag,
+		&model.BulkEditAllowed,
+		&model.UseField,
+		&model.Link,
+		&model.MandatoryFlag,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
 }
 
 func undelete(model DeletedObject) error {
@@ -4206,7 +8349,11 @@ func undelete(model DeletedObject) error {
 }
 
 func insertTimeline(model *Timeline) error {
-	row := db.QueryRow(`
+	return insertTimelineWith(db, model)
+}
+
+func insertTimelineWith(ex execer, model *Timeline) error {
+	row := ex.QueryRow(`
 		INSERT INTO timeline(
 		   	user_id,
 		   	under_company_id,
@@ -4238,6 +8385,7 @@ func insertTimeline(model *Timeline) error {
 			task_id,
 			workflow_id,
 			time_entry_id,
+			lost_reason_id,
 			action,
 		    created_at
 		)
@@ -4273,6 +8421,7 @@ func insertTimeline(model *Timeline) error {
 			$29,
 			$30,
 			$31,
+			$32,
 			current_timestamp
 		)
 		RETURNING id
@@ -4307,11 +8456,56 @@ func insertTimeline(model *Timeline) error {
 		maybeNull(model.TaskID),
 		maybeNull(model.WorkflowID),
 		maybeNull(model.TimeEntryID),
+		maybeNull(model.LostReasonID),
 		model.Action,
 	)
 	return row.Scan(&model.ID)
 }
 
+// claimSentEmail records that the e-mail identified by key is about to be sent.
+// It returns false if the e-mail has already been claimed, possibly by
+// another app instance, so scheduled e-mails go out only once.
+func claimSentEmail(key, userID string) (bool, error) {
+	var ID string
+	err := db.QueryRow(`
+		INSERT INTO sent_emails(
+			key,
+			user_id,
+			created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			current_timestamp
+		)
+		ON CONFLICT (key) DO NOTHING
+		RETURNING id
+	`,
+		key,
+		maybeNull(userID),
+	).Scan(&ID)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseSentEmail drops a claim so that a failed e-mail is retried.
+func releaseSentEmail(key string) error {
+	_, err := db.Exec(`
+		DELETE FROM
+			sent_emails
+		WHERE
+			key = $1
+	`,
+		key,
+	)
+	return err
+}
+
 func maybeNull(ID string) *string {
 	if ID == "" {
 		return nil
@@ -4524,6 +8718,73 @@ func selectCompanyUsersByCompany(companyID string) ([]CompanyUser, error) {
 	return scanCompanyUsers(rows)
 }
 
+// selectUserLocations returns the timezones of the users of the company by
+// user ID, recurring activities are followed in the one of their assignee
+func selectUserLocations(companyID string) (map[string]*time.Location, error) {
+	rows, err := db.Query(`
+		SELECT
+			users.id,
+			users.timezone_name
+		FROM
+			company_users
+		INNER JOIN
+			users ON users.id = company_users.user_id
+		WHERE
+			company_users.deleted_at IS NULL
+		AND
+			company_users.company_id = $1
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]*time.Location)
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.TimezoneName); err != nil {
+			return nil, err
+		}
+		result[user.ID] = userLocation(user)
+	}
+	return result, rows.Err()
+}
+
+// selectAgendaDigestRecipients returns the company users that get the
+// morning agenda e-mail
+func selectAgendaDigestRecipients() ([]CompanyUser, error) {
+	rows, err := db.Query(`
+		SELECT
+			company_users.id,
+			company_users.user_id,
+			company_users.is_admin,
+			company_users.company_id,
+		    company_users.created_at,
+		    company_users.updated_at,
+		    company_users.deleted_at,
+		    users.email,
+		    users.name
+		FROM
+			company_users
+		JOIN
+			users ON users.id = company_users.user_id
+		WHERE
+			company_users.deleted_at IS NULL
+		AND
+			users.deleted_at IS NULL
+		AND
+			users.agenda_digest_off = false
+		ORDER BY
+			company_users.company_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanCompanyUsers(rows)
+}
+
 func scanCompanyUsers(rows *sql.Rows) ([]CompanyUser, error) {
 	defer rows.Close()
 
@@ -4562,8 +8823,13 @@ func selectTaskByID(TaskID string) (*Task, error) {
 	var personName sql.NullString
 	var orgID sql.NullString
 	var orgName sql.NullString
+	var lostReasonID sql.NullString
 	var ownerName sql.NullString
 	var nextActivityID sql.NullString
+	var probability sql.NullInt64
+	var stageProbability sql.NullInt64
+	var decimalPoints sql.NullInt64
+	var currencySymbol sql.NullString
 
 	err := db.QueryRow(`
 		SELECT
@@ -4579,6 +8845,7 @@ func selectTaskByID(TaskID string) (*Task, error) {
 			tasks.stage_change_time,
 			tasks.status,
 			tasks.lost_reason,
+			tasks.lost_reason_id,
 			tasks.visible_to,
 			tasks.close_time,
 			tasks.workflow_id,
@@ -4588,7 +8855,13 @@ func selectTaskByID(TaskID string) (*Task, error) {
 			tasks.expected_close_date,
 			tasks.stage_order_nr,
 			tasks.formatted_value,
-			tasks.rotten_time,
+			(
+				case when stages.rotten_flag
+				and tasks.won_time is null
+				and tasks.lost_time is null
+				then tasks.stage_change_time + stages.rotten_days * interval '1 day'
+				end
+			) as rotten_time,
 			tasks.weighted_value,
 			tasks.formatted_weighted_value,
 			tasks.cc_email,
@@ -4617,7 +8890,26 @@ func selectTaskByID(TaskID string) (*Task, error) {
 		   		order by activities.due_date asc
 		   		limit 1
 		   	) as next_activity_id,
-		   	tasks.company_id
+		   	tasks.company_id,
+		   	tasks.probability,
+		   	tasks.custom_fields,
+		   	stages.task_probability,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
 		FROM
 			tasks
 		LEFT OUTER JOIN
@@ -4645,6 +8937,7 @@ func selectTaskByID(TaskID string) (*Task, error) {
 		&model.StageChangeTime,
 		&model.Status,
 		&model.LostReason,
+		&lostReasonID,
 		&model.VisibleTo,
 		&model.CloseTime,
 		&model.WorkflowID,
@@ -4670,6 +8963,11 @@ func selectTaskByID(TaskID string) (*Task, error) {
 		&model.NextActivityDate,
 		&nextActivityID,
 		&model.CompanyID,
+		&probability,
+		&model.CustomFields,
+		&stageProbability,
+		&decimalPoints,
+		&currencySymbol,
 	)
 	if err != nil {
 		return nil, err
@@ -4679,8 +8977,16 @@ func selectTaskByID(TaskID string) (*Task, error) {
 	model.PersonName = personName.String
 	model.OrgID = orgID.String
 	model.OrgName = orgName.String
+	model.LostReasonID = lostReasonID.String
 	model.OwnerName = ownerName.String
 	model.NextActivityID = nextActivityID.String
+	if probability.Valid {
+		p := int(probability.Int64)
+		model.Probability = &p
+	}
+	model.StageProbability = int(stageProbability.Int64)
+	model.DetectRotten()
+	model.CalculateValues(int(decimalPoints.Int64), currencySymbol.String)
 
 	return &model, nil
 }
@@ -4768,6 +9074,7 @@ func selectTimelineByCompany(companyID string) ([]Timeline, error) {
 			timeline.task_id,
 			timeline.workflow_id,
 			timeline.time_entry_id,
+			timeline.lost_reason_id,
 			timeline.action,
 		    timeline.created_at,
 		    (case when users.name = '' then users.email else users.name end) as user_name
@@ -4817,6 +9124,7 @@ func selectTimelineByCompany(companyID string) ([]Timeline, error) {
 		var taskID sql.NullString
 		var workflowID sql.NullString
 		var timeEntryID sql.NullString
+		var lostReasonID sql.NullString
 		var userName sql.NullString
 
 		err = rows.Scan(
@@ -4851,6 +9159,7 @@ func selectTimelineByCompany(companyID string) ([]Timeline, error) {
 			&taskID,
 			&workflowID,
 			&timeEntryID,
+			&lostReasonID,
 			&model.Action,
 			&model.CreatedAt,
 			&userName,
@@ -4886,6 +9195,7 @@ func selectTimelineByCompany(companyID string) ([]Timeline, error) {
 		model.TaskID = taskID.String
 		model.WorkflowID = workflowID.String
 		model.TimeEntryID = timeEntryID.String
+		model.LostReasonID = lostReasonID.String
 		model.UserName = userName.String
 
 		result = append(result, model)
@@ -4980,6 +9290,15 @@ func selectActivitiesByTask(taskID string) ([]Activity, error) {
 			activities.person_id,
 			activities.assigned_to_user_id,
 			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
 		    activities.created_at,
 		    activities.updated_at,
 		    activities.deleted_at,
@@ -4990,17 +9309,19 @@ func selectActivitiesByTask(taskID string) ([]Activity, error) {
 		    activities.type_id,
 		    activity_types.name as type,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_email,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_phone,
 		   	assigned_users.name as assigned_to_user_name
@@ -5050,6 +9371,15 @@ func selectActivitiesByPerson(personID string) ([]Activity, error) {
 			activities.person_id,
 			activities.assigned_to_user_id,
 			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
 		    activities.created_at,
 		    activities.updated_at,
 		    activities.deleted_at,
@@ -5060,17 +9390,19 @@ func selectActivitiesByPerson(personID string) ([]Activity, error) {
 		    activities.type_id,
 		    activity_types.name as type,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_email,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_phone,
 		   	assigned_users.name as assigned_to_user_name
@@ -5126,6 +9458,10 @@ func selectOrganizationByID(orgID string) (*Organization, error) {
 			organizations.address_admin_area_level_2,
 			organizations.address_country,
 			organizations.address_postal_code,
+			organizations.address_formatted_address,
+			organizations.address_latitude,
+			organizations.address_longitude,
+			organizations.custom_fields,
 			organizations.category_id,
 			organizations.first_char,
 			organizations.visible_to,
@@ -5194,6 +9530,10 @@ func selectOrganizationByID(orgID string) (*Organization, error) {
 		&model.AddressAdminAreaLevel2,
 		&model.AddressCountry,
 		&model.AddressPostalCode,
+		&model.AddressFormattedAddress,
+		&model.Latitude,
+		&model.Longitude,
+		&model.CustomFields,
 		&categoryID,
 		&model.FirstChar,
 		&model.VisibleTo,
@@ -5240,6 +9580,7 @@ func selectPersonByID(personID string) (*Person, error) {
 			persons.owner_id,
 			persons.org_id,
 			persons.first_name,
+			persons.custom_fields,
 		    persons.created_at,
 		    persons.updated_at,
 		    persons.deleted_at,
@@ -5275,17 +9616,19 @@ func selectPersonByID(personID string) (*Person, error) {
 		   		limit 1
 		   	) as next_activity_id,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as email,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as phone,
 		   	organizations.name AS org_name
@@ -5308,6 +9651,7 @@ func selectPersonByID(personID string) (*Person, error) {
 		&model.OwnerID,
 		&orgID,
 		&model.FirstName,
+		&model.CustomFields,
 		&model.CreatedAt,
 		&model.UpdatedAt,
 		&model.DeletedAt,
@@ -5335,6 +9679,11 @@ func selectPersonByID(personID string) (*Person, error) {
 	model.Phone = phone.String
 	model.OrgName = orgName.String
 
+	model.Contacts, err = selectContactsByPerson(model.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &model, nil
 }
 
@@ -5342,6 +9691,7 @@ func selectActivityByID(activityID string) (*Activity, error) {
 	var model Activity
 
 	var TaskID sql.NullString
+	var seriesID sql.NullString
 	var orgID sql.NullString
 	var personID sql.NullString
 	var assignedToUserID sql.NullString
@@ -5373,6 +9723,15 @@ func selectActivityByID(activityID string) (*Activity, error) {
 			activities.person_id,
 			activities.assigned_to_user_id,
 			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
 		    activities.created_at,
 		    activities.updated_at,
 		    activities.deleted_at,
@@ -5383,17 +9742,19 @@ func selectActivityByID(activityID string) (*Activity, error) {
 		    activities.type_id,
 		    activity_types.name as type,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_email,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_phone,
 		   	assigned_users.name as assigned_to_user_name
@@ -5433,6 +9794,15 @@ func selectActivityByID(activityID string) (*Activity, error) {
 		&personID,
 		&assignedToUserID,
 		&createdByUserID,
+		&model.CustomFields,
+		&model.RecurrenceRule,
+		&model.RecurrenceStart,
+		&model.RecurrenceIndex,
+		&seriesID,
+		&model.ReminderMinutes,
+		&model.ReminderOff,
+		&model.SnoozedUntil,
+		&model.AllDay,
 		&model.CreatedAt,
 		&model.UpdatedAt,
 		&model.DeletedAt,
@@ -5455,6 +9825,7 @@ func selectActivityByID(activityID string) (*Activity, error) {
 	}
 
 	model.TaskID = TaskID.String
+	model.SeriesID = seriesID.String
 	model.OrgID = orgID.String
 	model.PersonID = personID.String
 	model.AssignedToUserID = assignedToUserID.String
@@ -5479,6 +9850,7 @@ func scanActivities(rows *sql.Rows) ([]Activity, error) {
 		var model Activity
 
 		var taskID sql.NullString
+		var seriesID sql.NullString
 		var orgID sql.NullString
 		var personID sql.NullString
 		var assignedToUserID sql.NullString
@@ -5509,6 +9881,15 @@ func scanActivities(rows *sql.Rows) ([]Activity, error) {
 			&personID,
 			&assignedToUserID,
 			&createdByUserID,
+			&model.CustomFields,
+			&model.RecurrenceRule,
+			&model.RecurrenceStart,
+			&model.RecurrenceIndex,
+			&seriesID,
+			&model.ReminderMinutes,
+			&model.ReminderOff,
+			&model.SnoozedUntil,
+			&model.AllDay,
 			&model.CreatedAt,
 			&model.UpdatedAt,
 			&model.DeletedAt,
@@ -5526,6 +9907,7 @@ func scanActivities(rows *sql.Rows) ([]Activity, error) {
 		}
 
 		model.TaskID = taskID.String
+		model.SeriesID = seriesID.String
 		model.OrgID = orgID.String
 		model.PersonID = personID.String
 		model.AssignedToUserID = assignedToUserID.String
@@ -5596,6 +9978,7 @@ func selectTasksByOrganization(orgID string) ([]Task, error) {
 			tasks.stage_change_time,
 			tasks.status,
 			tasks.lost_reason,
+			tasks.lost_reason_id,
 			tasks.visible_to,
 			tasks.close_time,
 			tasks.workflow_id,
@@ -5605,7 +9988,13 @@ func selectTasksByOrganization(orgID string) ([]Task, error) {
 			tasks.expected_close_date,
 			tasks.stage_order_nr,
 			tasks.formatted_value,
-			tasks.rotten_time,
+			(
+				case when stages.rotten_flag
+				and tasks.won_time is null
+				and tasks.lost_time is null
+				then tasks.stage_change_time + stages.rotten_days * interval '1 day'
+				end
+			) as rotten_time,
 			tasks.weighted_value,
 			tasks.formatted_weighted_value,
 			tasks.cc_email,
@@ -5619,47 +10008,242 @@ func selectTasksByOrganization(orgID string) ([]Task, error) {
 		   	organizations.name as org_name,
 		   	stages.name as stage_name,
 		   	(
-		   		select activities.due_date
-		   		from activities
-		   		where activities.task_id = tasks.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_date,
+		   		select activities.due_date
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_date,
+		   	(
+		   		select activities.id
+		   		from activities
+		   		where activities.task_id = tasks.id
+		   		and activities.deleted_at is null
+		   		order by activities.due_date asc
+		   		limit 1
+		   	) as next_activity_id,
+		   	tasks.company_id,
+		   	tasks.probability,
+		   	tasks.custom_fields,
+		   	stages.task_probability,
+		   	(
+		   		select currencies.decimal_points
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_decimal_points,
+		   	(
+		   		select currencies.symbol
+		   		from currencies
+		   		where currencies.company_id = tasks.company_id
+		   		and currencies.code = tasks.currency
+		   		and currencies.deleted_at is null
+		   		limit 1
+		   	) as currency_symbol
+		FROM
+			tasks
+		LEFT OUTER JOIN
+			users ON users.id = tasks.user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = tasks.person_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = tasks.org_id
+		LEFT OUTER JOIN
+			stages ON stages.id = tasks.stage_id
+		WHERE
+			tasks.deleted_at IS NULL
+		AND
+			tasks.org_id = $1
+	`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTasks(rows)
+}
+
+func selectActivitiesByOrganization(orgID string) ([]Activity, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	activities.id,
+		   	activities.name,
+			activities.company_id,
+			activities.user_id,
+			activities.done,
+			activities.reference_type,
+			activities.reference_id,
+			activities.due_date,
+			activities.duration,
+			activities.marked_as_done_time,
+			activities.task_id,
+			activities.org_id,
+			activities.person_id,
+			activities.assigned_to_user_id,
+			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
+		    activities.created_at,
+		    activities.updated_at,
+		    activities.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as user_name,
+		    persons.name as person_name,
+		    tasks.name as task_name,
+		    organizations.name as org_name,
+		    activities.type_id,
+		    activity_types.name as type,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as person_email,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as person_phone,
+		   	assigned_users.name as assigned_to_user_name
+		FROM
+			activities
+		LEFT OUTER JOIN
+			users ON users.id = activities.user_id
+		LEFT OUTER JOIN
+			users AS assigned_users ON assigned_users.id = activities.assigned_to_user_id
+		LEFT OUTER JOIN
+			persons ON persons.id = activities.person_id
+		LEFT OUTER JOIN
+			tasks ON tasks.id = activities.task_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = activities.org_id
+		LEFT OUTER JOIN
+			activity_types ON activity_types.id = activities.type_id
+		WHERE
+			activities.deleted_at IS NULL
+		AND
+			activities.org_id = $1
+	`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanActivities(rows)
+}
+
+// selectUpcomingActivitiesByCompany returns the activities linked to an
+// organization that are not done and are due from since on, soonest first
+func selectUpcomingActivitiesByCompany(companyID string, since time.Time) ([]Activity, error) {
+	rows, err := db.Query(`
+		SELECT
+		   	activities.id,
+		   	activities.name,
+			activities.company_id,
+			activities.user_id,
+			activities.done,
+			activities.reference_type,
+			activities.reference_id,
+			activities.due_date,
+			activities.duration,
+			activities.marked_as_done_time,
+			activities.task_id,
+			activities.org_id,
+			activities.person_id,
+			activities.assigned_to_user_id,
+			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
+		    activities.created_at,
+		    activities.updated_at,
+		    activities.deleted_at,
+		    (case when users.name = '' then users.email else users.name end) as user_name,
+		    persons.name as person_name,
+		    tasks.name as task_name,
+		    organizations.name as org_name,
+		    activities.type_id,
+		    activity_types.name as type,
+		   	(
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as person_email,
 		   	(
-		   		select activities.id
-		   		from activities
-		   		where activities.task_id = tasks.id
-		   		and activities.deleted_at is null
-		   		order by activities.due_date asc
-		   		limit 1
-		   	) as next_activity_id,
-		   	tasks.company_id
+		   		select contacts.name
+		   		from contacts
+		   		where contacts.person_id = persons.id
+		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
+		   		and contacts.deleted_at is null
+		   	) as person_phone,
+		   	assigned_users.name as assigned_to_user_name
 		FROM
-			tasks
+			activities
 		LEFT OUTER JOIN
-			users ON users.id = tasks.user_id
+			users ON users.id = activities.user_id
 		LEFT OUTER JOIN
-			persons ON persons.id = tasks.person_id
+			users AS assigned_users ON assigned_users.id = activities.assigned_to_user_id
 		LEFT OUTER JOIN
-			organizations ON organizations.id = tasks.org_id
+			persons ON persons.id = activities.person_id
 		LEFT OUTER JOIN
-			stages ON stages.id = tasks.stage_id
+			tasks ON tasks.id = activities.task_id
+		LEFT OUTER JOIN
+			organizations ON organizations.id = activities.org_id
+		LEFT OUTER JOIN
+			activity_types ON activity_types.id = activities.type_id
 		WHERE
-			tasks.deleted_at IS NULL
+			activities.deleted_at IS NULL
 		AND
-			tasks.org_id = $1
+			activities.company_id = $1
+		AND
+			activities.org_id IS NOT NULL
+		AND
+			activities.done = false
+		AND
+			activities.due_date >= $2
+		ORDER BY
+			activities.due_date
 	`,
-		orgID,
+		companyID,
+		since,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return scanTasks(rows)
+	return scanActivities(rows)
 }
 
-func selectActivitiesByOrganization(orgID string) ([]Activity, error) {
+// selectActivitiesToRemind returns the undone activities that may need a
+// reminder: due until the given time and due or snoozed from since on.
+// All-day activities are due up to a day later in the timezones west of UTC.
+func selectActivitiesToRemind(since, until time.Time) ([]Activity, error) {
 	rows, err := db.Query(`
 		SELECT
 		   	activities.id,
@@ -5677,6 +10261,15 @@ func selectActivitiesByOrganization(orgID string) ([]Activity, error) {
 			activities.person_id,
 			activities.assigned_to_user_id,
 			activities.created_by_user_id,
+			activities.custom_fields,
+			activities.recurrence_rule,
+			activities.recurrence_start,
+			activities.recurrence_index,
+			activities.series_id,
+			activities.reminder_minutes,
+			activities.reminder_off,
+			activities.snoozed_until,
+			activities.all_day,
 		    activities.created_at,
 		    activities.updated_at,
 		    activities.deleted_at,
@@ -5687,17 +10280,19 @@ func selectActivitiesByOrganization(orgID string) ([]Activity, error) {
 		    activities.type_id,
 		    activity_types.name as type,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'email'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_email,
 		   	(
-		   		select string_agg(contacts.name, ', ')
+		   		select contacts.name
 		   		from contacts
 		   		where contacts.person_id = persons.id
 		   		and contacts.type = 'phone'
+		   		and contacts.primary_contact
 		   		and contacts.deleted_at is null
 		   	) as person_phone,
 		   	assigned_users.name as assigned_to_user_name
@@ -5718,9 +10313,24 @@ func selectActivitiesByOrganization(orgID string) ([]Activity, error) {
 		WHERE
 			activities.deleted_at IS NULL
 		AND
-			activities.org_id = $1
+			activities.done = false
+		AND
+			activities.reminder_off = false
+		AND
+			activities.due_date <= $2
+		AND
+			(
+				activities.due_date >= $1
+			OR
+				activities.snoozed_until >= $1
+			OR
+				(activities.all_day AND activities.due_date + interval '1 day' >= $1)
+			)
+		ORDER BY
+			activities.due_date
 	`,
-		orgID,
+		since,
+		until,
 	)
 	if err != nil {
 		return nil, err
@@ -6103,52 +10713,427 @@ func selectDeletedObjectsByCompany(companyID string) ([]DeletedObject, error) {
 			    tasks.updated_at,
 			    tasks.deleted_at
 			FROM
-				tasks
+				tasks
+			WHERE
+				tasks.deleted_at IS NOT NULL
+			and
+				tasks.company_id = $1
+		)		
+		UNION
+		(
+			SELECT
+				'prices',
+				prices.id,
+				products.name,
+			    prices.created_at,
+			    prices.updated_at,
+			    prices.deleted_at
+			FROM
+				prices
+			LEFT OUTER JOIN 
+				products on products.id = prices.product_id
+			WHERE
+				prices.deleted_at IS NOT NULL
+			and
+				products.company_id = $1
+		)		
+		ORDER BY
+			deleted_at DESC
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []DeletedObject
+	for rows.Next() {
+		var model DeletedObject
+
+		err = rows.Scan(
+			&model.Type,
+			&model.ID,
+			&model.Name,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func stopRunningTimeEntries(userID string) error {
+	_, err := db.Exec(`
+		UPDATE
+			time_entries
+		SET
+			finished_at = current_timestamp
+		WHERE
+			user_id = $1
+		AND
+			finished_at IS NULL
+		AND
+			deleted_at IS NULL
+	`,
+		userID,
+	)
+	return err
+}
+
+func insertTimeEntry(model *TimeEntry) error {
+	if nil == model.FinishedAt {
+		if err := stopRunningTimeEntries(model.UserID); err != nil {
+			return err
+		}
+	}
+
+	row := db.QueryRow(`
+		INSERT INTO time_entries(
+			user_id,
+			company_id,
+			task_id,
+			activity_id,
+			started_at,
+			finished_at,
+			name,
+			created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			current_timestamp
+		)
+		RETURNING id
+	`,
+		model.UserID,
+		model.CompanyID,
+		maybeNull(model.TaskID),
+		maybeNull(model.ActivityID),
+		model.StartedAt,
+		model.FinishedAt,
+		model.Name,
+	)
+	return row.Scan(&model.ID)
+}
+
+func updateTimeEntry(model TimeEntry) error {
+	_, err := db.Exec(`
+		UPDATE
+			time_entries
+		SET
+			task_id = $1,
+			activity_id = $2,
+			started_at = $3,
+			finished_at = $4,
+			name = $5,
+			updated_at = current_timestamp
+		WHERE
+			id = $6
+	`,
+		maybeNull(model.TaskID),
+		maybeNull(model.ActivityID),
+		model.StartedAt,
+		model.FinishedAt,
+		model.Name,
+		model.ID,
+	)
+	return err
+}
+
+func deleteTimeEntry(timeEntryID string) error {
+	_, err := db.Exec(`
+		UPDATE
+			time_entries
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		timeEntryID,
+	)
+	return err
+}
+
+const selectTimeEntriesByUserAndCompanySQL = `
+		(
+			SELECT
+				time_entries.id,
+				time_entries.user_id,
+				time_entries.company_id,
+				time_entries.name,
+				time_entries.started_at,
+				time_entries.finished_at,
+				time_entries.task_id,
+				tasks.name as task_name,
+				time_entries.activity_id,
+				activities.name as activity_name,
+			    time_entries.created_at,
+			    time_entries.updated_at,
+			    time_entries.deleted_at
+			FROM
+				time_entries
+			LEFT OUTER JOIN
+				tasks on tasks.id = time_entries.task_id
+			LEFT OUTER JOIN
+				activities on activities.id = time_entries.activity_id
 			WHERE
-				tasks.deleted_at IS NOT NULL
-			and
-				tasks.company_id = $1
-		)		
+				time_entries.deleted_at IS NULL
+			AND
+				time_entries.user_id = $1
+			AND
+				time_entries.company_id = $2
+			AND
+				time_entries.finished_at IS NULL
+		)
+
 		UNION
+
 		(
 			SELECT
-				'prices',
-				prices.id,
-				products.name,
-			    prices.created_at,
-			    prices.updated_at,
-			    prices.deleted_at
+				time_entries.id,
+				time_entries.user_id,
+				time_entries.company_id,
+				time_entries.name,
+				time_entries.started_at,
+				time_entries.finished_at,
+				time_entries.task_id,
+				tasks.name as task_name,
+				time_entries.activity_id,
+				activities.name as activity_name,
+			    time_entries.created_at,
+			    time_entries.updated_at,
+			    time_entries.deleted_at
 			FROM
-				prices
-			LEFT OUTER JOIN 
-				products on products.id = prices.product_id
+				time_entries
+			LEFT OUTER JOIN
+				tasks on tasks.id = time_entries.task_id
+			LEFT OUTER JOIN
+				activities on activities.id = time_entries.activity_id
 			WHERE
-				prices.deleted_at IS NOT NULL
-			and
-				products.company_id = $1
-		)		
+				time_entries.deleted_at IS NULL
+			AND
+				time_entries.user_id = $1
+			AND
+				time_entries.company_id = $2
+			AND
+				time_entries.finished_at IS NOT NULL
+			%s
+		)
+
 		ORDER BY
-			deleted_at DESC
+			started_at
+	`
+
+func selectTimeEntriesByUserAndCompany(userID, companyID string, fromTime, untilTime *time.Time) ([]TimeEntry, error) {
+	var rows *sql.Rows
+	var err error
+	if fromTime != nil && untilTime != nil {
+		query := fmt.Sprintf(selectTimeEntriesByUserAndCompanySQL, `
+			AND time_entries.started_at >= $3 AND time_entries.started_at < $4`)
+		rows, err = db.Query(query, userID, companyID, fromTime, untilTime)
+	} else {
+		query := fmt.Sprintf(selectTimeEntriesByUserAndCompanySQL, ``)
+		rows, err = db.Query(query, userID, companyID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTimeEntries(rows)
+}
+
+func scanTimeEntries(rows *sql.Rows) ([]TimeEntry, error) {
+	defer rows.Close()
+
+	var result []TimeEntry
+
+	for rows.Next() {
+		var model TimeEntry
+
+		var taskID sql.NullString
+		var taskName sql.NullString
+		var activityID sql.NullString
+		var activityName sql.NullString
+
+		if err := rows.Scan(
+			&model.ID,
+			&model.UserID,
+			&model.CompanyID,
+			&model.Name,
+			&model.StartedAt,
+			&model.FinishedAt,
+			&taskID,
+			&taskName,
+			&activityID,
+			&activityName,
+			&model.CreatedAt,
+			&model.UpdatedAt,
+			&model.DeletedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		model.TaskID = taskID.String
+		model.TaskName = taskName.String
+		model.ActivityID = activityID.String
+		model.ActivityName = activityName.String
+
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func selectTimeEntryByID(ID string) (*TimeEntry, error) {
+	var model TimeEntry
+
+	var taskID sql.NullString
+	var taskName sql.NullString
+	var activityID sql.NullString
+	var activityName sql.NullString
+
+	err := db.QueryRow(`
+		SELECT
+			time_entries.id,
+			time_entries.user_id,
+			time_entries.company_id,
+			time_entries.name,
+			time_entries.started_at,
+			time_entries.finished_at,
+			time_entries.task_id,
+			tasks.name as task_name,
+			time_entries.activity_id,
+			activities.name as activity_name,
+		    time_entries.created_at,
+		    time_entries.updated_at,
+		    time_entries.deleted_at
+		FROM
+			time_entries
+		LEFT OUTER JOIN
+			tasks on tasks.id = time_entries.task_id
+		LEFT OUTER JOIN
+			activities on activities.id = time_entries.activity_id
+		WHERE
+			time_entries.id = $1
 	`,
-		companyID,
+		ID,
+	).Scan(
+		&model.ID,
+		&model.UserID,
+		&model.CompanyID,
+		&model.Name,
+		&model.StartedAt,
+		&model.FinishedAt,
+		&taskID,
+		&taskName,
+		&activityID,
+		&activityName,
+		&model.CreatedAt,
+		&model.UpdatedAt,
+		&model.DeletedAt,
+	)
+
+	model.TaskID = taskID.String
+	model.TaskName = taskName.String
+	model.ActivityID = activityID.String
+	model.ActivityName = activityName.String
+
+	return &model, err
+}
+
+func selectUserIDByApiToken(token string) (string, error) {
+	var result string
+	err := db.QueryRow(`
+		select
+			id
+		from
+			users
+		where
+			api_token is not null
+		and
+			api_token <> ''
+		and
+			api_token = $1
+		limit 1
+	`,
+		token,
+	).Scan(
+		&result,
+	)
+	return result, err
+}
+
+func insertUserEvent(model *UserEvent) error {
+	row := db.QueryRow(`
+		INSERT INTO user_events(
+			name,
+			user_id,
+			created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			current_timestamp
+		)
+		RETURNING id
+	`,
+		model.Name,
+		model.UserID,
+	)
+	return row.Scan(&model.ID)
+}
+
+func selectUserEventsByUser(userID string) ([]UserEvent, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			user_id,
+			name,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			user_events
+		WHERE
+			deleted_at IS NULL
+		AND
+			user_id = $1
+	`,
+		userID,
 	)
 	if err != nil {
 		return nil, err
 	}
+
+	return scanUserEvents(rows)
+}
+
+func scanUserEvents(rows *sql.Rows) ([]UserEvent, error) {
 	defer rows.Close()
-	var result []DeletedObject
+
+	var result []UserEvent
+
 	for rows.Next() {
-		var model DeletedObject
+		var model UserEvent
 
-		err = rows.Scan(
-			&model.Type,
+		if err := rows.Scan(
 			&model.ID,
+			&model.UserID,
 			&model.Name,
 			&model.CreatedAt,
 			&model.UpdatedAt,
 			&model.DeletedAt,
-		)
-		if err != nil {
+		); err != nil {
 			return nil, err
 		}
 
@@ -6157,40 +11142,28 @@ func selectDeletedObjectsByCompany(companyID string) ([]DeletedObject, error) {
 	return result, rows.Err()
 }
 
-func stopRunningTimeEntries(userID string) error {
-	_, err := db.Exec(`
-		UPDATE
-			time_entries
-		SET
-			finished_at = current_timestamp
-		WHERE
-			user_id = $1
-		AND
-			finished_at IS NULL
-		AND
-			deleted_at IS NULL
-	`,
-		userID,
-	)
-	return err
-}
+func insertImport(model *Import) error {
+	if model.Data == "" {
+		return errors.New("Please select a file to import")
+	}
+	if len(model.Mapping) == 0 {
+		return errors.New("Please map at least one column")
+	}
 
-func insertTimeEntry(model *TimeEntry) error {
-	if nil == model.FinishedAt {
-		if err := stopRunningTimeEntries(model.UserID); err != nil {
-			return err
-		}
+	mapping, err := json.Marshal(model.Mapping)
+	if err != nil {
+		return err
 	}
 
 	row := db.QueryRow(`
-		INSERT INTO time_entries(
-			user_id,
+		INSERT INTO imports(
 			company_id,
-			task_id,
-			activity_id,
-			started_at,
-			finished_at,
+			user_id,
+			workflow_id,
 			name,
+			mapping,
+			data,
+			status,
 			created_at
 		)
 		VALUES(
@@ -6200,334 +11173,599 @@ func insertTimeEntry(model *TimeEntry) error {
 			$4,
 			$5,
 			$6,
-			$7,
+			'pending',
 			current_timestamp
 		)
-		RETURNING id
+		RETURNING
+			id,
+			status,
+			created_at
 	`,
-		model.UserID,
 		model.CompanyID,
-		maybeNull(model.TaskID),
-		maybeNull(model.ActivityID),
-		model.StartedAt,
-		model.FinishedAt,
+		model.UserID,
+		maybeNull(model.WorkflowID),
 		model.Name,
+		string(mapping),
+		model.Data,
+	)
+	return row.Scan(
+		&model.ID,
+		&model.Status,
+		&model.CreatedAt,
 	)
-	return row.Scan(&model.ID)
 }
 
-func updateTimeEntry(model TimeEntry) error {
-	_, err := db.Exec(`
+// updateImportProgress saves the status, progress and errors of a running
+// import.
+func updateImportProgress(model Import) error {
+	return updateImportProgressWith(db, model)
+}
+
+func updateImportProgressWith(ex execer, model Import) error {
+	errs, err := json.Marshal(model.Errors)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(`
 		UPDATE
-			time_entries
+			imports
 		SET
-			task_id = $1,
-			activity_id = $2,
-			started_at = $3,
-			finished_at = $4,
-			name = $5,
+			status = $1,
+			total_rows = $2,
+			processed_rows = $3,
+			errors = $4,
+			finished_at = $5,
 			updated_at = current_timestamp
 		WHERE
 			id = $6
 	`,
-		maybeNull(model.TaskID),
-		maybeNull(model.ActivityID),
-		model.StartedAt,
+		model.Status,
+		model.TotalRows,
+		model.ProcessedRows,
+		string(errs),
 		model.FinishedAt,
-		model.Name,
 		model.ID,
 	)
 	return err
 }
 
-func deleteTimeEntry(timeEntryID string) error {
-	_, err := db.Exec(`
+// claimPendingImport marks the oldest pending import as running and returns
+// it, or nil if there is none. Imports left running by a stopped app
+// instance are claimed again after ten minutes without progress.
+func claimPendingImport() (*Import, error) {
+	var ID string
+	err := db.QueryRow(`
 		UPDATE
-			time_entries
+			imports
 		SET
-			deleted_at = current_timestamp
+			status = 'running',
+			updated_at = current_timestamp
 		WHERE
-			id = $1
+			id = (
+				select id
+				from imports
+				where deleted_at is null
+				and (
+					status = 'pending'
+					or (status = 'running' and updated_at < current_timestamp - interval '10 minutes')
+				)
+				order by created_at
+				limit 1
+				for update skip locked
+			)
+		RETURNING id
+	`).Scan(&ID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return selectImportByID(ID)
+}
+
+func insertImportRecord(ex execer, importID, recordType, recordID string) error {
+	_, err := ex.Exec(`
+		INSERT INTO import_records(
+			import_id,
+			record_type,
+			record_id,
+			created_at
+		)
+		VALUES(
+			$1,
+			$2,
+			$3,
+			current_timestamp
+		)
 	`,
-		timeEntryID,
+		importID,
+		recordType,
+		recordID,
 	)
 	return err
 }
 
-const selectTimeEntriesByUserAndCompanySQL = `
-		(
-			SELECT
-				time_entries.id,
-				time_entries.user_id,
-				time_entries.company_id,
-				time_entries.name,
-				time_entries.started_at,
-				time_entries.finished_at,
-				time_entries.task_id,
-				tasks.name as task_name,
-				time_entries.activity_id,
-				activities.name as activity_name,
-			    time_entries.created_at,
-			    time_entries.updated_at,
-			    time_entries.deleted_at
-			FROM
-				time_entries
-			LEFT OUTER JOIN
-				tasks on tasks.id = time_entries.task_id
-			LEFT OUTER JOIN
-				activities on activities.id = time_entries.activity_id
-			WHERE
-				time_entries.deleted_at IS NULL
-			AND
-				time_entries.user_id = $1
-			AND
-				time_entries.company_id = $2
-			AND
-				time_entries.finished_at IS NULL
-		)
-
-		UNION
+// revertImport deletes the tasks, contacts, persons and organizations the
+// import created, and the stages it created that have no other tasks.
+func revertImport(model Import) error {
+	if model.Status != "done" && model.Status != "failed" {
+		return errors.New("Please wait until the import has finished")
+	}
 
-		(
-			SELECT
-				time_entries.id,
-				time_entries.user_id,
-				time_entries.company_id,
-				time_entries.name,
-				time_entries.started_at,
-				time_entries.finished_at,
-				time_entries.task_id,
-				tasks.name as task_name,
-				time_entries.activity_id,
-				activities.name as activity_name,
-			    time_entries.created_at,
-			    time_entries.updated_at,
-			    time_entries.deleted_at
-			FROM
-				time_entries
-			LEFT OUTER JOIN
-				tasks on tasks.id = time_entries.task_id
-			LEFT OUTER JOIN
-				activities on activities.id = time_entries.activity_id
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, record := range [][2]string{
+		{"task", "tasks"},
+		{"contact", "contacts"},
+		{"person", "persons"},
+		{"organization", "organizations"},
+	} {
+		if _, err := tx.Exec(fmt.Sprintf(`
+			UPDATE
+				%s
+			SET
+				deleted_at = current_timestamp
 			WHERE
-				time_entries.deleted_at IS NULL
-			AND
-				time_entries.user_id = $1
-			AND
-				time_entries.company_id = $2
+				deleted_at IS NULL
 			AND
-				time_entries.finished_at IS NOT NULL
-			%s
-		)
-
-		ORDER BY
-			started_at
-	`
+				id IN (
+					select record_id
+					from import_records
+					where import_id = $1
+					and record_type = $2
+				)
+		`, record[1]),
+			model.ID,
+			record[0],
+		); err != nil {
+			return err
+		}
+	}
 
-func selectTimeEntriesByUserAndCompany(userID, companyID string, fromTime, untilTime *time.Time) ([]TimeEntry, error) {
-	var rows *sql.Rows
-	var err error
-	if fromTime != nil && untilTime != nil {
-		query := fmt.Sprintf(selectTimeEntriesByUserAndCompanySQL, `
-			AND time_entries.started_at >= $3 AND time_entries.started_at < $4`)
-		rows, err = db.Query(query, userID, companyID, fromTime, untilTime)
-	} else {
-		query := fmt.Sprintf(selectTimeEntriesByUserAndCompanySQL, ``)
-		rows, err = db.Query(query, userID, companyID)
+	if _, err := tx.Exec(`
+		UPDATE
+			stages
+		SET
+			deleted_at = current_timestamp
+		WHERE
+			deleted_at IS NULL
+		AND
+			id IN (
+				select record_id
+				from import_records
+				where import_id = $1
+				and record_type = 'stage'
+			)
+		AND
+			NOT EXISTS (
+				select 1
+				from tasks
+				where tasks.stage_id = stages.id
+				and tasks.deleted_at is null
+			)
+	`,
+		model.ID,
+	); err != nil {
+		return err
+	}
+	if model.WorkflowID != "" {
+		if err := renumberStages(tx, model.WorkflowID); err != nil {
+			return err
+		}
 	}
 
-	if err != nil {
-		return nil, err
+	if _, err := tx.Exec(`
+		UPDATE
+			imports
+		SET
+			status = 'reverted',
+			reverted_at = current_timestamp,
+			updated_at = current_timestamp
+		WHERE
+			id = $1
+	`,
+		model.ID,
+	); err != nil {
+		return err
 	}
 
-	return scanTimeEntries(rows)
+	return tx.Commit()
 }
 
-func scanTimeEntries(rows *sql.Rows) ([]TimeEntry, error) {
+func selectImportsByCompany(companyID string) ([]Import, error) {
+	rows, err := db.Query(`
+		SELECT
+			id,
+			company_id,
+			user_id,
+			workflow_id,
+			name,
+			mapping,
+			'' as data,
+			status,
+			total_rows,
+			processed_rows,
+			errors,
+			finished_at,
+			reverted_at,
+		    created_at,
+		    updated_at,
+		    deleted_at
+		FROM
+			imports
+		WHERE
+			deleted_at IS NULL
+		AND
+			company_id = $1
+		ORDER BY
+			created_at DESC
+	`,
+		companyID,
+	)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
-
-	var result []TimeEntry
-
+	var result []Import
 	for rows.Next() {
-		var model TimeEntry
-
-		var taskID sql.NullString
-		var taskName sql.NullString
-		var activityID sql.NullString
-		var activityName sql.NullString
-
-		if err := rows.Scan(
-			&model.ID,
-			&model.UserID,
-			&model.CompanyID,
-			&model.Name,
-			&model.StartedAt,
-			&model.FinishedAt,
-			&taskID,
-			&taskName,
-			&activityID,
-			&activityName,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
-		); err != nil {
+		model, err := scanImport(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		model.TaskID = taskID.String
-		model.TaskName = taskName.String
-		model.ActivityID = activityID.String
-		model.ActivityName = activityName.String
-
-		result = append(result, model)
+		result = append(result, *model)
 	}
 	return result, rows.Err()
 }
 
-func selectTimeEntryByID(ID string) (*TimeEntry, error) {
-	var model TimeEntry
-
-	var taskID sql.NullString
-	var taskName sql.NullString
-	var activityID sql.NullString
-	var activityName sql.NullString
-
-	err := db.QueryRow(`
+func selectImportByID(ID string) (*Import, error) {
+	rows, err := db.Query(`
 		SELECT
-			time_entries.id,
-			time_entries.user_id,
-			time_entries.company_id,
-			time_entries.name,
-			time_entries.started_at,
-			time_entries.finished_at,
-			time_entries.task_id,
-			tasks.name as task_name,
-			time_entries.activity_id,
-			activities.name as activity_name,
-		    time_entries.created_at,
-		    time_entries.updated_at,
-		    time_entries.deleted_at
+			id,
+			company_id,
+			user_id,
+			workflow_id,
+			name,
+			mapping,
+			data,
+			status,
+			total_rows,
+			processed_rows,
+			errors,
+			finished_at,
+			reverted_at,
+		    created_at,
+		    updated_at,
+		    deleted_at
 		FROM
-			time_entries
-		LEFT OUTER JOIN
-			tasks on tasks.id = time_entries.task_id
-		LEFT OUTER JOIN
-			activities on activities.id = time_entries.activity_id
+			imports
 		WHERE
-			time_entries.id = $1
+			deleted_at IS NULL
+		AND
+			id = $1
 	`,
 		ID,
-	).Scan(
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanImport(rows)
+}
+
+func scanImport(rows *sql.Rows) (*Import, error) {
+	var model Import
+	var workflowID sql.NullString
+	var mapping, errs []byte
+
+	if err := rows.Scan(
 		&model.ID,
-		&model.UserID,
 		&model.CompanyID,
+		&model.UserID,
+		&workflowID,
 		&model.Name,
-		&model.StartedAt,
+		&mapping,
+		&model.Data,
+		&model.Status,
+		&model.TotalRows,
+		&model.ProcessedRows,
+		&errs,
 		&model.FinishedAt,
-		&taskID,
-		&taskName,
-		&activityID,
-		&activityName,
+		&model.RevertedAt,
 		&model.CreatedAt,
 		&model.UpdatedAt,
 		&model.DeletedAt,
-	)
+	); err != nil {
+		return nil, err
+	}
 
-	model.TaskID = taskID.String
-	model.TaskName = taskName.String
-	model.ActivityID = activityID.String
-	model.ActivityName = activityName.String
+	if err := json.Unmarshal(mapping, &model.Mapping); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(errs, &model.Errors); err != nil {
+		return nil, err
+	}
+	model.WorkflowID = workflowID.String
 
-	return &model, err
+	return &model, nil
 }
 
-func selectUserIDByApiToken(token string) (string, error) {
-	var result string
-	err := db.QueryRow(`
-		select
-			id
-		from
-			users
-		where
-			api_token is not null
-		and
-			api_token <> ''
-		and
-			api_token = $1
-		limit 1
+// selectGeocodeCache returns the cached location of an address query.
+// cached is false when the query has not been looked up yet.
+func selectGeocodeCache(query string) (location *Location, cached bool, err error) {
+	var found bool
+	var b []byte
+
+	err = db.QueryRow(`
+		SELECT
+			found,
+			location
+		FROM
+			geocode_cache
+		WHERE
+			query = $1
 	`,
-		token,
+		query,
 	).Scan(
-		&result,
+		&found,
+		&b,
 	)
-	return result, err
-}
 
-func insertUserEvent(model *UserEvent) error {
-	row := db.QueryRow(`
-		INSERT INTO user_events(
-			name,
-			user_id,
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	case !found:
+		return nil, true, nil
+	case b == nil:
+		// cached before the address parts were stored
+		return nil, false, nil
+	}
+
+	location = &Location{}
+	if err := json.Unmarshal(b, location); err != nil {
+		return nil, false, err
+	}
+	return location, true, nil
+}
+
+// insertGeocodeCache caches the location of an address query, nil when the
+// address was not found
+func insertGeocodeCache(query string, location *Location) error {
+	var latitude, longitude, b interface{}
+	formattedAddress := ""
+	if location != nil {
+		latitude, longitude = location.Latitude, location.Longitude
+		formattedAddress = location.FormattedAddress
+		b = string(must(json.Marshal(location)))
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO geocode_cache(
+			query,
+			found,
+			latitude,
+			longitude,
+			formatted_address,
+			location,
 			created_at
 		)
 		VALUES(
 			$1,
 			$2,
+			$3,
+			$4,
+			$5,
+			$6,
 			current_timestamp
 		)
-		RETURNING id
-	`,
-		model.Name,
-		model.UserID,
+		ON CONFLICT (query) DO UPDATE SET
+			found = excluded.found,
+			latitude = excluded.latitude,
+			longitude = excluded.longitude,
+			formatted_address = excluded.formatted_address,
+			location = excluded.location,
+			created_at = excluded.created_at
+	`,
+		query,
+		location != nil,
+		latitude,
+		longitude,
+		formattedAddress,
+		b,
 	)
-	return row.Scan(&model.ID)
+	return err
 }
 
-func selectUserEventsByUser(userID string) ([]UserEvent, error) {
+// claimOrganizationsToGeocode leases at most limit organizations with a new
+// or changed address and returns their addresses. Organizations claimed by
+// another run are skipped until their lease of timeout has expired.
+func claimOrganizationsToGeocode(limit int, timeout time.Duration) ([]Organization, error) {
 	rows, err := db.Query(`
-		SELECT
-			id,
-			user_id,
-			name,
-		    created_at,
-		    updated_at,
-		    deleted_at
-		FROM
-			user_events
+		UPDATE
+			organizations
+		SET
+			address_geocode_claimed_at = current_timestamp
 		WHERE
-			deleted_at IS NULL
-		AND
-			user_id = $1
+			id IN (
+				SELECT
+					id
+				FROM
+					organizations
+				WHERE
+					address_geocoded_at IS NULL
+				AND
+					(address_geocode_claimed_at IS NULL OR address_geocode_claimed_at < current_timestamp - $2 * interval '1 second')
+				AND
+					deleted_at IS NULL
+				ORDER BY
+					created_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+		RETURNING
+			id,
+			address,
+			address_subpremise,
+			address_street_number,
+			address_route,
+			address_sublocality,
+			address_locality,
+			address_admin_area_level_1,
+			address_admin_area_level_2,
+			address_country,
+			address_postal_code,
+			address_geocode_claimed_at
 	`,
-		userID,
+		limit,
+		int(timeout/time.Second),
 	)
 	if err != nil {
 		return nil, err
 	}
-
-	return scanUserEvents(rows)
-}
-
-func scanUserEvents(rows *sql.Rows) ([]UserEvent, error) {
 	defer rows.Close()
-
-	var result []UserEvent
-
+	var result []Organization
 	for rows.Next() {
-		var model UserEvent
-
+		var model Organization
 		if err := rows.Scan(
 			&model.ID,
-			&model.UserID,
-			&model.Name,
-			&model.CreatedAt,
-			&model.UpdatedAt,
-			&model.DeletedAt,
+			&model.Address,
+			&model.AddressSubpremise,
+			&model.AddressStreetNumber,
+			&model.AddressRoute,
+			&model.AddressSublocality,
+			&model.AddressLocality,
+			&model.AddressAdminAreaLevel1,
+			&model.AddressAdminAreaLevel2,
+			&model.AddressCountry,
+			&model.AddressPostalCode,
+			&model.geocodeClaimedAt,
 		); err != nil {
 			return nil, err
 		}
-
 		result = append(result, model)
 	}
 	return result, rows.Err()
 }
+
+// releaseOrganizationGeocoding returns a claimed organization to the ones
+// waiting to be geocoded
+func releaseOrganizationGeocoding(model Organization) error {
+	_, err := db.Exec(`
+		UPDATE
+			organizations
+		SET
+			address_geocode_claimed_at = NULL
+		WHERE
+			id = $1
+		AND
+			address_geocode_claimed_at = $2
+	`,
+		model.ID,
+		model.geocodeClaimedAt,
+	)
+	return err
+}
+
+// resetOrganizationGeocoding marks the organizations that were geocoded
+// without a result to be geocoded again and forgets the cached addresses
+// that were not found, so the provider is asked again
+func resetOrganizationGeocoding() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE
+			organizations
+		SET
+			address_geocoded_at = NULL
+		WHERE
+			address_geocoded_at IS NOT NULL
+		AND
+			address_latitude IS NULL
+		AND
+			deleted_at IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM
+			geocode_cache
+		WHERE
+			found = false
+	`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateOrganizationLocation stores the location of a claimed organization,
+// clearing it when location is nil. Empty address parts are filled from the
+// location. Nothing is stored when the address has changed or the lease has
+// been taken over after the organization was claimed.
+func updateOrganizationLocation(model Organization, location *Location) error {
+	var latitude, longitude interface{}
+	if location != nil {
+		latitude, longitude = location.Latitude, location.Longitude
+	} else {
+		location = &Location{}
+	}
+
+	_, err := db.Exec(`
+		UPDATE
+			organizations
+		SET
+			address_latitude = $1,
+			address_longitude = $2,
+			address_formatted_address = $3,
+			country_code = (case when country_code = '' then $4 else country_code end),
+			address_subpremise = (case when address_subpremise = '' then $5 else address_subpremise end),
+			address_street_number = (case when address_street_number = '' then $6 else address_street_number end),
+			address_route = (case when address_route = '' then $7 else address_route end),
+			address_sublocality = (case when address_sublocality = '' then $8 else address_sublocality end),
+			address_locality = (case when address_locality = '' then $9 else address_locality end),
+			address_admin_area_level_1 = (case when address_admin_area_level_1 = '' then $10 else address_admin_area_level_1 end),
+			address_admin_area_level_2 = (case when address_admin_area_level_2 = '' then $11 else address_admin_area_level_2 end),
+			address_country = (case when address_country = '' then $12 else address_country end),
+			address_postal_code = (case when address_postal_code = '' then $13 else address_postal_code end),
+			address_geocoded_at = current_timestamp,
+			address_geocode_claimed_at = NULL
+		WHERE
+			id = $14
+		AND
+			address_geocode_claimed_at = $15
+	`,
+		latitude,
+		longitude,
+		location.FormattedAddress,
+		location.CountryCode,
+		location.AddressSubpremise,
+		location.AddressStreetNumber,
+		location.AddressRoute,
+		location.AddressSublocality,
+		location.AddressLocality,
+		location.AddressAdminAreaLevel1,
+		location.AddressAdminAreaLevel2,
+		location.AddressCountry,
+		location.AddressPostalCode,
+		model.ID,
+		model.geocodeClaimedAt,
+	)
+	return err
+}
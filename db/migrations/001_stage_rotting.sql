@@ -0,0 +1,10 @@
+-- Stage rotting is computed from stage_change_time, so every task needs one
+UPDATE tasks SET stage_change_time = created_at WHERE stage_change_time IS NULL;
+
+-- Scheduled e-mails that have already been sent (digests, reminders)
+CREATE TABLE IF NOT EXISTS sent_emails (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	key text NOT NULL UNIQUE,
+	user_id uuid REFERENCES users(id),
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+);
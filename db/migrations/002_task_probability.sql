@@ -0,0 +1,2 @@
+-- Per-task override of the stage probability, used for the weighted value
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS probability integer;
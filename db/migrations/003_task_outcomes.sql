@@ -0,0 +1,21 @@
+-- Company-managed catalog of reasons for losing a task
+CREATE TABLE IF NOT EXISTS lost_reasons (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	company_id uuid NOT NULL REFERENCES companies(id),
+	name text NOT NULL,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone
+);
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS lost_reason_id uuid REFERENCES lost_reasons(id);
+ALTER TABLE timeline ADD COLUMN IF NOT EXISTS lost_reason_id uuid REFERENCES lost_reasons(id);
+
+-- Status used to be written by clients, derive it from the timestamps once
+UPDATE tasks SET status = (
+	case
+	when won_time IS NOT NULL then 'won'
+	when lost_time IS NOT NULL then 'lost'
+	else 'open' end
+);
+UPDATE tasks SET lost_time = NULL, lost_reason = '' WHERE status = 'won';
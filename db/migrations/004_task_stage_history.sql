@@ -0,0 +1,22 @@
+-- Every stage a task has been in, used for time in stage and conversion reports
+CREATE TABLE IF NOT EXISTS task_stage_history (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	task_id uuid NOT NULL REFERENCES tasks(id),
+	stage_id uuid NOT NULL REFERENCES stages(id),
+	entered_user_id uuid REFERENCES users(id),
+	entered_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	exited_user_id uuid REFERENCES users(id),
+	exited_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS task_stage_history_task_id_idx ON task_stage_history(task_id);
+CREATE INDEX IF NOT EXISTS task_stage_history_stage_id_idx ON task_stage_history(stage_id);
+
+-- Existing tasks start their history in the stage they are in now
+INSERT INTO task_stage_history(task_id, stage_id, entered_at)
+SELECT tasks.id, tasks.stage_id, coalesce(tasks.stage_change_time, tasks.created_at)
+FROM tasks
+WHERE tasks.stage_id IS NOT NULL
+AND NOT EXISTS (
+	select 1 from task_stage_history where task_stage_history.task_id = tasks.id
+);
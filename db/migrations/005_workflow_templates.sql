@@ -0,0 +1,11 @@
+-- Workflows companies have saved as templates, built-in templates live in
+-- db/workflow_templates.json
+CREATE TABLE IF NOT EXISTS workflow_templates (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	company_id uuid NOT NULL REFERENCES companies(id),
+	name text NOT NULL,
+	stages jsonb NOT NULL DEFAULT '[]',
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone
+);
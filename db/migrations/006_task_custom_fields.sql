@@ -0,0 +1,2 @@
+-- Custom field values by task_fields.key
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS custom_fields jsonb NOT NULL DEFAULT '{}';
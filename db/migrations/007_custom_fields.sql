@@ -0,0 +1,6 @@
+-- Custom field values by person_fields, organization_fields, activity_fields
+-- and product_fields key
+ALTER TABLE persons ADD COLUMN IF NOT EXISTS custom_fields jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS custom_fields jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS custom_fields jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS custom_fields jsonb NOT NULL DEFAULT '{}';
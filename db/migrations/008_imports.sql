@@ -0,0 +1,32 @@
+-- CSV imports run as background jobs, import_records lists what an import
+-- created so that it can be reverted
+CREATE TABLE IF NOT EXISTS imports (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	company_id uuid NOT NULL REFERENCES companies(id),
+	user_id uuid NOT NULL REFERENCES users(id),
+	workflow_id uuid REFERENCES workflows(id),
+	name text NOT NULL DEFAULT '',
+	mapping jsonb NOT NULL DEFAULT '{}',
+	data text NOT NULL DEFAULT '',
+	status text NOT NULL DEFAULT 'pending',
+	total_rows integer NOT NULL DEFAULT 0,
+	processed_rows integer NOT NULL DEFAULT 0,
+	errors jsonb NOT NULL DEFAULT '[]',
+	finished_at timestamp with time zone,
+	reverted_at timestamp with time zone,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS imports_status_idx ON imports (status, created_at);
+
+CREATE TABLE IF NOT EXISTS import_records (
+	id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+	import_id uuid NOT NULL REFERENCES imports(id),
+	record_type text NOT NULL,
+	record_id uuid NOT NULL,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS import_records_import_id_idx ON import_records (import_id, record_type);
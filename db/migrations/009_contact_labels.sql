@@ -0,0 +1,24 @@
+-- Contacts get a label (work, home, mobile, ...) and every person has at most
+-- one primary contact of each type
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS label text NOT NULL DEFAULT '';
+
+UPDATE contacts SET primary_contact = false
+WHERE primary_contact AND deleted_at IS NULL AND id <> (
+	SELECT c.id FROM contacts c
+	WHERE c.person_id = contacts.person_id AND c.type = contacts.type
+	AND c.primary_contact AND c.deleted_at IS NULL
+	ORDER BY c.created_at, c.id
+	LIMIT 1
+);
+
+UPDATE contacts SET primary_contact = true
+WHERE deleted_at IS NULL AND id = (
+	SELECT c.id FROM contacts c
+	WHERE c.person_id = contacts.person_id AND c.type = contacts.type
+	AND c.deleted_at IS NULL
+	ORDER BY c.primary_contact DESC, c.created_at, c.id
+	LIMIT 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS contacts_primary_idx
+	ON contacts (person_id, type) WHERE primary_contact AND deleted_at IS NULL;
@@ -0,0 +1,19 @@
+-- Coordinates of organization addresses. Organizations with a null
+-- address_geocoded_at are geocoded by a background job, geocode_cache keeps
+-- the results by address so the same address is looked up only once
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS address_formatted_address text NOT NULL DEFAULT '';
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS address_latitude double precision;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS address_longitude double precision;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS address_geocoded_at timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS organizations_geocode_pending_idx
+	ON organizations (created_at) WHERE address_geocoded_at IS NULL AND deleted_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS geocode_cache (
+	query text PRIMARY KEY,
+	found boolean NOT NULL,
+	latitude double precision,
+	longitude double precision,
+	formatted_address text NOT NULL DEFAULT '',
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+);
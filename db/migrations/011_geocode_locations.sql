@@ -0,0 +1,3 @@
+-- Geocoded locations are cached with their address parts. Queries are
+-- prefixed with the geocoding provider that answered them.
+ALTER TABLE geocode_cache ADD COLUMN IF NOT EXISTS location jsonb;
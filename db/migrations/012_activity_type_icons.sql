@@ -0,0 +1,5 @@
+-- Activity types get an icon, the built-in types use the icon named like
+-- their key
+ALTER TABLE activity_types ADD COLUMN IF NOT EXISTS icon text NOT NULL DEFAULT '';
+
+UPDATE activity_types SET icon = key_string WHERE icon = '' AND NOT is_custom_flag;
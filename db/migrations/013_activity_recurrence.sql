@@ -0,0 +1,11 @@
+-- Recurring activities. Every occurrence of a series keeps the RFC 5545
+-- RRULE and the start it is counted from, recurrence_index is its position
+-- from that start. The next occurrence is created when one is marked as
+-- done.
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS recurrence_rule text NOT NULL DEFAULT '';
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS recurrence_start timestamp with time zone;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS recurrence_index integer NOT NULL DEFAULT 0;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS series_id uuid;
+
+CREATE UNIQUE INDEX IF NOT EXISTS activities_series_idx
+	ON activities (series_id, recurrence_start, recurrence_index) WHERE series_id IS NOT NULL AND deleted_at IS NULL;
@@ -0,0 +1,13 @@
+-- Activity reminders. An activity without its own reminder_minutes uses the
+-- default of its assignee. Reminders are computed in the timezone of the
+-- assignee and sent_emails makes sure each is sent once.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reminder_minutes integer;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reminders_off boolean NOT NULL DEFAULT false;
+
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS reminder_minutes integer;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS reminder_off boolean NOT NULL DEFAULT false;
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS snoozed_until timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS activities_undone_due_idx
+	ON activities (due_date) WHERE done = false AND deleted_at IS NULL;
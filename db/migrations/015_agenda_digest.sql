@@ -0,0 +1,3 @@
+-- Morning agenda e-mail with the activities of the day, sent at the digest
+-- hour in the timezone of each user unless the user opts out.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS agenda_digest_off boolean NOT NULL DEFAULT false;
@@ -0,0 +1,4 @@
+-- Organizations being geocoded are claimed with a lease instead of being
+-- marked as geocoded, so the ones of a crashed run are picked up again once
+-- the lease has expired
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS address_geocode_claimed_at timestamp with time zone;
@@ -0,0 +1,9 @@
+-- All-day activities are flagged instead of being told apart by their due
+-- date. Activities that were shown as all-day, without a duration and due
+-- at midnight UTC, keep being so.
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS all_day boolean NOT NULL DEFAULT false;
+
+UPDATE activities SET all_day = true
+	WHERE coalesce(trim(duration), '') = ''
+	AND due_date IS NOT NULL
+	AND due_date AT TIME ZONE 'UTC' = date_trunc('day', due_date AT TIME ZONE 'UTC');
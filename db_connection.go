@@ -48,5 +48,14 @@ func recreateDB(dbname string) error {
 	if _, err := exec.Command("psql", dbname, "-f", filepath.Join("db", "setup.sql")).CombinedOutput(); err != nil {
 		return err
 	}
+	migrations, err := filepath.Glob(filepath.Join("db", "migrations", "*.sql"))
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if _, err := exec.Command("psql", dbname, "-v", "ON_ERROR_STOP=1", "-f", migration).CombinedOutput(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
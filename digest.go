@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+// sendRottenTaskDigests e-mails every owner a list of their rotten tasks,
+// once per day after config.DigestHour.
+func sendRottenTaskDigests() error {
+	now := time.Now()
+	if now.Hour() < config.DigestHour {
+		return nil
+	}
+
+	tasks, err := selectRottenTasks()
+	if err != nil {
+		return err
+	}
+
+	byOwner := make(map[string][]Task)
+	var owners []string
+	for _, task := range tasks {
+		if _, exists := byOwner[task.UserID]; !exists {
+			owners = append(owners, task.UserID)
+		}
+		byOwner[task.UserID] = append(byOwner[task.UserID], task)
+	}
+
+	for _, ownerID := range owners {
+		key := fmt.Sprintf("rotten_digest:%s:%s", ownerID, now.Format("2006-01-02"))
+		claimed, err := claimSentEmail(key, ownerID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		owner, err := selectUserByID(ownerID)
+		if err != nil {
+			log.Println(err)
+			if err := releaseSentEmail(key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ownerTasks := byOwner[ownerID]
+		subj := fmt.Sprintf("You have %d rotten tasks", len(ownerTasks))
+		if err := sendEmail(owner.Email, subj, rottenTaskDigestBody(ownerTasks)); err != nil {
+			log.Println("Error sending rotten task digest to", owner.Email, err)
+			if err := releaseSentEmail(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func rottenTaskDigestBody(tasks []Task) string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "These tasks have been sitting in the same stage for too long:\r\n\r\n")
+	for _, task := range tasks {
+		fmt.Fprintf(b, "- %s (%s), rotten since %s\r\n",
+			task.Name, task.StageName, task.RottenTime.Format("2006-01-02"))
+	}
+	fmt.Fprintf(b, "\r\nMove them forward or close them on http://superwork.io\r\n")
+	return b.String()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// normalizeName lowercases a name and collapses punctuation and whitespace
+// so that "Doe, John" and "john  doe" compare by their words.
+func normalizeName(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// similarNames reports whether two names are likely to mean the same thing.
+// Names match when their words are equal in any order or when they differ by
+// at most one edit per five characters.
+func similarNames(a, b string) bool {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b || sortedWords(a) == sortedWords(b) {
+		return true
+	}
+	longest := len([]rune(a))
+	if l := len([]rune(b)); l > longest {
+		longest = l
+	}
+	return levenshtein(a, b) <= longest/5
+}
+
+func sortedWords(s string) string {
+	words := strings.Fields(s)
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// addPersonDuplicate appends reason to the duplicate of person, adding the
+// duplicate if it is not in the list yet.
+func addPersonDuplicate(result []PersonDuplicate, person Person, reason string) []PersonDuplicate {
+	for i := range result {
+		if result[i].Person.ID == person.ID {
+			for _, r := range result[i].Reasons {
+				if r == reason {
+					return result
+				}
+			}
+			result[i].Reasons = append(result[i].Reasons, reason)
+			return result
+		}
+	}
+	return append(result, PersonDuplicate{Person: person, Reasons: []string{reason}})
+}
+
+// findPersonDuplicates returns the persons of the same company that share an
+// e-mail address or a phone number with the person, and the persons of the
+// same organization with a similar name.
+func findPersonDuplicates(person Person) ([]PersonDuplicate, error) {
+	contacts, err := selectContactsByPerson(person.ID)
+	if err != nil {
+		return nil, err
+	}
+	return findContactDuplicates(person, contacts)
+}
+
+// findContactDuplicates is findPersonDuplicates for a person whose contacts
+// are not saved yet.
+func findContactDuplicates(person Person, contacts []Contact) ([]PersonDuplicate, error) {
+	var result []PersonDuplicate
+	for _, contact := range contacts {
+		contact.PersonID = person.ID
+		IDs, err := selectPersonIDsByContact(person.CompanyID, contact)
+		if err != nil {
+			return nil, err
+		}
+		for _, ID := range IDs {
+			other, err := selectPersonByID(ID)
+			if err != nil {
+				return nil, err
+			}
+			if other != nil {
+				result = addPersonDuplicate(result, *other, contact.Type)
+			}
+		}
+	}
+
+	if person.OrgID != "" {
+		persons, err := selectPersonsByOrganization(person.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range persons {
+			if other.ID != person.ID && similarNames(person.Name, other.Name) {
+				result = addPersonDuplicate(result, other, "name")
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// organizationSuffixes are legal forms that are ignored when organization
+// names are compared.
+var organizationSuffixes = map[string]bool{
+	"ab":           true,
+	"ag":           true,
+	"as":           true,
+	"bv":           true,
+	"co":           true,
+	"company":      true,
+	"corp":         true,
+	"corporation":  true,
+	"gmbh":         true,
+	"inc":          true,
+	"incorporated": true,
+	"limited":      true,
+	"llc":          true,
+	"llp":          true,
+	"ltd":          true,
+	"nv":           true,
+	"oy":           true,
+	"oyj":          true,
+	"plc":          true,
+	"pty":          true,
+	"sa":           true,
+	"srl":          true,
+}
+
+// normalizeOrganizationName normalizes an organization name and drops its
+// legal form, so "ACME Ltd." and "Acme" are the same.
+func normalizeOrganizationName(name string) string {
+	words := strings.Fields(normalizeName(name))
+	for len(words) > 1 && organizationSuffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// addOrganizationDuplicate appends reason to the duplicate of org, adding the
+// duplicate if it is not in the list yet.
+func addOrganizationDuplicate(result []OrganizationDuplicate, org Organization, reason string) []OrganizationDuplicate {
+	for i := range result {
+		if result[i].Organization.ID == org.ID {
+			result[i].Reasons = append(result[i].Reasons, reason)
+			return result
+		}
+	}
+	return append(result, OrganizationDuplicate{Organization: org, Reasons: []string{reason}})
+}
+
+// findOrganizationDuplicates returns the organizations of the same company
+// with the same normalized name or address as the organization.
+func findOrganizationDuplicates(org Organization) ([]OrganizationDuplicate, error) {
+	orgs, err := selectOrganizationsByCompany(org.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := normalizeOrganizationName(org.Name)
+	address := normalizeName(org.Address)
+
+	var result []OrganizationDuplicate
+	for _, other := range orgs {
+		if other.ID == org.ID {
+			continue
+		}
+		if name != "" && normalizeOrganizationName(other.Name) == name {
+			result = addOrganizationDuplicate(result, other, "name")
+		}
+		if address != "" && normalizeName(other.Address) == address {
+			result = addOrganizationDuplicate(result, other, "address")
+		}
+	}
+
+	return result, nil
+}
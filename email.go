@@ -1,15 +1,69 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 )
 
 func sendEmail(toAddress, subj, body string) error {
+	return deliverEmail(toAddress, subj, nil, body)
+}
+
+// sendMultipartEmail sends an e-mail with both a plain text and an HTML
+// version of the body, mail clients show the one they support best
+func sendMultipartEmail(toAddress, subj, text, html string) error {
+	contentType, body, err := multipartAlternative(text, html)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"MIME-Version": "1.0",
+		"Content-Type": contentType,
+	}
+	return deliverEmail(toAddress, subj, headers, body)
+}
+
+// multipartAlternative returns the content type and the body of a
+// multipart/alternative message with the text and HTML parts
+func multipartAlternative(text, html string) (string, string, error) {
+	b := &bytes.Buffer{}
+	mw := multipart.NewWriter(b)
+	parts := []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return "", "", err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.content)); err != nil {
+			return "", "", err
+		}
+		if err := qw.Close(); err != nil {
+			return "", "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", "", err
+	}
+	return "multipart/alternative; boundary=" + mw.Boundary(), b.String(), nil
+}
+
+func deliverEmail(toAddress, subj string, extraHeaders map[string]string, body string) error {
 	if config.Env == "test" {
 		return nil
 	}
@@ -23,7 +77,10 @@ func sendEmail(toAddress, subj, body string) error {
 	headers := make(map[string]string)
 	headers["From"] = from.String()
 	headers["To"] = to.String()
-	headers["Subject"] = subj
+	headers["Subject"] = mime.QEncoding.Encode("utf-8", subj)
+	for k, v := range extraHeaders {
+		headers[k] = v
+	}
 
 	// Setup message
 	message := ""
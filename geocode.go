@@ -1,50 +1,194 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"net/http"
-	"net/url"
+	"strings"
+	"time"
 )
 
-type geocodeLocation struct {
-	Lat float64 `json:"lat"`
-	Lng float64 `json:"lng"`
+var (
+	errGeocodeNotFound  = errors.New("Address not found")
+	errGeocodeQuota     = errors.New("Geocoding quota exceeded, please try again later")
+	errGeocodeDisabled  = errors.New("Geocoding is not enabled")
+	errGeocodeNoAPIKey  = errors.New("Google geocoding needs an API key")
+	errGeocodeNoAddress = errors.New("Please enter an address")
+)
+
+// geocoder looks up the location of an address (forward geocoding) and the
+// address of a location (reverse geocoding). Both return errGeocodeNotFound
+// when there is no result and errGeocodeQuota when the provider refuses
+// because of its usage limits.
+type geocoder interface {
+	Name() string
+	Geocode(address string) (*Location, error)
+	ReverseGeocode(latitude, longitude float64) (*Location, error)
+}
+
+var geocodeClient = &http.Client{Timeout: 10 * time.Second}
+
+// geocodeClaimTimeout is how long the organizations claimed by a geocoding
+// run are left to it before another run takes them over
+const geocodeClaimTimeout = 10 * time.Minute
+
+// currentGeocoder returns the geocoder selected by config
+func currentGeocoder() (geocoder, error) {
+	provider := config.GeocodeProvider
+	if provider == "" && config.GeocodeAPIKey != "" {
+		provider = "google"
+	}
+
+	switch provider {
+	case "google":
+		if config.GeocodeAPIKey == "" {
+			return nil, errGeocodeNoAPIKey
+		}
+		return googleGeocoder{URL: config.GeocodeURL, APIKey: config.GeocodeAPIKey}, nil
+	case "nominatim":
+		return nominatimGeocoder{URL: config.GeocodeURL, Email: config.AdminEmail}, nil
+	case "", "none":
+		return nullGeocoder{}, nil
+	}
+	return nil, fmt.Errorf("Unknown geocoding provider %s", provider)
 }
 
-type geocodeGeometry struct {
-	Location geocodeLocation `json:"location"`
+// nullGeocoder is used when geocoding is off
+type nullGeocoder struct{}
+
+func (nullGeocoder) Name() string {
+	return "none"
+}
+
+func (nullGeocoder) Geocode(address string) (*Location, error) {
+	return nil, errGeocodeDisabled
+}
+
+func (nullGeocoder) ReverseGeocode(latitude, longitude float64) (*Location, error) {
+	return nil, errGeocodeDisabled
 }
 
-type geocodeResult struct {
-	Geometry geocodeGeometry `json:"geometry"`
+// cachedGeocode geocodes an address looking up every address only once.
+// Addresses that are not found are cached too, failed lookups are not.
+func cachedGeocode(g geocoder, address string) (*Location, error) {
+	query := strings.ToLower(strings.Join(strings.Fields(address), " "))
+	if query == "" {
+		return nil, errGeocodeNoAddress
+	}
+	query = g.Name() + ":" + query
+
+	location, cached, err := selectGeocodeCache(query)
+	if err != nil {
+		return nil, err
+	}
+	if cached && location == nil {
+		return nil, errGeocodeNotFound
+	}
+	if cached {
+		return location, nil
+	}
+
+	location, err = g.Geocode(address)
+	if err != nil && err != errGeocodeNotFound {
+		return nil, err
+	}
+	if err := insertGeocodeCache(query, location); err != nil {
+		return nil, err
+	}
+	return location, err
 }
 
-type geocodeResponse struct {
-	Results []geocodeResult `json:"results"`
+// organizationAddress returns the address of an organization to geocode,
+// built from the address parts when the full address is empty
+func organizationAddress(org Organization) string {
+	if strings.TrimSpace(org.Address) != "" {
+		return strings.TrimSpace(org.Address)
+	}
+	var parts []string
+	for _, part := range []string{
+		strings.TrimSpace(org.AddressStreetNumber + " " + org.AddressRoute),
+		org.AddressSubpremise,
+		org.AddressSublocality,
+		strings.TrimSpace(org.AddressPostalCode + " " + org.AddressLocality),
+		org.AddressAdminAreaLevel2,
+		org.AddressAdminAreaLevel1,
+		org.AddressCountry,
+	} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
 }
 
-func geocode(address string) (latitude, longitude float64, err error) {
-	key := config.GeocodeAPIKey
-	encodedAddress := url.QueryEscape(address)
-	uri := fmt.Sprintf("https://maps.googleapis.com/maps/api/geocode/json?address=%s&key=%s", encodedAddress, key)
-	response, err := http.Get(uri)
+// geocodeOrganizations geocodes at most limit organizations whose address
+// is new or has changed and returns how many were handled. Nothing is done
+// when geocoding is off.
+func geocodeOrganizations(limit int) (int, error) {
+	g, err := currentGeocoder()
 	if err != nil {
-		return 0, 0, err
+		return 0, err
 	}
-	defer response.Body.Close()
-	b, err := ioutil.ReadAll(response.Body)
+	if _, off := g.(nullGeocoder); off {
+		return 0, nil
+	}
+
+	orgs, err := claimOrganizationsToGeocode(limit, geocodeClaimTimeout)
 	if err != nil {
-		return 0, 0, err
+		return 0, err
 	}
-	var geo geocodeResponse
-	if err := json.Unmarshal(b, &geo); err != nil {
-		return 0, 0, err
+
+	// leave the rest to the next run
+	release := func(orgs []Organization) {
+		for _, org := range orgs {
+			if err := releaseOrganizationGeocoding(org); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	for i, org := range orgs {
+		var location *Location
+		if address := organizationAddress(org); address != "" {
+			location, err = cachedGeocode(g, address)
+			if err != nil && err != errGeocodeNotFound {
+				release(orgs[i:])
+				return i, err
+			}
+		}
+		if err := updateOrganizationLocation(org, location); err != nil {
+			release(orgs[i:])
+			return i, err
+		}
+	}
+
+	return len(orgs), nil
+}
+
+// geocodePendingOrganizations is the scheduled job that geocodes new and
+// changed organization addresses
+func geocodePendingOrganizations() error {
+	_, err := geocodeOrganizations(20)
+	return err
+}
+
+// backfillGeocoding geocodes all organizations that have no coordinates yet,
+// also the ones whose address was not found before
+func backfillGeocoding() error {
+	if err := resetOrganizationGeocoding(); err != nil {
+		return err
 	}
-	if len(geo.Results) > 0 {
-		location := geo.Results[0].Geometry.Location
-		return location.Lat, location.Lng, nil
+	total := 0
+	for {
+		n, err := geocodeOrganizations(100)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			log.Printf("Geocoded %d organizations", total)
+			return nil
+		}
+		total += n
 	}
-	return 0, 0, nil
 }
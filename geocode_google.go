@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const googleGeocodeURL = "https://maps.googleapis.com/maps/api/geocode/json"
+
+type googleLocation struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type googleGeometry struct {
+	Location googleLocation `json:"location"`
+}
+
+type googleAddressComponent struct {
+	LongName  string   `json:"long_name"`
+	ShortName string   `json:"short_name"`
+	Types     []string `json:"types"`
+}
+
+type googleResult struct {
+	FormattedAddress  string                   `json:"formatted_address"`
+	AddressComponents []googleAddressComponent `json:"address_components"`
+	Geometry          googleGeometry           `json:"geometry"`
+}
+
+type googleResponse struct {
+	Status       string         `json:"status"`
+	ErrorMessage string         `json:"error_message"`
+	Results      []googleResult `json:"results"`
+}
+
+// googleGeocoder uses the Google Geocoding API
+type googleGeocoder struct {
+	URL    string
+	APIKey string
+}
+
+func (g googleGeocoder) Name() string {
+	return "google"
+}
+
+func (g googleGeocoder) Geocode(address string) (*Location, error) {
+	return g.lookup(url.Values{"address": {address}})
+}
+
+func (g googleGeocoder) ReverseGeocode(latitude, longitude float64) (*Location, error) {
+	latlng := strconv.FormatFloat(latitude, 'f', -1, 64) + "," + strconv.FormatFloat(longitude, 'f', -1, 64)
+	return g.lookup(url.Values{"latlng": {latlng}})
+}
+
+func (g googleGeocoder) lookup(params url.Values) (*Location, error) {
+	uri := g.URL
+	if uri == "" {
+		uri = googleGeocodeURL
+	}
+	params.Set("key", g.APIKey)
+
+	response, err := geocodeClient.Get(uri + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var geo googleResponse
+	if err := json.NewDecoder(response.Body).Decode(&geo); err != nil {
+		return nil, err
+	}
+	switch geo.Status {
+	case "OK":
+	case "ZERO_RESULTS":
+		return nil, errGeocodeNotFound
+	case "OVER_QUERY_LIMIT", "OVER_DAILY_LIMIT":
+		return nil, errGeocodeQuota
+	default:
+		return nil, fmt.Errorf("Google geocoding failed with %s %s", geo.Status, geo.ErrorMessage)
+	}
+	if len(geo.Results) == 0 {
+		return nil, errGeocodeNotFound
+	}
+
+	result := geo.Results[0]
+	location := Location{
+		Latitude:         result.Geometry.Location.Lat,
+		Longitude:        result.Geometry.Location.Lng,
+		FormattedAddress: result.FormattedAddress,
+	}
+	for _, component := range result.AddressComponents {
+		for _, t := range component.Types {
+			switch t {
+			case "street_number":
+				location.AddressStreetNumber = component.LongName
+			case "route":
+				location.AddressRoute = component.LongName
+			case "subpremise":
+				location.AddressSubpremise = component.LongName
+			case "sublocality", "sublocality_level_1":
+				location.AddressSublocality = component.LongName
+			case "locality", "postal_town":
+				if location.AddressLocality == "" {
+					location.AddressLocality = component.LongName
+				}
+			case "administrative_area_level_1":
+				location.AddressAdminAreaLevel1 = component.LongName
+			case "administrative_area_level_2":
+				location.AddressAdminAreaLevel2 = component.LongName
+			case "country":
+				location.AddressCountry = component.LongName
+				location.CountryCode = component.ShortName
+			case "postal_code":
+				location.AddressPostalCode = component.LongName
+			}
+		}
+	}
+	return &location, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const nominatimURL = "https://nominatim.openstreetmap.org"
+
+// nominatimLimiter keeps the requests to the public Nominatim server one
+// second apart as its usage policy asks
+var nominatimLimiter = &requestLimiter{interval: time.Second}
+
+// requestLimiter spaces requests at least interval apart
+type requestLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	last     time.Time
+}
+
+// wait blocks until interval has passed since the previous request
+func (l *requestLimiter) wait() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if d := l.interval - time.Since(l.last); d > 0 {
+		time.Sleep(d)
+	}
+	l.last = time.Now()
+}
+
+type nominatimAddress struct {
+	HouseNumber  string `json:"house_number"`
+	Road         string `json:"road"`
+	Unit         string `json:"unit"`
+	Suburb       string `json:"suburb"`
+	CityDistrict string `json:"city_district"`
+	City         string `json:"city"`
+	Town         string `json:"town"`
+	Village      string `json:"village"`
+	Municipality string `json:"municipality"`
+	County       string `json:"county"`
+	State        string `json:"state"`
+	Postcode     string `json:"postcode"`
+	Country      string `json:"country"`
+	CountryCode  string `json:"country_code"`
+}
+
+type nominatimResult struct {
+	Lat         string           `json:"lat"`
+	Lon         string           `json:"lon"`
+	DisplayName string           `json:"display_name"`
+	Address     nominatimAddress `json:"address"`
+	Error       string           `json:"error"`
+}
+
+// nominatimGeocoder uses the OpenStreetMap Nominatim API. The public server
+// allows one request per second, see nominatimLimiter, and asks for a
+// contact e-mail address.
+type nominatimGeocoder struct {
+	URL   string
+	Email string
+}
+
+func (g nominatimGeocoder) Name() string {
+	return "nominatim"
+}
+
+func (g nominatimGeocoder) Geocode(address string) (*Location, error) {
+	var results []nominatimResult
+	if err := g.get("search", url.Values{"q": {address}, "limit": {"1"}}, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errGeocodeNotFound
+	}
+	return results[0].location()
+}
+
+func (g nominatimGeocoder) ReverseGeocode(latitude, longitude float64) (*Location, error) {
+	var result nominatimResult
+	params := url.Values{
+		"lat": {strconv.FormatFloat(latitude, 'f', -1, 64)},
+		"lon": {strconv.FormatFloat(longitude, 'f', -1, 64)},
+	}
+	if err := g.get("reverse", params, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, errGeocodeNotFound
+	}
+	return result.location()
+}
+
+func (g nominatimGeocoder) get(path string, params url.Values, v interface{}) error {
+	uri := g.URL
+	if uri == "" {
+		uri = nominatimURL
+	}
+	params.Set("format", "jsonv2")
+	params.Set("addressdetails", "1")
+	if g.Email != "" {
+		params.Set("email", g.Email)
+	}
+
+	request, err := http.NewRequest("GET", strings.TrimSuffix(uri, "/")+"/"+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "superwork")
+
+	if strings.TrimSuffix(uri, "/") == nominatimURL {
+		nominatimLimiter.wait()
+	}
+	response, err := geocodeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusForbidden:
+		return errGeocodeQuota
+	case response.StatusCode != http.StatusOK:
+		return fmt.Errorf("Nominatim geocoding failed with %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func (r nominatimResult) location() (*Location, error) {
+	latitude, err := strconv.ParseFloat(r.Lat, 64)
+	if err != nil {
+		return nil, err
+	}
+	longitude, err := strconv.ParseFloat(r.Lon, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	location := Location{
+		Latitude:               latitude,
+		Longitude:              longitude,
+		FormattedAddress:       r.DisplayName,
+		CountryCode:            strings.ToUpper(r.Address.CountryCode),
+		AddressSubpremise:      r.Address.Unit,
+		AddressStreetNumber:    r.Address.HouseNumber,
+		AddressRoute:           r.Address.Road,
+		AddressSublocality:     r.Address.Suburb,
+		AddressAdminAreaLevel1: r.Address.State,
+		AddressAdminAreaLevel2: r.Address.County,
+		AddressCountry:         r.Address.Country,
+		AddressPostalCode:      r.Address.Postcode,
+	}
+	if location.AddressSublocality == "" {
+		location.AddressSublocality = r.Address.CityDistrict
+	}
+	for _, locality := range []string{r.Address.City, r.Address.Town, r.Address.Village, r.Address.Municipality} {
+		if locality != "" {
+			location.AddressLocality = locality
+			break
+		}
+	}
+	return &location, nil
+}
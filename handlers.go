@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
@@ -193,8 +199,23 @@ func handlePutMe(w http.ResponseWriter, r *http.Request, user *User) {
 
 	activeCompanyChanged := user.ActiveCompanyID != input.ActiveCompanyID
 
+	if input.TimezoneName != "" {
+		if _, err := time.LoadLocation(input.TimezoneName); err != nil {
+			http.Error(w, "Unknown timezone "+input.TimezoneName, http.StatusBadRequest)
+			return
+		}
+	}
+	if input.ReminderMinutes != nil && (*input.ReminderMinutes < 0 || *input.ReminderMinutes > maxReminderMinutes) {
+		http.Error(w, "Please select a reminder of at most four weeks before", http.StatusBadRequest)
+		return
+	}
+
 	user.Phone = input.Phone
 	user.YearOfBirth = input.YearOfBirth
+	user.TimezoneName = input.TimezoneName
+	user.ReminderMinutes = input.ReminderMinutes
+	user.RemindersOff = input.RemindersOff
+	user.AgendaDigestOff = input.AgendaDigestOff
 	user.ActiveCompanyID = input.ActiveCompanyID
 	user.ActiveWorkflowID = input.ActiveWorkflowID
 
@@ -742,9 +763,109 @@ func handleGetActivities(w http.ResponseWriter, r *http.Request, user *User) {
 		return
 	}
 
+	// with a date range the activities due in it are returned together with
+	// the occurrences of recurring activities that are not created yet
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from != "" || to != "" {
+		fromDay, err := parseDayIn(from, userLocation(*user))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		toDay, err := parseDayIn(to, userLocation(*user))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		toDay = toDay.AddDate(0, 0, 1)
+		if !toDay.After(fromDay) || toDay.After(fromDay.AddDate(1, 0, 1)) {
+			http.Error(w, "Please select a range of at most a year", http.StatusBadRequest)
+			return
+		}
+		locations, err := selectUserLocations(user.ActiveCompanyID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Error loading users", http.StatusInternalServerError)
+			return
+		}
+		models = activitiesInRange(models, fromDay, toDay, locations)
+	}
+
 	w.Write(must(json.Marshal(models)))
 }
 
+// queryList returns the values of the query parameter, given repeated or
+// separated by commas
+func queryList(r *http.Request, key string) []string {
+	var result []string
+	for _, value := range r.URL.Query()[key] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+func activityFilterFromQuery(r *http.Request) (ActivityFilter, error) {
+	filter := ActivityFilter{
+		AssigneeIDs: queryList(r, "assignee_id"),
+		TypeIDs:     queryList(r, "type_id"),
+	}
+	switch r.URL.Query().Get("done") {
+	case "":
+	case "true":
+		done := true
+		filter.Done = &done
+	case "false":
+		done := false
+		filter.Done = &done
+	default:
+		return filter, errors.New("Please select done true or false")
+	}
+	return filter, nil
+}
+
+func handleGetActivityCalendar(w http.ResponseWriter, r *http.Request, user *User) {
+	location := userLocation(*user)
+	from, err := parseDayIn(r.URL.Query().Get("from"), location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseDayIn(r.URL.Query().Get("until"), location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if until.Before(from) || !until.Before(from.AddDate(1, 0, 0)) {
+		http.Error(w, "Please select a range of at most a year", http.StatusBadRequest)
+		return
+	}
+	filter, err := activityFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	models, err := selectActivitiesByCompany(user.ActiveCompanyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading activities", http.StatusInternalServerError)
+		return
+	}
+
+	locations, err := selectUserLocations(user.ActiveCompanyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading users", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(activityCalendar(models, from, until, location, locations, filter))))
+}
+
 func handlePostActivities(w http.ResponseWriter, r *http.Request, user *User) {
 	var input Activity
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -759,19 +880,31 @@ func handlePostActivities(w http.ResponseWriter, r *http.Request, user *User) {
 
 	if err := assignOrganization(&input, *user); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
 	if err := assignPerson(&input, *user); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	locations, err := selectUserLocations(user.ActiveCompanyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading users", http.StatusInternalServerError)
+		return
+	}
+
+	if err := prepareRecurrence(&input, assigneeLocation(input, locations)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	if err := insertActivity(&input); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -806,24 +939,60 @@ func handlePutActivity(w http.ResponseWriter, r *http.Request, user *User) {
 		return
 	}
 
+	vars := mux.Vars(r)
+	input.ID = vars["id"]
+	input.CompanyID = user.ActiveCompanyID
+
+	existing, err := selectActivityByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading activity", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil || existing.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity not found", http.StatusNotFound)
+		return
+	}
+
 	if err := assignOrganization(&input, *user); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
 	if err := assignPerson(&input, *user); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	locations, err := selectUserLocations(user.ActiveCompanyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading users", http.StatusInternalServerError)
+		return
+	}
+
+	scope := r.URL.Query().Get("scope")
+	if err := prepareActivityUpdate(&input, *existing, scope, assigneeLocation(input, locations)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	if err := updateActivity(input); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
+	if scope == "series" && input.SeriesID != "" {
+		if err := updateActivitySeries(input); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	timeline := Timeline{
 		UnderCompanyID: user.ActiveCompanyID,
 		UserID:         user.ID,
@@ -837,6 +1006,29 @@ func handlePutActivity(w http.ResponseWriter, r *http.Request, user *User) {
 		return
 	}
 
+	if input.Done && !existing.Done {
+		next, err := createNextOccurrence(input, assigneeLocation(input, locations))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if next != nil {
+			timeline := Timeline{
+				UnderCompanyID: user.ActiveCompanyID,
+				UserID:         user.ID,
+				ActivityID:     next.ID,
+				Action:         "created",
+			}
+			timeline.Name = next.Name
+			if err := insertTimeline(&timeline); err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
 	model, err := selectActivityByID(input.ID)
 	if err != nil {
 		log.Println(err)
@@ -847,221 +1039,2554 @@ func handlePutActivity(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal(model)))
 }
 
-func handleDeleteActivity(w http.ResponseWriter, r *http.Request, user *User) {
-	vars := mux.Vars(r)
-	ID := vars["id"]
-
-	model, err := selectActivityByID(ID)
+func handleGetActivityRoute(w http.ResponseWriter, r *http.Request, user *User) {
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	if userID == "" {
+		userID = user.ID
+	}
+	assignee, err := selectRouteUser(user.ActiveCompanyID, userID)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "error loading activity", http.StatusInternalServerError)
+		http.Error(w, "Error loading user", http.StatusInternalServerError)
 		return
 	}
-
-	if err := deleteActivity(ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println(err)
+	if assignee == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
-
-	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
-		UserID:         user.ID,
-		ActivityID:     ID,
-		Action:         "deleted",
-	}
-	timeline.Name = model.Name
-	if err := insertTimeline(&timeline); err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	day, err := parseDayIn(query.Get("date"), userLocation(*assignee))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Write(must(json.Marshal("ok")))
-}
-
-func handleGetActivityFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostActivityFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutActivityField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteActivityField(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	var start *[2]float64
+	if query.Get("start_lat") != "" || query.Get("start_lng") != "" {
+		latitude, err := strconv.ParseFloat(query.Get("start_lat"), 64)
+		if err != nil || latitude < -90 || latitude > 90 {
+			http.Error(w, "Invalid start latitude", http.StatusBadRequest)
+			return
+		}
+		longitude, err := strconv.ParseFloat(query.Get("start_lng"), 64)
+		if err != nil || longitude < -180 || longitude > 180 {
+			http.Error(w, "Invalid start longitude", http.StatusBadRequest)
+			return
+		}
+		start = &[2]float64{latitude, longitude}
+	}
 
-func handleGetActivityTypes(w http.ResponseWriter, r *http.Request, user *User) {
-	models, err := selectActivityTypesByCompany(user.ActiveCompanyID)
+	plan, err := planRoute(user.ActiveCompanyID, userID, day, start)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
+		http.Error(w, "Error planning route", http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(models)))
-}
-
-func handlePostActivityTypes(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutActivityType(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteActivityType(w http.ResponseWriter, r *http.Request, user *User) {
+	w.Write(must(json.Marshal(plan)))
 }
 
-func handleGetCurrencies(w http.ResponseWriter, r *http.Request, user *User) {
-	models, err := selectCurrenciesByCompany(user.ActiveCompanyID)
+func handlePostActivityRoute(w http.ResponseWriter, r *http.Request, user *User) {
+	var input RouteOrder
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, "Error parsing route", http.StatusBadRequest)
+		return
+	}
+	if input.UserID == "" {
+		input.UserID = user.ID
+	}
+	assignee, err := selectRouteUser(user.ActiveCompanyID, input.UserID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
+		http.Error(w, "Error loading user", http.StatusInternalServerError)
+		return
+	}
+	if assignee == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	day, err := parseDayIn(input.Date, userLocation(*assignee))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.Write(must(json.Marshal(models)))
-}
-
-func handlePostCurrencies(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutCurrency(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteCurrency(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleGetTasks(w http.ResponseWriter, r *http.Request, user *User) {
-	personID := r.URL.Query().Get("person_id")
-	orgID := r.URL.Query().Get("org_id")
-	onlyActiveTasks := r.URL.Query().Get("only_active_tasks") == "true"
 
-	var models []Task
-	var err error
+	if err := applyRouteOrder(user.ActiveCompanyID, input.UserID, day, input.ActivityIDs); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if personID != "" {
-		models, err = selectTasksByPerson(personID)
-	} else if orgID != "" {
-		models, err = selectTasksByOrganization(orgID)
-	} else {
-		models, err = selectTasksByWorkflow(user.ActiveWorkflowID, onlyActiveTasks)
+	for _, ID := range input.ActivityIDs {
+		model, err := selectActivityByID(ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		timeline := Timeline{
+			UnderCompanyID: user.ActiveCompanyID,
+			UserID:         user.ID,
+			ActivityID:     ID,
+			Action:         "updated",
+		}
+		timeline.Name = model.Name
+		if err := insertTimeline(&timeline); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
+	activities, err := selectRouteActivities(user.ActiveCompanyID, input.UserID, day)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
+		http.Error(w, "Error loading activities", http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(models)))
+	w.Write(must(json.Marshal(activities)))
 }
 
-func handleGetTask(w http.ResponseWriter, r *http.Request, user *User) {
+func handlePostActivitySnooze(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	model, err := selectTaskByID(ID)
-	if err != nil {
-		http.Error(w, "Error loading task", http.StatusBadRequest)
-		return
+	var input struct {
+		Minutes int `json:"minutes"`
 	}
-
-	w.Write(must(json.Marshal(model)))
-}
-
-func handlePostTasks(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Task
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if input.Minutes < 1 || input.Minutes > maxReminderMinutes {
+		http.Error(w, "Please select a snooze of at most four weeks", http.StatusBadRequest)
+		return
+	}
 
-	input.CompanyID = user.ActiveCompanyID
-	input.WorkflowID = user.ActiveWorkflowID
-	input.CreatorUserID = user.ID
-
-	if err := assignOrganization(&input, *user); err != nil {
+	model, err := selectActivityByID(ID)
+	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error loading activity", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity not found", http.StatusNotFound)
 		return
 	}
 
-	if err := assignPerson(&input, *user); err != nil {
+	if err := updateActivitySnooze(ID, time.Now().Add(time.Duration(input.Minutes)*time.Minute)); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := insertTask(&input); err != nil {
+	model, err = selectActivityByID(ID)
+	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
-		UserID:         user.ID,
-		TaskID:         input.ID,
-		Action:         "created",
-	}
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteActivity(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectActivityByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading activity", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity not found", http.StatusNotFound)
+		return
+	}
+
+	locations, err := selectUserLocations(user.ActiveCompanyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading users", http.StatusInternalServerError)
+		return
+	}
+
+	// deleting an undone occurrence skips it, the series goes on with the
+	// next one unless the whole series is deleted
+	scope := r.URL.Query().Get("scope")
+	if scope == "series" && model.SeriesID != "" {
+		if err := deleteActivitySeries(model.SeriesID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	} else if !model.Done {
+		if _, err := createNextOccurrence(*model, assigneeLocation(*model, locations)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	if err := deleteActivity(ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		ActivityID:     ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetActivityFields(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectActivityFieldsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
+}
+
+
+func handlePostActivityFields(w http.ResponseWriter, r *http.Request, user *User) {
+	var input ActivityField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := insertActivityField(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:  user.ActiveCompanyID,
+		UserID:          user.ID,
+		ActivityFieldID: input.ID,
+		Action:          "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+
+func handlePutActivityField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input ActivityField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err := selectActivityFieldByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading activity field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity field not found", http.StatusNotFound)
+		return
+	}
+
+	model.Name = input.Name
+	model.Key = input.Key
+	model.OrderNr = input.OrderNr
+	model.PicklistData = input.PicklistData
+	model.FieldType = input.FieldType
+	model.EditFlag = input.EditFlag
+	model.IndexVisibleFlag = input.IndexVisibleFlag
+	model.DetailsVisibleFlag = input.DetailsVisibleFlag
+	model.AddVisibleFlag = input.AddVisibleFlag
+	model.ImportantFlag = input.ImportantFlag
+	model.BulkEditAllowed = input.BulkEditAllowed
+	model.MandatoryFlag = input.MandatoryFlag
+
+	if err := updateActivityField(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:  model.CompanyID,
+		UserID:          user.ID,
+		ActivityFieldID: model.ID,
+		Action:          "updated",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+
+func handleDeleteActivityField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectActivityFieldByID(ID)
+	if err != nil {
+		http.Error(w, "error loading activity field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity field not found", http.StatusNotFound)
+		return
+	}
+
+	if err := deleteActivityField(*model); err != nil {
+		http.Error(w, "error deleting activity field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:  model.CompanyID,
+		UserID:          user.ID,
+		ActivityFieldID: model.ID,
+		Action:          "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetActivityTypes(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectActivityTypesByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostActivityTypes(w http.ResponseWriter, r *http.Request, user *User) {
+	var input ActivityType
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := prepareActivityType(&input, nil); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := insertActivityType(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		ActivityTypeID: input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+func handlePutActivityTypesOrder(w http.ResponseWriter, r *http.Request, user *User) {
+	var input []string
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := orderActivityTypes(user.ActiveCompanyID, input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	models, err := selectActivityTypesByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePutActivityType(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input ActivityType
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err := selectActivityTypeByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading activity type", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model == nil || model.DeletedAt != nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity type not found", http.StatusNotFound)
+		return
+	}
+
+	input.CompanyID = model.CompanyID
+	input.OrderNr = model.OrderNr
+	if err := prepareActivityType(&input, model); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := updateActivityType(input); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: model.CompanyID,
+		UserID:         user.ID,
+		ActivityTypeID: model.ID,
+		Action:         "updated",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err = selectActivityTypeByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteActivityType(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectActivityTypeByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading activity type", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model == nil || model.DeletedAt != nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Activity type not found", http.StatusNotFound)
+		return
+	}
+
+	if err := removeActivityType(*model, r.URL.Query().Get("replacement_id")); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: model.CompanyID,
+		UserID:         user.ID,
+		ActivityTypeID: model.ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetCurrencies(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectCurrenciesByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostCurrencies(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutCurrency(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteCurrency(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetLostReasons(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectLostReasonsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostLostReasons(w http.ResponseWriter, r *http.Request, user *User) {
+	var input LostReason
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := insertLostReason(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		LostReasonID:   input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+func handlePutLostReason(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input LostReason
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err := selectLostReasonByID(ID)
+	if err != nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Error loading lost reason", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	model.Name = input.Name
+
+	if err := updateLostReason(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: model.CompanyID,
+		UserID:         user.ID,
+		LostReasonID:   model.ID,
+		Action:         "updated",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteLostReason(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectLostReasonByID(ID)
+	if err != nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "error loading lost reason", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if err := deleteLostReason(*model); err != nil {
+		http.Error(w, "error deleting lost reason", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: model.CompanyID,
+		UserID:         user.ID,
+		LostReasonID:   model.ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetTasks(w http.ResponseWriter, r *http.Request, user *User) {
+	personID := r.URL.Query().Get("person_id")
+	orgID := r.URL.Query().Get("org_id")
+	onlyActiveTasks := r.URL.Query().Get("only_active_tasks") == "true"
+
+	var models []Task
+	var err error
+
+	if personID != "" {
+		models, err = selectTasksByPerson(personID)
+	} else if orgID != "" {
+		models, err = selectTasksByOrganization(orgID)
+	} else {
+		models, err = selectTasksByWorkflow(user.ActiveWorkflowID, onlyActiveTasks)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	if filters := customFieldFilters(r.URL.Query()); len(filters) > 0 {
+		var filtered []Task
+		for _, model := range models {
+			if matchCustomFields(model.CustomFields, filters) {
+				filtered = append(filtered, model)
+			}
+		}
+		models = filtered
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handleGetTask(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectTaskByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading task", http.StatusBadRequest)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePostTasks(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Task
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+	input.WorkflowID = user.ActiveWorkflowID
+	input.CreatorUserID = user.ID
+
+	if err := assignOrganization(&input, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := assignPerson(&input, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := insertTask(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		TaskID:         input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectTaskByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePutTask(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Task
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, "Error parsing task", http.StatusBadRequest)
+		return
+	}
+
+	if err := assignOrganization(&input, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := assignPerson(&input, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := updateTask(input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	moved, err := recordTaskStage(input.ID, input.StageID, user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: input.CompanyID,
+		UserID:         user.ID,
+		TaskID:         input.ID,
+		Action:         "updated",
+	}
+	if moved {
+		timeline.StageID = input.StageID
+		timeline.Action = "moved"
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectTaskByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteTask(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	task, err := selectTaskByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading task", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteTask(ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		TaskID:         ID,
+		Action:         "deleted",
+	}
+	timeline.Name = task.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handlePostTaskWon(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	task, err := selectTaskByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading task", http.StatusBadRequest)
+		return
+	}
+	if task.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	if err := markTaskWon(task.ID); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: task.CompanyID,
+		UserID:         user.ID,
+		TaskID:         task.ID,
+		Action:         "won",
+	}
+	timeline.Name = task.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectTaskByID(task.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePostTaskLost(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input Task
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, "Error parsing task", http.StatusBadRequest)
+		return
+	}
+
+	task, err := selectTaskByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading task", http.StatusBadRequest)
+		return
+	}
+	if task.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	if input.LostReasonID == "" {
+		http.Error(w, "Please select a lost reason", http.StatusBadRequest)
+		return
+	}
+	reason, err := selectLostReasonByID(input.LostReasonID)
+	if err != nil || reason.CompanyID != task.CompanyID {
+		log.Println(err)
+		http.Error(w, "Error loading lost reason", http.StatusBadRequest)
+		return
+	}
+
+	if err := markTaskLost(task.ID, *reason); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: task.CompanyID,
+		UserID:         user.ID,
+		TaskID:         task.ID,
+		LostReasonID:   reason.ID,
+		Action:         "lost",
+	}
+	timeline.Name = task.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectTaskByID(task.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePostTaskReopen(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	task, err := selectTaskByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading task", http.StatusBadRequest)
+		return
+	}
+	if task.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	if err := reopenTask(task.ID); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: task.CompanyID,
+		UserID:         user.ID,
+		TaskID:         task.ID,
+		Action:         "reopened",
+	}
+	timeline.Name = task.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectTaskByID(task.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleGetTaskStageHistory(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	task, err := selectTaskByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading task", http.StatusBadRequest)
+		return
+	}
+	if task.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	models, err := selectTaskStageHistory(task.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostTasksReorder(w http.ResponseWriter, r *http.Request, user *User) {
+	var input TaskOrder
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, "Error parsing task order", http.StatusBadRequest)
+		return
+	}
+
+	stage, err := selectStageByID(input.StageID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading stage", http.StatusBadRequest)
+		return
+	}
+
+	workflow, err := selectWorkflowByID(stage.WorkflowID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading workflow", http.StatusInternalServerError)
+		return
+	}
+	if workflow.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Stage not found", http.StatusNotFound)
+		return
+	}
+
+	moved, err := reorderTasks(*stage, workflow.CompanyID, input.TaskIDs, user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, taskID := range moved {
+		task, err := selectTaskByID(taskID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		timeline := Timeline{
+			UnderCompanyID: workflow.CompanyID,
+			UserID:         user.ID,
+			TaskID:         task.ID,
+			StageID:        stage.ID,
+			Action:         "moved",
+		}
+		timeline.Name = task.Name
+		if err := insertTimeline(&timeline); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	models, err := selectTasksByWorkflow(workflow.ID, true)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handleGetForecast(w http.ResponseWriter, r *http.Request, user *User) {
+	fromTime, err := parseTime(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	untilTime, err := parseTime(r.URL.Query().Get("until"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	workflowID := r.URL.Query().Get("workflow_id")
+	if workflowID != "" && !isUUID(workflowID) {
+		http.Error(w, "Invalid workflow_id", http.StatusBadRequest)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID != "" && !isUUID(userID) {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	models, err := selectForecastByCompany(user.ActiveCompanyID, workflowID, userID, fromTime, untilTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handleGetStageReport(w http.ResponseWriter, r *http.Request, user *User) {
+	fromTime, err := parseTime(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	untilTime, err := parseTime(r.URL.Query().Get("until"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	workflowID := r.URL.Query().Get("workflow_id")
+
+	models, err := selectStageReportByCompany(user.ActiveCompanyID, workflowID, fromTime, untilTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handleGetTaskFields(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectTaskFieldsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostTaskFields(w http.ResponseWriter, r *http.Request, user *User) {
+	var input TaskField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := insertTaskField(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		TaskFieldID:    input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+func handlePutTaskField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input TaskField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err := selectTaskFieldByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading task field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Task field not found", http.StatusNotFound)
+		return
+	}
+
+	model.Name = input.Name
+	model.Key = input.Key
+	model.OrderNr = input.OrderNr
+	model.PicklistData = input.PicklistData
+	model.FieldType = input.FieldType
+	model.EditFlag = input.EditFlag
+	model.IndexVisibleFlag = input.IndexVisibleFlag
+	model.DetailsVisibleFlag = input.DetailsVisibleFlag
+	model.AddVisibleFlag = input.AddVisibleFlag
+	model.ImportantFlag = input.ImportantFlag
+	model.BulkEditAllowed = input.BulkEditAllowed
+	model.MandatoryFlag = input.MandatoryFlag
+
+	if err := updateTaskField(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: model.CompanyID,
+		UserID:         user.ID,
+		TaskFieldID:    model.ID,
+		Action:         "updated",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteTaskField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectTaskFieldByID(ID)
+	if err != nil {
+		http.Error(w, "error loading task field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Task field not found", http.StatusNotFound)
+		return
+	}
+
+	if err := deleteTaskField(*model); err != nil {
+		http.Error(w, "error deleting task field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: model.CompanyID,
+		UserID:         user.ID,
+		TaskFieldID:    model.ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetFiles(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePostFiles(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutFile(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteFile(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetFilters(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePostFilters(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutFilter(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteFilter(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetGoals(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePostGoals(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutGoal(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteGoal(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetNotes(w http.ResponseWriter, r *http.Request, user *User) {
+	taskID := r.URL.Query().Get("task_id")
+	personID := r.URL.Query().Get("person_id")
+	orgID := r.URL.Query().Get("org_id")
+
+	var models []Note
+	var err error
+
+	if taskID != "" {
+		models, err = selectNotesByTask(taskID)
+	} else if personID != "" {
+		models, err = selectNotesByPerson(personID)
+	} else if orgID != "" {
+		models, err = selectNotesByOrganization(orgID)
+	}
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading notes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostNotes(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Note
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+	input.UserID = user.ID
+	input.UserName = user.Name
+
+	if err := insertNote(&input); err != nil {
+		log.Println(err)
+		http.Error(w, "Error creating note", http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: input.CompanyID,
+		UserID:         user.ID,
+		NoteID:         input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+func handlePutNote(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteNote(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	note, err := selectNoteByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error selecting note", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteNote(ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: note.CompanyID,
+		UserID:         user.ID,
+		NoteID:         ID,
+		Action:         "deleted",
+	}
+	timeline.Name = note.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetNoteFields(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePostNoteFields(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutNoteField(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteNoteField(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetCategories(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePostCategories(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutCategory(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeleteCategory(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetOrganizations(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectOrganizationsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostOrganizations(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Organization
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+	input.OwnerID = user.ID
+
+	if err := insertOrganization(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		OrganizationID: input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectOrganizationByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePutOrganization(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Organization
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := updateOrganization(input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		OrganizationID: input.ID,
+		Action:         "updated",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectOrganizationByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteOrganization(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectOrganizationByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading organization", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteOrganization(ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		OrganizationID: ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetOrganizationDuplicates(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectOrganizationByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organization", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	duplicates, err := findOrganizationDuplicates(*model)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error finding duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(duplicates)))
+}
+
+func handlePostOrganizationMerge(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input OrganizationMerge
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if input.MergeID == "" || input.MergeID == ID {
+		http.Error(w, "Please select another organization to merge", http.StatusBadRequest)
+		return
+	}
+
+	winner, err := selectOrganizationByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organization", http.StatusInternalServerError)
+		return
+	}
+	if winner == nil || winner.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	loser, err := selectOrganizationByID(input.MergeID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organization", http.StatusInternalServerError)
+		return
+	}
+	if loser == nil || loser.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	if err := mergeOrganizations(*winner, *loser); err != nil {
+		log.Println(err)
+		if errorStatus(err) == http.StatusBadRequest {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error merging organizations", http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		OrganizationID: winner.ID,
+		Action:         "merged",
+	}
+	timeline.Name = loser.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectOrganizationByID(winner.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleGetOrganizationFields(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectOrganizationFieldsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
+}
+
+
+func handlePostOrganizationFields(w http.ResponseWriter, r *http.Request, user *User) {
+	var input OrganizationField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := insertOrganizationField(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:      user.ActiveCompanyID,
+		UserID:              user.ID,
+		OrganizationFieldID: input.ID,
+		Action:              "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+
+func handlePutOrganizationField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input OrganizationField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err := selectOrganizationFieldByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading organization field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization field not found", http.StatusNotFound)
+		return
+	}
+
+	model.Name = input.Name
+	model.Key = input.Key
+	model.OrderNr = input.OrderNr
+	model.PicklistData = input.PicklistData
+	model.FieldType = input.FieldType
+	model.EditFlag = input.EditFlag
+	model.IndexVisibleFlag = input.IndexVisibleFlag
+	model.DetailsVisibleFlag = input.DetailsVisibleFlag
+	model.AddVisibleFlag = input.AddVisibleFlag
+	model.ImportantFlag = input.ImportantFlag
+	model.BulkEditAllowed = input.BulkEditAllowed
+	model.UseField = input.UseField
+	model.Link = input.Link
+	model.MandatoryFlag = input.MandatoryFlag
+
+	if err := updateOrganizationField(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:      model.CompanyID,
+		UserID:              user.ID,
+		OrganizationFieldID: model.ID,
+		Action:              "updated",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+
+func handleDeleteOrganizationField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectOrganizationFieldByID(ID)
+	if err != nil {
+		http.Error(w, "error loading organization field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization field not found", http.StatusNotFound)
+		return
+	}
+
+	if err := deleteOrganizationField(*model); err != nil {
+		http.Error(w, "error deleting organization field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:      model.CompanyID,
+		UserID:              user.ID,
+		OrganizationFieldID: model.ID,
+		Action:              "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetOrganizationGraph(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectOrganizationByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organization", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	graph, err := selectOrganizationGraph(*model)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organization hierarchy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(graph)))
+}
+
+// geocodeErrorStatus returns the HTTP status of a geocoding error
+func geocodeErrorStatus(err error) int {
+	switch err {
+	case errGeocodeNotFound:
+		return http.StatusNotFound
+	case errGeocodeQuota:
+		return http.StatusServiceUnavailable
+	case errGeocodeNoAddress:
+		return http.StatusBadRequest
+	case errGeocodeDisabled:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func handleGetGeocode(w http.ResponseWriter, r *http.Request, user *User) {
+	address := r.URL.Query().Get("address")
+
+	g, err := currentGeocoder()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	location, err := cachedGeocode(g, address)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), geocodeErrorStatus(err))
+		return
+	}
+
+	w.Write(must(json.Marshal(location)))
+}
+
+func handleGetReverseGeocode(w http.ResponseWriter, r *http.Request, user *User) {
+	latitude, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	if err != nil {
+		http.Error(w, "Invalid latitude", http.StatusBadRequest)
+		return
+	}
+	longitude, err := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
+	if err != nil {
+		http.Error(w, "Invalid longitude", http.StatusBadRequest)
+		return
+	}
+
+	g, err := currentGeocoder()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	location, err := g.ReverseGeocode(latitude, longitude)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), geocodeErrorStatus(err))
+		return
+	}
+
+	w.Write(must(json.Marshal(location)))
+}
+
+// organizationFilterFromQuery reads the owner_id, category_id and
+// open_tasks map filters
+func organizationFilterFromQuery(r *http.Request) (OrganizationFilter, error) {
+	query := r.URL.Query()
+	filter := OrganizationFilter{
+		OwnerID:    query.Get("owner_id"),
+		CategoryID: query.Get("category_id"),
+		OpenTasks:  query.Get("open_tasks"),
+	}
+	if filter.OpenTasks != "" && filter.OpenTasks != "true" && filter.OpenTasks != "false" {
+		return filter, errors.New("Please select open_tasks true or false")
+	}
+	return filter, nil
+}
+
+func handleGetNearbyOrganizations(w http.ResponseWriter, r *http.Request, user *User) {
+	latitude, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		http.Error(w, "Invalid latitude", http.StatusBadRequest)
+		return
+	}
+	longitude, err := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		http.Error(w, "Invalid longitude", http.StatusBadRequest)
+		return
+	}
+	radius := 10.0
+	if s := r.URL.Query().Get("radius"); s != "" {
+		radius, err = strconv.ParseFloat(s, 64)
+		if err != nil || radius <= 0 {
+			http.Error(w, "Invalid radius", http.StatusBadRequest)
+			return
+		}
+	}
+	filter, err := organizationFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := selectNearbyOrganizations(user.ActiveCompanyID, latitude, longitude, radius, filter, userLocation(*user))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organizations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(result)))
+}
+
+func handleGetOrganizationsGeoJSON(w http.ResponseWriter, r *http.Request, user *User) {
+	filter, err := organizationFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orgs, err := selectMappedOrganizations(user.ActiveCompanyID, filter)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organizations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(must(json.Marshal(organizationsGeoJSON(orgs))))
+}
+
+func handleGetActivitiesGeoJSON(w http.ResponseWriter, r *http.Request, user *User) {
+	filter, err := organizationFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orgs, err := selectMappedOrganizations(user.ActiveCompanyID, filter)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organizations", http.StatusInternalServerError)
+		return
+	}
+
+	activities, err := selectUpcomingActivitiesByCompany(user.ActiveCompanyID, startOfToday(userLocation(*user)))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading activities", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(must(json.Marshal(activitiesGeoJSON(activities, orgs))))
+}
+
+func handleGetOrganizationRelationships(w http.ResponseWriter, r *http.Request, user *User) {
+	orgID := r.URL.Query().Get("org_id")
+
+	org, err := selectOrganizationByID(orgID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading organization", http.StatusInternalServerError)
+		return
+	}
+	if org == nil || org.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	models, err := selectOrganizationRelationshipsByOrganization(orgID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostOrganizationRelationships(w http.ResponseWriter, r *http.Request, user *User) {
+	var input OrganizationRelationship
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.ID = ""
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := saveOrganizationRelationship(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	model, err := selectOrganizationRelationshipByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:             user.ActiveCompanyID,
+		UserID:                     user.ID,
+		OrganizationRelationshipID: model.ID,
+		OrganizationID:             model.RelOwnerOrgID,
+		Action:                     "created",
+	}
+	timeline.Name = model.RelatedOrganizationName
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePutOrganizationRelationship(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	existing, err := selectOrganizationRelationshipByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading relationship", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil || existing.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Relationship not found", http.StatusNotFound)
+		return
+	}
+
+	var input OrganizationRelationship
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.ID = ID
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := saveOrganizationRelationship(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	model, err := selectOrganizationRelationshipByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:             user.ActiveCompanyID,
+		UserID:                     user.ID,
+		OrganizationRelationshipID: model.ID,
+		OrganizationID:             model.RelOwnerOrgID,
+		Action:                     "updated",
+	}
+	timeline.Name = model.RelatedOrganizationName
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteOrganizationRelationship(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectOrganizationRelationshipByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading relationship", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Relationship not found", http.StatusNotFound)
+		return
+	}
+
+	if err := deleteOrganizationRelationship(*model); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID:             user.ActiveCompanyID,
+		UserID:                     user.ID,
+		OrganizationRelationshipID: model.ID,
+		OrganizationID:             model.RelOwnerOrgID,
+		Action:                     "deleted",
+	}
+	timeline.Name = model.RelatedOrganizationName
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetContacts(w http.ResponseWriter, r *http.Request, user *User) {
+	personID := r.URL.Query().Get("person_id")
+
+	models, err := selectContactsByPerson(personID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostContacts(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Contact
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.Type == "" {
+		input.DetectType()
+	}
+
+	if err := insertContact(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		ContactID:      input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(input)))
+}
+
+func handlePutContact(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Contact
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.Type == "" {
+		input.DetectType()
+	}
+
+	if err := updateContact(input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		ContactID:      input.ID,
+		Action:         "updated",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectContactByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeleteContact(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectContactByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading contact", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteContact(ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		ContactID:      model.ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetPerson(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectPersonByID(ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleGetPersons(w http.ResponseWriter, r *http.Request, user *User) {
+	orgID := r.URL.Query().Get("org_id")
+
+	var models []Person
+	var err error
+
+	if orgID != "" {
+		models, err = selectPersonsByOrganization(orgID)
+	} else {
+		models, err = selectPersonsByCompany(user.ActiveCompanyID)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Write(must(json.Marshal(models)))
+}
+
+func handlePostPersons(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Person
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+	input.OwnerID = user.ID
+
+	if err := assignOrganization(&input, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Phone and Email are kept for clients that send a single number and
+	// address
+	contacts := input.Contacts
+	for _, contact := range []Contact{{Type: "phone"}, {Type: "email"}} {
+		contact.Name = input.Phone
+		if contact.Type == "email" {
+			contact.Name = input.Email
+		}
+		if contact.Name != "" {
+			contact.Primary = !hasPrimaryContact(contacts, contact.Type)
+			contacts = append(contacts, contact)
+		}
+	}
+	if err := normalizePersonContacts(contacts); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := insertPerson(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		PersonID:       input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := savePersonContacts(input, contacts, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectPersonByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handlePutPerson(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Person
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := normalizePersonContacts(input.Contacts); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := assignOrganization(&input, *user); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := updatePerson(input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// contacts are left as they are when the list is not sent
+	if input.Contacts != nil {
+		if err := savePersonContacts(input, input.Contacts, *user); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		PersonID:       input.ID,
+		Action:         "updated",
+	}
 	timeline.Name = input.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	model, err := selectPersonByID(input.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleDeletePerson(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectPersonByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading person", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deletePerson(ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		PersonID:       ID,
+		Action:         "deleted",
+	}
+	timeline.Name = model.Name
+	if err := insertTimeline(&timeline); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal("ok")))
+}
+
+func handleGetPersonDuplicates(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectPersonByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error loading person", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Person not found", http.StatusNotFound)
 		return
 	}
 
-	model, err := selectTaskByID(input.ID)
+	duplicates, err := findPersonDuplicates(*model)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error finding duplicates", http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(model)))
+	w.Write(must(json.Marshal(duplicates)))
 }
 
-func handlePutTask(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Task
+func handlePostPersonMerge(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input PersonMerge
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
-		http.Error(w, "Error parsing task", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if input.MergeID == "" || input.MergeID == ID {
+		http.Error(w, "Please select another person to merge", http.StatusBadRequest)
 		return
 	}
 
-	if err := assignOrganization(&input, *user); err != nil {
+	winner, err := selectPersonByID(ID)
+	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error loading person", http.StatusInternalServerError)
+		return
+	}
+	if winner == nil || winner.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Person not found", http.StatusNotFound)
 		return
 	}
 
-	if err := assignPerson(&input, *user); err != nil {
+	loser, err := selectPersonByID(input.MergeID)
+	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error loading person", http.StatusInternalServerError)
+		return
+	}
+	if loser == nil || loser.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Person not found", http.StatusNotFound)
 		return
 	}
 
-	if err := updateTask(input); err != nil {
+	if err := mergePersons(*winner, *loser); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error merging persons", http.StatusInternalServerError)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: input.CompanyID,
+		UnderCompanyID: user.ActiveCompanyID,
 		UserID:         user.ID,
-		TaskID:         input.ID,
-		Action:         "updated",
+		PersonID:       winner.ID,
+		Action:         "merged",
 	}
-	timeline.Name = input.Name
+	timeline.Name = loser.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	model, err := selectTaskByID(input.ID)
+	model, err := selectPersonByID(winner.ID)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1071,173 +3596,385 @@ func handlePutTask(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal(model)))
 }
 
-func handleDeleteTask(w http.ResponseWriter, r *http.Request, user *User) {
-	vars := mux.Vars(r)
-	ID := vars["id"]
+func handlePostPersonsVCardPreview(w http.ResponseWriter, r *http.Request, user *User) {
+	imports, err := parseVCards(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	task, err := selectTaskByID(ID)
+	if err := previewPersonImports(imports, user.ActiveCompanyID); err != nil {
+		log.Println(err)
+		http.Error(w, "Error finding duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(must(json.Marshal(imports)))
+}
+
+func handlePostPersonsVCard(w http.ResponseWriter, r *http.Request, user *User) {
+	var input []PersonImport
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	models, err := importPersons(input, *user)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "error loading task", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := deleteTask(ID); err != nil {
+	w.Write(must(json.Marshal(models)))
+}
+
+func handleGetPersonsVCard(w http.ResponseWriter, r *http.Request, user *User) {
+	query := r.URL.Query()
+	version := query.Get("version")
+	if version == "" {
+		version = "3.0"
+	}
+
+	var models []Person
+	var err error
+	if orgID := query.Get("org_id"); orgID != "" {
+		models, err = selectPersonsByOrganization(orgID)
+	} else {
+		models, err = selectPersonsByCompany(user.ActiveCompanyID)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
-		UserID:         user.ID,
-		TaskID:         ID,
-		Action:         "deleted",
+	IDs := make(map[string]bool)
+	for _, ID := range strings.Split(query.Get("ids"), ",") {
+		if ID != "" {
+			IDs[ID] = true
+		}
 	}
-	timeline.Name = task.Name
-	if err := insertTimeline(&timeline); err != nil {
+	filters := customFieldFilters(query)
+
+	var b bytes.Buffer
+	for _, model := range models {
+		if model.CompanyID != user.ActiveCompanyID || (len(IDs) > 0 && !IDs[model.ID]) || !matchCustomFields(model.CustomFields, filters) {
+			continue
+		}
+		contacts, err := selectContactsByPerson(model.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if err := writeVCard(&b, model, contacts, version); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="persons.vcf"`)
+	w.Write(b.Bytes())
+}
+
+func handleGetPersonVCard(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = "3.0"
+	}
+
+	model, err := selectPersonByID(ID)
+	if err != nil {
 		log.Println(err)
+		http.Error(w, "Error loading person", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Person not found", http.StatusNotFound)
+		return
+	}
+
+	contacts, err := selectContactsByPerson(model.ID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
 
-	w.Write(must(json.Marshal("ok")))
-}
+	var b bytes.Buffer
+	if err := writeVCard(&b, *model, contacts, version); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handleGetTaskFields(w http.ResponseWriter, r *http.Request, user *User) {
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.vcf"`, customFieldKey(model.Name)))
+	w.Write(b.Bytes())
 }
 
-func handlePostTaskFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
+func handlePostImportPreview(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Import
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handlePutTaskField(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	preview, err := previewImport(input.Data, user.ActiveCompanyID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handleDeleteTaskField(w http.ResponseWriter, r *http.Request, user *User) {
+	w.Write(must(json.Marshal(preview)))
 }
 
-func handleGetFiles(w http.ResponseWriter, r *http.Request, user *User) {
+func handleGetImports(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectImportsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
 }
 
-func handlePostFiles(w http.ResponseWriter, r *http.Request, user *User) {
-}
+func handleGetImport(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
 
-func handlePutFile(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	model, err := selectImportByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading import", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+	model.Data = ""
 
-func handleDeleteFile(w http.ResponseWriter, r *http.Request, user *User) {
+	w.Write(must(json.Marshal(model)))
 }
 
-func handleGetFilters(w http.ResponseWriter, r *http.Request, user *User) {
-}
+func handlePostImports(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Import
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handlePostFilters(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	input.CompanyID = user.ActiveCompanyID
+	input.UserID = user.ID
 
-func handlePutFilter(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	if input.WorkflowID != "" {
+		workflow, err := selectWorkflowByID(input.WorkflowID)
+		if err != nil {
+			http.Error(w, "Error loading workflow", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if workflow.CompanyID != user.ActiveCompanyID {
+			http.Error(w, "Workflow not found", http.StatusNotFound)
+			return
+		}
+	}
 
-func handleDeleteFilter(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	if err := validateImport(input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handleGetGoals(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	if _, err := readCSV(input.Data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handlePostGoals(w http.ResponseWriter, r *http.Request, user *User) {
+	if err := insertImport(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	input.Data = ""
+
+	w.Write(must(json.Marshal(input)))
 }
 
-func handlePutGoal(w http.ResponseWriter, r *http.Request, user *User) {
+func handlePostImportRevert(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	model, err := selectImportByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading import", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+
+	if err := revertImport(*model); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	model, err = selectImportByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading import", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	model.Data = ""
+
+	w.Write(must(json.Marshal(model)))
 }
 
-func handleDeleteGoal(w http.ResponseWriter, r *http.Request, user *User) {
+func handleGetPersonFields(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectPersonFieldsByCompany(user.ActiveCompanyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Write(must(json.Marshal(models)))
 }
 
-func handleGetNotes(w http.ResponseWriter, r *http.Request, user *User) {
-	taskID := r.URL.Query().Get("task_id")
-	personID := r.URL.Query().Get("person_id")
-	orgID := r.URL.Query().Get("org_id")
 
-	var models []Note
-	var err error
+func handlePostPersonFields(w http.ResponseWriter, r *http.Request, user *User) {
+	var input PersonField
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if taskID != "" {
-		models, err = selectNotesByTask(taskID)
-	} else if personID != "" {
-		models, err = selectNotesByPerson(personID)
-	} else if orgID != "" {
-		models, err = selectNotesByOrganization(orgID)
+	input.CompanyID = user.ActiveCompanyID
+
+	if err := insertPersonField(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if err != nil {
+	timeline := Timeline{
+		UnderCompanyID: user.ActiveCompanyID,
+		UserID:         user.ID,
+		PersonFieldID:  input.ID,
+		Action:         "created",
+	}
+	timeline.Name = input.Name
+	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
-		http.Error(w, "Error loading notes", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(models)))
+	w.Write(must(json.Marshal(input)))
 }
 
-func handlePostNotes(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Note
+
+func handlePutPersonField(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input PersonField
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	input.CompanyID = user.ActiveCompanyID
-	input.UserID = user.ID
-	input.UserName = user.Name
+	model, err := selectPersonFieldByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading person field", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Person field not found", http.StatusNotFound)
+		return
+	}
 
-	if err := insertNote(&input); err != nil {
+	model.Name = input.Name
+	model.Key = input.Key
+	model.OrderNr = input.OrderNr
+	model.PicklistData = input.PicklistData
+	model.FieldType = input.FieldType
+	model.EditFlag = input.EditFlag
+	model.IndexVisibleFlag = input.IndexVisibleFlag
+	model.DetailsVisibleFlag = input.DetailsVisibleFlag
+	model.AddVisibleFlag = input.AddVisibleFlag
+	model.ImportantFlag = input.ImportantFlag
+	model.BulkEditAllowed = input.BulkEditAllowed
+	model.UseField = input.UseField
+	model.Link = input.Link
+	model.MandatoryFlag = input.MandatoryFlag
+
+	if err := updatePersonField(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Println(err)
-		http.Error(w, "Error creating note", http.StatusInternalServerError)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: input.CompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		NoteID:         input.ID,
-		Action:         "created",
+		PersonFieldID:  model.ID,
+		Action:         "updated",
 	}
-	timeline.Name = input.Name
+	timeline.Name = model.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(input)))
+	w.Write(must(json.Marshal(model)))
 }
 
-func handlePutNote(w http.ResponseWriter, r *http.Request, user *User) {
-}
 
-func handleDeleteNote(w http.ResponseWriter, r *http.Request, user *User) {
+func handleDeletePersonField(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	note, err := selectNoteByID(ID)
+	model, err := selectPersonFieldByID(ID)
 	if err != nil {
+		http.Error(w, "error loading person field", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, "error selecting note", http.StatusInternalServerError)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Person field not found", http.StatusNotFound)
 		return
 	}
 
-	if err := deleteNote(ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := deletePersonField(*model); err != nil {
+		http.Error(w, "error deleting person field", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: note.CompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		NoteID:         ID,
+		PersonFieldID:  model.ID,
 		Action:         "deleted",
 	}
-	timeline.Name = note.Name
+	timeline.Name = model.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1247,32 +3984,8 @@ func handleDeleteNote(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal("ok")))
 }
 
-func handleGetNoteFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostNoteFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutNoteField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteNoteField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleGetCategories(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostCategories(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutCategory(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteCategory(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleGetOrganizations(w http.ResponseWriter, r *http.Request, user *User) {
-	models, err := selectOrganizationsByCompany(user.ActiveCompanyID)
+func handleGetWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectWorkflowsByCompany(user.ActiveCompanyID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
@@ -1281,8 +3994,8 @@ func handleGetOrganizations(w http.ResponseWriter, r *http.Request, user *User)
 	w.Write(must(json.Marshal(models)))
 }
 
-func handlePostOrganizations(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Organization
+func handlePostWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Workflow
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -1290,9 +4003,20 @@ func handlePostOrganizations(w http.ResponseWriter, r *http.Request, user *User)
 	}
 
 	input.CompanyID = user.ActiveCompanyID
-	input.OwnerID = user.ID
 
-	if err := insertOrganization(&input); err != nil {
+	if input.TemplateID != "" {
+		template, err := findWorkflowTemplate(user.ActiveCompanyID, input.TemplateID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Error loading workflow template", http.StatusBadRequest)
+			return
+		}
+		if err := insertWorkflowFromTemplate(&input, *template); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := insertWorkflow(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1301,7 +4025,7 @@ func handlePostOrganizations(w http.ResponseWriter, r *http.Request, user *User)
 	timeline := Timeline{
 		UnderCompanyID: user.ActiveCompanyID,
 		UserID:         user.ID,
-		OrganizationID: input.ID,
+		WorkflowID:     input.ID,
 		Action:         "created",
 	}
 	timeline.Name = input.Name
@@ -1311,77 +4035,86 @@ func handlePostOrganizations(w http.ResponseWriter, r *http.Request, user *User)
 		return
 	}
 
-	model, err := selectOrganizationByID(input.ID)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Write(must(json.Marshal(model)))
+	w.Write(must(json.Marshal(input)))
 }
 
-func handlePutOrganization(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Organization
+func handlePutWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input Workflow
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := updateOrganization(input); err != nil {
+	model, err := selectWorkflowByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading workflow", http.StatusInternalServerError)
 		log.Println(err)
+		return
+	}
+
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	model.Name = input.Name
+	model.OrderNr = input.OrderNr
+
+	if err := updateWorkflow(*model); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		OrganizationID: input.ID,
+		WorkflowID:     model.ID,
 		Action:         "updated",
 	}
-	timeline.Name = input.Name
+	timeline.Name = model.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	model, err := selectOrganizationByID(input.ID)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	w.Write(must(json.Marshal(model)))
 }
 
-func handleDeleteOrganization(w http.ResponseWriter, r *http.Request, user *User) {
+func handleDeleteWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	model, err := selectOrganizationByID(ID)
+	workflow, err := selectWorkflowByID(ID)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "error loading organization", http.StatusInternalServerError)
+		http.Error(w, "error loading workflow", http.StatusInternalServerError)
 		return
 	}
 
-	if err := deleteOrganization(ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if workflow.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	if err := deleteWorkflow(ID); err != nil {
 		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
+		UnderCompanyID: workflow.CompanyID,
 		UserID:         user.ID,
-		OrganizationID: ID,
+		WorkflowID:     ID,
 		Action:         "deleted",
 	}
-	timeline.Name = model.Name
+	timeline.Name = workflow.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1391,176 +4124,237 @@ func handleDeleteOrganization(w http.ResponseWriter, r *http.Request, user *User
 	w.Write(must(json.Marshal("ok")))
 }
 
-func handleGetOrganizationFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostOrganizationFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutOrganizationField(w http.ResponseWriter, r *http.Request, user *User) {
-}
+func handlePostWorkflowMigrate(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
 
-func handleDeleteOrganizationField(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	var input WorkflowMigration
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handleGetOrganizationRelationships(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	source, err := selectWorkflowByID(ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading workflow", http.StatusInternalServerError)
+		return
+	}
+	if source.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
 
-func handlePostOrganizationRelationships(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	target, err := selectWorkflowByID(input.TargetWorkflowID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error loading target workflow", http.StatusBadRequest)
+		return
+	}
+	if target.CompanyID != source.CompanyID {
+		http.Error(w, "Target workflow not found", http.StatusNotFound)
+		return
+	}
 
-func handlePutOrganizationRelationship(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	stageMap, err := workflowStageMap(source.ID, target.ID, input.StageMap)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handleDeleteOrganizationRelationship(w http.ResponseWriter, r *http.Request, user *User) {
-}
+	moved, err := migrateAndDeleteWorkflow(*source, *target, stageMap, user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func handleGetContacts(w http.ResponseWriter, r *http.Request, user *User) {
-	personID := r.URL.Query().Get("person_id")
+	for _, task := range moved {
+		timeline := Timeline{
+			UnderCompanyID: source.CompanyID,
+			UserID:         user.ID,
+			TaskID:         task.ID,
+			StageID:        task.StageID,
+			Action:         "moved",
+		}
+		timeline.Name = task.Name
+		if err := insertTimeline(&timeline); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	models, err := selectContactsByPerson(personID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	timeline := Timeline{
+		UnderCompanyID: source.CompanyID,
+		UserID:         user.ID,
+		WorkflowID:     source.ID,
+		Action:         "deleted",
+	}
+	timeline.Name = source.Name
+	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(models)))
+	w.Write(must(json.Marshal("ok")))
 }
 
-func handlePostContacts(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Contact
+func handlePostWorkflowClone(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input WorkflowClone
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	input.DetectType()
-
-	if err := insertContact(&input); err != nil {
+	source, err := selectWorkflowByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading workflow", http.StatusInternalServerError)
 		log.Println(err)
+		return
+	}
+	if source.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	model, err := cloneWorkflow(*source, input.Name, user.ID, input.IncludeTasks)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		ContactID:      input.ID,
+		WorkflowID:     model.ID,
 		Action:         "created",
 	}
-	timeline.Name = input.Name
+	timeline.Name = model.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(must(json.Marshal(input)))
+	w.Write(must(json.Marshal(model)))
 }
 
-func handlePutContact(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Contact
+func handlePostWorkflowTemplate(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input WorkflowTemplate
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	input.DetectType()
-
-	if err := updateContact(input); err != nil {
+	workflow, err := selectWorkflowByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading workflow", http.StatusInternalServerError)
 		log.Println(err)
+		return
+	}
+	if workflow.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	model, err := saveWorkflowAsTemplate(*workflow, input.Name)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
 
-	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
-		UserID:         user.ID,
-		ContactID:      input.ID,
-		Action:         "updated",
-	}
-	timeline.Name = input.Name
-	if err := insertTimeline(&timeline); err != nil {
-		log.Println(err)
+	w.Write(must(json.Marshal(model)))
+}
+
+func handleGetWorkflowTemplates(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectWorkflowTemplates(user.ActiveCompanyID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
 		return
 	}
-
-	w.Write(must(json.Marshal(input)))
+	w.Write(must(json.Marshal(models)))
 }
 
-func handleDeleteContact(w http.ResponseWriter, r *http.Request, user *User) {
+func handleDeleteWorkflowTemplate(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	model, err := selectContactByID(ID)
+	model, err := selectWorkflowTemplateByID(ID)
 	if err != nil {
+		http.Error(w, "error loading workflow template", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, "error loading contact", http.StatusInternalServerError)
 		return
 	}
-
-	if err := deleteContact(ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println(err)
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Workflow template not found", http.StatusNotFound)
 		return
 	}
 
-	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
-		UserID:         user.ID,
-		ContactID:      model.ID,
-		Action:         "deleted",
-	}
-	timeline.Name = model.Name
-	if err := insertTimeline(&timeline); err != nil {
+	if err := deleteWorkflowTemplate(*model); err != nil {
+		http.Error(w, "error deleting workflow template", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Write(must(json.Marshal("ok")))
 }
 
-func handleGetPerson(w http.ResponseWriter, r *http.Request, user *User) {
-	vars := mux.Vars(r)
-	ID := vars["id"]
+func handleGetPrices(w http.ResponseWriter, r *http.Request, user *User) {
+}
 
-	model, err := selectPersonByID(ID)
+func handlePostPrices(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handlePutPrice(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleDeletePrice(w http.ResponseWriter, r *http.Request, user *User) {
+}
+
+func handleGetProducts(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectProductsByCompany(user.ActiveCompanyID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	w.Write(must(json.Marshal(model)))
+	w.Write(must(json.Marshal(models)))
 }
 
-func handleGetPersons(w http.ResponseWriter, r *http.Request, user *User) {
-	orgID := r.URL.Query().Get("org_id")
-
-	var models []Person
-	var err error
-
-	if orgID != "" {
-		models, err = selectPersonsByOrganization(orgID)
-	} else {
-		models, err = selectPersonsByCompany(user.ActiveCompanyID)
-	}
+func handleGetProduct(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
 
+	model, err := selectProductByID(ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error loading product", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-
-	w.Write(must(json.Marshal(models)))
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	w.Write(must(json.Marshal(model)))
 }
 
-func handlePostPersons(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Person
+func handlePostProducts(w http.ResponseWriter, r *http.Request, user *User) {
+	var input Product
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -1568,24 +4362,20 @@ func handlePostPersons(w http.ResponseWriter, r *http.Request, user *User) {
 	}
 
 	input.CompanyID = user.ActiveCompanyID
-	input.OwnerID = user.ID
-
-	if err := assignOrganization(&input, *user); err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if input.OwnerID == "" {
+		input.OwnerID = user.ID
 	}
 
-	if err := insertPerson(&input); err != nil {
+	if err := insertProduct(&input); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	timeline := Timeline{
 		UnderCompanyID: user.ActiveCompanyID,
 		UserID:         user.ID,
-		PersonID:       input.ID,
+		ProductID:      input.ID,
 		Action:         "created",
 	}
 	timeline.Name = input.Name
@@ -1595,90 +4385,61 @@ func handlePostPersons(w http.ResponseWriter, r *http.Request, user *User) {
 		return
 	}
 
-	if input.Phone != "" {
-		contact := Contact{
-			PersonID: input.ID,
-		}
-		contact.Name = input.Phone
-
-		timeline := Timeline{
-			UnderCompanyID: user.ActiveCompanyID,
-			UserID:         user.ID,
-			ContactID:      contact.ID,
-			Action:         "created",
-		}
-		timeline.Name = contact.Name
-		if err := insertTimeline(&timeline); err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	if input.Email != "" {
-		contact := Contact{
-			PersonID: input.ID,
-		}
-		contact.Name = input.Email
-
-		timeline := Timeline{
-			UnderCompanyID: user.ActiveCompanyID,
-			UserID:         user.ID,
-			ContactID:      contact.ID,
-			Action:         "created",
-		}
-		timeline.Name = contact.Name
-		if err := insertTimeline(&timeline); err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	model, err := selectPersonByID(input.ID)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Write(must(json.Marshal(model)))
+	w.Write(must(json.Marshal(input)))
 }
 
-func handlePutPerson(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Person
+func handlePutProduct(w http.ResponseWriter, r *http.Request, user *User) {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+
+	var input Product
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := assignOrganization(&input, *user); err != nil {
+	model, err := selectProductByID(ID)
+	if err != nil {
+		http.Error(w, "Error loading product", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
 
-	if err := updatePerson(input); err != nil {
+	model.Name = input.Name
+	model.Code = input.Code
+	model.Unit = input.Unit
+	model.Tax = input.Tax
+	model.Selectable = input.Selectable
+	model.FirstChar = input.FirstChar
+	model.VisibleTo = input.VisibleTo
+	model.OwnerID = input.OwnerID
+	model.CustomFields = input.CustomFields
+
+	if err := updateProduct(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		PersonID:       input.ID,
+		ProductID:      model.ID,
 		Action:         "updated",
 	}
-	timeline.Name = input.Name
+	timeline.Name = model.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	model, err := selectPersonByID(input.ID)
+	model, err = selectProductByID(model.ID)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1688,27 +4449,31 @@ func handlePutPerson(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal(model)))
 }
 
-func handleDeletePerson(w http.ResponseWriter, r *http.Request, user *User) {
+func handleDeleteProduct(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	model, err := selectPersonByID(ID)
+	model, err := selectProductByID(ID)
 	if err != nil {
+		http.Error(w, "error loading product", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, "error loading person", http.StatusInternalServerError)
+		return
+	}
+	if model == nil || model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
 
-	if err := deletePerson(ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := deleteProduct(*model); err != nil {
+		http.Error(w, "error deleting product", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: user.ActiveCompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		PersonID:       ID,
+		ProductID:      model.ID,
 		Action:         "deleted",
 	}
 	timeline.Name = model.Name
@@ -1721,20 +4486,8 @@ func handleDeletePerson(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal("ok")))
 }
 
-func handleGetPersonFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostPersonFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutPersonField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeletePersonField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleGetWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
-	models, err := selectWorkflowsByCompany(user.ActiveCompanyID)
+func handleGetProductFields(w http.ResponseWriter, r *http.Request, user *User) {
+	models, err := selectProductFieldsByCompany(user.ActiveCompanyID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Println(err)
@@ -1743,8 +4496,9 @@ func handleGetWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal(models)))
 }
 
-func handlePostWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
-	var input Workflow
+
+func handlePostProductFields(w http.ResponseWriter, r *http.Request, user *User) {
+	var input ProductField
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -1753,16 +4507,16 @@ func handlePostWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
 
 	input.CompanyID = user.ActiveCompanyID
 
-	if err := insertWorkflow(&input); err != nil {
+	if err := insertProductField(&input); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	timeline := Timeline{
 		UnderCompanyID: user.ActiveCompanyID,
 		UserID:         user.ID,
-		WorkflowID:     input.ID,
+		ProductFieldID: input.ID,
 		Action:         "created",
 	}
 	timeline.Name = input.Name
@@ -1775,28 +4529,46 @@ func handlePostWorkflows(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal(input)))
 }
 
-func handlePutWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
+
+func handlePutProductField(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	var input Workflow
+	var input ProductField
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	model, err := selectWorkflowByID(ID)
+	model, err := selectProductFieldByID(ID)
 	if err != nil {
-		http.Error(w, "Error loading workflow", http.StatusInternalServerError)
+		http.Error(w, "Error loading product field", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Product field not found", http.StatusNotFound)
+		return
+	}
 
 	model.Name = input.Name
-
-	if err := updateWorkflow(*model); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	model.Key = input.Key
+	model.OrderNr = input.OrderNr
+	model.PicklistData = input.PicklistData
+	model.FieldType = input.FieldType
+	model.EditFlag = input.EditFlag
+	model.IndexVisibleFlag = input.IndexVisibleFlag
+	model.DetailsVisibleFlag = input.DetailsVisibleFlag
+	model.AddVisibleFlag = input.AddVisibleFlag
+	model.ImportantFlag = input.ImportantFlag
+	model.BulkEditAllowed = input.BulkEditAllowed
+	model.UseField = input.UseField
+	model.Link = input.Link
+	model.MandatoryFlag = input.MandatoryFlag
+
+	if err := updateProductField(*model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Println(err)
 		return
 	}
@@ -1804,7 +4576,7 @@ func handlePutWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
 	timeline := Timeline{
 		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		WorkflowID:     model.ID,
+		ProductFieldID: model.ID,
 		Action:         "updated",
 	}
 	timeline.Name = model.Name
@@ -1817,30 +4589,35 @@ func handlePutWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal(model)))
 }
 
-func handleDeleteWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
+
+func handleDeleteProductField(w http.ResponseWriter, r *http.Request, user *User) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
-	workflow, err := selectWorkflowByID(ID)
+	model, err := selectProductFieldByID(ID)
 	if err != nil {
+		http.Error(w, "error loading product field", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, "error loading workflow", http.StatusInternalServerError)
+		return
+	}
+	if model.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Product field not found", http.StatusNotFound)
 		return
 	}
 
-	if err := deleteWorkflow(ID); err != nil {
+	if err := deleteProductField(*model); err != nil {
+		http.Error(w, "error deleting product field", http.StatusInternalServerError)
 		log.Println(err)
-		http.Error(w, "error deleting workflow", http.StatusInternalServerError)
 		return
 	}
 
 	timeline := Timeline{
-		UnderCompanyID: workflow.CompanyID,
+		UnderCompanyID: model.CompanyID,
 		UserID:         user.ID,
-		WorkflowID:     ID,
+		ProductFieldID: model.ID,
 		Action:         "deleted",
 	}
-	timeline.Name = workflow.Name
+	timeline.Name = model.Name
 	if err := insertTimeline(&timeline); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1850,42 +4627,6 @@ func handleDeleteWorkflow(w http.ResponseWriter, r *http.Request, user *User) {
 	w.Write(must(json.Marshal("ok")))
 }
 
-func handleGetPrices(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostPrices(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutPrice(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeletePrice(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleGetProducts(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostProducts(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutProduct(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteProduct(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleGetProductFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePostProductFields(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handlePutProductField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
-func handleDeleteProductField(w http.ResponseWriter, r *http.Request, user *User) {
-}
-
 func handleGetPushNotifications(w http.ResponseWriter, r *http.Request, user *User) {
 }
 
@@ -1964,6 +4705,9 @@ func handlePutStage(w http.ResponseWriter, r *http.Request, user *User) {
 
 	stage.OrderNr = input.OrderNr
 	stage.Name = input.Name
+	stage.TaskProbability = input.TaskProbability
+	stage.RottenFlag = input.RottenFlag
+	stage.RottenDays = input.RottenDays
 
 	if err := updateStage(*stage); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -2012,12 +4756,43 @@ func handleDeleteStage(w http.ResponseWriter, r *http.Request, user *User) {
 		return
 	}
 
-	if err := deleteStage(ID); err != nil {
-		http.Error(w, "error deleting stage", http.StatusInternalServerError)
-		log.Println(err)
+	if workflow.CompanyID != user.ActiveCompanyID {
+		http.Error(w, "Stage not found", http.StatusNotFound)
 		return
 	}
 
+	targetStageID := r.URL.Query().Get("target_stage_id")
+	if targetStageID == "" {
+		if err := deleteStage(ID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+	} else {
+		moved, err := moveTasksAndDeleteStage(*stage, targetStageID, user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+
+		for _, task := range moved {
+			timeline := Timeline{
+				UnderCompanyID: workflow.CompanyID,
+				UserID:         user.ID,
+				TaskID:         task.ID,
+				StageID:        task.StageID,
+				Action:         "moved",
+			}
+			timeline.Name = task.Name
+			if err := insertTimeline(&timeline); err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
 	timeline := Timeline{
 		UnderCompanyID: workflow.CompanyID,
 		UserID:         user.ID,
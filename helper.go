@@ -2,8 +2,13 @@ package main
 
 import (
 	"log"
+	"math"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/satori/go.uuid"
 )
 
 func must(b []byte, err error) []byte {
@@ -13,6 +18,13 @@ func must(b []byte, err error) []byte {
 	return b
 }
 
+// isUUID reports whether s is a well-formed uuid, so it can be compared to
+// uuid columns
+func isUUID(s string) bool {
+	_, err := uuid.FromString(s)
+	return err == nil
+}
+
 func parseTime(s string) (*time.Time, error) {
 	if s == "" {
 		return nil, nil
@@ -27,3 +39,33 @@ func parseTime(s string) (*time.Time, error) {
 
 	return &t, nil
 }
+
+// formatMoney formats amount with thousands separators and the given number
+// of decimals, prefixed by the currency symbol, e.g. "€1,234.50"
+func formatMoney(amount float64, decimalPoints int, symbol string) string {
+	s := strconv.FormatFloat(math.Abs(amount), 'f', decimalPoints, 64)
+
+	integer, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		integer, fraction = s[:i], s[i:]
+	}
+
+	b := &strings.Builder{}
+	if amount < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteString("-")
+	}
+	b.WriteString(symbol)
+	if utf8.RuneCountInString(symbol) > 1 {
+		// currency codes and symbols like "kr" read better with a space
+		b.WriteString(" ")
+	}
+	for i, c := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteString(",")
+		}
+		b.WriteRune(c)
+	}
+	b.WriteString(fraction)
+
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+)
+
+// prepareOrganizationRelationship validates a relationship and fills its
+// calculated type from the point of view of the owner organization. A
+// daughter relationship is stored as the parent relationship the other way
+// round. An organization has at most one parent and a parent chain must not
+// lead back to the organization itself, see saveOrganizationRelationship.
+func prepareOrganizationRelationship(ex execer, model *OrganizationRelationship) error {
+	if model.Type == "daughter" {
+		model.Type = "parent"
+		model.RelOwnerOrgID, model.RelLinkedOrgID = model.RelLinkedOrgID, model.RelOwnerOrgID
+	}
+	if model.Type != "parent" && model.Type != "related" {
+		return validationError("Please select parent, daughter or related")
+	}
+	if model.RelOwnerOrgID == "" || model.RelLinkedOrgID == "" {
+		return validationError("Please select both organizations")
+	}
+	if model.RelOwnerOrgID == model.RelLinkedOrgID {
+		return validationError("An organization cannot be related to itself")
+	}
+
+	orgs := make(map[string]*Organization)
+	for _, ID := range []string{model.RelOwnerOrgID, model.RelLinkedOrgID} {
+		org, err := selectOrganizationByID(ID)
+		if err != nil {
+			return err
+		}
+		if org == nil || org.CompanyID != model.CompanyID {
+			return validationError("Organization not found")
+		}
+		orgs[ID] = org
+	}
+
+	exists, err := organizationRelationshipExists(ex, *model)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return validationError("The organizations are already related")
+	}
+
+	model.CalculatedType = "related"
+	model.CalculatedRelatedOrgID = model.RelLinkedOrgID
+	if model.Type != "parent" {
+		return nil
+	}
+	model.CalculatedType = "daughter"
+
+	parents, err := selectOrganizationAncestorIDs(ex, model.RelLinkedOrgID, model.ID)
+	if err != nil {
+		return err
+	}
+	if len(parents) > 0 {
+		return validationErrorf("%s already has a parent organization", orgs[model.RelLinkedOrgID].Name)
+	}
+
+	ancestors, err := selectOrganizationAncestorIDs(ex, model.RelOwnerOrgID, model.ID)
+	if err != nil {
+		return err
+	}
+	for _, ID := range ancestors {
+		if ID == model.RelLinkedOrgID {
+			return validationErrorf("%s is a subsidiary of %s", orgs[model.RelOwnerOrgID].Name, orgs[model.RelLinkedOrgID].Name)
+		}
+	}
+
+	return nil
+}
+
+// checkMergedHierarchy checks that the parent relationships, pairs of
+// parent and subsidiary, still form a tree once loserID is merged into
+// winnerID. Relationships between the two are dropped by the merge.
+func checkMergedHierarchy(parents [][2]string, winnerID, loserID string) error {
+	parentOf := make(map[string]string)
+	for _, edge := range parents {
+		parent, child := edge[0], edge[1]
+		if parent == loserID {
+			parent = winnerID
+		}
+		if child == loserID {
+			child = winnerID
+		}
+		if parent == child {
+			continue
+		}
+		if other, ok := parentOf[child]; ok && other != parent {
+			return validationError("The merged organization would have two parent organizations")
+		}
+		parentOf[child] = parent
+	}
+
+	for child := range parentOf {
+		seen := map[string]bool{child: true}
+		for ID := parentOf[child]; ID != ""; ID = parentOf[ID] {
+			if seen[ID] {
+				return validationError("The merge would make an organization its own parent")
+			}
+			seen[ID] = true
+		}
+	}
+	return nil
+}
+
+// selectOrganizationGraph returns the hierarchy of the organization from its
+// topmost parent down and the related relationships of the organizations in
+// it. Every organization comes with the counters of its subsidiaries rolled
+// up.
+func selectOrganizationGraph(org Organization) (*OrganizationGraph, error) {
+	relationships, err := selectOrganizationRelationshipsByCompany(org.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string]string)
+	children := make(map[string][]string)
+	for _, relationship := range relationships {
+		if relationship.Type != "parent" {
+			continue
+		}
+		if _, ok := parents[relationship.RelLinkedOrgID]; ok {
+			continue
+		}
+		parents[relationship.RelLinkedOrgID] = relationship.RelOwnerOrgID
+		children[relationship.RelOwnerOrgID] = append(children[relationship.RelOwnerOrgID], relationship.RelLinkedOrgID)
+	}
+
+	// walk up to the topmost parent, stopping if the chain loops
+	rootID := org.ID
+	seen := map[string]bool{rootID: true}
+	for parents[rootID] != "" && !seen[parents[rootID]] {
+		rootID = parents[rootID]
+		seen[rootID] = true
+	}
+
+	members := make(map[string]bool)
+	var node func(ID string) (*OrganizationNode, error)
+	node = func(ID string) (*OrganizationNode, error) {
+		members[ID] = true
+		model, err := selectOrganizationByID(ID)
+		if err != nil || model == nil {
+			return nil, err
+		}
+		if err := selectOrganizationRollup(model); err != nil {
+			return nil, err
+		}
+		result := OrganizationNode{Organization: *model, Children: []OrganizationNode{}}
+		for _, childID := range children[ID] {
+			if members[childID] {
+				continue
+			}
+			child, err := node(childID)
+			if err != nil {
+				return nil, err
+			}
+			if child != nil {
+				result.Children = append(result.Children, *child)
+			}
+		}
+		return &result, nil
+	}
+
+	root, err := node(rootID)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, errors.New("Organization not found")
+	}
+
+	result := OrganizationGraph{Root: *root, Related: []OrganizationRelationship{}}
+	for _, relationship := range relationships {
+		if relationship.Type == "related" && (members[relationship.RelOwnerOrgID] || members[relationship.RelLinkedOrgID]) {
+			result.Related = append(result.Related, relationship)
+		}
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importFields are the fields CSV columns can be mapped to. Custom fields
+// are mapped as "organization.cf_<key>", "person.cf_<key>" and
+// "task.cf_<key>".
+var importFields = []string{
+	"organization.name",
+	"organization.address",
+	"organization.address_subpremise",
+	"organization.address_street_number",
+	"organization.address_route",
+	"organization.address_sublocality",
+	"organization.address_locality",
+	"organization.address_admin_area_level_1",
+	"organization.address_admin_area_level_2",
+	"organization.address_country",
+	"organization.address_postal_code",
+	"organization.country_code",
+	"person.name",
+	"person.first_name",
+	"person.email",
+	"person.phone",
+	"task.name",
+	"task.value",
+	"task.currency",
+	"task.stage",
+	"task.expected_close_date",
+}
+
+// readCSV parses CSV data with a header row. Semicolon separated files, as
+// saved by spreadsheets in many locales, are detected from the header.
+func readCSV(data string) ([][]string, error) {
+	header := data
+	if i := strings.IndexByte(data, '\n'); i >= 0 {
+		header = data[:i]
+	}
+
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(data, "\ufeff")))
+	if strings.Count(header, ";") > strings.Count(header, ",") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("The file is empty")
+	}
+	return records, nil
+}
+
+// importFieldsByCompany returns importFields and the custom fields of the
+// company that columns can be mapped to.
+func importFieldsByCompany(companyID string) ([]string, error) {
+	result := append([]string{}, importFields...)
+
+	orgFields, err := selectOrganizationFieldsByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range orgFields {
+		result = append(result, "organization.cf_"+field.Key)
+	}
+
+	personFields, err := selectPersonFieldsByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range personFields {
+		result = append(result, "person.cf_"+field.Key)
+	}
+
+	taskFields, err := selectTaskFieldsByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range taskFields {
+		result = append(result, "task.cf_"+field.Key)
+	}
+
+	return result, nil
+}
+
+// suggestImportMapping maps the headers that name a field, like
+// "Organization name" or "E-mail", to that field.
+func suggestImportMapping(headers, fields []string) map[string]string {
+	byKey := make(map[string][]string)
+	for _, field := range fields {
+		entity := field[:strings.Index(field, ".")]
+		name := strings.TrimPrefix(field[len(entity)+1:], "cf_")
+		byKey[customFieldKey(entity+" "+name)] = append(byKey[customFieldKey(entity+" "+name)], field)
+		byKey[customFieldKey(name)] = append(byKey[customFieldKey(name)], field)
+	}
+
+	result := make(map[string]string)
+	for _, header := range headers {
+		key := customFieldKey(header)
+		if key == "e_mail" {
+			key = "email"
+		}
+		if candidates := byKey[key]; len(candidates) == 1 {
+			result[header] = candidates[0]
+		}
+	}
+	return result
+}
+
+func previewImport(data, companyID string) (*ImportPreview, error) {
+	records, err := readCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := importFieldsByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := records[1:]
+	if len(rows) > 5 {
+		rows = rows[:5]
+	}
+
+	return &ImportPreview{
+		Headers: records[0],
+		Rows:    rows,
+		Mapping: suggestImportMapping(records[0], fields),
+		Fields:  fields,
+	}, nil
+}
+
+// validateImport checks that the mapping uses known fields and that tasks
+// have a workflow to go to.
+func validateImport(model Import) error {
+	fields, err := importFieldsByCompany(model.CompanyID)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, field := range fields {
+		known[field] = true
+	}
+
+	for header, field := range model.Mapping {
+		if field == "" {
+			continue
+		}
+		if !known[field] {
+			return fmt.Errorf("Unknown field %s for column %s", field, header)
+		}
+		if strings.HasPrefix(field, "task.") && model.WorkflowID == "" {
+			return errors.New("Please select a workflow for the tasks")
+		}
+	}
+	return nil
+}
+
+// importState caches what rows of an import resolve names against
+type importState struct {
+	orgIDs     map[string]string
+	personIDs  map[string]string
+	stageIDs   map[string]string
+	firstStage string
+	stageCount int
+	moneyKeys  map[string]bool
+}
+
+func newImportState(model Import) (*importState, error) {
+	state := &importState{
+		personIDs: make(map[string]string),
+		stageIDs:  make(map[string]string),
+		moneyKeys: make(map[string]bool),
+	}
+
+	orgIDs, err := organizationIDsByName(model.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	state.orgIDs = orgIDs
+
+	persons, err := selectPersonsByCompany(model.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, person := range persons {
+		state.personIDs[normalizeName(person.Name)+"|"+person.OrgID] = person.ID
+	}
+
+	if model.WorkflowID != "" {
+		stages, err := selectStagesByWorkflow(model.WorkflowID)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range stages {
+			if state.firstStage == "" {
+				state.firstStage = stage.ID
+			}
+			state.stageIDs[normalizeName(stage.Name)] = stage.ID
+		}
+		state.stageCount = len(stages)
+	}
+
+	orgFields, err := selectOrganizationFieldsByCompany(model.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range orgFields {
+		state.moneyKeys["organization.cf_"+field.Key] = field.FieldType == "money"
+	}
+	personFields, err := selectPersonFieldsByCompany(model.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range personFields {
+		state.moneyKeys["person.cf_"+field.Key] = field.FieldType == "money"
+	}
+	taskFields, err := selectTaskFieldsByCompany(model.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range taskFields {
+		state.moneyKeys["task.cf_"+field.Key] = field.FieldType == "money"
+	}
+
+	return state, nil
+}
+
+// importCustomFields collects the custom field values of an entity from a
+// row. Money is written as "<amount> <currency>".
+func importCustomFields(values map[string]string, entity string, state *importState) CustomFields {
+	result := CustomFields{}
+	for field, value := range values {
+		if !strings.HasPrefix(field, entity+".cf_") || value == "" {
+			continue
+		}
+		key := strings.TrimPrefix(field, entity+".cf_")
+		if state.moneyKeys[field] {
+			parts := strings.Fields(value)
+			money := map[string]interface{}{"amount": parts[0]}
+			if len(parts) > 1 {
+				money["currency"] = parts[1]
+			}
+			result[key] = money
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// parseImportValue parses a task value written with either "," or "." as
+// the decimal separator. The other one, spaces and "'" group the thousands.
+// A single separator followed by three digits can be either and is rejected.
+func parseImportValue(s string) (float64, error) {
+	value := strings.NewReplacer(" ", "", "\u00a0", "", "'", "").Replace(s)
+	commas, dots := strings.Count(value, ","), strings.Count(value, ".")
+
+	decimal := ""
+	switch {
+	case commas > 0 && dots > 0:
+		decimal = "."
+		if strings.LastIndex(value, ",") > strings.LastIndex(value, ".") {
+			decimal = ","
+		}
+	case commas == 1 && dots == 0:
+		decimal = ","
+	case dots == 1 && commas == 0:
+		decimal = "."
+	}
+
+	integer, fraction := value, ""
+	if decimal != "" {
+		i := strings.LastIndex(value, decimal)
+		integer, fraction = value[:i], value[i+1:]
+		if commas+dots == 1 && len(fraction) == 3 {
+			return 0, fmt.Errorf("Ambiguous value %s, please write it without a thousands separator", s)
+		}
+	}
+
+	thousands := ","
+	if decimal == "," || (decimal == "" && dots > 0) {
+		thousands = "."
+	}
+	if groups := strings.Split(strings.TrimPrefix(integer, "-"), thousands); len(groups) > 1 {
+		for i, group := range groups {
+			if group == "" || len(group) > 3 || i > 0 && len(group) != 3 {
+				return 0, fmt.Errorf("Invalid value %s", s)
+			}
+		}
+	}
+
+	number := strings.Replace(integer, thousands, "", -1)
+	if fraction != "" {
+		number += "." + fraction
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %s", s)
+	}
+	return f, nil
+}
+
+func hasImportValues(values map[string]string, entity string) bool {
+	for field, value := range values {
+		if strings.HasPrefix(field, entity+".") && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// importRow resolves the organization, person and stage of a row by name,
+// creating the ones that do not exist, and creates the task. Everything is
+// validated before anything is saved and the row is saved in one
+// transaction with the progress of the import.
+func importRow(model Import, state *importState, values map[string]string) error {
+	var org *Organization
+	orgID := ""
+	if hasImportValues(values, "organization") {
+		name := values["organization.name"]
+		if name == "" {
+			return errors.New("Organization name is missing")
+		}
+		orgID = state.orgIDs[normalizeOrganizationName(name)]
+		if orgID == "" {
+			org = &Organization{
+				CompanyID:              model.CompanyID,
+				OwnerID:                model.UserID,
+				CountryCode:            values["organization.country_code"],
+				Address:                values["organization.address"],
+				AddressSubpremise:      values["organization.address_subpremise"],
+				AddressStreetNumber:    values["organization.address_street_number"],
+				AddressRoute:           values["organization.address_route"],
+				AddressSublocality:     values["organization.address_sublocality"],
+				AddressLocality:        values["organization.address_locality"],
+				AddressAdminAreaLevel1: values["organization.address_admin_area_level_1"],
+				AddressAdminAreaLevel2: values["organization.address_admin_area_level_2"],
+				AddressCountry:         values["organization.address_country"],
+				AddressPostalCode:      values["organization.address_postal_code"],
+				CustomFields:           importCustomFields(values, "organization", state),
+			}
+			org.Name = name
+			org.implicit = true
+			if err := validateCustomFieldsFor("organization", &org.CustomFields, org.CompanyID, org.ID, !org.implicit); err != nil {
+				return err
+			}
+		}
+	}
+
+	var person *Person
+	personID := ""
+	if hasImportValues(values, "person") {
+		name := values["person.name"]
+		if name == "" {
+			name = values["person.first_name"]
+		}
+		if name == "" {
+			return errors.New("Person name is missing")
+		}
+		if email := values["person.email"]; email != "" {
+			IDs, err := selectPersonIDsByContact(model.CompanyID, Contact{Type: "email", Base: Base{Name: email}})
+			if err != nil {
+				return err
+			}
+			if len(IDs) > 0 {
+				personID = IDs[0]
+			}
+		}
+		if personID == "" && orgID != "" {
+			personID = state.personIDs[normalizeName(name)+"|"+orgID]
+		}
+		if personID == "" && org == nil && orgID == "" {
+			personID = state.personIDs[normalizeName(name)+"|"]
+		}
+		if personID == "" {
+			person = &Person{
+				CompanyID:    model.CompanyID,
+				OwnerID:      model.UserID,
+				FirstName:    values["person.first_name"],
+				CustomFields: importCustomFields(values, "person", state),
+			}
+			person.Name = name
+			person.implicit = true
+			if err := validateCustomFieldsFor("person", &person.CustomFields, person.CompanyID, person.ID, !person.implicit); err != nil {
+				return err
+			}
+			for _, contactType := range []string{"email", "phone"} {
+				if values["person."+contactType] == "" {
+					continue
+				}
+				contact := Contact{Primary: true, Type: contactType}
+				contact.Name = values["person."+contactType]
+				person.Contacts = append(person.Contacts, contact)
+			}
+			if err := normalizePersonContacts(person.Contacts); err != nil {
+				return err
+			}
+		}
+	}
+
+	var task *Task
+	stageName := ""
+	if hasImportValues(values, "task") {
+		name := values["task.name"]
+		if name == "" {
+			return errors.New("Task name is missing")
+		}
+		task = &Task{
+			CreatorUserID: model.UserID,
+			UserID:        model.UserID,
+			WorkflowID:    model.WorkflowID,
+			Currency:      values["task.currency"],
+			CompanyID:     model.CompanyID,
+			CustomFields:  importCustomFields(values, "task", state),
+		}
+		task.Name = name
+		if value := values["task.value"]; value != "" {
+			f, err := parseImportValue(value)
+			if err != nil {
+				return err
+			}
+			task.Value = int(math.Round(f))
+		}
+		if date := values["task.expected_close_date"]; date != "" {
+			t, err := time.Parse("2006-01-02", date)
+			if err != nil {
+				return fmt.Errorf("Invalid expected close date %s", date)
+			}
+			task.ExpectedCloseDate = &t
+		}
+		stageName = values["task.stage"]
+		task.StageID = state.stageIDs[normalizeName(stageName)]
+		if stageName == "" {
+			task.StageID = state.firstStage
+		}
+		if task.StageID == "" && stageName == "" {
+			return errors.New("The workflow has no stages")
+		}
+		if err := validateCustomFieldsFor("task", &task.CustomFields, task.CompanyID, task.ID, true); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if org != nil {
+		if err := insertOrganizationWith(tx, org); err != nil {
+			return err
+		}
+		if err := insertImportRecord(tx, model.ID, "organization", org.ID); err != nil {
+			return err
+		}
+		if err := insertImportTimeline(tx, model, Timeline{OrganizationID: org.ID}, org.Name); err != nil {
+			return err
+		}
+		orgID = org.ID
+	}
+
+	if person != nil {
+		person.OrgID = orgID
+		if err := insertPersonWith(tx, person); err != nil {
+			return err
+		}
+		if err := insertImportRecord(tx, model.ID, "person", person.ID); err != nil {
+			return err
+		}
+		if err := insertImportTimeline(tx, model, Timeline{PersonID: person.ID}, person.Name); err != nil {
+			return err
+		}
+		for _, contact := range person.Contacts {
+			contact.PersonID = person.ID
+			if err := insertContactWith(tx, &contact); err != nil {
+				return err
+			}
+			if err := insertImportRecord(tx, model.ID, "contact", contact.ID); err != nil {
+				return err
+			}
+		}
+		personID = person.ID
+	}
+
+	var stage *Stage
+	if task != nil {
+		if task.StageID == "" {
+			stage = &Stage{WorkflowID: model.WorkflowID, OrderNr: state.stageCount}
+			stage.Name = stageName
+			if err := insertStageWith(tx, stage); err != nil {
+				return err
+			}
+			if err := insertImportRecord(tx, model.ID, "stage", stage.ID); err != nil {
+				return err
+			}
+			task.StageID = stage.ID
+		}
+
+		task.OrgID = orgID
+		task.PersonID = personID
+		if err := insertTaskWith(tx, task); err != nil {
+			return err
+		}
+		if err := insertImportRecord(tx, model.ID, "task", task.ID); err != nil {
+			return err
+		}
+		if err := insertImportTimeline(tx, model, Timeline{TaskID: task.ID}, task.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := updateImportProgressWith(tx, model); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// the names resolve to the new records only once they are saved
+	if org != nil {
+		state.orgIDs[normalizeOrganizationName(org.Name)] = org.ID
+	}
+	if person != nil {
+		state.personIDs[normalizeName(person.Name)+"|"+orgID] = person.ID
+	}
+	if stage != nil {
+		state.stageIDs[normalizeName(stage.Name)] = stage.ID
+		state.stageCount++
+		if state.firstStage == "" {
+			state.firstStage = stage.ID
+		}
+	}
+
+	return nil
+}
+
+func insertImportTimeline(ex execer, model Import, timeline Timeline, name string) error {
+	timeline.UnderCompanyID = model.CompanyID
+	timeline.UserID = model.UserID
+	timeline.Action = "created"
+	timeline.Name = name
+	return insertTimelineWith(ex, &timeline)
+}
+
+// runImport imports the rows of an import that have not been processed yet
+// and saves the progress after each row, in the transaction of the row. Rows that fail are reported in
+// Errors and do not stop the import.
+func runImport(model *Import) error {
+	records, err := readCSV(model.Data)
+	if err != nil {
+		return err
+	}
+	headers, rows := records[0], records[1:]
+	model.TotalRows = len(rows)
+
+	state, err := newImportState(*model)
+	if err != nil {
+		return err
+	}
+
+	for i := model.ProcessedRows; i < len(rows); i++ {
+		values := make(map[string]string)
+		for column, header := range headers {
+			if field := model.Mapping[header]; field != "" && column < len(rows[i]) {
+				values[field] = strings.TrimSpace(rows[i][column])
+			}
+		}
+
+		// imported rows save the progress with their records, so a row
+		// is not imported twice when the import is claimed again
+		model.ProcessedRows = i + 1
+		if err := importRow(*model, state, values); err != nil {
+			model.Errors = append(model.Errors, ImportError{Row: i + 2, Message: err.Error()})
+			if err := updateImportProgress(*model); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	model.Status = "done"
+	model.FinishedAt = &now
+	return updateImportProgress(*model)
+}
+
+// runPendingImports runs the pending imports one by one
+func runPendingImports() error {
+	for {
+		model, err := claimPendingImport()
+		if err != nil {
+			return err
+		}
+		if model == nil {
+			return nil
+		}
+
+		if err := runImport(model); err != nil {
+			log.Println("Error running import", model.ID, err)
+			now := time.Now()
+			model.Status = "failed"
+			model.FinishedAt = &now
+			model.Errors = append(model.Errors, ImportError{Message: err.Error()})
+			if err := updateImportProgress(*model); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
     "database/sql"
+    "flag"
     "fmt"
     "log"
     "net/http"
@@ -21,6 +22,10 @@ const sessionName = "superwork"
 var db *sql.DB
 
 func main() {
+    geocodeBackfill := flag.Bool("geocode-backfill", false, "geocode the organizations that have no coordinates yet and exit")
+    contactsBackfill := flag.Bool("contacts-backfill", false, "normalize the phone numbers and e-mail addresses of existing contacts and exit")
+    flag.Parse()
+
     // Parse environment variables into config
     if err := envconfig.Process("superwork", &config); err != nil {
         log.Fatal(err)
@@ -66,6 +71,25 @@ func main() {
         log.Panic(err)
     }
 
+    // Geocode the addresses of existing organizations instead of serving
+    if *geocodeBackfill {
+        if err := backfillGeocoding(); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    // Normalize the contacts saved before they were validated
+    if *contactsBackfill {
+        if err := backfillContacts(); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    // Start background jobs (digest e-mails etc.)
+    startScheduler()
+
     // Define all routes for the HTTP server
     r := defineRoutes()
 
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -699,14 +705,15 @@ func TestContact(t *testing.T) {
 	}
 
 	model := Contact{}
-	model.Name = "Work"
+	model.Name = "+44 20 7946 0000"
 	model.PersonID = person.ID
 	model.Type = "phone"
+	model.Label = "work"
 	if err := insertContact(&model); err != nil {
 		t.Fatal(err)
 	}
 
-	model.Name = "updated contact"
+	model.Name = "+44 20 7946 0001"
 	if err := updateContact(model); err != nil {
 		t.Fatal(err)
 	}
@@ -911,9 +918,7 @@ func TestTask(t *testing.T) {
 		t.Fatal("tasks not found")
 	}
 
-	now := time.Now()
-	model.WonTime = &now
-	if err := updateTask(model); err != nil {
+	if err := markTaskWon(model.ID); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1009,6 +1014,3495 @@ func TestTask(t *testing.T) {
 	}
 }
 
+func TestRottenTasks(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone400@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "rotting stage"
+	stage.RottenFlag = true
+	if err := insertStage(&stage); err == nil {
+		t.Fatal("rotting stage without rotten days should fail")
+	}
+	stage.RottenDays = 3
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	model := Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = stage.ID
+	model.Name = "fresh task"
+	model.CompanyID = company.ID
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.RottenTime == nil {
+		t.Fatal("rotten time expected")
+	}
+	if task.IsRotten {
+		t.Fatal("fresh task should not be rotten")
+	}
+
+	if _, err := db.Exec(`
+		update tasks
+		set stage_change_time = current_timestamp - interval '4 days'
+		where id = $1
+	`, model.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !task.IsRotten {
+		t.Fatal("task should be rotten")
+	}
+
+	tasks, err := selectRottenTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, rotten := range tasks {
+		if rotten.ID == model.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("rotten task not found")
+	}
+
+	// moving the task to another stage resets rotting
+
+	stage2 := Stage{}
+	stage2.WorkflowID = workflow.ID
+	stage2.Name = "fresh stage"
+	stage2.OrderNr = 1
+	if err := insertStage(&stage2); err != nil {
+		t.Fatal(err)
+	}
+
+	task.StageID = stage2.ID
+	if err := updateTask(*task); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.IsRotten || task.RottenTime != nil {
+		t.Fatal("task should not be rotten any more")
+	}
+
+	key := "rotten_digest:" + user.ID + ":test"
+	claimed, err := claimSentEmail(key, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Fatal("e-mail should be claimed")
+	}
+	claimed, err = claimSentEmail(key, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed {
+		t.Fatal("e-mail should not be claimed twice")
+	}
+}
+
+func TestTaskValues(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone401@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	currency := Currency{}
+	currency.CompanyID = company.ID
+	currency.Name = "Euro"
+	currency.Code = "EUR"
+	currency.DecimalPoints = 2
+	currency.Symbol = "€"
+	if err := insertCurrency(&currency); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "first stage"
+	stage.TaskProbability = 50
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	closeDate := time.Date(2030, 5, 15, 12, 0, 0, 0, time.UTC)
+
+	model := Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = stage.ID
+	model.Name = "valuable task"
+	model.CompanyID = company.ID
+	model.Value = 1000
+	model.Currency = "EUR"
+	model.ExpectedCloseDate = &closeDate
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.WeightedValue != 500 {
+		t.Fatal("weighted value should use stage probability")
+	}
+	if task.FormattedValue != "€1,000.00" {
+		t.Fatal("invalid formatted value", task.FormattedValue)
+	}
+	if task.FormattedWeightedValue != "€500.00" {
+		t.Fatal("invalid formatted weighted value", task.FormattedWeightedValue)
+	}
+
+	probability := 20
+	task.Probability = &probability
+	if err := updateTask(*task); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.WeightedValue != 200 {
+		t.Fatal("weighted value should use task probability")
+	}
+
+	probability = 101
+	task.Probability = &probability
+	if err := updateTask(*task); err == nil {
+		t.Fatal("invalid probability should fail")
+	}
+
+	forecast, err := selectForecastByCompany(company.ID, "", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forecast) != 1 {
+		t.Fatal("forecast not found")
+	}
+	if forecast[0].Month != "2030-05" {
+		t.Fatal("invalid forecast month", forecast[0].Month)
+	}
+	if forecast[0].Value != 1000 || forecast[0].WeightedValue != 200 {
+		t.Fatal("invalid forecast values")
+	}
+}
+
+func TestTaskOutcomes(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone402@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "first stage"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	reason := LostReason{}
+	reason.CompanyID = company.ID
+	reason.Name = "too expensive"
+	if err := insertLostReason(&reason); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons, err := selectLostReasonsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 1 {
+		t.Fatal("lost reasons not found")
+	}
+
+	model := Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = stage.ID
+	model.Name = "uncertain task"
+	model.CompanyID = company.ID
+	model.Status = "won"
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+	if model.Status != "open" {
+		t.Fatal("new task should be open")
+	}
+
+	if err := markTaskWon(model.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := markTaskWon(model.ID); err == nil {
+		t.Fatal("task should not be won twice")
+	}
+
+	task, err := selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != "won" || task.WonTime == nil || task.FirstWonTime == nil || task.CloseTime == nil {
+		t.Fatal("won task is inconsistent")
+	}
+	firstWonTime := *task.FirstWonTime
+
+	if err := markTaskLost(model.ID, reason); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != "lost" || task.WonTime != nil || task.LostTime == nil {
+		t.Fatal("lost task is inconsistent")
+	}
+	if task.LostReasonID != reason.ID || task.LostReason != reason.Name {
+		t.Fatal("lost reason not set")
+	}
+
+	task.Status = "open"
+	task.LostTime = nil
+	if err := updateTask(*task); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != "lost" {
+		t.Fatal("status should not be writable")
+	}
+
+	if err := reopenTask(model.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != "open" || task.LostTime != nil || task.LostReasonID != "" || task.CloseTime != nil {
+		t.Fatal("reopened task is inconsistent")
+	}
+	if task.FirstWonTime == nil || !task.FirstWonTime.Equal(firstWonTime) {
+		t.Fatal("first won time should be preserved")
+	}
+}
+
+func TestStageHistory(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone403@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	first := Stage{}
+	first.WorkflowID = workflow.ID
+	first.Name = "first stage"
+	first.OrderNr = 1
+	if err := insertStage(&first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := Stage{}
+	second.WorkflowID = workflow.ID
+	second.Name = "second stage"
+	second.OrderNr = 2
+	if err := insertStage(&second); err != nil {
+		t.Fatal(err)
+	}
+
+	model := Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = first.ID
+	model.Name = "moving task"
+	model.CompanyID = company.ID
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	model.StageID = second.ID
+	if err := updateTask(model); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := recordTaskStage(model.ID, model.StageID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !moved {
+		t.Fatal("task should have moved")
+	}
+	moved, err = recordTaskStage(model.ID, model.StageID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved {
+		t.Fatal("task should not move to the same stage")
+	}
+
+	history, err := selectTaskStageHistory(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatal("invalid stage history", len(history))
+	}
+	if history[0].StageID != first.ID || history[0].ExitedAt == nil || history[0].ExitedUserID != user.ID {
+		t.Fatal("first stage entry should be closed")
+	}
+	if history[1].StageID != second.ID || history[1].ExitedAt != nil {
+		t.Fatal("second stage entry should be open")
+	}
+
+	if err := markTaskWon(model.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := selectStageReportByCompany(company.ID, workflow.ID, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 {
+		t.Fatal("workflow report not found")
+	}
+	if report[0].ClosedTasksCount != 1 {
+		t.Fatal("closed task not counted")
+	}
+	if len(report[0].Stages) != 2 {
+		t.Fatal("stage reports not found")
+	}
+	if report[0].Stages[0].TasksCount != 1 || report[0].Stages[0].ConversionRate != 1 {
+		t.Fatal("invalid first stage conversion")
+	}
+	if report[0].Stages[1].TasksCount != 1 || report[0].Stages[1].ConversionRate != 0 {
+		t.Fatal("invalid second stage conversion")
+	}
+}
+
+func TestReorderTasks(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone404@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	first := Stage{}
+	first.WorkflowID = workflow.ID
+	first.Name = "first stage"
+	first.OrderNr = 1
+	if err := insertStage(&first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := Stage{}
+	second.WorkflowID = workflow.ID
+	second.Name = "second stage"
+	second.OrderNr = 2
+	if err := insertStage(&second); err != nil {
+		t.Fatal(err)
+	}
+
+	var taskIDs []string
+	for _, name := range []string{"a", "b", "c"} {
+		model := Task{}
+		model.CreatorUserID = user.ID
+		model.UserID = user.ID
+		model.WorkflowID = workflow.ID
+		model.StageID = first.ID
+		model.Name = name
+		model.CompanyID = company.ID
+		if err := insertTask(&model); err != nil {
+			t.Fatal(err)
+		}
+		taskIDs = append(taskIDs, model.ID)
+	}
+
+	moved, err := reorderTasks(second, company.ID, []string{taskIDs[2], taskIDs[0]}, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 2 {
+		t.Fatal("tasks should have moved")
+	}
+
+	tasks, err := selectTasksByWorkflow(workflow.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 3 {
+		t.Fatal("tasks not found")
+	}
+	if tasks[0].Name != "b" || tasks[1].Name != "c" || tasks[2].Name != "a" {
+		t.Fatal("invalid task order", tasks[0].Name, tasks[1].Name, tasks[2].Name)
+	}
+	if tasks[1].StageID != second.ID || tasks[1].StageOrderNr != 1 {
+		t.Fatal("task not moved")
+	}
+
+	other := Company{}
+	other.Name = "othercompany"
+	if err := insertCompany(&other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reorderTasks(first, other.ID, []string{taskIDs[0]}, user.ID); err == nil {
+		t.Fatal("tasks of another company should not move")
+	}
+
+	task, err := selectTaskByID(taskIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.StageID != second.ID {
+		t.Fatal("failed reorder should not change tasks")
+	}
+}
+
+func TestWorkflowTemplates(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone405@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	template, err := findWorkflowTemplate(company.ID, "sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.CompanyID = company.ID
+	if err := insertWorkflowFromTemplate(&workflow, *template); err != nil {
+		t.Fatal(err)
+	}
+	if workflow.Name != template.Name {
+		t.Fatal("workflow should be named after the template")
+	}
+
+	stages, err := selectStagesByWorkflow(workflow.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != len(template.Stages) {
+		t.Fatal("template stages not created")
+	}
+	if stages[0].TaskProbability != template.Stages[0].TaskProbability || !stages[0].RottenFlag {
+		t.Fatal("template stage settings not copied")
+	}
+
+	model := Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = stages[0].ID
+	model.Name = "open task"
+	model.CompanyID = company.ID
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	model = Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = stages[0].ID
+	model.Name = "won task"
+	model.CompanyID = company.ID
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+	if err := markTaskWon(model.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := saveWorkflowAsTemplate(workflow, "our sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := selectWorkflowTemplates(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, template := range templates {
+		if template.ID == saved.ID && len(template.Stages) == len(stages) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("saved template not found")
+	}
+
+	clone, err := cloneWorkflow(workflow, "cloned", user.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloneStages, err := selectStagesByWorkflow(clone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cloneStages) != len(stages) {
+		t.Fatal("stages not cloned")
+	}
+
+	tasks, err := selectTasksByWorkflow(clone.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Name != "open task" || tasks[0].StageID != cloneStages[0].ID {
+		t.Fatal("open tasks not cloned")
+	}
+}
+
+func TestMigrateWorkflow(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	source := Workflow{}
+	source.Name = "old"
+	source.CompanyID = company.ID
+	if err := insertWorkflow(&source); err != nil {
+		t.Fatal(err)
+	}
+
+	target := Workflow{}
+	target.Name = "new"
+	target.CompanyID = company.ID
+	if err := insertWorkflow(&target); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:            "someone406@somewhere.com",
+		ActiveCompanyID:  company.ID,
+		ActiveWorkflowID: source.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	var sourceStages []Stage
+	for i, name := range []string{"first", "second", "gone"} {
+		stage := Stage{}
+		stage.WorkflowID = source.ID
+		stage.Name = name
+		stage.OrderNr = i
+		if err := insertStage(&stage); err != nil {
+			t.Fatal(err)
+		}
+		sourceStages = append(sourceStages, stage)
+	}
+
+	targetStage := Stage{}
+	targetStage.WorkflowID = target.ID
+	targetStage.Name = "only"
+	if err := insertStage(&targetStage); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stage := range sourceStages {
+		model := Task{}
+		model.CreatorUserID = user.ID
+		model.UserID = user.ID
+		model.WorkflowID = source.ID
+		model.StageID = stage.ID
+		model.Name = "task in " + stage.Name
+		model.CompanyID = company.ID
+		if err := insertTask(&model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := deleteWorkflow(source.ID); err == nil {
+		t.Fatal("workflow with tasks should not be deleted")
+	}
+
+	// a task left in a deleted stage goes to the first stage of the target
+	if _, err := db.Exec(`
+		update stages
+		set deleted_at = current_timestamp
+		where id = $1
+	`, sourceStages[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// so does a task without a stage
+	stageless := Task{}
+	stageless.CreatorUserID = user.ID
+	stageless.UserID = user.ID
+	stageless.WorkflowID = source.ID
+	stageless.StageID = sourceStages[0].ID
+	stageless.Name = "task without a stage"
+	stageless.CompanyID = company.ID
+	if err := insertTask(&stageless); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+		update tasks
+		set stage_id = null
+		where id = $1
+	`, stageless.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	stageMap, err := workflowStageMap(source.ID, target.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stageMap) != 2 || stageMap[sourceStages[1].ID] != targetStage.ID {
+		t.Fatal("invalid stage map")
+	}
+
+	moved, err := migrateAndDeleteWorkflow(source, target, stageMap, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 4 {
+		t.Fatal("tasks not moved")
+	}
+
+	tasks, err := selectTasksByWorkflow(target.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 4 {
+		t.Fatal("tasks not found in target workflow")
+	}
+	orderNrs := make(map[int]bool)
+	for _, task := range tasks {
+		orderNrs[task.StageOrderNr] = true
+	}
+	if len(orderNrs) != 4 {
+		t.Fatal("moved tasks should be numbered after each other", tasks)
+	}
+
+	history, err := selectTaskStageHistory(tasks[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatal("stage change not recorded")
+	}
+
+	u, err := selectUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ActiveWorkflowID != target.ID {
+		t.Fatal("active workflow not switched")
+	}
+
+	workflows, err := selectWorkflowsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workflows) != 1 {
+		t.Fatal("workflow not deleted")
+	}
+}
+
+func TestDeleteStageWithTasks(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone407@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	var stages []Stage
+	for i, name := range []string{"first", "second", "third"} {
+		stage := Stage{}
+		stage.WorkflowID = workflow.ID
+		stage.Name = name
+		stage.OrderNr = i
+		if err := insertStage(&stage); err != nil {
+			t.Fatal(err)
+		}
+		stages = append(stages, stage)
+	}
+
+	for _, stage := range []Stage{stages[0], stages[1], stages[1]} {
+		model := Task{}
+		model.CreatorUserID = user.ID
+		model.UserID = user.ID
+		model.WorkflowID = workflow.ID
+		model.StageID = stage.ID
+		model.Name = "task in " + stage.Name
+		model.CompanyID = company.ID
+		if err := insertTask(&model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := deleteStage(stages[1].ID); err == nil {
+		t.Fatal("stage with tasks should not be deleted")
+	}
+
+	other := Workflow{}
+	other.Name = "other"
+	other.CompanyID = company.ID
+	if err := insertWorkflow(&other); err != nil {
+		t.Fatal(err)
+	}
+
+	otherStage := Stage{}
+	otherStage.WorkflowID = other.ID
+	otherStage.Name = "elsewhere"
+	if err := insertStage(&otherStage); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := moveTasksAndDeleteStage(stages[1], otherStage.ID, user.ID); err == nil {
+		t.Fatal("tasks should not move to another workflow")
+	}
+
+	moved, err := moveTasksAndDeleteStage(stages[1], stages[0].ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 2 {
+		t.Fatal("tasks not moved")
+	}
+
+	remaining, err := selectStagesByWorkflow(workflow.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatal("stage not deleted")
+	}
+	if remaining[0].OrderNr != 0 || remaining[1].OrderNr != 1 || remaining[1].ID != stages[2].ID {
+		t.Fatal("stages not renumbered")
+	}
+
+	tasks, err := selectTasksByWorkflow(workflow.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := make(map[int]bool)
+	for _, task := range tasks {
+		if task.StageID != stages[0].ID {
+			t.Fatal("task left in deleted stage")
+		}
+		if positions[task.StageOrderNr] {
+			t.Fatal("moved tasks should not share a position", task.StageOrderNr)
+		}
+		positions[task.StageOrderNr] = true
+	}
+}
+
+func TestTaskCustomFields(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone408@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "first stage"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	source := TaskField{}
+	source.CompanyID = company.ID
+	source.Name = "Lead source"
+	source.FieldType = "picklist"
+	source.PicklistData = `["web", "referral"]`
+	source.MandatoryFlag = true
+	if err := insertTaskField(&source); err != nil {
+		t.Fatal(err)
+	}
+	if source.Key != "lead_source" {
+		t.Fatal("invalid field key", source.Key)
+	}
+
+	budget := TaskField{}
+	budget.CompanyID = company.ID
+	budget.Name = "Budget"
+	budget.FieldType = "money"
+	if err := insertTaskField(&budget); err != nil {
+		t.Fatal(err)
+	}
+
+	duplicate := TaskField{}
+	duplicate.CompanyID = company.ID
+	duplicate.Name = "Budget"
+	duplicate.FieldType = "number"
+	if err := insertTaskField(&duplicate); err == nil {
+		t.Fatal("duplicate field key should fail")
+	}
+
+	invalid := TaskField{}
+	invalid.CompanyID = company.ID
+	invalid.Name = "Whatever"
+	invalid.FieldType = "whatever"
+	if err := insertTaskField(&invalid); err == nil {
+		t.Fatal("unknown field type should fail")
+	}
+
+	model := Task{}
+	model.CreatorUserID = user.ID
+	model.UserID = user.ID
+	model.WorkflowID = workflow.ID
+	model.StageID = stage.ID
+	model.Name = "custom task"
+	model.CompanyID = company.ID
+	if err := insertTask(&model); err == nil {
+		t.Fatal("mandatory field should be enforced")
+	}
+
+	model.CustomFields = CustomFields{"lead_source": "tv"}
+	if err := insertTask(&model); err == nil {
+		t.Fatal("picklist value should be validated")
+	}
+
+	model.CustomFields = CustomFields{"lead_source": "web", "nonsense": "x"}
+	if err := insertTask(&model); err == nil {
+		t.Fatal("unknown field should fail")
+	}
+
+	model.CustomFields = CustomFields{"lead_source": "web", "budget": 100}
+	if err := insertTask(&model); err == nil {
+		t.Fatal("money without currency should fail")
+	}
+
+	model.CustomFields = CustomFields{
+		"lead_source": "web",
+		"budget":      map[string]interface{}{"amount": 100, "currency": "EUR"},
+	}
+	if err := insertTask(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.CustomFields["lead_source"] != "web" {
+		t.Fatal("custom field not stored")
+	}
+	if !matchCustomFields(task.CustomFields, map[string]string{"lead_source": "web", "budget": "100"}) {
+		t.Fatal("custom field filter should match")
+	}
+	if matchCustomFields(task.CustomFields, map[string]string{"lead_source": "referral"}) {
+		t.Fatal("custom field filter should not match")
+	}
+
+	task.CustomFields["lead_source"] = ""
+	if err := updateTask(*task); err == nil {
+		t.Fatal("mandatory field should be enforced on update")
+	}
+
+	manager := TaskField{}
+	manager.CompanyID = company.ID
+	manager.Name = "Manager"
+	manager.FieldType = "user"
+	if err := insertTaskField(&manager); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"nobody", "00000000-0000-0000-0000-000000000000"} {
+		task.CustomFields = CustomFields{"lead_source": "web", "manager": value}
+		if err := updateTask(*task); err == nil || errorStatus(err) != http.StatusBadRequest {
+			t.Fatal("invalid user should be a validation error", value, err)
+		}
+	}
+
+	// renaming a key moves the values, deleting a field removes them
+	budget.Key = "deal_budget"
+	if err := updateTaskField(budget); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteTaskField(source); err != nil {
+		t.Fatal(err)
+	}
+	task, err = selectTaskByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := task.CustomFields["lead_source"]; ok {
+		t.Fatal("values of a deleted field should be removed", task.CustomFields)
+	}
+	if _, ok := task.CustomFields["deal_budget"]; !ok {
+		t.Fatal("values should move to the new key", task.CustomFields)
+	}
+
+	// a stale copy of the task can still be saved
+	if _, err := db.Exec(`
+		update tasks
+		set custom_fields = custom_fields || '{"lead_source": "web"}'
+		where id = $1
+	`, model.ID); err != nil {
+		t.Fatal(err)
+	}
+	task.CustomFields["lead_source"] = "web"
+	if err := updateTask(*task); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEntityCustomFields(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone409@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	companyUser := CompanyUser{
+		CompanyID: company.ID,
+		UserID:    user.ID,
+	}
+	if err := insertCompanyUser(&companyUser); err != nil {
+		t.Fatal(err)
+	}
+
+	birthday := PersonField{}
+	birthday.CompanyID = company.ID
+	birthday.Name = "Birthday"
+	birthday.FieldType = "date"
+	if err := insertPersonField(&birthday); err != nil {
+		t.Fatal(err)
+	}
+
+	person := Person{}
+	person.CompanyID = company.ID
+	person.OwnerID = user.ID
+	person.Name = "custom person"
+	person.CustomFields = CustomFields{"birthday": "someday"}
+	if err := insertPerson(&person); err == nil {
+		t.Fatal("date value should be validated")
+	}
+	person.CustomFields = CustomFields{"birthday": "1980-02-29T00:00:00Z"}
+	if err := insertPerson(&person); err != nil {
+		t.Fatal(err)
+	}
+	savedPerson, err := selectPersonByID(person.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedPerson.CustomFields["birthday"] != "1980-02-29" {
+		t.Fatal("invalid person custom fields", savedPerson.CustomFields)
+	}
+
+	employees := OrganizationField{}
+	employees.CompanyID = company.ID
+	employees.Name = "Employees"
+	employees.FieldType = "number"
+	employees.MandatoryFlag = true
+	if err := insertOrganizationField(&employees); err != nil {
+		t.Fatal(err)
+	}
+
+	org := Organization{}
+	org.CompanyID = company.ID
+	org.OwnerID = user.ID
+	org.Name = "custom organization"
+	if err := insertOrganization(&org); err == nil {
+		t.Fatal("mandatory field should be enforced")
+	}
+	org.CustomFields = CustomFields{"employees": "12"}
+	if err := insertOrganization(&org); err != nil {
+		t.Fatal(err)
+	}
+	orgs, err := selectOrganizationsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 1 || orgs[0].CustomFields["employees"] != float64(12) {
+		t.Fatal("invalid organization custom fields", orgs)
+	}
+
+	outcome := ActivityField{}
+	outcome.CompanyID = company.ID
+	outcome.Name = "Outcome"
+	outcome.FieldType = "picklist"
+	outcome.PicklistData = "reached, voicemail"
+	if err := insertActivityField(&outcome); err != nil {
+		t.Fatal(err)
+	}
+
+	activity := Activity{}
+	activity.CompanyID = company.ID
+	activity.UserID = user.ID
+	activity.Name = "custom activity"
+	activity.CustomFields = CustomFields{"outcome": "voicemail", "unknown": "x"}
+	if err := insertActivity(&activity); err == nil {
+		t.Fatal("unknown field should fail")
+	}
+	delete(activity.CustomFields, "unknown")
+	if err := insertActivity(&activity); err != nil {
+		t.Fatal(err)
+	}
+	savedActivity, err := selectActivityByID(activity.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedActivity.CustomFields["outcome"] != "voicemail" {
+		t.Fatal("invalid activity custom fields", savedActivity.CustomFields)
+	}
+
+	if err := deleteActivityField(outcome); err != nil {
+		t.Fatal(err)
+	}
+	activityFields, err := selectActivityFieldsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activityFields) != 0 {
+		t.Fatal("activity field should be deleted")
+	}
+	savedActivity, err = selectActivityByID(activity.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := savedActivity.CustomFields["outcome"]; ok {
+		t.Fatal("values of a deleted field should be removed", savedActivity.CustomFields)
+	}
+
+	// organizations created from a name with an activity get their mandatory
+	// fields later
+	quick := Activity{}
+	quick.CompanyID = company.ID
+	quick.UserID = user.ID
+	quick.Name = "quick activity"
+	quick.OrgName = "quick organization"
+	if err := assignOrganization(&quick, user); err != nil {
+		t.Fatal(err)
+	}
+	if quick.OrgID == "" {
+		t.Fatal("organization should be created")
+	}
+
+	manager := ProductField{}
+	manager.CompanyID = company.ID
+	manager.Name = "Product manager"
+	manager.FieldType = "user"
+	if err := insertProductField(&manager); err != nil {
+		t.Fatal(err)
+	}
+
+	product := Product{}
+	product.CompanyID = company.ID
+	product.OwnerID = user.ID
+	product.Name = "custom product"
+	product.CustomFields = CustomFields{"product_manager": person.ID}
+	if err := insertProduct(&product); err == nil {
+		t.Fatal("user value should be validated")
+	}
+	product.CustomFields = CustomFields{"product_manager": user.ID}
+	if err := insertProduct(&product); err != nil {
+		t.Fatal(err)
+	}
+	savedProduct, err := selectProductByID(product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedProduct.CustomFields["product_manager"] != user.ID {
+		t.Fatal("invalid product custom fields", savedProduct.CustomFields)
+	}
+
+	manager.Key = "owner"
+	if err := updateProductField(manager); err != nil {
+		t.Fatal(err)
+	}
+	savedProduct, err = selectProductByID(product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedProduct.CustomFields["owner"] != user.ID {
+		t.Fatal("values should move to the new key", savedProduct.CustomFields)
+	}
+}
+
+func TestPersonDuplicates(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone410@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "first stage"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	org := Organization{}
+	org.CompanyID = company.ID
+	org.OwnerID = user.ID
+	org.Name = "duplicate org"
+	if err := insertOrganization(&org); err != nil {
+		t.Fatal(err)
+	}
+
+	var persons []Person
+	for _, name := range []string{"John Doe", "J. Smith", "Jon Doe"} {
+		person := Person{}
+		person.CompanyID = company.ID
+		person.OwnerID = user.ID
+		person.OrgID = org.ID
+		person.Name = name
+		if err := insertPerson(&person); err != nil {
+			t.Fatal(err)
+		}
+		persons = append(persons, person)
+	}
+	john, smith, jon := persons[0], persons[1], persons[2]
+
+	contacts := []Contact{
+		{PersonID: john.ID, Type: "email"},
+		{PersonID: smith.ID, Type: "email"},
+		{PersonID: john.ID, Type: "phone"},
+		{PersonID: jon.ID, Type: "phone"},
+	}
+	contacts[0].Name = "john@example.com"
+	contacts[1].Name = " John@Example.com"
+	contacts[2].Name = "+358 40 123 4567"
+	contacts[3].Name = "00358-401234567"
+	for i := range contacts {
+		if err := insertContact(&contacts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	duplicates, err := findPersonDuplicates(john)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, duplicate := range duplicates {
+		reasons[duplicate.Person.ID] = strings.Join(duplicate.Reasons, ",")
+	}
+	if len(reasons) != 2 || reasons[smith.ID] != "email" || reasons[jon.ID] != "phone,name" {
+		t.Fatal("invalid duplicates", reasons)
+	}
+
+	// a national number matches the same number with a country code
+	national := Contact{Type: "phone"}
+	national.Name = "040 123 4567"
+	IDs, err := selectPersonIDsByContact(company.ID, national)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(IDs) != 2 {
+		t.Fatal("national number should match", IDs)
+	}
+
+	task := Task{}
+	task.CreatorUserID = user.ID
+	task.UserID = user.ID
+	task.WorkflowID = workflow.ID
+	task.StageID = stage.ID
+	task.Name = "duplicate task"
+	task.CompanyID = company.ID
+	task.PersonID = smith.ID
+	if err := insertTask(&task); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mergePersons(john, smith); err != nil {
+		t.Fatal(err)
+	}
+
+	loser, err := selectPersonByID(smith.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loser != nil {
+		t.Fatal("merged person should be deleted")
+	}
+
+	tasks, err := selectTasksByPerson(john.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != task.ID {
+		t.Fatal("task should be moved to the surviving person", tasks)
+	}
+
+	johnContacts, err := selectContactsByPerson(john.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(johnContacts) != 2 {
+		t.Fatal("duplicate contacts should not be moved", johnContacts)
+	}
+}
+
+func TestSimilarNames(t *testing.T) {
+	if !similarNames("John Doe", "doe, john") {
+		t.Fatal("names in other order should match")
+	}
+	if !similarNames("Jonathan Smith", "Jonathon Smith") {
+		t.Fatal("names with a typo should match")
+	}
+	if similarNames("Jon Doe", "Jane Roe") {
+		t.Fatal("different names should not match")
+	}
+}
+
+func TestOrganizationDuplicates(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone411@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "first stage"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	var orgs []Organization
+	for _, name := range []string{"Acme", "ACME Ltd", "Acme Ltd.", "Road Runner Inc"} {
+		org := Organization{}
+		org.CompanyID = company.ID
+		org.OwnerID = user.ID
+		org.Name = name
+		if name == "ACME Ltd" || name == "Road Runner Inc" {
+			org.Address = "1 Desert Road, Arizona"
+		}
+		if err := insertOrganization(&org); err != nil {
+			t.Fatal(err)
+		}
+		orgs = append(orgs, org)
+	}
+	acme, acmeLtd, acmeDot, roadRunner := orgs[0], orgs[1], orgs[2], orgs[3]
+
+	duplicates, err := findOrganizationDuplicates(acmeLtd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, duplicate := range duplicates {
+		reasons[duplicate.Organization.ID] = strings.Join(duplicate.Reasons, ",")
+	}
+	if len(reasons) != 3 || reasons[acme.ID] != "name" || reasons[acmeDot.ID] != "name" || reasons[roadRunner.ID] != "address" {
+		t.Fatal("invalid duplicates", reasons)
+	}
+
+	person := Person{}
+	person.CompanyID = company.ID
+	person.OwnerID = user.ID
+	person.OrgID = acmeLtd.ID
+	person.Name = "Wile E. Coyote"
+	if err := insertPerson(&person); err != nil {
+		t.Fatal(err)
+	}
+
+	task := Task{}
+	task.CreatorUserID = user.ID
+	task.UserID = user.ID
+	task.WorkflowID = workflow.ID
+	task.StageID = stage.ID
+	task.Name = "duplicate task"
+	task.CompanyID = company.ID
+	task.OrgID = acmeLtd.ID
+	if err := insertTask(&task); err != nil {
+		t.Fatal(err)
+	}
+
+	relationships := []OrganizationRelationship{
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: acme.ID, RelLinkedOrgID: acmeLtd.ID},
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: acme.ID, RelLinkedOrgID: roadRunner.ID},
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: acmeLtd.ID, RelLinkedOrgID: roadRunner.ID},
+	}
+	for i := range relationships {
+		if err := insertOrganizationRelationship(&relationships[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mergeOrganizations(acme, acmeLtd); err != nil {
+		t.Fatal(err)
+	}
+
+	loser, err := selectOrganizationByID(acmeLtd.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loser != nil {
+		t.Fatal("merged organization should be deleted")
+	}
+
+	winner, err := selectOrganizationByID(acme.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if winner.PeopleCount != 1 || winner.OpenTasksCount != 1 {
+		t.Fatal("invalid counters after merge", winner.PeopleCount, winner.OpenTasksCount)
+	}
+	if winner.Address != "1 Desert Road, Arizona" {
+		t.Fatal("empty address should be taken from the merged organization", winner.Address)
+	}
+
+	var count int
+	if err := db.QueryRow(`
+		select count(1)
+		from organization_relationships
+		where deleted_at is null
+		and (rel_owner_org_id = $1 or rel_linked_org_id = $1)
+	`, acme.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("self and repeated relationships should be deleted", count)
+	}
+}
+
+func TestNormalizeOrganizationName(t *testing.T) {
+	for _, name := range []string{"Acme", "ACME Ltd", "Acme Ltd.", "acme, inc"} {
+		if normalizeOrganizationName(name) != "acme" {
+			t.Fatal("invalid normalized name", name, normalizeOrganizationName(name))
+		}
+	}
+	if normalizeOrganizationName("Ltd") != "ltd" {
+		t.Fatal("legal form alone should be kept")
+	}
+}
+
+func TestParseVCards(t *testing.T) {
+	data := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"N:Doe;John;;;\r\n" +
+		"FN:John Doe\r\n" +
+		"ORG:Acme\\, Inc.;Sales\r\n" +
+		"EMAIL;TYPE=INTERNET:john@example.com\r\n" +
+		"EMAIL;TYPE=INTERNET,PREF:john.doe@exam\r\n" +
+		" ple.com\r\n" +
+		"item1.TEL;TYPE=CELL:+358 40 123 4567\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\n" +
+		"VERSION:2.1\n" +
+		"N:Smith;Jane\n" +
+		"TEL;WORK;VOICE:555-1234\n" +
+		"END:VCARD\n"
+
+	imports, err := parseVCards(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 2 {
+		t.Fatal("invalid number of cards", len(imports))
+	}
+
+	john := imports[0]
+	if john.Person.Name != "John Doe" || john.Person.FirstName != "John" || john.Person.OrgName != "Acme, Inc." {
+		t.Fatal("invalid person", john.Person)
+	}
+	if len(john.Contacts) != 3 {
+		t.Fatal("invalid contacts", john.Contacts)
+	}
+	if john.Contacts[0].Primary || !john.Contacts[1].Primary || john.Contacts[1].Name != "john.doe@example.com" {
+		t.Fatal("preferred e-mail should be primary", john.Contacts)
+	}
+	if john.Contacts[2].Type != "phone" || !john.Contacts[2].Primary {
+		t.Fatal("only phone should be primary", john.Contacts[2])
+	}
+
+	jane := imports[1]
+	if jane.Person.Name != "Jane Smith" || len(jane.Contacts) != 1 || jane.Contacts[0].Name != "555-1234" {
+		t.Fatal("invalid vCard 2.1 person", jane)
+	}
+
+	qp := "BEGIN:VCARD\r\n" +
+		"VERSION:2.1\r\n" +
+		"N;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:J=C3=A4rvinen;Matti\r\n" +
+		"ORG;CHARSET=ISO-8859-1;QUOTED-PRINTABLE:Kahvila M=E4kel=E4 Oy=\r\n" +
+		" ja Kumppanit\r\n" +
+		"NOTE;ENCODING=QUOTED-PRINTABLE:first=0D=0A=\r\n" +
+		"second\r\n" +
+		"EMAIL;INTERNET:matti@example.com\r\n" +
+		"END:VCARD\r\n"
+	imports, err = parseVCards(strings.NewReader(qp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 1 || imports[0].Person.Name != "Matti Järvinen" || imports[0].Person.OrgName != "Kahvila Mäkelä Oy ja Kumppanit" || len(imports[0].Contacts) != 1 {
+		t.Fatal("invalid quoted-printable card", imports)
+	}
+
+	if _, err := parseVCards(strings.NewReader("BEGIN:VCARD\nFN:Nobody\n")); err == nil {
+		t.Fatal("unterminated card should fail")
+	}
+
+	for _, version := range []string{"3.0", "4.0"} {
+		var b bytes.Buffer
+		if err := writeVCard(&b, john.Person, john.Contacts, version); err != nil {
+			t.Fatal(err)
+		}
+		again, err := parseVCards(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != 1 || again[0].Person.Name != "John Doe" || again[0].Person.OrgName != "Acme, Inc." || len(again[0].Contacts) != 3 || !again[0].Contacts[1].Primary {
+			t.Fatal("invalid round trip", version, again)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := writeVCard(&b, john.Person, john.Contacts, "2.1"); err == nil {
+		t.Fatal("unsupported version should fail")
+	}
+}
+
+func TestImportPersons(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone412@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := Person{}
+	existing.CompanyID = company.ID
+	existing.OwnerID = user.ID
+	existing.Name = "Johnny Doe"
+	if err := insertPerson(&existing); err != nil {
+		t.Fatal(err)
+	}
+	contact := Contact{PersonID: existing.ID, Type: "email"}
+	contact.Name = "john@example.com"
+	if err := insertContact(&contact); err != nil {
+		t.Fatal(err)
+	}
+
+	data := "BEGIN:VCARD\nVERSION:4.0\nFN:John Doe\nORG:Imported Org\nEMAIL:JOHN@example.com\nEND:VCARD\n" +
+		"BEGIN:VCARD\nVERSION:4.0\nFN:Jane Smith\nORG:Imported Org\nEND:VCARD\n"
+	imports, err := parseVCards(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := previewPersonImports(imports, company.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(imports[0].Duplicates) != 1 || imports[0].Duplicates[0].Person.ID != existing.ID {
+		t.Fatal("e-mail duplicate should be found", imports[0].Duplicates)
+	}
+	if len(imports[1].Duplicates) != 0 {
+		t.Fatal("invalid duplicates", imports[1].Duplicates)
+	}
+
+	persons, err := importPersons(imports, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if persons[0].OrgID == "" || persons[0].OrgID != persons[1].OrgID {
+		t.Fatal("imported persons should share the organization", persons[0].OrgID, persons[1].OrgID)
+	}
+
+	contacts, err := selectContactsByPerson(persons[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || !contacts[0].Primary || contacts[0].Type != "email" {
+		t.Fatal("invalid imported contacts", contacts)
+	}
+
+	failing := []PersonImport{{}, {}}
+	failing[0].Person.Name = "Saved Nowhere"
+	failing[0].Person.OrgName = "Rolled Back Org"
+	if _, err := importPersons(failing, user); err == nil {
+		t.Fatal("card without a name should fail")
+	}
+	orgIDs, err := organizationIDsByName(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orgIDs[normalizeOrganizationName("Rolled Back Org")] != "" {
+		t.Fatal("failed import should save nothing")
+	}
+}
+
+func TestCSVImport(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone413@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "Lead"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	acme := Organization{}
+	acme.CompanyID = company.ID
+	acme.OwnerID = user.ID
+	acme.Name = "Acme"
+	if err := insertOrganization(&acme); err != nil {
+		t.Fatal(err)
+	}
+
+	data := "Organization;City;Contact;E-mail;Deal;Value;Stage\n" +
+		"Acme Ltd;Helsinki;John Doe;john@example.com;Big deal;1 000,50;Lead\n" +
+		"New Org;Espoo;Jane Roe;;Second deal;200;Negotiation\n" +
+		";;;;;abc;\n" +
+		"New Org;Espoo;Jane Roe;;Third deal;x;Lead\n"
+
+	preview, err := previewImport(data, company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Headers) != 7 || len(preview.Rows) != 4 {
+		t.Fatal("invalid preview", preview.Headers, preview.Rows)
+	}
+	if preview.Mapping["E-mail"] != "person.email" || preview.Mapping["Value"] != "task.value" || preview.Mapping["Stage"] != "task.stage" {
+		t.Fatal("invalid suggested mapping", preview.Mapping)
+	}
+
+	model := Import{
+		CompanyID: company.ID,
+		UserID:    user.ID,
+		Data:      data,
+		Mapping: map[string]string{
+			"Organization": "organization.name",
+			"City":         "organization.address_locality",
+			"Contact":      "person.name",
+			"E-mail":       "person.email",
+			"Deal":         "task.name",
+			"Value":        "task.value",
+			"Stage":        "task.stage",
+		},
+	}
+	if err := validateImport(model); err == nil {
+		t.Fatal("tasks without a workflow should fail")
+	}
+	model.WorkflowID = workflow.ID
+	if err := validateImport(model); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertImport(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runPendingImports(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := selectImportByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != "done" || saved.TotalRows != 4 || saved.ProcessedRows != 4 {
+		t.Fatal("invalid import progress", saved.Status, saved.TotalRows, saved.ProcessedRows)
+	}
+	if len(saved.Errors) != 2 || saved.Errors[0].Row != 4 || saved.Errors[1].Row != 5 {
+		t.Fatal("invalid import errors", saved.Errors)
+	}
+
+	orgs, err := selectOrganizationsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 {
+		t.Fatal("existing organization should be reused", len(orgs))
+	}
+
+	tasks, err := selectTasksByWorkflow(workflow.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatal("invalid number of imported tasks", len(tasks))
+	}
+	for _, task := range tasks {
+		if task.Name == "Big deal" && (task.Value != 1001 || task.OrgID != acme.ID || task.PersonID == "") {
+			t.Fatal("invalid imported task", task)
+		}
+	}
+
+	stages, err := selectStagesByWorkflow(workflow.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != 2 || stages[1].Name != "Negotiation" {
+		t.Fatal("missing stage should be created", stages)
+	}
+
+	if err := revertImport(*saved); err != nil {
+		t.Fatal(err)
+	}
+
+	orgs, err = selectOrganizationsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persons, err := selectPersonsByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err = selectTasksByWorkflow(workflow.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, err = selectStagesByWorkflow(workflow.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 1 || len(persons) != 0 || len(tasks) != 0 || len(stages) != 1 {
+		t.Fatal("import should be reverted", len(orgs), len(persons), len(tasks), len(stages))
+	}
+
+	saved, err = selectImportByID(model.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != "reverted" {
+		t.Fatal("invalid status after revert", saved.Status)
+	}
+}
+
+func TestNormalizeContact(t *testing.T) {
+	countryCode := config.PhoneCountryCode
+	defer func() { config.PhoneCountryCode = countryCode }()
+	config.PhoneCountryCode = ""
+
+	phones := map[string]string{
+		"+44 (0)20 7946-0000": "+442079460000",
+		"00358 40 123 4567":   "+358401234567",
+		"tel:+1.212.555.0100": "+12125550100",
+	}
+	for input, expected := range phones {
+		contact := Contact{Type: "phone"}
+		contact.Name = input
+		if err := normalizeContact(&contact); err != nil || contact.Name != expected {
+			t.Fatal("invalid phone number", input, contact.Name, err)
+		}
+	}
+
+	contact := Contact{Type: "phone"}
+	contact.Name = " 040 123 4567 "
+	if err := normalizeContact(&contact); err != nil || contact.Name != "040 123 4567" {
+		t.Fatal("national number should be kept without a country code", contact.Name, err)
+	}
+
+	for _, input := range []string{"+44 20 7946 0000 ext 12", "+123", "Work"} {
+		contact := Contact{Type: "phone"}
+		contact.Name = input
+		if err := normalizeContact(&contact); err == nil {
+			t.Fatal("phone number should fail", input)
+		}
+	}
+
+	config.PhoneCountryCode = "358"
+	contact = Contact{Type: "phone", Label: " Mobile"}
+	contact.Name = "040 123 4567"
+	if err := normalizeContact(&contact); err != nil || contact.Name != "+358401234567" || contact.Label != "mobile" {
+		t.Fatal("national number should get the country code", contact, err)
+	}
+
+	contact = Contact{Type: "email"}
+	contact.Name = " John.Doe@Example.COM "
+	if err := normalizeContact(&contact); err != nil || contact.Name != "John.Doe@example.com" {
+		t.Fatal("invalid e-mail address", contact.Name, err)
+	}
+	for _, input := range []string{"john", "john@localhost", "John <john@example.com>"} {
+		contact := Contact{Type: "email"}
+		contact.Name = input
+		if err := normalizeContact(&contact); err == nil {
+			t.Fatal("e-mail address should fail", input)
+		}
+	}
+
+	contact = Contact{Type: "email", Label: "office"}
+	contact.Name = "john@example.com"
+	if err := normalizeContact(&contact); err == nil {
+		t.Fatal("unknown label should fail")
+	}
+
+	contacts := []Contact{{Type: "email", Primary: true}, {Type: "email", Primary: true}}
+	contacts[0].Name = "john@example.com"
+	contacts[1].Name = "doe@example.com"
+	if err := normalizePersonContacts(contacts); err == nil {
+		t.Fatal("two primary e-mail addresses should fail")
+	}
+}
+
+func TestPersonContacts(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone414@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	person := Person{}
+	person.CompanyID = company.ID
+	person.OwnerID = user.ID
+	person.Name = "John Doe"
+	if err := insertPerson(&person); err != nil {
+		t.Fatal(err)
+	}
+
+	contacts := []Contact{
+		{Type: "email", Label: "work"},
+		{Type: "email", Label: "home", Primary: true},
+		{Type: "phone", Label: "mobile"},
+		{Type: "website"},
+	}
+	contacts[0].Name = "john@example.com"
+	contacts[1].Name = "john@home.example.com"
+	contacts[2].Name = "+358 40 123 4567"
+	contacts[3].Name = "https://example.com"
+	if err := normalizePersonContacts(contacts); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePersonContacts(person, contacts, user); err != nil {
+		t.Fatal(err)
+	}
+
+	model, err := selectPersonByID(person.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(model.Contacts) != 4 {
+		t.Fatal("invalid contacts", model.Contacts)
+	}
+	if model.Email != "john@home.example.com" || model.Phone != "+358401234567" {
+		t.Fatal("e-mail and phone should come from the primary contacts", model.Email, model.Phone)
+	}
+
+	var work, home Contact
+	for _, contact := range model.Contacts {
+		switch contact.Label {
+		case "work":
+			work = contact
+		case "home":
+			home = contact
+		}
+	}
+
+	work.Primary = true
+	if err := updateContact(work); err != nil {
+		t.Fatal(err)
+	}
+	model, err = selectPersonByID(person.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Email != "john@example.com" {
+		t.Fatal("primary e-mail should change", model.Email)
+	}
+
+	if err := savePersonContacts(person, []Contact{home}, user); err != nil {
+		t.Fatal(err)
+	}
+	model, err = selectPersonByID(person.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(model.Contacts) != 1 || !model.Contacts[0].Primary || model.Email != "john@home.example.com" || model.Phone != "" {
+		t.Fatal("remaining e-mail should become primary", model.Contacts)
+	}
+}
+
+func TestOrganizationHierarchy(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone415@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "first stage"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	var orgs []Organization
+	for _, name := range []string{"Holding", "Subsidiary", "Branch", "Partner"} {
+		org := Organization{}
+		org.CompanyID = company.ID
+		org.OwnerID = user.ID
+		org.Name = name
+		if err := insertOrganization(&org); err != nil {
+			t.Fatal(err)
+		}
+		orgs = append(orgs, org)
+	}
+	holding, subsidiary, branch, partner := orgs[0], orgs[1], orgs[2], orgs[3]
+
+	valid := []OrganizationRelationship{
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: holding.ID, RelLinkedOrgID: subsidiary.ID},
+		{CompanyID: company.ID, Type: "daughter", RelOwnerOrgID: branch.ID, RelLinkedOrgID: subsidiary.ID},
+		{CompanyID: company.ID, Type: "related", RelOwnerOrgID: partner.ID, RelLinkedOrgID: branch.ID},
+	}
+	for i := range valid {
+		if err := saveOrganizationRelationship(&valid[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if valid[1].Type != "parent" || valid[1].RelOwnerOrgID != subsidiary.ID || valid[1].CalculatedType != "daughter" {
+		t.Fatal("daughter relationship should be stored as parent", valid[1])
+	}
+
+	invalid := []OrganizationRelationship{
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: branch.ID, RelLinkedOrgID: holding.ID},
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: partner.ID, RelLinkedOrgID: subsidiary.ID},
+		{CompanyID: company.ID, Type: "related", RelOwnerOrgID: branch.ID, RelLinkedOrgID: partner.ID},
+		{CompanyID: company.ID, Type: "parent", RelOwnerOrgID: partner.ID, RelLinkedOrgID: partner.ID},
+		{CompanyID: company.ID, Type: "sister", RelOwnerOrgID: partner.ID, RelLinkedOrgID: holding.ID},
+	}
+	for _, relationship := range invalid {
+		if err := saveOrganizationRelationship(&relationship); errorStatus(err) != http.StatusBadRequest {
+			t.Fatal("relationship should fail", relationship, err)
+		}
+	}
+
+	relationships, err := selectOrganizationRelationshipsByOrganization(subsidiary.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]string)
+	for _, relationship := range relationships {
+		types[relationship.CalculatedRelatedOrgID] = relationship.CalculatedType
+	}
+	if len(types) != 2 || types[holding.ID] != "parent" || types[branch.ID] != "daughter" {
+		t.Fatal("invalid relationships", types)
+	}
+
+	for _, org := range []Organization{branch, holding} {
+		task := Task{}
+		task.CreatorUserID = user.ID
+		task.UserID = user.ID
+		task.WorkflowID = workflow.ID
+		task.StageID = stage.ID
+		task.Name = "hierarchy task"
+		task.CompanyID = company.ID
+		task.OrgID = org.ID
+		task.Currency = "EUR"
+		task.Value = 100
+		if err := insertTask(&task); err != nil {
+			t.Fatal(err)
+		}
+		if org.ID == holding.ID {
+			if err := markTaskWon(task.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	graph, err := selectOrganizationGraph(branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := graph.Root
+	if root.Organization.ID != holding.ID || len(root.Children) != 1 || len(root.Children[0].Children) != 1 {
+		t.Fatal("invalid hierarchy", root)
+	}
+	if root.Organization.RelatedOpenTasksCount != 1 || root.Organization.RelatedWonTasksCount != 1 || root.Organization.RelatedOpenTasksValues["EUR"] != 100 {
+		t.Fatal("tasks of subsidiaries should be rolled up", root.Organization)
+	}
+	if sub := root.Children[0].Organization; sub.RelatedOpenTasksCount != 1 || sub.RelatedWonTasksCount != 0 {
+		t.Fatal("invalid subsidiary roll-up", sub)
+	}
+	if len(graph.Related) != 1 || graph.Related[0].RelOwnerOrgID != partner.ID {
+		t.Fatal("invalid related relationships", graph.Related)
+	}
+}
+
+func TestGeocoding(t *testing.T) {
+	var mutex sync.Mutex
+	lookups := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := r.URL.Query().Get("address")
+		mutex.Lock()
+		lookups[address]++
+		mutex.Unlock()
+		switch address {
+		case "1 Main Street, Springfield":
+			fmt.Fprint(w, `{"status": "OK", "results": [{"formatted_address": "1 Main St, Springfield, USA", "geometry": {"location": {"lat": 39.8, "lng": -89.6}},
+				"address_components": [
+					{"long_name": "1", "short_name": "1", "types": ["street_number"]},
+					{"long_name": "Main Street", "short_name": "Main St", "types": ["route"]},
+					{"long_name": "Springfield", "short_name": "Springfield", "types": ["locality", "political"]},
+					{"long_name": "United States", "short_name": "US", "types": ["country", "political"]}
+				]}]}`)
+		case "2 Elm Street, Springfield":
+			fmt.Fprint(w, `{"status": "OK", "results": [{"formatted_address": "2 Elm St, Springfield, USA", "geometry": {"location": {"lat": 39.7, "lng": -89.5}}}]}`)
+		default:
+			fmt.Fprint(w, `{"status": "ZERO_RESULTS", "results": []}`)
+		}
+	}))
+	defer server.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	config.GeocodeProvider = "google"
+	config.GeocodeAPIKey = "test"
+	config.GeocodeURL = server.URL
+
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone416@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	var orgs []Organization
+	for _, address := range []string{"1 Main Street, Springfield", "1  main street, Springfield", "Nowhere"} {
+		org := Organization{}
+		org.CompanyID = company.ID
+		org.OwnerID = user.ID
+		org.Name = "Geocoded"
+		org.Address = address
+		if err := insertOrganization(&org); err != nil {
+			t.Fatal(err)
+		}
+		orgs = append(orgs, org)
+	}
+
+	if err := backfillGeocoding(); err != nil {
+		t.Fatal(err)
+	}
+	if lookups["1 Main Street, Springfield"]+lookups["1  main street, Springfield"] != 1 {
+		t.Fatal("the same address should be looked up once", lookups)
+	}
+
+	model, err := selectOrganizationByID(orgs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Latitude == nil || *model.Latitude != 39.8 || model.AddressFormattedAddress != "1 Main St, Springfield, USA" {
+		t.Fatal("organization should be geocoded", model.Latitude, model.AddressFormattedAddress)
+	}
+	if model.AddressRoute != "Main Street" || model.AddressLocality != "Springfield" || model.CountryCode != "US" {
+		t.Fatal("empty address parts should be filled", model.AddressRoute, model.AddressLocality, model.CountryCode)
+	}
+
+	model, err = selectOrganizationByID(orgs[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Latitude != nil {
+		t.Fatal("unknown address should have no coordinates", *model.Latitude)
+	}
+
+	model, err = selectOrganizationByID(orgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.Name = "Renamed"
+	if err := updateOrganization(*model); err != nil {
+		t.Fatal(err)
+	}
+	model.Address = "2 Elm Street, Springfield"
+	if err := updateOrganization(*model); err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillGeocoding(); err != nil {
+		t.Fatal(err)
+	}
+	if lookups["1 Main Street, Springfield"] != 1 || lookups["2 Elm Street, Springfield"] != 1 {
+		t.Fatal("only the changed address should be looked up", lookups)
+	}
+	model, err = selectOrganizationByID(orgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Longitude == nil || *model.Longitude != -89.5 {
+		t.Fatal("changed address should be geocoded again", model.Longitude)
+	}
+	// claimed by a run that crashed, with the old and the new kind of claim
+	for _, org := range orgs[1:] {
+		if _, err := db.Exec(`update organizations set address_latitude = null, address_geocoded_at = current_timestamp where id = $1`, org.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`update organizations set address_geocoded_at = null, address_geocode_claimed_at = current_timestamp - interval '1 hour' where id = $1`, orgs[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillGeocoding(); err != nil {
+		t.Fatal(err)
+	}
+	model, err = selectOrganizationByID(orgs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Latitude == nil || *model.Latitude != 39.8 {
+		t.Fatal("organization without coordinates should be geocoded again", model.Latitude)
+	}
+	var pending bool
+	if err := db.QueryRow(`select address_geocoded_at is null from organizations where id = $1`, orgs[2].ID).Scan(&pending); err != nil || pending {
+		t.Fatal("expired claim should be taken over", err)
+	}
+	if lookups["Nowhere"] != 3 {
+		t.Fatal("addresses not found should be looked up again by the backfill", lookups)
+	}
+}
+
+func TestGeocoders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path == "/search" && query.Get("q") == "Mannerheimintie 1, Helsinki":
+			fmt.Fprint(w, `[{"lat": "60.1699", "lon": "24.9384", "display_name": "1, Mannerheimintie, Helsinki, Finland",
+				"address": {"house_number": "1", "road": "Mannerheimintie", "city": "Helsinki", "postcode": "00100", "country": "Finland", "country_code": "fi"}}]`)
+		case r.URL.Path == "/search" && query.Get("q") == "busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/search":
+			fmt.Fprint(w, `[]`)
+		case r.URL.Path == "/reverse":
+			fmt.Fprint(w, `{"error": "Unable to geocode"}`)
+		case query.Get("address") == "busy":
+			fmt.Fprint(w, `{"status": "OVER_QUERY_LIMIT", "results": []}`)
+		default:
+			fmt.Fprint(w, `{"status": "ZERO_RESULTS", "results": []}`)
+		}
+	}))
+	defer server.Close()
+
+	nominatim := nominatimGeocoder{URL: server.URL}
+	location, err := nominatim.Geocode("Mannerheimintie 1, Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Latitude != 60.1699 || location.AddressRoute != "Mannerheimintie" || location.AddressLocality != "Helsinki" || location.CountryCode != "FI" {
+		t.Fatal("invalid Nominatim location", location)
+	}
+	if _, err := nominatim.Geocode("nowhere"); err != errGeocodeNotFound {
+		t.Fatal("unknown address should not be found", err)
+	}
+	if _, err := nominatim.Geocode("busy"); err != errGeocodeQuota {
+		t.Fatal("rate limit should be a quota error", err)
+	}
+	if _, err := nominatim.ReverseGeocode(0, 0); err != errGeocodeNotFound {
+		t.Fatal("empty reverse result should not be found", err)
+	}
+
+	google := googleGeocoder{URL: server.URL, APIKey: "test"}
+	if _, err := google.Geocode("nowhere"); err != errGeocodeNotFound {
+		t.Fatal("zero results should not be found", err)
+	}
+	if _, err := google.Geocode("busy"); err != errGeocodeQuota {
+		t.Fatal("over query limit should be a quota error", err)
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config.GeocodeProvider = ""
+	config.GeocodeAPIKey = ""
+	if g, err := currentGeocoder(); err != nil || g.Name() != "none" {
+		t.Fatal("geocoding should be off without an API key", err)
+	}
+	config.GeocodeProvider = "google"
+	if _, err := currentGeocoder(); err != errGeocodeNoAPIKey {
+		t.Fatal("Google should need an API key", err)
+	}
+	config.GeocodeProvider = "nominatim"
+	if g, err := currentGeocoder(); err != nil || g.Name() != "nominatim" {
+		t.Fatal("Nominatim should be selected", err)
+	}
+}
+
+func TestNearbyOrganizations(t *testing.T) {
+	if d := distanceKm(51.5074, -0.1278, 48.8566, 2.3522); d < 340 || d > 345 {
+		t.Fatal("invalid distance from London to Paris", d)
+	}
+
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone417@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	orgs := make(map[string]Organization)
+	for _, place := range []struct {
+		name      string
+		latitude  float64
+		longitude float64
+	}{
+		{"Charing Cross", 51.5080, -0.1247},
+		{"Camden", 51.5390, -0.1426},
+		{"Paris", 48.8566, 2.3522},
+		{"Unknown", 0, 0},
+	} {
+		org := Organization{}
+		org.CompanyID = company.ID
+		org.OwnerID = user.ID
+		org.Name = place.name
+		if err := insertOrganization(&org); err != nil {
+			t.Fatal(err)
+		}
+		if place.name != "Unknown" {
+			if _, err := db.Exec(`
+				update organizations
+				set address_latitude = $1, address_longitude = $2, address_geocoded_at = current_timestamp
+				where id = $3
+			`, place.latitude, place.longitude, org.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		orgs[place.name] = org
+	}
+
+	tomorrow := time.Now().Add(24 * time.Hour)
+	nextWeek := time.Now().Add(7 * 24 * time.Hour)
+	yesterday := time.Now().Add(-48 * time.Hour)
+	for _, a := range []struct {
+		name string
+		due  time.Time
+		done bool
+	}{
+		{"visit next week", nextWeek, false},
+		{"visit tomorrow", tomorrow, false},
+		{"done visit", tomorrow, true},
+		{"past visit", yesterday, false},
+	} {
+		due := a.due
+		activity := Activity{}
+		activity.CompanyID = company.ID
+		activity.UserID = user.ID
+		activity.OrgID = orgs["Charing Cross"].ID
+		activity.Name = a.name
+		activity.DueDate = &due
+		activity.Done = a.done
+		if err := insertActivity(&activity); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nearby, err := selectNearbyOrganizations(company.ID, 51.5074, -0.1278, 10, OrganizationFilter{}, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearby) != 2 || nearby[0].Name != "Charing Cross" || nearby[1].Name != "Camden" {
+		t.Fatal("invalid nearby organizations", nearby)
+	}
+	if nearby[0].Distance > nearby[1].Distance || nearby[0].Distance > 1 {
+		t.Fatal("invalid distances", nearby[0].Distance, nearby[1].Distance)
+	}
+	if nearby[0].NextActivity == nil || nearby[0].NextActivity.Name != "visit tomorrow" {
+		t.Fatal("invalid next activity", nearby[0].NextActivity)
+	}
+	if nearby[1].NextActivity != nil {
+		t.Fatal("Camden should have no next activity")
+	}
+
+	nearby, err = selectNearbyOrganizations(company.ID, 51.5074, -0.1278, 1000, OrganizationFilter{}, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearby) != 3 || nearby[2].Name != "Paris" {
+		t.Fatal("Paris should be the furthest", nearby)
+	}
+
+	for _, filter := range []OrganizationFilter{{OpenTasks: "true"}, {OwnerID: company.ID}} {
+		nearby, err = selectNearbyOrganizations(company.ID, 51.5074, -0.1278, 1000, filter, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nearby) != 0 {
+			t.Fatal("filter should leave nothing", filter, nearby)
+		}
+	}
+
+	mapped, err := selectMappedOrganizations(company.ID, OrganizationFilter{OwnerID: user.ID, OpenTasks: "false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgsJSON := organizationsGeoJSON(mapped)
+	if orgsJSON.Type != "FeatureCollection" || len(orgsJSON.Features) != 3 {
+		t.Fatal("invalid organizations GeoJSON", orgsJSON)
+	}
+	for _, feature := range orgsJSON.Features {
+		if feature.ID == orgs["Paris"].ID && (feature.Geometry.Coordinates[0] != 2.3522 || feature.Geometry.Coordinates[1] != 48.8566) {
+			t.Fatal("GeoJSON coordinates should be longitude, latitude", feature.Geometry)
+		}
+	}
+
+	activities, err := selectUpcomingActivitiesByCompany(company.ID, startOfToday(time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	activitiesJSON := activitiesGeoJSON(activities, mapped)
+	if len(activitiesJSON.Features) != 2 || activitiesJSON.Features[0].Properties["name"] != "visit tomorrow" {
+		t.Fatal("invalid activities GeoJSON", activitiesJSON)
+	}
+	if len(activitiesGeoJSON(activities, nil).Features) != 0 {
+		t.Fatal("activities of filtered organizations should be left out")
+	}
+}
+
+func TestRouteOrder(t *testing.T) {
+	order := routeOrder([][2]float64{{0, 0}, {0, 0.3}, {0, 0.1}, {0, 0.2}})
+	if fmt.Sprint(order) != "[0 2 3 1]" {
+		t.Fatal("invalid route order", order)
+	}
+
+	// nearest neighbor goes to 0.1 first and has to come back for -0.05,
+	// 2-opt visits -0.05 first
+	order = routeOrder([][2]float64{{0, 0}, {0, 0.1}, {0, -0.05}, {0, 1}})
+	if fmt.Sprint(order) != "[0 2 1 3]" {
+		t.Fatal("invalid route order", order)
+	}
+
+	if len(routeOrder(nil)) != 0 {
+		t.Fatal("empty route should have no order")
+	}
+}
+
+func TestRoutePlan(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone418@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	day := startOfToday(time.Local).AddDate(0, 0, 1)
+	var activities []Activity
+	for i, place := range []struct {
+		longitude interface{}
+		userID    string
+	}{
+		{0.10, user.ID},
+		{0.00, user.ID},
+		{0.05, user.ID},
+		{nil, user.ID},
+		{0.02, company.ID},
+	} {
+		org := Organization{}
+		org.CompanyID = company.ID
+		org.OwnerID = user.ID
+		org.Name = fmt.Sprint("Stop ", i)
+		if err := insertOrganization(&org); err != nil {
+			t.Fatal(err)
+		}
+		if place.longitude != nil {
+			if _, err := db.Exec(`
+				update organizations
+				set address_latitude = 51.5, address_longitude = $1, address_geocoded_at = current_timestamp
+				where id = $2
+			`, place.longitude, org.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		due := day.Add(time.Duration(9+i) * time.Hour)
+		activity := Activity{}
+		activity.CompanyID = company.ID
+		activity.UserID = user.ID
+		activity.AssignedToUserID = place.userID
+		activity.OrgID = org.ID
+		activity.Name = org.Name
+		activity.DueDate = &due
+		if err := insertActivity(&activity); err != nil {
+			t.Fatal(err)
+		}
+		activities = append(activities, activity)
+	}
+
+	plan, err := planRoute(company.ID, user.ID, day, &[2]float64{51.5, -0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Stops) != 3 || len(plan.Unplaced) != 1 || plan.Unplaced[0].ID != activities[3].ID {
+		t.Fatal("invalid route plan", plan)
+	}
+	for i, ID := range []string{activities[1].ID, activities[2].ID, activities[0].ID} {
+		stop := plan.Stops[i]
+		if stop.Activity.ID != ID {
+			t.Fatal("invalid stop", i, stop.Activity.Name)
+		}
+		if !stop.SuggestedDueDate.Equal(day.Add(time.Duration(9+i) * time.Hour)) {
+			t.Fatal("invalid suggested due date", i, stop.SuggestedDueDate)
+		}
+	}
+	if plan.TotalDistance < 10 || plan.TotalDistance > 11 {
+		t.Fatal("invalid total distance", plan.TotalDistance)
+	}
+
+	if err := applyRouteOrder(company.ID, user.ID, day, []string{activities[1].ID, activities[2].ID}); err == nil {
+		t.Fatal("missing visit should fail")
+	}
+	if err := applyRouteOrder(company.ID, user.ID, day, []string{activities[1].ID, activities[2].ID, activities[0].ID, activities[4].ID}); err == nil {
+		t.Fatal("visit of another user should fail")
+	}
+	if err := applyRouteOrder(company.ID, user.ID, day, []string{activities[1].ID, activities[3].ID, activities[2].ID, activities[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	ordered, err := selectRouteActivities(company.ID, user.ID, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ID := range []string{activities[1].ID, activities[2].ID, activities[0].ID, activities[3].ID} {
+		if ordered[i].ID != ID || !ordered[i].DueDate.Equal(day.Add(time.Duration(9+i)*time.Hour)) {
+			t.Fatal("order was not applied", i, ordered[i].Name, ordered[i].DueDate)
+		}
+	}
+	if err := applyRouteOrder(company.ID, user.ID, day, []string{activities[2].ID, activities[0].ID, activities[1].ID}); err != nil {
+		t.Fatal("unplaced visit can be left out of the order", err)
+	}
+}
+
+func TestActivityTypeManagement(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone419@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	call := ActivityType{}
+	call.CompanyID = company.ID
+	call.Name = "Call"
+	call.KeyString = "call"
+	call.Icon = "call"
+	if err := insertActivityType(&call); err != nil {
+		t.Fatal(err)
+	}
+
+	visit := ActivityType{CompanyID: company.ID, Color: "#00AA00", Icon: "visit"}
+	visit.Name = " Site visit "
+	if err := prepareActivityType(&visit, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !visit.IsCustomFlag || visit.KeyString != "site_visit" || visit.OrderNr != 1 || visit.Color != "#00aa00" {
+		t.Fatal("invalid new activity type", visit)
+	}
+	if err := insertActivityType(&visit); err != nil {
+		t.Fatal(err)
+	}
+
+	demo := Base{Name: "Demo"}
+	for _, invalid := range []ActivityType{
+		{CompanyID: company.ID},
+		{Base: demo, CompanyID: company.ID, Color: "green"},
+		{Base: demo, CompanyID: company.ID, Icon: "rocket"},
+		{Base: demo, CompanyID: company.ID, KeyString: "call"},
+	} {
+		if err := prepareActivityType(&invalid, nil); errorStatus(err) != http.StatusBadRequest {
+			t.Fatal("invalid activity type should fail", invalid)
+		}
+	}
+
+	renamed := ActivityType{Icon: "car", KeyString: "renamed"}
+	renamed.Name = "Phone call"
+	renamed.CompanyID = company.ID
+	if err := prepareActivityType(&renamed, &call); err != nil {
+		t.Fatal(err)
+	}
+	if renamed.KeyString != "call" || renamed.IsCustomFlag {
+		t.Fatal("built-in activity type should keep its key", renamed)
+	}
+
+	if err := orderActivityTypes(company.ID, []string{visit.ID}); errorStatus(err) != http.StatusBadRequest {
+		t.Fatal("ordering some types should fail")
+	}
+	if err := orderActivityTypes(company.ID, []string{visit.ID, call.ID}); err != nil {
+		t.Fatal(err)
+	}
+	types, err := selectActivityTypesByCompany(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0].ID != visit.ID || types[0].Icon != "visit" {
+		t.Fatal("invalid activity type order", types)
+	}
+
+	activity := Activity{}
+	activity.CompanyID = company.ID
+	activity.UserID = user.ID
+	activity.TypeID = visit.ID
+	activity.Name = "visit"
+	if err := insertActivity(&activity); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeActivityType(call, ""); errorStatus(err) != http.StatusBadRequest {
+		t.Fatal("built-in activity type should not be deleted")
+	}
+	if err := removeActivityType(visit, ""); errorStatus(err) != http.StatusBadRequest {
+		t.Fatal("used activity type should need a replacement")
+	}
+	if err := removeActivityType(visit, visit.ID); errorStatus(err) != http.StatusBadRequest {
+		t.Fatal("activity type should not replace itself")
+	}
+	if err := removeActivityType(visit, call.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := selectActivityByID(activity.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.TypeID != call.ID {
+		t.Fatal("activity should have been moved to the replacement type", moved.TypeID)
+	}
+	deleted, err := selectActivityTypeByID(visit.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.DeletedAt == nil {
+		t.Fatal("activity type should be deleted")
+	}
+	missing, err := selectActivityTypeByID(company.ID)
+	if err != nil || missing != nil {
+		t.Fatal("missing activity type should be nil", missing, err)
+	}
+}
+
+func TestRecurrenceRule(t *testing.T) {
+	occurrences := func(rule string, start time.Time, n int) []string {
+		r, err := parseRecurrenceRule(rule, time.UTC)
+		if err != nil {
+			t.Fatal(rule, err)
+		}
+		var result []string
+		r.each(start, func(index int, t time.Time) bool {
+			result = append(result, t.Format("2006-01-02 15:04"))
+			return len(result) < n
+		})
+		return result
+	}
+
+	// Thursday 2026-10-01 09:30
+	start := time.Date(2026, 10, 1, 9, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		rule     string
+		expected string
+	}{
+		{"FREQ=DAILY;COUNT=3", "[2026-10-01 09:30 2026-10-02 09:30 2026-10-03 09:30]"},
+		{"RRULE:FREQ=DAILY;INTERVAL=2;UNTIL=20261005", "[2026-10-01 09:30 2026-10-03 09:30 2026-10-05 09:30]"},
+		{"FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR", "[2026-10-01 09:30 2026-10-02 09:30 2026-10-05 09:30 2026-10-06 09:30]"},
+		{"FREQ=WEEKLY;INTERVAL=2", "[2026-10-01 09:30 2026-10-15 09:30 2026-10-29 09:30 2026-11-12 09:30]"},
+		{"FREQ=MONTHLY;BYDAY=-1FR;COUNT=3", "[2026-10-01 09:30 2026-10-30 09:30 2026-11-27 09:30]"},
+		{"FREQ=MONTHLY;BYDAY=1TH", "[2026-10-01 09:30 2026-11-05 09:30 2026-12-03 09:30 2027-01-07 09:30]"},
+		{"FREQ=MONTHLY;BYMONTHDAY=31", "[2026-10-01 09:30 2026-10-31 09:30 2026-12-31 09:30 2027-01-31 09:30]"},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,-1", "[2026-10-01 09:30 2026-10-31 09:30 2026-11-01 09:30 2026-11-30 09:30]"},
+	} {
+		if result := fmt.Sprint(occurrences(test.rule, start, 4)); result != test.expected {
+			t.Fatal(test.rule, result)
+		}
+	}
+
+	rule, err := parseRecurrenceRule("rrule:freq=weekly;byday=mo,fr;count=10;interval=1", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.String() != "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=10" {
+		t.Fatal("invalid rule", rule.String())
+	}
+	if at, ok := rule.occurrence(start, 2); !ok || at.Format("2006-01-02") != "2026-10-05" {
+		t.Fatal("invalid occurrence", at)
+	}
+	if _, ok := rule.occurrence(start, 10); ok {
+		t.Fatal("rule should end after 10 occurrences")
+	}
+
+	for _, invalid := range []string{
+		"",
+		"FREQ=YEARLY",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=MONTHLY;BYDAY=XX",
+		"FREQ=DAILY;BYHOUR=9",
+		"FREQ=DAILY;FREQ=WEEKLY",
+	} {
+		if _, err := parseRecurrenceRule(invalid, time.UTC); err == nil {
+			t.Fatal("invalid rule should fail", invalid)
+		}
+	}
+
+	series := Activity{
+		RecurrenceRule:  "FREQ=WEEKLY",
+		RecurrenceStart: &start,
+		RecurrenceIndex: 1,
+		SeriesID:        "series",
+	}
+	due := start.AddDate(0, 0, 7)
+	series.DueDate = &due
+	done := series
+	done.Done = true
+	done.DueDate = &start
+	done.RecurrenceIndex = 0
+	from := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 29, 0, 0, 0, 0, time.UTC)
+	var days []string
+	for _, activity := range activitiesInRange([]Activity{series, done}, from, to, nil) {
+		days = append(days, fmt.Sprint(activity.DueDate.Format("01-02"), " ", activity.RecurrenceIndex, " ", activity.Projected))
+	}
+	if fmt.Sprint(days) != "[10-08 1 false 10-15 2 true 10-22 3 true]" {
+		t.Fatal("invalid activities in range", days)
+	}
+
+	// 09:00 in Helsinki stays 09:00 after daylight saving time ends on 25
+	// October, also when the start comes with the fixed offset of summer time
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summer := time.Date(2026, 10, 19, 9, 0, 0, 0, time.FixedZone("", 3*60*60))
+	series.AssignedToUserID = "me"
+	series.RecurrenceStart = &summer
+	series.DueDate = &summer
+	series.RecurrenceIndex = 0
+	var times []string
+	for _, activity := range activitiesInRange([]Activity{series}, summer, summer.AddDate(0, 0, 14), map[string]*time.Location{"me": helsinki}) {
+		times = append(times, activity.DueDate.In(helsinki).Format("01-02 15:04"))
+	}
+	if fmt.Sprint(times) != "[10-19 09:00 10-26 09:00]" {
+		t.Fatal("occurrences should follow the timezone of the assignee", times)
+	}
+	if until, err := parseRRuleTime("20261031", helsinki); err != nil || !until.Equal(time.Date(2026, 10, 31, 23, 59, 59, 0, helsinki)) {
+		t.Fatal("floating until should be in the location", until, err)
+	}
+}
+
+func TestRecurringActivities(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone420@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	activity := Activity{}
+	activity.CompanyID = company.ID
+	activity.UserID = user.ID
+	activity.Name = "check-in call"
+	activity.RecurrenceRule = "FREQ=WEEKLY;COUNT=3"
+	if err := prepareRecurrence(&activity, time.Local); err == nil {
+		t.Fatal("recurrence without due date should fail")
+	}
+	due := time.Date(2026, 10, 1, 9, 0, 0, 0, time.Local)
+	activity.DueDate = &due
+	if err := prepareRecurrence(&activity, time.Local); err != nil {
+		t.Fatal(err)
+	}
+	if activity.SeriesID == "" || !activity.RecurrenceStart.Equal(due) {
+		t.Fatal("recurring activity should start a series", activity)
+	}
+	if err := insertActivity(&activity); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := selectActivityByID(activity.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.SeriesID != activity.SeriesID || saved.RecurrenceRule != "FREQ=WEEKLY;COUNT=3" || saved.RecurrenceStart == nil {
+		t.Fatal("recurrence was not saved", saved)
+	}
+
+	// marking the occurrence done creates the next one once
+	edited := *saved
+	edited.Name = "renamed call"
+	edited.Done = true
+	edited.RecurrenceRule = "FREQ=DAILY"
+	if err := prepareActivityUpdate(&edited, *saved, "", time.Local); err != nil {
+		t.Fatal(err)
+	}
+	if edited.RecurrenceRule != saved.RecurrenceRule {
+		t.Fatal("editing an occurrence should keep the rule of the series")
+	}
+	if err := updateActivity(edited); err != nil {
+		t.Fatal(err)
+	}
+	next, err := createNextOccurrence(edited, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || next.Done || next.RecurrenceIndex != 1 || !next.DueDate.Equal(due.AddDate(0, 0, 7)) {
+		t.Fatal("invalid next occurrence", next)
+	}
+	if again, err := createNextOccurrence(edited, time.Local); err != nil || again != nil {
+		t.Fatal("next occurrence should be created once", again, err)
+	}
+
+	// the whole series moves to Mondays, one of three occurrences is done
+	second, err := selectActivityByID(next.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := *second
+	monday := time.Date(2026, 10, 12, 9, 0, 0, 0, time.Local)
+	moved.DueDate = &monday
+	moved.RecurrenceRule = "FREQ=WEEKLY;BYDAY=MO;COUNT=3"
+	if err := prepareActivityUpdate(&moved, *second, "sometimes", time.Local); err == nil {
+		t.Fatal("unknown scope should fail")
+	}
+	if err := prepareActivityUpdate(&moved, *second, "series", time.Local); err != nil {
+		t.Fatal(err)
+	}
+	if moved.RecurrenceRule != "FREQ=WEEKLY;BYDAY=MO;COUNT=2" || moved.RecurrenceIndex != 0 || !moved.RecurrenceStart.Equal(monday) {
+		t.Fatal("series should start again from the edited occurrence", moved)
+	}
+	if err := updateActivity(moved); err != nil {
+		t.Fatal(err)
+	}
+	moved.Done = true
+	third, err := createNextOccurrence(moved, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == nil || !third.DueDate.Equal(monday.AddDate(0, 0, 7)) {
+		t.Fatal("invalid third occurrence", third)
+	}
+	third.Done = true
+	if last, err := createNextOccurrence(*third, time.Local); err != nil || last != nil {
+		t.Fatal("series should end after three occurrences", last, err)
+	}
+
+	if err := deleteActivitySeries(activity.SeriesID); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := selectActivityByID(third.ID); err != nil || deleted != nil {
+		t.Fatal("undone occurrence should be deleted with the series", deleted, err)
+	}
+	if kept, err := selectActivityByID(activity.ID); err != nil || kept == nil {
+		t.Fatal("done occurrence should be kept", err)
+	}
+}
+
+func TestReminderTime(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := 24 * 60
+	user := User{TimezoneName: "Europe/London", ReminderMinutes: &day}
+
+	// clocks go back on 2026-10-25, a day before is 25 hours before
+	due := time.Date(2026, 10, 25, 9, 0, 0, 0, london).UTC()
+	activity := Activity{DueDate: &due}
+	activity.Name = "Review"
+	at, ok := reminderTime(activity, user)
+	if !ok || !at.Equal(time.Date(2026, 10, 24, 9, 0, 0, 0, london)) || due.Sub(at) != 25*time.Hour {
+		t.Fatal("invalid reminder time", at, ok)
+	}
+
+	quarter := 15
+	activity.ReminderMinutes = &quarter
+	if at, ok := reminderTime(activity, user); !ok || due.Sub(at) != 15*time.Minute {
+		t.Fatal("activity reminder should override the default", at)
+	}
+
+	snoozed := due.Add(-5 * time.Minute)
+	activity.SnoozedUntil = &snoozed
+	if at, ok := reminderTime(activity, user); !ok || !at.Equal(snoozed) {
+		t.Fatal("snooze should move the reminder", at)
+	}
+	snoozed = due.Add(-time.Hour)
+	if at, _ := reminderTime(activity, user); due.Sub(at) != 15*time.Minute {
+		t.Fatal("earlier snooze should not move the reminder", at)
+	}
+
+	activity.ReminderOff = true
+	if _, ok := reminderTime(activity, user); ok {
+		t.Fatal("reminder should be off for the activity")
+	}
+	activity.ReminderOff = false
+	user.RemindersOff = true
+	if _, ok := reminderTime(activity, user); ok {
+		t.Fatal("reminders should be off for the user")
+	}
+	if _, ok := reminderTime(Activity{DueDate: &due}, User{}); ok {
+		t.Fatal("no reminder without minutes")
+	}
+
+	subj, body := activityReminderEmail(activity, userLocation(user))
+	if subj != "Reminder: Review at Sun 25 Oct 09:00" || !strings.Contains(body, "09:00 GMT") {
+		t.Fatal("invalid reminder e-mail", subj, body)
+	}
+	if userLocation(User{TimezoneName: "Nowhere/Land"}) != time.Local {
+		t.Fatal("unknown timezone should fall back to the server timezone")
+	}
+
+	// all-day activities are due at the start of their date for the user
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	holiday := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	activity = Activity{AllDay: true, DueDate: &holiday, ReminderMinutes: &quarter}
+	activity.Name = "Holiday"
+	user = User{TimezoneName: "America/New_York"}
+	if at, ok := reminderTime(activity, user); !ok || !at.Equal(time.Date(2026, 10, 19, 23, 45, 0, 0, newYork)) {
+		t.Fatal("invalid all-day reminder time", at, ok)
+	}
+	subj, body = activityReminderEmail(activity, userLocation(user))
+	if subj != "Reminder: Holiday on Tue 20 Oct" || !strings.Contains(body, "Holiday is due Tuesday 20 October 2026\r\n") {
+		t.Fatal("invalid all-day reminder e-mail", subj, body)
+	}
+}
+
+func TestActivityReminders(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone421@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	quarter := 15
+	user.TimezoneName = "Europe/London"
+	user.ReminderMinutes = &quarter
+	if err := updateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := selectUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.TimezoneName != "Europe/London" || saved.ReminderMinutes == nil || *saved.ReminderMinutes != 15 {
+		t.Fatal("reminder settings were not saved", saved)
+	}
+
+	var activities []Activity
+	for _, off := range []bool{false, true} {
+		due := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+		activity := Activity{}
+		activity.CompanyID = company.ID
+		activity.UserID = user.ID
+		activity.Name = "reminded call"
+		activity.DueDate = &due
+		activity.ReminderOff = off
+		if err := insertActivity(&activity); err != nil {
+			t.Fatal(err)
+		}
+		activities = append(activities, activity)
+	}
+
+	tooEarly := maxReminderMinutes + 1
+	activities[0].ReminderMinutes = &tooEarly
+	if err := updateActivity(activities[0]); errorStatus(err) != http.StatusBadRequest {
+		t.Fatal("reminder more than four weeks before should fail")
+	}
+
+	// both app instances send the reminder once
+	for i := 0; i < 2; i++ {
+		if err := sendActivityReminders(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at, _ := reminderTime(activities[0], *saved)
+	key := fmt.Sprintf("activity_reminder:%s:%d", activities[0].ID, at.Unix())
+	if claimed, err := claimSentEmail(key, user.ID); err != nil || claimed {
+		t.Fatal("reminder should have been sent", err)
+	}
+	if claimed, err := claimSentEmail(fmt.Sprintf("activity_reminder:%s:%d", activities[1].ID, at.Unix()), user.ID); err != nil || !claimed {
+		t.Fatal("reminder that is off should not have been sent", err)
+	}
+
+	// a snooze that has run out sends the reminder again
+	if err := updateActivitySnooze(activities[0].ID, time.Now().Add(-time.Minute).Truncate(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	snoozed, err := selectActivityByID(activities[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendActivityReminders(); err != nil {
+		t.Fatal(err)
+	}
+	at, _ = reminderTime(*snoozed, *saved)
+	if claimed, err := claimSentEmail(fmt.Sprintf("activity_reminder:%s:%d", snoozed.ID, at.Unix()), user.ID); err != nil || claimed {
+		t.Fatal("snoozed reminder should have been sent", err)
+	}
+}
+
+func TestAgendaEmail(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 9, 0, 0, 0, 0, location)
+	at := func(days, hour int) *time.Time {
+		t := time.Date(2026, 3, 9+days, hour, 0, 0, 0, location)
+		return &t
+	}
+
+	var activities []Activity
+	for i, due := range []*time.Time{at(0, 15), at(0, 9), at(-3, 10), at(-1, 10), at(1, 9), at(-2, 10)} {
+		activity := Activity{}
+		activity.Name = fmt.Sprintf("call %d", i)
+		activity.UserID = "me"
+		activity.DueDate = due
+		activities = append(activities, activity)
+	}
+	activities[0].Name = "<b>lunch</b>"
+	activities[0].OrgName = "Fish & Chips"
+	activities[2].AssignedToUserID = "someone else"
+	activities[5].Done = true
+
+	// a daily series created yesterday shows up today
+	series := Activity{}
+	series.Name = "standup"
+	series.UserID = "me"
+	series.DueDate = at(-1, 8)
+	series.SeriesID = "series"
+	series.RecurrenceRule = "FREQ=DAILY"
+	series.RecurrenceStart = series.DueDate
+	series.Done = true
+	activities = append(activities, series)
+
+	tasks := []Task{{UserID: "me", StageName: "Lead"}, {UserID: "someone else"}}
+	tasks[0].Name = "forgotten deal"
+	tasks[1].Name = "not mine"
+
+	a := composeAgenda("me", activities, tasks, day, location)
+	if len(a.Today) != 2 || a.Today[0].Name != "call 1" || a.Today[1].Name != "<b>lunch</b>" {
+		t.Fatal("invalid activities of the day", a.Today)
+	}
+	if len(a.Overdue) != 1 || a.Overdue[0].Name != "call 3" {
+		t.Fatal("invalid overdue activities", a.Overdue)
+	}
+	if len(a.Tasks) != 1 || a.Tasks[0].Name != "forgotten deal" {
+		t.Fatal("invalid tasks", a.Tasks)
+	}
+
+	series.Done = false
+	activities[len(activities)-1] = series
+	a = composeAgenda("me", activities, tasks, day, location)
+	if len(a.Today) != 3 || a.Today[0].Name != "standup" || !a.Today[0].Projected {
+		t.Fatal("occurrence of the series expected today", a.Today)
+	}
+
+	subj, text, html, err := agendaEmail(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subj != "Your agenda for Mon 9 Mar: 3 activities, 2 overdue" {
+		t.Fatal("invalid subject", subj)
+	}
+	if !strings.Contains(text, "- 15:00 <b>lunch</b> (Fish & Chips)\r\n") || !strings.Contains(text, "- forgotten deal (Lead)\r\n") {
+		t.Fatal("invalid text", text)
+	}
+	if !strings.Contains(html, "&lt;b&gt;lunch&lt;/b&gt;") || !strings.Contains(html, "Fish &amp; Chips") {
+		t.Fatal("html should be escaped", html)
+	}
+
+	// all-day activities are on their date, not in the evening before
+	holiday := time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)
+	allDay := Activity{AllDay: true, DueDate: &holiday}
+	allDay.Name = "holiday"
+	allDay.UserID = "me"
+	a = composeAgenda("me", append(activities, allDay), tasks, day, location)
+	if len(a.Today) != 4 || a.Today[0].Name != "holiday" || len(a.Overdue) != 2 {
+		t.Fatal("all-day activity expected today", a.Today, a.Overdue)
+	}
+	if _, allDayText, _, err := agendaEmail(a); err != nil || !strings.Contains(allDayText, "- All day holiday\r\n") {
+		t.Fatal("all-day activity should have no time", allDayText, err)
+	}
+
+	contentType, body, err := multipartAlternative(text, html)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(contentType, "multipart/alternative; boundary=") {
+		t.Fatal("invalid content type", contentType)
+	}
+	if !strings.Contains(body, "Content-Type: text/plain; charset=utf-8") || !strings.Contains(body, "Content-Type: text/html; charset=utf-8") {
+		t.Fatal("text and html parts expected", body)
+	}
+}
+
+func TestAgendaDigest(t *testing.T) {
+	company := Company{}
+	company.Name = "supercompany"
+	if err := insertCompany(&company); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{
+		Email:           "someone422@somewhere.com",
+		ActiveCompanyID: company.ID,
+	}
+	if err := insertUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	companyUser := CompanyUser{
+		CompanyID: company.ID,
+		UserID:    user.ID,
+	}
+	if err := insertCompanyUser(&companyUser); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := Workflow{}
+	workflow.Name = "voodoo"
+	workflow.CompanyID = company.ID
+	if err := insertWorkflow(&workflow); err != nil {
+		t.Fatal(err)
+	}
+	stage := Stage{}
+	stage.WorkflowID = workflow.ID
+	stage.Name = "lead"
+	if err := insertStage(&stage); err != nil {
+		t.Fatal(err)
+	}
+
+	var taskIDs []string
+	for _, name := range []string{"planned task", "forgotten task"} {
+		task := Task{}
+		task.CreatorUserID = user.ID
+		task.UserID = user.ID
+		task.WorkflowID = workflow.ID
+		task.StageID = stage.ID
+		task.Name = name
+		task.CompanyID = company.ID
+		if err := insertTask(&task); err != nil {
+			t.Fatal(err)
+		}
+		taskIDs = append(taskIDs, task.ID)
+	}
+
+	due := time.Now().Add(time.Hour)
+	activity := Activity{}
+	activity.CompanyID = company.ID
+	activity.UserID = user.ID
+	activity.TaskID = taskIDs[0]
+	activity.Name = "call"
+	activity.DueDate = &due
+	if err := insertActivity(&activity); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := selectTasksWithoutNextActivity(company.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != taskIDs[1] {
+		t.Fatal("only the task without a next activity expected", tasks)
+	}
+	if tasks[0].RottenTime != nil {
+		t.Fatal("task of a stage that does not rot should have no rotten time", tasks[0].RottenTime)
+	}
+
+	recipient := func() bool {
+		recipients, err := selectAgendaDigestRecipients()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, recipient := range recipients {
+			if recipient.UserID == user.ID && recipient.CompanyID == company.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if !recipient() {
+		t.Fatal("user should get the agenda")
+	}
+
+	user.AgendaDigestOff = true
+	if err := updateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := selectUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.AgendaDigestOff {
+		t.Fatal("opt out was not saved")
+	}
+	if recipient() {
+		t.Fatal("user opted out of the agenda")
+	}
+
+	if err := sendAgendaDigests(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActivityCalendar(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"":            0,
+		"01:30":       90 * time.Minute,
+		"00:45:30.00": 45*time.Minute + 30*time.Second,
+		"2h15m":       135 * time.Minute,
+	} {
+		if d, err := parseActivityDuration(s); err != nil || d != expected {
+			t.Fatal("invalid duration", s, d, err)
+		}
+	}
+	for _, s := range []string{"1:75", "soon", "-1h", "1:2:3:4"} {
+		if _, err := parseActivityDuration(s); err == nil {
+			t.Fatal("invalid duration should fail", s)
+		}
+	}
+
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, location)
+	until := time.Date(2026, 10, 31, 0, 0, 0, 0, location)
+
+	newActivity := func(name string, due time.Time, duration, assignee, typeID string, done bool) Activity {
+		activity := Activity{}
+		activity.Name = name
+		activity.UserID = "me"
+		activity.AssignedToUserID = assignee
+		activity.TypeID = typeID
+		activity.DueDate = &due
+		activity.Duration = duration
+		activity.Done = done
+		return activity
+	}
+	activities := []Activity{
+		// the whole 1 October, which is still 30 September in Los Angeles
+		newActivity("holiday", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), "", "", "leave", false),
+		// 1 October in UTC but the evening of 30 September in Los Angeles
+		newActivity("late call", time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC), "00:30", "", "call", false),
+		newActivity("meeting", time.Date(2026, 10, 15, 9, 0, 0, 0, location), "01:30", "", "meeting", true),
+		newActivity("their call", time.Date(2026, 10, 15, 11, 0, 0, 0, location), "00:15", "someone else", "call", false),
+		newActivity("last day", time.Date(2026, 10, 31, 23, 30, 0, 0, location), "", "", "call", false),
+		newActivity("next month", time.Date(2026, 11, 1, 0, 30, 0, 0, location), "", "", "call", false),
+		// at midnight UTC without a duration but not flagged as all-day
+		newActivity("standup", time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), "", "", "meeting", true),
+	}
+	activities[0].AllDay = true
+
+	calendar := activityCalendar(activities, from, until, location, nil, ActivityFilter{})
+	if len(calendar.Days) != 31 || calendar.Days[0].Date != "2026-10-01" || calendar.Days[30].Date != "2026-10-31" {
+		t.Fatal("every day of October expected", calendar.Days)
+	}
+	var names []string
+	for _, activity := range calendar.Activities {
+		names = append(names, activity.Name+" "+activity.Day)
+	}
+	if strings.Join(names, ", ") != "holiday 2026-10-01, meeting 2026-10-15, their call 2026-10-15, standup 2026-10-19, last day 2026-10-31" {
+		t.Fatal("invalid activities", names)
+	}
+	if !isAllDay(calendar.Activities[0].Activity) || isAllDay(calendar.Activities[1].Activity) || isAllDay(calendar.Activities[3].Activity) {
+		t.Fatal("only the holiday takes all day")
+	}
+	meeting := calendar.Activities[1]
+	if meeting.DurationMinutes != 90 || meeting.End == nil || !meeting.End.Equal(time.Date(2026, 10, 15, 10, 30, 0, 0, location)) {
+		t.Fatal("invalid end of meeting", meeting.DurationMinutes, meeting.End)
+	}
+	if day := calendar.Days[14]; day.Count != 2 || day.Done != 1 || day.Undone != 1 || day.Minutes != 105 {
+		t.Fatal("invalid counts", day)
+	}
+
+	done := false
+	calendar = activityCalendar(activities, from, until, location, nil, ActivityFilter{AssigneeIDs: []string{"me"}, TypeIDs: []string{"call", "meeting"}, Done: &done})
+	if len(calendar.Activities) != 1 || calendar.Activities[0].Name != "last day" {
+		t.Fatal("filtered activities expected", calendar.Activities)
+	}
+	if calendar.Days[14].Count != 0 || calendar.Days[30].Count != 1 {
+		t.Fatal("counts should be filtered", calendar.Days)
+	}
+}
+
+func TestCheckMergedHierarchy(t *testing.T) {
+	// a is the parent of x, x of b and c of d
+	parents := [][2]string{{"a", "x"}, {"x", "b"}, {"c", "d"}}
+	if err := checkMergedHierarchy(parents, "a", "b"); err == nil {
+		t.Fatal("merging a and b makes x its own parent")
+	}
+	if err := checkMergedHierarchy(parents, "b", "d"); err == nil {
+		t.Fatal("merging b and d gives two parents")
+	}
+	if err := checkMergedHierarchy(parents, "x", "b"); err != nil {
+		t.Fatal("the relationship between x and b is dropped", err)
+	}
+	if err := checkMergedHierarchy(parents, "a", "c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	limiter := &requestLimiter{interval: 50 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatal("requests should be spaced by the interval", elapsed)
+	}
+}
+
+func TestPrepareAllDay(t *testing.T) {
+	location := time.FixedZone("UTC-5", -5*60*60)
+	for _, c := range []struct {
+		due, expected time.Time
+	}{
+		{time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		// midnight UTC read back in another timezone
+		{time.Date(2026, 10, 18, 19, 0, 0, 0, location), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 19, 22, 0, 0, 0, location), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+	} {
+		due := c.due
+		activity := Activity{AllDay: true, DueDate: &due}
+		activity.Duration = "01:00"
+		prepareAllDay(&activity)
+		if !activity.DueDate.Equal(c.expected) || activity.DueDate.Location() != time.UTC || activity.Duration != "" {
+			t.Fatal("invalid all-day activity", c.due, activity.DueDate, activity.Duration)
+		}
+	}
+
+	due := time.Date(2026, 10, 19, 22, 0, 0, 0, location)
+	activity := Activity{DueDate: &due}
+	activity.Duration = "01:00"
+	prepareAllDay(&activity)
+	if !activity.DueDate.Equal(due) || activity.Duration != "01:00" {
+		t.Fatal("timed activities should be kept", activity.DueDate, activity.Duration)
+	}
+}
+
+func TestParseImportValue(t *testing.T) {
+	for value, expected := range map[string]float64{
+		"1000":         1000,
+		"1 000":        1000,
+		"1,5":          1.5,
+		"1.50":         1.5,
+		"1,000.50":     1000.5,
+		"1.234,56":     1234.56,
+		"1.234.567":    1234567,
+		"1,234,567.89": 1234567.89,
+		"-1.234,5":     -1234.5,
+	} {
+		f, err := parseImportValue(value)
+		if err != nil || f != expected {
+			t.Fatal("invalid value", value, f, err)
+		}
+	}
+	for _, value := range []string{"1,000", "1.000", "1,00,000", "12.34.5", "1,2,3", "abc", ""} {
+		if _, err := parseImportValue(value); err == nil {
+			t.Fatal("value should be rejected", value)
+		}
+	}
+}
+
+func TestAllDayRecurrence(t *testing.T) {
+	// local midnight in Helsinki is still the day before in UTC
+	due := time.Date(2026, 10, 20, 0, 0, 0, 0, time.FixedZone("EEST", 3*60*60))
+	activity := Activity{AllDay: true, DueDate: &due}
+	activity.Name = "holiday"
+	activity.RecurrenceRule = "FREQ=DAILY;COUNT=3"
+	if err := prepareRecurrence(&activity, assigneeLocation(activity, nil)); err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	if !activity.DueDate.Equal(first) || !activity.RecurrenceStart.Equal(first) {
+		t.Fatal("all-day series should start at midnight UTC", activity.DueDate, activity.RecurrenceStart)
+	}
+
+	rule, err := parseRecurrenceRule(activity.RecurrenceRule, assigneeLocation(activity, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, ok := rule.occurrence(*activity.RecurrenceStart, 1)
+	if !ok || !next.Equal(first.AddDate(0, 0, 1)) {
+		t.Fatal("invalid next occurrence", next)
+	}
+
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 19, 0, 0, 0, 0, location)
+	until := time.Date(2026, 10, 23, 0, 0, 0, 0, location)
+	calendar := activityCalendar([]Activity{activity}, from, until, location, nil, ActivityFilter{})
+	var days []string
+	for _, model := range calendar.Activities {
+		days = append(days, model.Day)
+	}
+	if strings.Join(days, ", ") != "2026-10-20, 2026-10-21, 2026-10-22" {
+		t.Fatal("occurrences should be projected on their dates", days)
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	if s := formatMoney(1234567.5, 2, "€"); s != "€1,234,567.50" {
+		t.Fatal("invalid format", s)
+	}
+	if s := formatMoney(-999, 0, "$"); s != "-$999" {
+		t.Fatal("invalid format", s)
+	}
+	if s := formatMoney(1000, 0, "EUR"); s != "EUR 1,000" {
+		t.Fatal("invalid format", s)
+	}
+}
+
 func TestOrganizationField(t *testing.T) {
 	company := Company{}
 	company.Name = "supercompany"
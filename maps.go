@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const earthRadiusKm = 6371.0
+
+// distanceKm returns the great-circle distance between two points using the
+// haversine formula
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(lat2 - lat1)
+	dLng := rad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// matches reports whether the organization passes the filter
+func (f OrganizationFilter) matches(org Organization) bool {
+	if f.OwnerID != "" && org.OwnerID != f.OwnerID {
+		return false
+	}
+	if f.CategoryID != "" && org.CategoryID != f.CategoryID {
+		return false
+	}
+	switch f.OpenTasks {
+	case "true":
+		return org.OpenTasksCount > 0
+	case "false":
+		return org.OpenTasksCount == 0
+	}
+	return true
+}
+
+// selectMappedOrganizations returns the geocoded organizations of the company
+// that pass the filter
+func selectMappedOrganizations(companyID string, filter OrganizationFilter) ([]Organization, error) {
+	orgs, err := selectOrganizationsByCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+	var result []Organization
+	for _, org := range orgs {
+		if org.Latitude == nil || org.Longitude == nil || !filter.matches(org) {
+			continue
+		}
+		result = append(result, org)
+	}
+	return result, nil
+}
+
+// startOfToday is where upcoming activities begin in the location,
+// activities due earlier today are still upcoming
+func startOfToday(location *time.Location) time.Time {
+	now := time.Now().In(location)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+}
+
+// selectNearbyOrganizations returns the organizations within radius
+// kilometers of the point, nearest first, with their next activity from the
+// start of today in the location
+func selectNearbyOrganizations(companyID string, latitude, longitude, radius float64, filter OrganizationFilter, location *time.Location) ([]NearbyOrganization, error) {
+	orgs, err := selectMappedOrganizations(companyID, filter)
+	if err != nil {
+		return nil, err
+	}
+	activities, err := selectUpcomingActivitiesByCompany(companyID, startOfToday(location))
+	if err != nil {
+		return nil, err
+	}
+
+	// activities are sorted by due date, so the first one is the next one
+	next := make(map[string]*Activity)
+	for i := range activities {
+		if next[activities[i].OrgID] == nil {
+			next[activities[i].OrgID] = &activities[i]
+		}
+	}
+
+	result := []NearbyOrganization{}
+	for _, org := range orgs {
+		distance := distanceKm(latitude, longitude, *org.Latitude, *org.Longitude)
+		if distance > radius {
+			continue
+		}
+		result = append(result, NearbyOrganization{
+			Organization: org,
+			Distance:     distance,
+			NextActivity: next[org.ID],
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Distance < result[j].Distance
+	})
+	return result, nil
+}
+
+func geoJSONPoint(latitude, longitude float64) GeoJSONGeometry {
+	return GeoJSONGeometry{Type: "Point", Coordinates: []float64{longitude, latitude}}
+}
+
+// organizationsGeoJSON returns the organizations as GeoJSON points
+func organizationsGeoJSON(orgs []Organization) GeoJSONFeatureCollection {
+	result := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, org := range orgs {
+		if org.Latitude == nil || org.Longitude == nil {
+			continue
+		}
+		result.Features = append(result.Features, GeoJSONFeature{
+			Type:     "Feature",
+			ID:       org.ID,
+			Geometry: geoJSONPoint(*org.Latitude, *org.Longitude),
+			Properties: map[string]interface{}{
+				"name":                      org.Name,
+				"address_formatted_address": org.AddressFormattedAddress,
+				"owner_id":                  org.OwnerID,
+				"owner_name":                org.OwnerName,
+				"category_id":               org.CategoryID,
+				"open_tasks_count":          org.OpenTasksCount,
+				"next_activity_date":        org.NextActivityDate,
+			},
+		})
+	}
+	return result
+}
+
+// activitiesGeoJSON returns the activities as GeoJSON points at the location
+// of their organization. Activities of organizations that are not in orgs
+// are left out.
+func activitiesGeoJSON(activities []Activity, orgs []Organization) GeoJSONFeatureCollection {
+	byID := make(map[string]Organization)
+	for _, org := range orgs {
+		byID[org.ID] = org
+	}
+
+	result := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, activity := range activities {
+		org, ok := byID[activity.OrgID]
+		if !ok || org.Latitude == nil || org.Longitude == nil {
+			continue
+		}
+		result.Features = append(result.Features, GeoJSONFeature{
+			Type:     "Feature",
+			ID:       activity.ID,
+			Geometry: geoJSONPoint(*org.Latitude, *org.Longitude),
+			Properties: map[string]interface{}{
+				"name":                  activity.Name,
+				"type":                  activity.Type,
+				"due_date":              activity.DueDate,
+				"duration":              activity.Duration,
+				"assigned_to_user_id":   activity.AssignedToUserID,
+				"assigned_to_user_name": activity.AssignedToUserName,
+				"org_id":                org.ID,
+				"org_name":              org.Name,
+				"person_id":             activity.PersonID,
+				"person_name":           activity.PersonName,
+			},
+		})
+	}
+	return result
+}
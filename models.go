@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"time"
 )
@@ -43,6 +44,14 @@ type User struct {
 	HasPassword        bool       `json:"has_password"`
 	ActiveCompanyName  string     `json:"active_company_name"`
 	ActiveWorkflowName string     `json:"active_workflow_name"`
+
+	// Default minutes before the due date to remind of activities, nil for
+	// no reminders unless an activity has its own
+	ReminderMinutes *int `json:"reminder_minutes"`
+	RemindersOff    bool `json:"reminders_off"`
+
+	// The morning e-mail with the activities of the day is not sent
+	AgendaDigestOff bool `json:"agenda_digest_off"`
 }
 
 type CompanyUser struct {
@@ -123,6 +132,8 @@ type Activity struct {
 	AssignedToUserID string     `json:"assigned_to_user_id"`
 	CreatedByUserID  string     `json:"created_by_user_id"`
 
+	CustomFields CustomFields `json:"custom_fields"`
+
 	Type               string `json:"type"`
 	OwnerName          string `json:"owner_name"`
 	AssignedToUserName string `json:"assigned_to_user_name"`
@@ -131,6 +142,25 @@ type Activity struct {
 	PersonName         string `json:"person_name"`
 	PersonEmail        string `json:"person_email"`
 	PersonPhone        string `json:"person_phone"`
+
+	// Recurring activities repeat by an RFC 5545 RRULE from RecurrenceStart.
+	// The occurrences of a series share SeriesID and RecurrenceIndex is the
+	// position of the occurrence. Projected occurrences are not saved yet,
+	// they are created one at a time as the previous one is done.
+	RecurrenceRule  string     `json:"recurrence_rule"`
+	RecurrenceStart *time.Time `json:"recurrence_start"`
+	RecurrenceIndex int        `json:"recurrence_index"`
+	SeriesID        string     `json:"series_id"`
+	Projected       bool       `json:"projected,omitempty"`
+
+	// Minutes before the due date to send a reminder, nil for the default
+	// of the assignee
+	ReminderMinutes *int       `json:"reminder_minutes"`
+	ReminderOff     bool       `json:"reminder_off"`
+	SnoozedUntil    *time.Time `json:"snoozed_until"`
+
+	// All-day activities are due at midnight UTC of their date
+	AllDay bool `json:"all_day"`
 }
 
 type ModelWithPerson interface {
@@ -204,6 +234,7 @@ type ActivityType struct {
 	OrderNr      int    `json:"order_nr"`
 	Color        string `json:"color"`
 	IsCustomFlag bool   `json:"is_custom_flag"`
+	Icon         string `json:"icon"`
 }
 
 type Currency struct {
@@ -215,6 +246,45 @@ type Currency struct {
 	IsCustomFlag  bool   `json:"is_custom_flag"`
 }
 
+// Import is a CSV file imported in the background. Mapping maps column
+// headers to fields such as "organization.name" or "task.cf_<key>".
+// Status is "pending", "running", "done", "failed" or "reverted".
+type Import struct {
+	Base
+	CompanyID     string            `json:"company_id"`
+	UserID        string            `json:"user_id"`
+	WorkflowID    string            `json:"workflow_id"`
+	Mapping       map[string]string `json:"mapping"`
+	Data          string            `json:"data,omitempty"`
+	Status        string            `json:"status"`
+	TotalRows     int               `json:"total_rows"`
+	ProcessedRows int               `json:"processed_rows"`
+	Errors        []ImportError     `json:"errors"`
+	FinishedAt    *time.Time        `json:"finished_at"`
+	RevertedAt    *time.Time        `json:"reverted_at"`
+}
+
+// ImportError is the reason a row was not imported. Row is the line number
+// in the file.
+type ImportError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ImportPreview shows the first rows of a CSV file with a suggested mapping
+// and the fields the columns can be mapped to.
+type ImportPreview struct {
+	Headers []string          `json:"headers"`
+	Rows    [][]string        `json:"rows"`
+	Mapping map[string]string `json:"mapping"`
+	Fields  []string          `json:"fields"`
+}
+
+type LostReason struct {
+	Base
+	CompanyID string `json:"company_id"`
+}
+
 type ModelWithOrg interface {
 	GetOrgName() string
 	GetOrgID() string
@@ -233,6 +303,7 @@ type Task struct {
 	StageChangeTime        *time.Time `json:"stage_change_time"`
 	Status                 string     `json:"status"`
 	LostReason             string     `json:"lost_reason"`
+	LostReasonID           string     `json:"lost_reason_id"`
 	VisibleTo              int        `json:"visible_to"`
 	CloseTime              *time.Time `json:"close_time"`
 	WorkflowID             string     `json:"workflow_id"`
@@ -241,8 +312,10 @@ type Task struct {
 	LostTime               *time.Time `json:"lost_time"`
 	ExpectedCloseDate      *time.Time `json:"expected_close_date"`
 	StageOrderNr           int        `json:"stage_order_nr"`
+	Probability            *int       `json:"probability"`
 	FormattedValue         string     `json:"formatted_value"`
 	RottenTime             *time.Time `json:"rotten_time"`
+	IsRotten               bool       `json:"is_rotten"`
 	WeightedValue          int        `json:"weighted_value"`
 	FormattedWeightedValue string     `json:"formatted_weighted_value"`
 	CCEmail                string     `json:"cc_email"`
@@ -250,6 +323,8 @@ type Task struct {
 	PersonHidden           bool       `json:"person_hidden"`
 	CompanyID              string     `json:"company_id"`
 
+	CustomFields CustomFields `json:"custom_fields"`
+
 	LastIncomingMailTime *time.Time `json:"last_incoming_mail_time"`
 	LastOutgoingMailTime *time.Time `json:"last_outgoing_mail_time"`
 
@@ -277,6 +352,7 @@ type Task struct {
 	ReferenceActivitiesCount int    `json:"reference_activities_count"`
 	ParticipantsCount        int    `json:"participants_count"`
 	StageName                string `json:"stage_name"`
+	StageProbability         int    `json:"stage_probability"`
 }
 
 func (model Task) GetPersonName() string {
@@ -303,6 +379,84 @@ func (model *Task) SetOrgID(ID string) {
 	model.OrgID = ID
 }
 
+// CalculateValues sets the weighted value (value × probability) and the
+// formatted values of the task. Task probability overrides the stage one.
+func (model *Task) CalculateValues(decimalPoints int, symbol string) {
+	probability := model.StageProbability
+	if model.Probability != nil {
+		probability = *model.Probability
+	}
+	if symbol == "" {
+		symbol = model.Currency
+	}
+
+	weightedValue := float64(model.Value) * float64(probability) / 100
+
+	model.WeightedValue = int(math.Round(weightedValue))
+	model.FormattedValue = formatMoney(float64(model.Value), decimalPoints, symbol)
+	model.FormattedWeightedValue = formatMoney(weightedValue, decimalPoints, symbol)
+}
+
+// DetectRotten flags the task as rotten once its rotten time has passed.
+// RottenTime itself is calculated from the stage settings when loading tasks.
+func (model *Task) DetectRotten() {
+	model.IsRotten = model.RottenTime != nil && !model.RottenTime.After(time.Now())
+}
+
+// Forecast is the sum of open tasks expected to close in a month,
+// per workflow, owner and currency
+type Forecast struct {
+	Month                  string `json:"month"`
+	WorkflowID             string `json:"workflow_id"`
+	WorkflowName           string `json:"workflow_name"`
+	UserID                 string `json:"user_id"`
+	OwnerName              string `json:"owner_name"`
+	Currency               string `json:"currency"`
+	TasksCount             int    `json:"tasks_count"`
+	Value                  int    `json:"value"`
+	WeightedValue          int    `json:"weighted_value"`
+	FormattedValue         string `json:"formatted_value"`
+	FormattedWeightedValue string `json:"formatted_weighted_value"`
+}
+
+// TaskOrder is the new order of tasks in a stage, see reorderTasks
+type TaskOrder struct {
+	StageID string   `json:"stage_id"`
+	TaskIDs []string `json:"task_ids"`
+}
+
+type TaskStageHistory struct {
+	ID            string     `json:"id"`
+	TaskID        string     `json:"task_id"`
+	StageID       string     `json:"stage_id"`
+	StageName     string     `json:"stage_name"`
+	EnteredUserID string     `json:"entered_user_id"`
+	EnteredAt     time.Time  `json:"entered_at"`
+	ExitedUserID  string     `json:"exited_user_id"`
+	ExitedAt      *time.Time `json:"exited_at"`
+}
+
+// StageReport durations are in seconds. ConversionRate is the share of
+// tasks in the stage that later moved on to a stage further down the
+// workflow.
+type StageReport struct {
+	StageID             string  `json:"stage_id"`
+	StageName           string  `json:"stage_name"`
+	OrderNr             int     `json:"order_nr"`
+	TasksCount          int     `json:"tasks_count"`
+	ConvertedTasksCount int     `json:"converted_tasks_count"`
+	ConversionRate      float64 `json:"conversion_rate"`
+	AverageTimeInStage  int64   `json:"average_time_in_stage"`
+}
+
+type WorkflowReport struct {
+	WorkflowID       string        `json:"workflow_id"`
+	WorkflowName     string        `json:"workflow_name"`
+	ClosedTasksCount int           `json:"closed_tasks_count"`
+	AverageCycleTime int64         `json:"average_cycle_time"`
+	Stages           []StageReport `json:"stages"`
+}
+
 type TaskField struct {
 	Base
 	CompanyID          string `json:"company_id"`
@@ -433,6 +587,16 @@ type Organization struct {
 	AddressPostalCode      string `json:"address_postal_code"`
 	CCEmail                string `json:"cc_email"`
 
+	CustomFields CustomFields `json:"custom_fields"`
+
+	// implicit organizations are created from a name, with a task, activity
+	// or person or by an import, and get their mandatory custom fields later
+	implicit bool
+
+	// geocodeClaimedAt is the lease of the geocoding run that claimed the
+	// organization, see claimOrganizationsToGeocode
+	geocodeClaimedAt time.Time
+
 	NextActivityDate *time.Time `json:"next_activity_date"`
 	NextActivityID   string     `json:"next_activity_id"`
 	LastActivityID   string     `json:"last_activity_id"`
@@ -457,6 +621,28 @@ type Organization struct {
 	LostTasksCount           int    `json:"lost_tasks_count"`
 	RelatedLostTasksCount    int    `json:"related_lost_tasks_count"`
 	OwnerName                string `json:"owner_name"`
+
+	// Coordinates of the address, nil until it has been geocoded
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+
+	// Values of the open and won tasks of the organization and its
+	// subsidiaries by currency
+	RelatedOpenTasksValues map[string]int `json:"related_open_tasks_values,omitempty"`
+	RelatedWonTasksValues  map[string]int `json:"related_won_tasks_values,omitempty"`
+}
+
+// OrganizationDuplicate is an organization that probably is the same as
+// another organization. Reasons are "name" and "address".
+type OrganizationDuplicate struct {
+	Organization Organization `json:"organization"`
+	Reasons      []string     `json:"reasons"`
+}
+
+// OrganizationMerge merges the organization MergeID into another
+// organization
+type OrganizationMerge struct {
+	MergeID string `json:"merge_id"`
 }
 
 type OrganizationField struct {
@@ -489,17 +675,153 @@ type OrganizationRelationship struct {
 	RelatedOrganizationName string `json:"related_organization_name"`
 }
 
+// OrganizationNode is an organization with its subsidiaries
+type OrganizationNode struct {
+	Organization Organization       `json:"organization"`
+	Children     []OrganizationNode `json:"children"`
+}
+
+// OrganizationGraph is the hierarchy an organization belongs to from its
+// topmost parent down, with the related relationships of the organizations
+// in it
+type OrganizationGraph struct {
+	Root    OrganizationNode           `json:"root"`
+	Related []OrganizationRelationship `json:"related"`
+}
+
+// Location is a geocoded address. The address parts are named like the
+// address fields of Organization.
+type Location struct {
+	Latitude               float64 `json:"latitude"`
+	Longitude              float64 `json:"longitude"`
+	FormattedAddress       string  `json:"formatted_address"`
+	CountryCode            string  `json:"country_code"`
+	AddressSubpremise      string  `json:"address_subpremise"`
+	AddressStreetNumber    string  `json:"address_street_number"`
+	AddressRoute           string  `json:"address_route"`
+	AddressSublocality     string  `json:"address_sublocality"`
+	AddressLocality        string  `json:"address_locality"`
+	AddressAdminAreaLevel1 string  `json:"address_admin_area_level_1"`
+	AddressAdminAreaLevel2 string  `json:"address_admin_area_level_2"`
+	AddressCountry         string  `json:"address_country"`
+	AddressPostalCode      string  `json:"address_postal_code"`
+}
+
+// OrganizationFilter narrows the organizations on the map. OpenTasks is
+// "true" for organizations with open tasks, "false" for those without and
+// empty for all.
+type OrganizationFilter struct {
+	OwnerID    string `json:"owner_id"`
+	CategoryID string `json:"category_id"`
+	OpenTasks  string `json:"open_tasks"`
+}
+
+// NearbyOrganization is an organization found around a point with its
+// distance in kilometers and its next activity
+type NearbyOrganization struct {
+	Organization
+	Distance     float64   `json:"distance"`
+	NextActivity *Activity `json:"next_activity"`
+}
+
+// RouteStop is a visit of a route plan. Distance is the straight-line
+// distance in kilometers from the previous stop.
+type RouteStop struct {
+	Activity         Activity   `json:"activity"`
+	Latitude         float64    `json:"latitude"`
+	Longitude        float64    `json:"longitude"`
+	Distance         float64    `json:"distance"`
+	SuggestedDueDate *time.Time `json:"suggested_due_date"`
+}
+
+// RoutePlan is the suggested order of the visits of a user on a day
+type RoutePlan struct {
+	UserID         string      `json:"user_id"`
+	Date           string      `json:"date"`
+	StartLatitude  float64     `json:"start_latitude"`
+	StartLongitude float64     `json:"start_longitude"`
+	Stops          []RouteStop `json:"stops"`
+	TotalDistance  float64     `json:"total_distance"`
+	Unplaced       []Activity  `json:"unplaced"`
+}
+
+// RouteOrder is the order of the visits of a user on a day to apply to
+// their due times
+type RouteOrder struct {
+	UserID      string   `json:"user_id"`
+	Date        string   `json:"date"`
+	ActivityIDs []string `json:"activity_ids"`
+}
+
+// ActivityFilter narrows the activities of a calendar, empty fields match
+// every activity
+type ActivityFilter struct {
+	AssigneeIDs []string
+	TypeIDs     []string
+	Done        *bool
+}
+
+// CalendarActivity is an activity placed on a day of the calendar. Timed
+// activities end their duration after the due date.
+type CalendarActivity struct {
+	Activity
+	Day             string     `json:"day"`
+	DurationMinutes int        `json:"duration_minutes"`
+	End             *time.Time `json:"end"`
+}
+
+// CalendarDay counts the activities of a day for month views
+type CalendarDay struct {
+	Date    string `json:"date"`
+	Count   int    `json:"count"`
+	Done    int    `json:"done"`
+	Undone  int    `json:"undone"`
+	Minutes int    `json:"minutes"`
+}
+
+type ActivityCalendar struct {
+	From         string             `json:"from"`
+	Until        string             `json:"until"`
+	TimezoneName string             `json:"timezone_name"`
+	Activities   []CalendarActivity `json:"activities"`
+	Days         []CalendarDay      `json:"days"`
+}
+
+// GeoJSONFeatureCollection is a GeoJSON (RFC 7946) collection of points
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// GeoJSONGeometry is a point, its coordinates are longitude then latitude
+type GeoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
 type Contact struct {
 	Base
 	PersonID string `json:"person_id"`
 	Primary  bool   `json:"primary"`
 	Type     string `json:"type"`
+	Label    string `json:"label"`
 }
 
 func (c *Contact) DetectType() {
-	if strings.Contains(c.Name, "@") {
+	name := strings.ToLower(c.Name)
+	switch {
+	case strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "www."):
+		c.Type = "website"
+	case strings.Contains(name, "@"):
 		c.Type = "email"
-	} else {
+	default:
 		c.Type = "phone"
 	}
 }
@@ -516,9 +838,17 @@ type Person struct {
 	PictureID string `json:"picture_id"`
 	CCEmail   string `json:"cc_email"`
 
+	CustomFields CustomFields `json:"custom_fields"`
+
+	// implicit persons are created from a name, with a task or activity or
+	// by an import, and get their mandatory custom fields later
+	implicit bool
+
 	Phone string `json:"phone"`
 	Email string `json:"email"`
 
+	Contacts []Contact `json:"contacts,omitempty"`
+
 	NextActivityDate     *time.Time `json:"next_activity_date"`
 	NextActivityID       string     `json:"next_activity_id"`
 	LastActivityID       string     `json:"last_activity_id"`
@@ -560,6 +890,27 @@ func (model *Person) SetOrgID(ID string) {
 	model.OrgID = ID
 }
 
+// PersonDuplicate is a person that probably is the same human as another
+// person. Reasons are "email", "phone" and "name".
+type PersonDuplicate struct {
+	Person  Person   `json:"person"`
+	Reasons []string `json:"reasons"`
+}
+
+// PersonImport is a person read from an import file with its contacts and
+// the existing persons it may duplicate. Skip leaves it out of the import.
+type PersonImport struct {
+	Person     Person            `json:"person"`
+	Contacts   []Contact         `json:"contacts"`
+	Duplicates []PersonDuplicate `json:"duplicates"`
+	Skip       bool              `json:"skip"`
+}
+
+// PersonMerge merges the person MergeID into another person
+type PersonMerge struct {
+	MergeID string `json:"merge_id"`
+}
+
 type PersonField struct {
 	Base
 	CompanyID          string `json:"company_id"`
@@ -583,6 +934,37 @@ type Workflow struct {
 	CompanyID string `json:"company_id"`
 	URLTitle  string `json:"url_title"`
 	OrderNr   int    `json:"order_nr"`
+
+	// TemplateID is only read when creating a workflow
+	TemplateID string `json:"template_id,omitempty"`
+}
+
+// WorkflowTemplate is either built-in, with a key as ID and no company,
+// or saved by a company from one of its workflows.
+type WorkflowTemplate struct {
+	Base
+	CompanyID string                  `json:"company_id"`
+	Stages    []WorkflowTemplateStage `json:"stages"`
+}
+
+type WorkflowTemplateStage struct {
+	Name            string `json:"name"`
+	TaskProbability int    `json:"task_probability"`
+	RottenFlag      bool   `json:"rotten_flag"`
+	RottenDays      int    `json:"rotten_days"`
+}
+
+// WorkflowMigration tells where the tasks of a deleted workflow go.
+// StageMap maps source stage IDs to target stage IDs, stages left out are
+// matched by position.
+type WorkflowMigration struct {
+	TargetWorkflowID string            `json:"target_workflow_id"`
+	StageMap         map[string]string `json:"stage_map"`
+}
+
+type WorkflowClone struct {
+	Name         string `json:"name"`
+	IncludeTasks bool   `json:"include_tasks"`
 }
 
 type Price struct {
@@ -606,6 +988,8 @@ type Product struct {
 	OwnerID    string  `json:"owner_id"`
 	Prices     []Price `json:"prices"`
 
+	CustomFields CustomFields `json:"custom_fields"`
+
 	FilesCount     int `json:"files_count"`
 	FollowersCount int `json:"followers_count"`
 }
@@ -681,6 +1065,7 @@ type Timeline struct {
 	TaskID                     string `json:"task_id,omitempty"`
 	WorkflowID                 string `json:"workflow_id,omitempty"`
 	TimeEntryID                string `json:"time_entry_id,omitempty"`
+	LostReasonID               string `json:"lost_reason_id,omitempty"`
 
 	UserName string `json:"user_name"`
 }
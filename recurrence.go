@@ -0,0 +1,525 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// maxRecurrencePeriods bounds how many days, weeks or months a rule is
+// followed when looking for occurrences
+const maxRecurrencePeriods = 10000
+
+// recurrenceRule is the part of an RFC 5545 RRULE that activities support:
+// FREQ DAILY, WEEKLY or MONTHLY with INTERVAL, BYDAY, BYMONTHDAY and WKST,
+// ending by COUNT or UNTIL. The rule is followed in Location, the timezone
+// of the user the activity is for, so the occurrences stay at the same time
+// of day over daylight saving changes.
+type recurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []recurrenceDay
+	ByMonthDay []int
+	Count      int
+	Until      *time.Time
+	WeekStart  time.Weekday
+	Location   *time.Location
+}
+
+// recurrenceDay is a BYDAY entry, MO or in monthly rules 2TU for the second
+// Tuesday or -1FR for the last Friday of the month
+type recurrenceDay struct {
+	N       int
+	Weekday time.Weekday
+}
+
+var rruleWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+func parseRRuleWeekday(s string) (time.Weekday, error) {
+	for i, name := range rruleWeekdays {
+		if name == s {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid weekday %s", s)
+}
+
+// parseRRuleTime parses an UNTIL value, in the location unless it is UTC.
+// A date without time includes the whole day.
+func parseRRuleTime(s string, location *time.Location) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102T150405", s, location); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("20060102", s, location)
+	if err != nil {
+		return t, fmt.Errorf("Invalid recurrence end %s", s)
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// parseRecurrenceRule parses an RRULE with or without its RRULE: prefix to
+// be followed in the location
+func parseRecurrenceRule(s string, location *time.Location) (*recurrenceRule, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	rule := recurrenceRule{Interval: 1, WeekStart: time.Monday, Location: location}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 || pair[1] == "" {
+			return nil, fmt.Errorf("Invalid recurrence rule part %s", part)
+		}
+		name, value := pair[0], pair[1]
+		if seen[name] {
+			return nil, fmt.Errorf("The recurrence rule has %s twice", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "FREQ":
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" {
+				return nil, fmt.Errorf("Recurrence frequency %s is not supported, please use DAILY, WEEKLY or MONTHLY", value)
+			}
+			rule.Freq = value
+		case "INTERVAL", "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Invalid recurrence %s %s", strings.ToLower(name), value)
+			}
+			if name == "INTERVAL" {
+				rule.Interval = n
+			} else {
+				rule.Count = n
+			}
+		case "UNTIL":
+			until, err := parseRRuleTime(value, location)
+			if err != nil {
+				return nil, err
+			}
+			rule.Until = &until
+		case "BYDAY":
+			for _, entry := range strings.Split(value, ",") {
+				if len(entry) < 2 {
+					return nil, fmt.Errorf("Invalid weekday %s", entry)
+				}
+				weekday, err := parseRRuleWeekday(entry[len(entry)-2:])
+				if err != nil {
+					return nil, err
+				}
+				day := recurrenceDay{Weekday: weekday}
+				if prefix := entry[:len(entry)-2]; prefix != "" {
+					day.N, err = strconv.Atoi(prefix)
+					if err != nil || day.N == 0 || day.N < -5 || day.N > 5 {
+						return nil, fmt.Errorf("Invalid weekday %s", entry)
+					}
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			for _, entry := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(entry)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("Invalid day of month %s", entry)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		case "WKST":
+			weekday, err := parseRRuleWeekday(value)
+			if err != nil {
+				return nil, err
+			}
+			rule.WeekStart = weekday
+		default:
+			return nil, fmt.Errorf("Recurrence rule part %s is not supported", name)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, errors.New("Please select how often the activity recurs")
+	}
+	if rule.Count > 0 && rule.Until != nil {
+		return nil, errors.New("A recurrence ends either after a count or on a date")
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq != "MONTHLY" {
+		return nil, errors.New("Days of the month need a monthly recurrence")
+	}
+	if len(rule.ByMonthDay) > 0 && len(rule.ByDay) > 0 {
+		return nil, errors.New("Please select either weekdays or days of the month")
+	}
+	for _, day := range rule.ByDay {
+		if day.N != 0 && rule.Freq != "MONTHLY" {
+			return nil, errors.New("Numbered weekdays need a monthly recurrence")
+		}
+	}
+	return &rule, nil
+}
+
+// String returns the rule in RRULE syntax without the RRULE: prefix
+func (r recurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, day := range r.ByDay {
+			prefix := ""
+			if day.N != 0 {
+				prefix = strconv.Itoa(day.N)
+			}
+			days = append(days, prefix+rruleWeekdays[day.Weekday])
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+rruleWeekdays[r.WeekStart])
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (r recurrenceRule) hasWeekday(weekday time.Weekday) bool {
+	for _, day := range r.ByDay {
+		if day.Weekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// period returns the times matching the rule in the k-th day, week or month
+// after the one of start, in order and at the time of day of start
+func (r recurrenceRule) period(start time.Time, k int) []time.Time {
+	hour, minute, second := start.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, start.Location())
+	}
+
+	switch r.Freq {
+	case "DAILY":
+		day := at(start.Year(), start.Month(), start.Day()+k*r.Interval)
+		if len(r.ByDay) > 0 && !r.hasWeekday(day.Weekday()) {
+			return nil
+		}
+		return []time.Time{day}
+
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(r.WeekStart) + 7) % 7
+		first := start.Day() - offset + 7*k*r.Interval
+		var result []time.Time
+		for i := 0; i < 7; i++ {
+			day := at(start.Year(), start.Month(), first+i)
+			if (len(r.ByDay) == 0 && day.Weekday() == start.Weekday()) || r.hasWeekday(day.Weekday()) {
+				result = append(result, day)
+			}
+		}
+		return result
+	}
+
+	// monthly
+	month := at(start.Year(), start.Month()+time.Month(k*r.Interval), 1)
+	last := at(month.Year(), month.Month()+1, 0).Day()
+	var days []int
+	switch {
+	case len(r.ByMonthDay) > 0:
+		for _, day := range r.ByMonthDay {
+			if day < 0 {
+				day = last + 1 + day
+			}
+			if day >= 1 && day <= last {
+				days = append(days, day)
+			}
+		}
+	case len(r.ByDay) > 0:
+		for _, byDay := range r.ByDay {
+			var matching []int
+			for day := 1; day <= last; day++ {
+				if at(month.Year(), month.Month(), day).Weekday() == byDay.Weekday {
+					matching = append(matching, day)
+				}
+			}
+			switch {
+			case byDay.N == 0:
+				days = append(days, matching...)
+			case byDay.N > 0 && byDay.N <= len(matching):
+				days = append(days, matching[byDay.N-1])
+			case byDay.N < 0 && -byDay.N <= len(matching):
+				days = append(days, matching[len(matching)+byDay.N])
+			}
+		}
+	case start.Day() <= last:
+		days = append(days, start.Day())
+	}
+	sort.Ints(days)
+
+	var result []time.Time
+	for i, day := range days {
+		if i > 0 && day == days[i-1] {
+			continue
+		}
+		result = append(result, at(month.Year(), month.Month(), day))
+	}
+	return result
+}
+
+// each calls fn with the index and time of the occurrences of the rule in
+// order until fn returns false or the rule ends. Start is always the first
+// occurrence, as DTSTART is in RFC 5545. The times are in the location of
+// start.
+func (r recurrenceRule) each(start time.Time, fn func(index int, t time.Time) bool) {
+	index := 0
+	next := func(t time.Time) bool {
+		if r.Until != nil && t.After(*r.Until) {
+			return false
+		}
+		if r.Count > 0 && index >= r.Count {
+			return false
+		}
+		if !fn(index, t.In(start.Location())) {
+			return false
+		}
+		index++
+		return true
+	}
+
+	if !next(start) {
+		return
+	}
+	local := start
+	if r.Location != nil {
+		local = start.In(r.Location)
+	}
+	for k := 0; k < maxRecurrencePeriods; k++ {
+		for _, t := range r.period(local, k) {
+			if t.After(start) && !next(t) {
+				return
+			}
+		}
+	}
+}
+
+// occurrence returns the time of the occurrence at index, false when the
+// rule ends before it
+func (r recurrenceRule) occurrence(start time.Time, index int) (time.Time, bool) {
+	var result time.Time
+	found := false
+	r.each(start, func(i int, t time.Time) bool {
+		if i == index {
+			result, found = t, true
+			return false
+		}
+		return true
+	})
+	return result, found
+}
+
+// prepareRecurrence starts a new series when an activity that does not
+// recur yet is given a recurrence rule. The activity is the first
+// occurrence. The rule is read in the location of the assignee. All-day
+// activities are moved to midnight UTC of their date first, so the series
+// starts there too.
+func prepareRecurrence(model *Activity, location *time.Location) error {
+	prepareAllDay(model)
+	model.RecurrenceRule = strings.TrimSpace(model.RecurrenceRule)
+	model.RecurrenceIndex = 0
+	model.RecurrenceStart = nil
+	model.SeriesID = ""
+	if model.RecurrenceRule == "" {
+		return nil
+	}
+
+	rule, err := parseRecurrenceRule(model.RecurrenceRule, location)
+	if err != nil {
+		return err
+	}
+	if model.DueDate == nil {
+		return errors.New("Please enter the due date of the first occurrence")
+	}
+
+	start := *model.DueDate
+	model.RecurrenceRule = rule.String()
+	model.RecurrenceStart = &start
+	model.SeriesID = uuid.NewV4().String()
+	return nil
+}
+
+// prepareActivityUpdate keeps the recurrence of an edited activity. Scope
+// "occurrence", the default, changes only this occurrence. Scope "series"
+// changes the rest of the series too and may change its rule, which then
+// starts from this occurrence: its due date is the new start and a COUNT
+// is reduced by the occurrences before it. An empty rule ends the series.
+// All-day activities are moved to midnight UTC of their date first.
+func prepareActivityUpdate(model *Activity, existing Activity, scope string, location *time.Location) error {
+	prepareAllDay(model)
+	if scope != "" && scope != "occurrence" && scope != "series" {
+		return errors.New("Please select occurrence or series")
+	}
+	if existing.SeriesID == "" {
+		return prepareRecurrence(model, location)
+	}
+
+	model.SeriesID = existing.SeriesID
+	if scope != "series" {
+		model.RecurrenceRule = existing.RecurrenceRule
+		model.RecurrenceStart = existing.RecurrenceStart
+		model.RecurrenceIndex = existing.RecurrenceIndex
+		return nil
+	}
+
+	model.RecurrenceRule = strings.TrimSpace(model.RecurrenceRule)
+	if model.RecurrenceRule == "" {
+		model.RecurrenceStart = nil
+		model.RecurrenceIndex = 0
+		return nil
+	}
+	rule, err := parseRecurrenceRule(model.RecurrenceRule, location)
+	if err != nil {
+		return err
+	}
+	if model.DueDate == nil {
+		return errors.New("Please enter the due date of the occurrence")
+	}
+
+	sameDueDate := existing.DueDate != nil && existing.DueDate.Equal(*model.DueDate)
+	if rule.String() == existing.RecurrenceRule && sameDueDate {
+		model.RecurrenceRule = existing.RecurrenceRule
+		model.RecurrenceStart = existing.RecurrenceStart
+		model.RecurrenceIndex = existing.RecurrenceIndex
+		return nil
+	}
+
+	if rule.Count > 0 {
+		rule.Count -= existing.RecurrenceIndex
+		if rule.Count < 1 {
+			rule.Count = 1
+		}
+	}
+	start := *model.DueDate
+	model.RecurrenceRule = rule.String()
+	model.RecurrenceStart = &start
+	model.RecurrenceIndex = 0
+	return nil
+}
+
+// createNextOccurrence creates the occurrence after the given one when the
+// series goes on and it does not exist yet. It returns nil otherwise. The
+// rule is followed in the location of the assignee.
+func createNextOccurrence(model Activity, location *time.Location) (*Activity, error) {
+	if model.SeriesID == "" || model.RecurrenceRule == "" || model.RecurrenceStart == nil {
+		return nil, nil
+	}
+	rule, err := parseRecurrenceRule(model.RecurrenceRule, location)
+	if err != nil {
+		return nil, err
+	}
+	due, ok := rule.occurrence(*model.RecurrenceStart, model.RecurrenceIndex+1)
+	if !ok {
+		return nil, nil
+	}
+
+	exists, err := activityOccurrenceExists(model.SeriesID, *model.RecurrenceStart, model.RecurrenceIndex+1)
+	if err != nil || exists {
+		return nil, err
+	}
+
+	next := model
+	next.ID = ""
+	next.Done = false
+	next.DoneAt = nil
+	next.DueDate = &due
+	next.SnoozedUntil = nil
+	next.RecurrenceIndex++
+	if err := insertActivity(&next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// activitiesInRange returns the activities due from from until to and the
+// occurrences their series will have in that time. The occurrences that are
+// not created yet are projected from the last undone occurrence of every
+// series, following their rules in the locations of the assignees by user
+// ID. The result is sorted by due date.
+func activitiesInRange(models []Activity, from, to time.Time, locations map[string]*time.Location) []Activity {
+	result := []Activity{}
+	last := make(map[string]Activity)
+	for _, model := range models {
+		if model.DueDate == nil {
+			continue
+		}
+		if !model.DueDate.Before(from) && model.DueDate.Before(to) {
+			result = append(result, model)
+		}
+		if model.SeriesID == "" || model.RecurrenceRule == "" || model.RecurrenceStart == nil || model.Done {
+			continue
+		}
+		if previous, ok := last[model.SeriesID]; !ok || model.DueDate.After(*previous.DueDate) {
+			last[model.SeriesID] = model
+		}
+	}
+
+	for _, model := range last {
+		rule, err := parseRecurrenceRule(model.RecurrenceRule, assigneeLocation(model, locations))
+		if err != nil {
+			continue
+		}
+		rule.each(*model.RecurrenceStart, func(index int, t time.Time) bool {
+			if index <= model.RecurrenceIndex {
+				return true
+			}
+			if !t.Before(to) {
+				return false
+			}
+			if !t.Before(from) {
+				due := t
+				projected := model
+				projected.ID = ""
+				projected.DueDate = &due
+				projected.RecurrenceIndex = index
+				projected.Projected = true
+				result = append(result, projected)
+			}
+			return true
+		})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].DueDate.Before(*result[j].DueDate)
+	})
+	return result
+}
+
+// assigneeLocation returns the timezone of the user the activity is for
+// among the locations by user ID, time.Local for users not in them. All-day
+// activities follow UTC, the timezone their dates are kept in.
+func assigneeLocation(activity Activity, locations map[string]*time.Location) *time.Location {
+	if activity.AllDay {
+		return time.UTC
+	}
+	if location, ok := locations[activityAssigneeID(activity)]; ok {
+		return location
+	}
+	return time.Local
+}
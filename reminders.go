@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+// maxReminderMinutes is the earliest a reminder can be sent, four weeks
+// before the due date
+const maxReminderMinutes = 4 * 7 * 24 * 60
+
+// reminderGrace is how late a reminder is still sent, for instance after
+// the app was down
+const reminderGrace = time.Hour
+
+// userLocation returns the timezone of the user, the server timezone when
+// the user has none or it is unknown
+func userLocation(user User) *time.Location {
+	if user.TimezoneName != "" {
+		if location, err := time.LoadLocation(user.TimezoneName); err == nil {
+			return location
+		}
+	}
+	return time.Local
+}
+
+// activityAssigneeID returns the user an activity is for, its assignee or
+// its owner when it is not assigned
+func activityAssigneeID(activity Activity) string {
+	if activity.AssignedToUserID != "" {
+		return activity.AssignedToUserID
+	}
+	return activity.UserID
+}
+
+// reminderTime returns when to remind the assignee of the activity. Whole
+// days before are counted on the calendar of the assignee, so a reminder a
+// day before is at the same local time across daylight saving changes.
+// All-day activities are due at the start of their date for the assignee. A
+// snooze moves the reminder later. It returns false when there is no
+// reminder.
+func reminderTime(activity Activity, assignee User) (time.Time, bool) {
+	if activity.DueDate == nil || activity.Done || activity.ReminderOff || assignee.RemindersOff {
+		return time.Time{}, false
+	}
+	minutes := activity.ReminderMinutes
+	if minutes == nil {
+		minutes = assignee.ReminderMinutes
+	}
+	if minutes == nil {
+		return time.Time{}, false
+	}
+
+	days, rest := *minutes/(24*60), *minutes%(24*60)
+	due := activityDue(activity, userLocation(assignee))
+	at := due.AddDate(0, 0, -days).Add(-time.Duration(rest) * time.Minute)
+	if activity.SnoozedUntil != nil && activity.SnoozedUntil.After(at) {
+		at = *activity.SnoozedUntil
+	}
+	return at, true
+}
+
+// sendActivityReminders e-mails the reminders that are due. Every reminder
+// is claimed by the activity and the time it is for, so it goes out once
+// and again after a snooze.
+func sendActivityReminders() error {
+	now := time.Now()
+	activities, err := selectActivitiesToRemind(now.Add(-reminderGrace), now.Add(maxReminderMinutes*time.Minute+25*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*User)
+	for _, activity := range activities {
+		userID := activityAssigneeID(activity)
+		assignee, ok := users[userID]
+		if !ok {
+			assignee, err = selectUserByID(userID)
+			if err != nil {
+				log.Println(err)
+			}
+			users[userID] = assignee
+		}
+		if assignee == nil || assignee.DeletedAt != nil {
+			continue
+		}
+
+		at, ok := reminderTime(activity, *assignee)
+		if !ok || at.After(now) || now.Sub(at) > reminderGrace {
+			continue
+		}
+
+		key := fmt.Sprintf("activity_reminder:%s:%d", activity.ID, at.Unix())
+		claimed, err := claimSentEmail(key, assignee.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		subj, body := activityReminderEmail(activity, userLocation(*assignee))
+		if err := sendEmail(assignee.Email, subj, body); err != nil {
+			log.Println("Error sending activity reminder to", assignee.Email, err)
+			if err := releaseSentEmail(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func activityReminderEmail(activity Activity, location *time.Location) (string, string) {
+	due := activityDue(activity, location)
+	subj := fmt.Sprintf("Reminder: %s at %s", activity.Name, due.Format("Mon 2 Jan 15:04"))
+	when := due.Format("Monday 2 January 2006 at 15:04 MST")
+	if isAllDay(activity) {
+		subj = fmt.Sprintf("Reminder: %s on %s", activity.Name, due.Format("Mon 2 Jan"))
+		when = due.Format("Monday 2 January 2006")
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s is due %s\r\n", activity.Name, when)
+	if activity.Type != "" {
+		fmt.Fprintf(b, "Type: %s\r\n", activity.Type)
+	}
+	if activity.OrgName != "" {
+		fmt.Fprintf(b, "Organization: %s\r\n", activity.OrgName)
+	}
+	if activity.PersonName != "" {
+		fmt.Fprintf(b, "Person: %s\r\n", activity.PersonName)
+	}
+	if activity.TaskTitle != "" {
+		fmt.Fprintf(b, "Task: %s\r\n", activity.TaskTitle)
+	}
+	fmt.Fprintf(b, "\r\nSee it on http://superwork.io\r\n")
+	return subj, b.String()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// routeOrder returns the order in which to visit the points starting from
+// points[0], which stays first. The order is built nearest neighbor first
+// and then shortened with 2-opt. The route ends at the last visit, it does
+// not return to the start.
+func routeOrder(points [][2]float64) []int {
+	if len(points) == 0 {
+		return nil
+	}
+	distance := func(i, j int) float64 {
+		return distanceKm(points[i][0], points[i][1], points[j][0], points[j][1])
+	}
+
+	order := []int{0}
+	visited := make([]bool, len(points))
+	visited[0] = true
+	for len(order) < len(points) {
+		last := order[len(order)-1]
+		next := -1
+		for i := range points {
+			if !visited[i] && (next == -1 || distance(last, i) < distance(last, next)) {
+				next = i
+			}
+		}
+		visited[next] = true
+		order = append(order, next)
+	}
+
+	// reverse order[i:k+1] while that makes the route shorter
+	for improved := true; improved; {
+		improved = false
+		for i := 1; i < len(order)-1; i++ {
+			for k := i + 1; k < len(order); k++ {
+				delta := distance(order[i-1], order[k]) - distance(order[i-1], order[i])
+				if k+1 < len(order) {
+					delta += distance(order[i], order[k+1]) - distance(order[k], order[k+1])
+				}
+				if delta < -1e-9 {
+					for a, b := i, k; a < b; a, b = a+1, b-1 {
+						order[a], order[b] = order[b], order[a]
+					}
+					improved = true
+				}
+			}
+		}
+	}
+
+	return order
+}
+
+// parseDayIn parses a YYYY-MM-DD date and returns the start of the day in
+// the location
+func parseDayIn(date string, location *time.Location) (time.Time, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, location)
+	if err != nil {
+		return day, errors.New("Please enter the date as YYYY-MM-DD")
+	}
+	return day, nil
+}
+
+// selectRouteUser returns the user whose visits are routed, nil when there
+// is no such user in the company. The day of the route is in the timezone of
+// that user.
+func selectRouteUser(companyID, userID string) (*User, error) {
+	if !isUUID(userID) {
+		return nil, nil
+	}
+	member, err := selectCompanyUserByUserAndCompany(userID, companyID)
+	if err != nil || member == nil {
+		return nil, err
+	}
+	return selectUserByID(userID)
+}
+
+// selectRouteActivities returns the undone activities linked to an
+// organization that are assigned to the user, or created by the user when
+// unassigned, and are due on the day, sorted by due time
+func selectRouteActivities(companyID, userID string, day time.Time) ([]Activity, error) {
+	activities, err := selectUpcomingActivitiesByCompany(companyID, day)
+	if err != nil {
+		return nil, err
+	}
+	end := day.AddDate(0, 0, 1)
+	var result []Activity
+	for _, activity := range activities {
+		if !activity.DueDate.Before(end) {
+			break
+		}
+		if activity.AssignedToUserID == userID || (activity.AssignedToUserID == "" && activity.UserID == userID) {
+			result = append(result, activity)
+		}
+	}
+	return result, nil
+}
+
+// dueTimes returns the due times of the activities in order
+func dueTimes(activities []Activity) []time.Time {
+	var result []time.Time
+	for _, activity := range activities {
+		result = append(result, *activity.DueDate)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Before(result[j]) })
+	return result
+}
+
+// planRoute orders the visits of the user on the day. Without a start the
+// route starts at the first visit of the day. Every stop comes with the
+// straight-line distance from the previous one and the due time it gets
+// when the order is applied, which are the due times the visits already
+// have in the new order. Visits of organizations that are not geocoded are
+// returned as unplaced.
+func planRoute(companyID, userID string, day time.Time, start *[2]float64) (*RoutePlan, error) {
+	activities, err := selectRouteActivities(companyID, userID, day)
+	if err != nil {
+		return nil, err
+	}
+	placed, points, unplaced, err := placeRouteActivities(companyID, activities)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := RoutePlan{
+		UserID:   userID,
+		Date:     day.Format("2006-01-02"),
+		Stops:    []RouteStop{},
+		Unplaced: append([]Activity{}, unplaced...),
+	}
+	if len(placed) == 0 {
+		return &plan, nil
+	}
+
+	// the start is point 0, either given or the first visit of the day
+	offset := 1
+	if start != nil {
+		points = append([][2]float64{*start}, points...)
+	} else {
+		offset = 0
+	}
+	plan.StartLatitude, plan.StartLongitude = points[0][0], points[0][1]
+
+	times := dueTimes(placed)
+	order := routeOrder(points)
+	previous := order[0]
+	for _, i := range order {
+		if i < offset {
+			continue
+		}
+		stop := RouteStop{
+			Activity:  placed[i-offset],
+			Latitude:  points[i][0],
+			Longitude: points[i][1],
+			Distance:  distanceKm(points[previous][0], points[previous][1], points[i][0], points[i][1]),
+		}
+		due := times[len(plan.Stops)]
+		stop.SuggestedDueDate = &due
+		plan.TotalDistance += stop.Distance
+		plan.Stops = append(plan.Stops, stop)
+		previous = i
+	}
+
+	return &plan, nil
+}
+
+// applyRouteOrder gives the visits of the user on the day the given order.
+// The visits keep the due times they have, handed out again in the new
+// order, like the suggested due times of planRoute. All placed visits of
+// the day must be in the order, unplaced visits keep their due times and
+// are left out of it.
+func applyRouteOrder(companyID, userID string, day time.Time, activityIDs []string) error {
+	activities, err := selectRouteActivities(companyID, userID, day)
+	if err != nil {
+		return err
+	}
+	placed, _, unplaced, err := placeRouteActivities(companyID, activities)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]bool)
+	for _, activity := range placed {
+		byID[activity.ID] = true
+	}
+	skip := make(map[string]bool)
+	for _, activity := range unplaced {
+		skip[activity.ID] = true
+	}
+	dueDates := make(map[string]time.Time)
+	times := dueTimes(placed)
+	for _, ID := range activityIDs {
+		if skip[ID] {
+			continue
+		}
+		if !byID[ID] {
+			return errors.New("Activity not found")
+		}
+		if _, ok := dueDates[ID]; ok {
+			return errors.New("Please order every visit once")
+		}
+		dueDates[ID] = times[len(dueDates)]
+	}
+	if len(dueDates) != len(placed) {
+		return errors.New("Please order all the visits of the day")
+	}
+
+	return updateActivityDueDates(dueDates)
+}
+
+// placeRouteActivities splits the visits into the ones of geocoded
+// organizations, returned with their coordinates, and the unplaced ones
+func placeRouteActivities(companyID string, activities []Activity) ([]Activity, [][2]float64, []Activity, error) {
+	orgs, err := selectMappedOrganizations(companyID, OrganizationFilter{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	byID := make(map[string]Organization)
+	for _, org := range orgs {
+		byID[org.ID] = org
+	}
+
+	var placed, unplaced []Activity
+	var points [][2]float64
+	for _, activity := range activities {
+		org, ok := byID[activity.OrgID]
+		if !ok {
+			unplaced = append(unplaced, activity)
+			continue
+		}
+		placed = append(placed, activity)
+		points = append(points, [2]float64{*org.Latitude, *org.Longitude})
+	}
+	return placed, points, unplaced, nil
+}
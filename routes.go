@@ -68,8 +68,13 @@ func defineRoutes() *mux.Router {
 
 		r.Handle("/api/activities", limit(requireUser(handleGetActivities))).Methods("GET")
 		r.Handle("/api/activities", limit(requireUser(handlePostActivities))).Methods("POST")
+		r.Handle("/api/activities/calendar", limit(requireUser(handleGetActivityCalendar))).Methods("GET")
+		r.Handle("/api/activities/geojson", limit(requireUser(handleGetActivitiesGeoJSON))).Methods("GET")
+		r.Handle("/api/activities/route", limit(requireUser(handleGetActivityRoute))).Methods("GET")
+		r.Handle("/api/activities/route", limit(requireUser(handlePostActivityRoute))).Methods("POST")
 		r.Handle("/api/activities/{id}", limit(requireUser(handlePutActivity))).Methods("PUT")
 		r.Handle("/api/activities/{id}", limit(requireUser(handleDeleteActivity))).Methods("DELETE")
+		r.Handle("/api/activities/{id}/snooze", limit(requireUser(handlePostActivitySnooze))).Methods("POST")
 
 		r.Handle("/api/activity_fields", limit(requireUser(handleGetActivityFields))).Methods("GET")
 		r.Handle("/api/activity_fields", limit(requireUser(handlePostActivityFields))).Methods("POST")
@@ -78,6 +83,7 @@ func defineRoutes() *mux.Router {
 
 		r.Handle("/api/activity_types", limit(requireUser(handleGetActivityTypes))).Methods("GET")
 		r.Handle("/api/activity_types", limit(requireUser(handlePostActivityTypes))).Methods("POST")
+		r.Handle("/api/activity_types/order", limit(requireUser(handlePutActivityTypesOrder))).Methods("PUT")
 		r.Handle("/api/activity_types/{id}", limit(requireUser(handlePutActivityType))).Methods("PUT")
 		r.Handle("/api/activity_types/{id}", limit(requireUser(handleDeleteActivityType))).Methods("DELETE")
 
@@ -86,11 +92,24 @@ func defineRoutes() *mux.Router {
 		r.Handle("/api/currencies/{id}", limit(requireUser(handlePutCurrency))).Methods("PUT")
 		r.Handle("/api/currencies/{id}", limit(requireUser(handleDeleteCurrency))).Methods("DELETE")
 
+		r.Handle("/api/lost_reasons", limit(requireUser(handleGetLostReasons))).Methods("GET")
+		r.Handle("/api/lost_reasons", limit(requireUser(handlePostLostReasons))).Methods("POST")
+		r.Handle("/api/lost_reasons/{id}", limit(requireUser(handlePutLostReason))).Methods("PUT")
+		r.Handle("/api/lost_reasons/{id}", limit(requireUser(handleDeleteLostReason))).Methods("DELETE")
+
 		r.Handle("/api/tasks", limit(requireUser(handleGetTasks))).Methods("GET")
 		r.Handle("/api/tasks", limit(requireUser(handlePostTasks))).Methods("POST")
+		r.Handle("/api/tasks/reorder", limit(requireUser(handlePostTasksReorder))).Methods("POST")
 		r.Handle("/api/tasks/{id}", limit(requireUser(handleGetTask))).Methods("GET")
 		r.Handle("/api/tasks/{id}", limit(requireUser(handlePutTask))).Methods("PUT")
 		r.Handle("/api/tasks/{id}", limit(requireUser(handleDeleteTask))).Methods("DELETE")
+		r.Handle("/api/tasks/{id}/won", limit(requireUser(handlePostTaskWon))).Methods("POST")
+		r.Handle("/api/tasks/{id}/lost", limit(requireUser(handlePostTaskLost))).Methods("POST")
+		r.Handle("/api/tasks/{id}/reopen", limit(requireUser(handlePostTaskReopen))).Methods("POST")
+		r.Handle("/api/tasks/{id}/stage_history", limit(requireUser(handleGetTaskStageHistory))).Methods("GET")
+
+		r.Handle("/api/forecast", limit(requireUser(handleGetForecast))).Methods("GET")
+		r.Handle("/api/reports/stages", limit(requireUser(handleGetStageReport))).Methods("GET")
 
 		r.Handle("/api/task_fields", limit(requireUser(handleGetTaskFields))).Methods("GET")
 		r.Handle("/api/task_fields", limit(requireUser(handlePostTaskFields))).Methods("POST")
@@ -129,8 +148,15 @@ func defineRoutes() *mux.Router {
 
 		r.Handle("/api/organizations", limit(requireUser(handleGetOrganizations))).Methods("GET")
 		r.Handle("/api/organizations", limit(requireUser(handlePostOrganizations))).Methods("POST")
+		r.Handle("/api/organizations/nearby", limit(requireUser(handleGetNearbyOrganizations))).Methods("GET")
+		r.Handle("/api/organizations/geojson", limit(requireUser(handleGetOrganizationsGeoJSON))).Methods("GET")
 		r.Handle("/api/organizations/{id}", limit(requireUser(handlePutOrganization))).Methods("PUT")
 		r.Handle("/api/organizations/{id}", limit(requireUser(handleDeleteOrganization))).Methods("DELETE")
+		r.Handle("/api/organizations/{id}/duplicates", limit(requireUser(handleGetOrganizationDuplicates))).Methods("GET")
+		r.Handle("/api/organizations/{id}/merge", limit(requireUser(handlePostOrganizationMerge))).Methods("POST")
+		r.Handle("/api/organizations/{id}/graph", limit(requireUser(handleGetOrganizationGraph))).Methods("GET")
+		r.Handle("/api/geocode", limit(requireUser(handleGetGeocode))).Methods("GET")
+		r.Handle("/api/geocode/reverse", limit(requireUser(handleGetReverseGeocode))).Methods("GET")
 
 		r.Handle("/api/organizations_fields", limit(requireUser(handleGetOrganizationFields))).Methods("GET")
 		r.Handle("/api/organizations_fields", limit(requireUser(handlePostOrganizationFields))).Methods("POST")
@@ -147,11 +173,23 @@ func defineRoutes() *mux.Router {
 		r.Handle("/api/contacts/{id}", limit(requireUser(handlePutContact))).Methods("PUT")
 		r.Handle("/api/contacts/{id}", limit(requireUser(handleDeleteContact))).Methods("DELETE")
 
+		r.Handle("/api/imports", limit(requireUser(handleGetImports))).Methods("GET")
+		r.Handle("/api/imports", limit(requireUser(handlePostImports))).Methods("POST")
+		r.Handle("/api/imports/preview", limit(requireUser(handlePostImportPreview))).Methods("POST")
+		r.Handle("/api/imports/{id}", limit(requireUser(handleGetImport))).Methods("GET")
+		r.Handle("/api/imports/{id}/revert", limit(requireUser(handlePostImportRevert))).Methods("POST")
+
+		r.Handle("/api/persons/vcard", limit(requireUser(handleGetPersonsVCard))).Methods("GET")
+		r.Handle("/api/persons/vcard", limit(requireUser(handlePostPersonsVCard))).Methods("POST")
+		r.Handle("/api/persons/vcard/preview", limit(requireUser(handlePostPersonsVCardPreview))).Methods("POST")
 		r.Handle("/api/persons/{id}", limit(requireUser(handleGetPerson))).Methods("GET")
+		r.Handle("/api/persons/{id}/vcard", limit(requireUser(handleGetPersonVCard))).Methods("GET")
 		r.Handle("/api/persons", limit(requireUser(handleGetPersons))).Methods("GET")
 		r.Handle("/api/persons", limit(requireUser(handlePostPersons))).Methods("POST")
 		r.Handle("/api/persons/{id}", limit(requireUser(handlePutPerson))).Methods("PUT")
 		r.Handle("/api/persons/{id}", limit(requireUser(handleDeletePerson))).Methods("DELETE")
+		r.Handle("/api/persons/{id}/duplicates", limit(requireUser(handleGetPersonDuplicates))).Methods("GET")
+		r.Handle("/api/persons/{id}/merge", limit(requireUser(handlePostPersonMerge))).Methods("POST")
 
 		r.Handle("/api/person_fields", limit(requireUser(handleGetPersonFields))).Methods("GET")
 		r.Handle("/api/person_fields", limit(requireUser(handlePostPersonFields))).Methods("POST")
@@ -162,6 +200,12 @@ func defineRoutes() *mux.Router {
 		r.Handle("/api/workflows", limit(requireUser(handlePostWorkflows))).Methods("POST")
 		r.Handle("/api/workflows/{id}", limit(requireUser(handlePutWorkflow))).Methods("PUT")
 		r.Handle("/api/workflows/{id}", limit(requireUser(handleDeleteWorkflow))).Methods("DELETE")
+		r.Handle("/api/workflows/{id}/migrate", limit(requireUser(handlePostWorkflowMigrate))).Methods("POST")
+		r.Handle("/api/workflows/{id}/clone", limit(requireUser(handlePostWorkflowClone))).Methods("POST")
+		r.Handle("/api/workflows/{id}/template", limit(requireUser(handlePostWorkflowTemplate))).Methods("POST")
+
+		r.Handle("/api/workflow_templates", limit(requireUser(handleGetWorkflowTemplates))).Methods("GET")
+		r.Handle("/api/workflow_templates/{id}", limit(requireUser(handleDeleteWorkflowTemplate))).Methods("DELETE")
 
 		r.Handle("/api/prices", limit(requireUser(handleGetPrices))).Methods("GET")
 		r.Handle("/api/prices", limit(requireUser(handlePostPrices))).Methods("POST")
@@ -170,6 +214,7 @@ func defineRoutes() *mux.Router {
 
 		r.Handle("/api/products", limit(requireUser(handleGetProducts))).Methods("GET")
 		r.Handle("/api/products", limit(requireUser(handlePostProducts))).Methods("POST")
+		r.Handle("/api/products/{id}", limit(requireUser(handleGetProduct))).Methods("GET")
 		r.Handle("/api/products/{id}", limit(requireUser(handlePutProduct))).Methods("PUT")
 		r.Handle("/api/products/{id}", limit(requireUser(handleDeleteProduct))).Methods("DELETE")
 
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+func startScheduler() {
+	go schedule("rotten task digest", time.Hour, sendRottenTaskDigests)
+	go schedule("csv import", 5*time.Second, runPendingImports)
+	go schedule("geocoding", time.Minute, geocodePendingOrganizations)
+	go schedule("activity reminders", time.Minute, sendActivityReminders)
+	go schedule("agenda digest", 15*time.Minute, sendAgendaDigests)
+}
+
+// schedule runs job every interval until the process exits.
+// Jobs must be safe to run on several app instances at once.
+func schedule(name string, interval time.Duration, job func() error) {
+	for {
+		if err := job(); err != nil {
+			log.Println("Error running", name, err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// vcardLines reads the content lines of vCard data, unfolding lines that
+// continue on the next line and joining quoted-printable values of vCard 2.1
+// across soft line breaks.
+func vcardLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	softBreak := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if softBreak {
+			last := lines[len(lines)-1]
+			lines[len(lines)-1] = last[:len(last)-1] + line
+			softBreak = strings.HasSuffix(line, "=")
+			continue
+		}
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+			if _, params, _, ok := parseVCardLine(line); ok {
+				softBreak = strings.HasSuffix(line, "=") && vcardQuotedPrintable(params)
+			}
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// vcardQuotedPrintable reports whether the value of a content line is
+// quoted-printable, ENCODING=QUOTED-PRINTABLE or just QUOTED-PRINTABLE in
+// vCard 2.1.
+func vcardQuotedPrintable(params map[string][]string) bool {
+	for _, value := range append(params["ENCODING"], params["TYPE"]...) {
+		if value == "quoted-printable" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeVCardValue decodes a quoted-printable value of vCard 2.1 in its
+// CHARSET, UTF-8 unless told otherwise. Values that are not
+// quoted-printable or do not decode are returned as they are.
+func decodeVCardValue(params map[string][]string, value string) string {
+	if !vcardQuotedPrintable(params) {
+		return value
+	}
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+	if err != nil {
+		return value
+	}
+	for _, charset := range params["CHARSET"] {
+		if charset == "iso-8859-1" || charset == "latin1" {
+			runes := make([]rune, len(decoded))
+			for i, c := range decoded {
+				runes[i] = rune(c)
+			}
+			return string(runes)
+		}
+	}
+	return string(decoded)
+}
+
+// splitVCardValue splits a value at unescaped separators and unescapes
+// the parts.
+func splitVCardValue(value string, separator byte) []string {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value):
+			i++
+			if value[i] == 'n' || value[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(value[i])
+			}
+		case c == separator:
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(parts, b.String())
+}
+
+// unescapeVCardValue unescapes a value that has no components
+func unescapeVCardValue(value string) string {
+	return splitVCardValue(value, 0)[0]
+}
+
+func escapeVCardValue(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		",", `\,`,
+		";", `\;`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// parseVCardLine splits a content line into its property name, its
+// lowercased parameters and its value.
+func parseVCardLine(line string) (string, map[string][]string, string, bool) {
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	name := strings.ToUpper(parts[0])
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		name = name[dot+1:]
+	}
+
+	params := make(map[string][]string)
+	for _, param := range parts[1:] {
+		key, value := "TYPE", param
+		if eq := strings.Index(param, "="); eq >= 0 {
+			key, value = strings.ToUpper(param[:eq]), param[eq+1:]
+		}
+		for _, v := range strings.Split(strings.Trim(value, `"`), ",") {
+			params[key] = append(params[key], strings.ToLower(v))
+		}
+	}
+
+	return name, params, line[colon+1:], true
+}
+
+// vcardPreferred reports whether TYPE=pref (3.0) or PREF (4.0) is set
+func vcardPreferred(params map[string][]string) bool {
+	for _, t := range params["TYPE"] {
+		if t == "pref" {
+			return true
+		}
+	}
+	return len(params["PREF"]) > 0
+}
+
+// vcardLabels maps contact labels to vCard TYPE parameter values
+var vcardLabels = map[string]string{
+	"work":   "work",
+	"home":   "home",
+	"mobile": "cell",
+	"fax":    "fax",
+}
+
+// vcardLabel returns the contact label of the TYPE parameters. A mobile or
+// fax number that is also marked as work or home is labeled by its kind.
+func vcardLabel(params map[string][]string) string {
+	for _, label := range []string{"mobile", "fax", "work", "home"} {
+		for _, value := range params["TYPE"] {
+			if value == vcardLabels[label] {
+				return label
+			}
+		}
+	}
+	return ""
+}
+
+// parseVCards reads the persons of vCard 2.1, 3.0 or 4.0 data with their
+// e-mail addresses, phone numbers, websites and instant messaging addresses.
+// The first contact of each type on a card is primary unless the card marks
+// another one as preferred.
+func parseVCards(r io.Reader) ([]PersonImport, error) {
+	lines, err := vcardLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []PersonImport
+	var card *PersonImport
+	var lastName string
+	for _, line := range lines {
+		name, params, value, ok := parseVCardLine(line)
+		if !ok {
+			continue
+		}
+		value = decodeVCardValue(params, value)
+
+		switch name {
+		case "BEGIN":
+			if strings.EqualFold(value, "VCARD") {
+				card = &PersonImport{}
+				lastName = ""
+			}
+			continue
+		case "END":
+			if card == nil {
+				return nil, errors.New("Invalid vCard, END without BEGIN")
+			}
+			finishVCard(card, lastName)
+			result = append(result, *card)
+			card = nil
+			continue
+		}
+		if card == nil {
+			continue
+		}
+
+		switch name {
+		case "FN":
+			card.Person.Name = strings.TrimSpace(unescapeVCardValue(value))
+		case "N":
+			n := splitVCardValue(value, ';')
+			lastName = strings.TrimSpace(n[0])
+			if len(n) > 1 {
+				card.Person.FirstName = strings.TrimSpace(n[1])
+			}
+		case "ORG":
+			card.Person.OrgName = strings.TrimSpace(splitVCardValue(value, ';')[0])
+		case "EMAIL", "TEL", "URL", "IMPP":
+			contact := Contact{Primary: vcardPreferred(params), Type: "email", Label: vcardLabel(params)}
+			contact.Name = strings.TrimSpace(unescapeVCardValue(value))
+			switch name {
+			case "TEL":
+				contact.Type = "phone"
+				contact.Name = strings.TrimPrefix(contact.Name, "tel:")
+			case "URL":
+				contact.Type = "website"
+			case "IMPP":
+				contact.Type = "im"
+			}
+			if contact.Name != "" {
+				card.Contacts = append(card.Contacts, contact)
+			}
+		}
+	}
+	if card != nil {
+		return nil, errors.New("Invalid vCard, BEGIN without END")
+	}
+
+	return result, nil
+}
+
+// finishVCard fills the name of a card without FN and picks the primary
+// contacts.
+func finishVCard(card *PersonImport, lastName string) {
+	if card.Person.Name == "" {
+		card.Person.Name = strings.TrimSpace(card.Person.FirstName + " " + lastName)
+	}
+	if card.Person.Name == "" && len(card.Contacts) > 0 {
+		card.Person.Name = card.Contacts[0].Name
+	}
+
+	for contactType := range contactTypes {
+		primary := -1
+		for i, contact := range card.Contacts {
+			if contact.Type != contactType {
+				continue
+			}
+			if primary < 0 || (contact.Primary && !card.Contacts[primary].Primary) {
+				primary = i
+			}
+		}
+		for i := range card.Contacts {
+			if card.Contacts[i].Type == contactType {
+				card.Contacts[i].Primary = i == primary
+			}
+		}
+	}
+}
+
+// foldVCardLine breaks a content line into lines of at most 75 octets
+func foldVCardLine(line string) string {
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// writeVCard writes a person with its contacts as a vCard of version 3.0
+// or 4.0.
+func writeVCard(w io.Writer, person Person, contacts []Contact, version string) error {
+	if version != "3.0" && version != "4.0" {
+		return fmt.Errorf("Unsupported vCard version %s", version)
+	}
+
+	firstName := person.FirstName
+	lastName := strings.TrimSpace(strings.TrimPrefix(person.Name, firstName))
+	if firstName == "" {
+		if words := strings.Fields(person.Name); len(words) > 1 {
+			firstName = strings.Join(words[:len(words)-1], " ")
+			lastName = words[len(words)-1]
+		}
+	}
+
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:" + version,
+		"FN:" + escapeVCardValue(person.Name),
+		"N:" + escapeVCardValue(lastName) + ";" + escapeVCardValue(firstName) + ";;;",
+	}
+	if version == "4.0" {
+		lines = append(lines, "UID:urn:uuid:"+person.ID)
+	} else {
+		lines = append(lines, "UID:"+person.ID)
+	}
+	if person.OrgName != "" {
+		lines = append(lines, "ORG:"+escapeVCardValue(person.OrgName))
+	}
+
+	for _, contact := range contacts {
+		var property string
+		var types []string
+		switch contact.Type {
+		case "email":
+			property = "EMAIL"
+			if version == "3.0" {
+				types = append(types, "INTERNET")
+			}
+		case "phone":
+			property = "TEL"
+			if version == "4.0" {
+				property += ";VALUE=text"
+			} else if contact.Label != "mobile" && contact.Label != "fax" {
+				types = append(types, "VOICE")
+			}
+		case "website":
+			property = "URL"
+		case "im":
+			property = "IMPP"
+		default:
+			continue
+		}
+		if t := vcardLabels[contact.Label]; t != "" {
+			if version == "3.0" {
+				t = strings.ToUpper(t)
+			}
+			types = append(types, t)
+		}
+		if contact.Primary && version == "3.0" {
+			types = append(types, "PREF")
+		}
+		if len(types) > 0 {
+			property += ";TYPE=" + strings.Join(types, ",")
+		}
+		if contact.Primary && version == "4.0" {
+			property += ";PREF=1"
+		}
+		lines = append(lines, property+":"+escapeVCardValue(contact.Name))
+	}
+	lines = append(lines, "END:VCARD")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, foldVCardLine(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}